@@ -47,6 +47,7 @@ const AVAILABLE_EVENTS = [
   { id: 'node.offline', name: 'Node Offline', description: 'When a node goes offline' },
   { id: 'request.completed', name: 'Request Completed', description: 'When a proxy request completes' },
   { id: 'request.failed', name: 'Request Failed', description: 'When a proxy request fails' },
+  { id: 'session.rotated', name: 'Session Rotated', description: 'When a sticky session moves to a new exit IP' },
   { id: 'quota.warning', name: 'Quota Warning', description: 'When usage reaches 80%' },
   { id: 'quota.exceeded', name: 'Quota Exceeded', description: 'When usage limit is reached' },
   { id: 'api_key.created', name: 'API Key Created', description: 'When a new API key is created' },
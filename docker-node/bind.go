@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ─── Bind Listeners (SOCKS5 BIND) ──────────────────────────────────────────────
+//
+// bind_open asks the node to listen for a single inbound TCP connection:
+//
+//   bind_open      → listen, answer bind_response with the bound port
+//   first accept   → bind_accepted with the peer address, then the connection
+//                    is an ordinary mux stream on the given stream_id
+//   timeout        → bind_accepted with success=false, listener closed
+//
+// Listeners never outlive their timeout and accept at most one connection; an
+// RST on the stream before that cancels the listener.
+
+const (
+	bindDefaultTimeout = 30 * time.Second
+	bindMaxTimeout     = 2 * time.Minute
+)
+
+type BindOpen struct {
+	TunnelID string `json:"tunnel_id"`
+	StreamID uint32 `json:"stream_id"`
+	Window   int    `json:"window,omitempty"`
+	Priority uint8  `json:"priority,omitempty"`
+	Timeout  int    `json:"timeout,omitempty"` // seconds to wait for the inbound connection
+}
+
+func (a *NodeAgent) handleBindOpen(req BindOpen) {
+	send := func(msgType string, data map[string]interface{}) {
+		data["tunnel_id"] = req.TunnelID
+		msg, _ := json.Marshal(map[string]interface{}{
+			"type": msgType,
+			"data": data,
+		})
+		a.safeWrite(websocket.TextMessage, msg)
+	}
+
+	if req.StreamID == 0 {
+		send("bind_response", map[string]interface{}{"success": false, "error": "bind requires mux stream"})
+		return
+	}
+	if !a.featureEnabled("bind") {
+		send("bind_response", map[string]interface{}{"success": false, "error": "bind disabled by node config"})
+		return
+	}
+	if err := a.refuseRelay(); err != nil {
+		send("bind_response", map[string]interface{}{"success": false, "error": err.Error()})
+		return
+	}
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	if err != nil {
+		send("bind_response", map[string]interface{}{"success": false, "error": err.Error()})
+		return
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	send("bind_response", map[string]interface{}{"success": true, "bound_port": port})
+
+	timeout := time.Duration(req.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = bindDefaultTimeout
+	}
+	if timeout > bindMaxTimeout {
+		timeout = bindMaxTimeout
+	}
+	ln.SetDeadline(time.Now().Add(timeout))
+	a.binds.Store(req.StreamID, ln)
+
+	conn, err := ln.Accept()
+	a.binds.Delete(req.StreamID)
+	ln.Close()
+	if err != nil {
+		reason := err.Error()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			reason = "timeout"
+		}
+		log.Printf("[NODE] Bind %s on port %d closed without a peer: %s", req.TunnelID, port, reason)
+		send("bind_accepted", map[string]interface{}{"success": false, "error": reason})
+		return
+	}
+
+	log.Printf("[NODE] Bind %s accepted %s on port %d", req.TunnelID, conn.RemoteAddr(), port)
+	a.trackTunnel(req.TunnelID, conn)
+	stream := newMuxStream(a, TunnelOpen{
+		TunnelID: req.TunnelID,
+		StreamID: req.StreamID,
+		Window:   req.Window,
+		Priority: req.Priority,
+	}, conn)
+	a.streams.Store(req.StreamID, stream)
+
+	send("bind_accepted", map[string]interface{}{"success": true, "remote_addr": conn.RemoteAddr().String()})
+	stream.run()
+}
+
+// cancelBind closes a listener still waiting for its peer; returns false if none
+func (a *NodeAgent) cancelBind(streamID uint32) bool {
+	val, ok := a.binds.LoadAndDelete(streamID)
+	if !ok {
+		return false
+	}
+	val.(*net.TCPListener).Close()
+	return true
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ─── Resource Caps ─────────────────────────────────────────────────────────────
+//
+// Operators limit how much of their connection the node uses:
+//
+//	--max-up-mbps / --max-down-mbps  relay throughput; up is what tunnels send
+//	                                 to targets, down is what they receive
+//	--daily-gb / --monthly-gb        relayed traffic (both directions) per
+//	                                 calendar day / month, local time
+//	--max-tunnels                    concurrent TCP tunnels
+//
+// Throughput is shaped with one token bucket per direction shared by every
+// relay goroutine. Once a quota is used up new tunnels, UDP associations and
+// binds are refused until the day or month rolls over. Usage is kept beside
+// the identity key so restarts don't reset it. The caps go to the gateway in
+// registration and caps_usage updates, so it stops picking a node near them.
+
+const (
+	capUp   = "up"
+	capDown = "down"
+
+	usageFileName       = "usage.json"
+	capsReportInterval  = 30 * time.Second
+	minBucketBurstBytes = 64 * 1024
+)
+
+type capsConfig struct {
+	MaxUpMbps   float64
+	MaxDownMbps float64
+	DailyGB     float64
+	MonthlyGB   float64
+	MaxTunnels  int
+	UsageFile   string
+}
+
+// limited reports whether any cap is set
+func (c capsConfig) limited() bool {
+	return c.MaxUpMbps > 0 || c.MaxDownMbps > 0 || c.DailyGB > 0 || c.MonthlyGB > 0 || c.MaxTunnels > 0
+}
+
+// rateBucket is a token bucket in bytes. Reservations may overdraw it; the
+// caller sleeps until the debt is paid, so concurrent relays share the rate.
+type rateBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateBucket(mbps float64) *rateBucket {
+	if mbps <= 0 {
+		return nil
+	}
+	rate := mbps * 1e6 / 8
+	burst := math.Max(rate, minBucketBurstBytes)
+	return &rateBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes n bytes and returns how long to wait before using them
+func (b *rateBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// usageRecord is the quota usage kept on disk
+type usageRecord struct {
+	Day          string `json:"day"`   // 2006-01-02
+	Month        string `json:"month"` // 2006-01
+	DailyBytes   int64  `json:"daily_bytes"`
+	MonthlyBytes int64  `json:"monthly_bytes"`
+}
+
+type resourceCaps struct {
+	cfg  capsConfig
+	up   *rateBucket // nil = unlimited
+	down *rateBucket
+
+	mu    sync.Mutex
+	usage usageRecord
+	dirty bool
+
+	// Relayed since the last report, for the throughput the gateway sees
+	upBytes    atomic.Int64
+	downBytes  atomic.Int64
+	lastReport time.Time
+}
+
+func newResourceCaps(cfg capsConfig) *resourceCaps {
+	c := &resourceCaps{
+		cfg:        cfg,
+		up:         newRateBucket(cfg.MaxUpMbps),
+		down:       newRateBucket(cfg.MaxDownMbps),
+		lastReport: time.Now(),
+	}
+	if data, err := os.ReadFile(cfg.UsageFile); err == nil {
+		if err := json.Unmarshal(data, &c.usage); err != nil {
+			log.Printf("[NODE] Usage file %s unreadable, starting from zero: %v", cfg.UsageFile, err)
+		}
+	}
+	c.rollover(time.Now())
+	return c
+}
+
+// rollover starts a new day or month; c.mu held or not yet shared
+func (c *resourceCaps) rollover(now time.Time) {
+	if day := now.Format("2006-01-02"); c.usage.Day != day {
+		c.usage.Day = day
+		c.usage.DailyBytes = 0
+		c.dirty = true
+	}
+	if month := now.Format("2006-01"); c.usage.Month != month {
+		c.usage.Month = month
+		c.usage.MonthlyBytes = 0
+		c.dirty = true
+	}
+}
+
+// count records n relayed bytes and returns how long the relay should wait
+// to stay under the direction's rate
+func (c *resourceCaps) count(dir string, n int) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	c.mu.Lock()
+	c.rollover(time.Now())
+	c.usage.DailyBytes += int64(n)
+	c.usage.MonthlyBytes += int64(n)
+	c.dirty = true
+	c.mu.Unlock()
+
+	bucket := c.down
+	if dir == capUp {
+		c.upBytes.Add(int64(n))
+		bucket = c.up
+	} else {
+		c.downBytes.Add(int64(n))
+	}
+	if bucket == nil {
+		return 0
+	}
+	return bucket.reserve(n)
+}
+
+// throttle counts n bytes and sleeps off any rate debt
+func (c *resourceCaps) throttle(dir string, n int) {
+	if d := c.count(dir, n); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// exhausted returns why new relays are refused, or nil
+func (c *resourceCaps) exhausted() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rollover(time.Now())
+	if c.cfg.DailyGB > 0 && float64(c.usage.DailyBytes) >= c.cfg.DailyGB*1e9 {
+		return fmt.Errorf("node reached its daily cap of %g GB", c.cfg.DailyGB)
+	}
+	if c.cfg.MonthlyGB > 0 && float64(c.usage.MonthlyBytes) >= c.cfg.MonthlyGB*1e9 {
+		return fmt.Errorf("node reached its monthly cap of %g GB", c.cfg.MonthlyGB)
+	}
+	return nil
+}
+
+// save writes the usage if it changed
+func (c *resourceCaps) save() {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return
+	}
+	data, err := json.Marshal(c.usage)
+	c.dirty = false
+	c.mu.Unlock()
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(c.cfg.UsageFile, data, 0600); err != nil {
+		log.Printf("[NODE] Could not save usage: %v", err)
+	}
+}
+
+// report is the caps object sent in registration and caps_usage: the limits
+// (maxTunnels includes the remote config's) and current usage. Throughput is averaged since the previous report.
+func (c *resourceCaps) report(openTunnels, maxTunnels int) map[string]interface{} {
+	c.mu.Lock()
+	c.rollover(time.Now())
+	usage := c.usage
+	elapsed := time.Since(c.lastReport).Seconds()
+	c.lastReport = time.Now()
+	c.mu.Unlock()
+
+	mbps := func(bytes int64) float64 {
+		if elapsed <= 0 {
+			return 0
+		}
+		return math.Round(float64(bytes)*8/1e6/elapsed*100) / 100
+	}
+	return map[string]interface{}{
+		"max_up_mbps":   c.cfg.MaxUpMbps,
+		"max_down_mbps": c.cfg.MaxDownMbps,
+		"daily_gb":      c.cfg.DailyGB,
+		"monthly_gb":    c.cfg.MonthlyGB,
+		"max_tunnels":   maxTunnels,
+		"up_mbps":       mbps(c.upBytes.Swap(0)),
+		"down_mbps":     mbps(c.downBytes.Swap(0)),
+		"daily_bytes":   usage.DailyBytes,
+		"monthly_bytes": usage.MonthlyBytes,
+		"open_tunnels":  openTunnels,
+	}
+}
+
+// reportCaps sends caps_usage every capsReportInterval while connected
+func (a *NodeAgent) reportCaps(stop <-chan struct{}) {
+	if !a.caps.cfg.limited() {
+		return
+	}
+	ticker := time.NewTicker(capsReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.caps.save()
+			msg, _ := json.Marshal(map[string]interface{}{
+				"type": "caps_usage",
+				"data": a.caps.report(int(a.openTunnels.Load()), a.tunnelLimit()),
+			})
+			a.safeWrite(websocket.TextMessage, msg)
+		case <-stop:
+			a.caps.save()
+			return
+		case <-a.done:
+			a.caps.save()
+			return
+		}
+	}
+}
+
+// tunnelLimit is the lower of the operator's and the remote config's
+// concurrent tunnel limits; 0 = unlimited
+func (a *NodeAgent) tunnelLimit() int {
+	limit := a.caps.cfg.MaxTunnels
+	if remote := a.remote().MaxTunnels; remote > 0 && (limit == 0 || remote < limit) {
+		limit = remote
+	}
+	return limit
+}
+
+// refuseRelay returns why a new tunnel, association or bind is refused
+func (a *NodeAgent) refuseRelay() error {
+	if err := a.unavailable(); err != nil {
+		return err
+	}
+	if err := a.caps.exhausted(); err != nil {
+		return err
+	}
+	if limit := a.tunnelLimit(); limit > 0 && int(a.openTunnels.Load()) >= limit {
+		return fmt.Errorf("node at its limit of %d tunnels", limit)
+	}
+	return nil
+}
+
+// defaultUsageFile keeps quota usage beside the identity key
+func defaultUsageFile(identityFile string) string {
+	return filepath.Join(filepath.Dir(identityFile), usageFileName)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ─── Remote Config ─────────────────────────────────────────────────────────────
+//
+// The gateway can push config_update {version, payload, signature}: payload
+// is a JSON config document signed with the gateway's Ed25519 key over
+// "iploop-node-config:v1:<version>:<payload>". The node checks it against
+// --config-key (the public_key the gateway's /admin/configs shows), applies
+// it, keeps it next to the identity key so it survives restarts, and answers
+// config_ack. Without --config-key every update is rejected.
+//
+//	{"tunnel_buffer_kb": 64, "keepalive_interval_sec": 120, "max_tunnels": 200,
+//	 "features": {"udp": true, "bind": false}}
+//
+// Omitted fields keep the built-in defaults.
+
+const (
+	configSignaturePrefix = "iploop-node-config:v1:"
+	configFileName        = "config.json"
+
+	defaultTunnelBuffer = 32 * 1024
+	defaultKeepalive    = 5 * time.Minute
+)
+
+// remoteConfig is what a config document may set
+type remoteConfig struct {
+	TunnelBufferKB int             `json:"tunnel_buffer_kb,omitempty"`       // legacy tunnel read buffer, 4-256
+	KeepaliveSec   int             `json:"keepalive_interval_sec,omitempty"` // 30-3600
+	MaxTunnels     int             `json:"max_tunnels,omitempty"`            // concurrent tunnels, 0 = unlimited
+	Features       map[string]bool `json:"features,omitempty"`               // udp, bind; unset = on
+}
+
+func (c *remoteConfig) validate() error {
+	switch {
+	case c.TunnelBufferKB != 0 && (c.TunnelBufferKB < 4 || c.TunnelBufferKB > 256):
+		return fmt.Errorf("tunnel_buffer_kb %d out of range 4-256", c.TunnelBufferKB)
+	case c.KeepaliveSec != 0 && (c.KeepaliveSec < 30 || c.KeepaliveSec > 3600):
+		return fmt.Errorf("keepalive_interval_sec %d out of range 30-3600", c.KeepaliveSec)
+	case c.MaxTunnels < 0:
+		return fmt.Errorf("max_tunnels %d is negative", c.MaxTunnels)
+	}
+	return nil
+}
+
+// signedConfig is a config_update as received and as kept on disk
+type signedConfig struct {
+	Version   int64  `json:"version"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// parseConfigKey reads --config-key; "" disables config push
+func parseConfigKey(s string) (ed25519.PublicKey, error) {
+	if s == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("not a base64 Ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// verifyConfig checks a document's signature and parses it
+func (a *NodeAgent) verifyConfig(doc signedConfig) (*remoteConfig, error) {
+	if a.configKey == nil {
+		return nil, errors.New("no --config-key configured")
+	}
+	sig, err := base64.StdEncoding.DecodeString(doc.Signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, errors.New("invalid signature")
+	}
+	msg := configSignaturePrefix + strconv.FormatInt(doc.Version, 10) + ":" + doc.Payload
+	if !ed25519.Verify(a.configKey, []byte(msg), sig) {
+		return nil, errors.New("invalid signature")
+	}
+	var cfg remoteConfig
+	if err := json.Unmarshal([]byte(doc.Payload), &cfg); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// loadRemoteConfig applies the document kept from a previous run, if it
+// still verifies
+func (a *NodeAgent) loadRemoteConfig() {
+	data, err := os.ReadFile(a.configFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[NODE] Remote config: %v", err)
+		}
+		return
+	}
+	var doc signedConfig
+	if err := json.Unmarshal(data, &doc); err != nil {
+		log.Printf("[NODE] Remote config %s unreadable: %v", a.configFile, err)
+		return
+	}
+	cfg, err := a.verifyConfig(doc)
+	if err != nil {
+		log.Printf("[NODE] Ignoring remote config v%d: %v", doc.Version, err)
+		return
+	}
+	a.applyConfig(doc.Version, cfg)
+}
+
+// handleConfigUpdate verifies, applies and acknowledges a config_update
+func (a *NodeAgent) handleConfigUpdate(data interface{}) {
+	dataBytes, _ := json.Marshal(data)
+	var doc signedConfig
+	if json.Unmarshal(dataBytes, &doc) != nil || doc.Version <= 0 {
+		return
+	}
+
+	running := a.configVersion.Load()
+	if doc.Version == running {
+		a.ackConfig(doc.Version, nil)
+		return
+	}
+	if doc.Version < running {
+		a.ackConfig(doc.Version, fmt.Errorf("older than running version %d", running))
+		return
+	}
+	cfg, err := a.verifyConfig(doc)
+	if err != nil {
+		log.Printf("[NODE] Rejected remote config v%d: %v", doc.Version, err)
+		a.ackConfig(doc.Version, err)
+		return
+	}
+	a.applyConfig(doc.Version, cfg)
+	if data, err := json.Marshal(doc); err == nil {
+		if err := os.WriteFile(a.configFile, data, 0600); err != nil {
+			log.Printf("[NODE] Could not keep remote config: %v", err)
+		}
+	}
+	a.ackConfig(doc.Version, nil)
+}
+
+func (a *NodeAgent) applyConfig(version int64, cfg *remoteConfig) {
+	a.config.Store(cfg)
+	a.configVersion.Store(version)
+	log.Printf("[NODE] Running remote config v%d (buffer %dKB, keepalive %v, max tunnels %d, features %v)",
+		version, a.tunnelBufferSize()/1024, a.keepaliveInterval(), cfg.MaxTunnels, cfg.Features)
+}
+
+func (a *NodeAgent) ackConfig(version int64, err error) {
+	data := map[string]interface{}{
+		"version": version,
+		"status":  "applied",
+	}
+	if err != nil {
+		data["status"] = "rejected"
+		data["error"] = err.Error()
+	}
+	ack, _ := json.Marshal(map[string]interface{}{
+		"type": "config_ack",
+		"data": data,
+	})
+	a.safeWrite(websocket.TextMessage, ack)
+}
+
+// remote returns the running config; the zero config means all defaults
+func (a *NodeAgent) remote() *remoteConfig {
+	if cfg, ok := a.config.Load().(*remoteConfig); ok {
+		return cfg
+	}
+	return &remoteConfig{}
+}
+
+func (a *NodeAgent) tunnelBufferSize() int {
+	if kb := a.remote().TunnelBufferKB; kb > 0 {
+		return kb * 1024
+	}
+	return defaultTunnelBuffer
+}
+
+func (a *NodeAgent) keepaliveInterval() time.Duration {
+	if sec := a.remote().KeepaliveSec; sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	return defaultKeepalive
+}
+
+// featureEnabled reports whether a feature flag is on; unset flags are on
+func (a *NodeAgent) featureEnabled(name string) bool {
+	on, ok := a.remote().Features[name]
+	return !ok || on
+}
+
+// defaultConfigFile keeps the remote config beside the identity key
+func defaultConfigFile(identityFile string) string {
+	return filepath.Join(filepath.Dir(identityFile), configFileName)
+}
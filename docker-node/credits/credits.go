@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,6 +24,10 @@ const (
 type CreditService struct {
 	db *sql.DB
 	mu sync.Mutex
+
+	// Devices closed by DeviceScheduledOff and not reconnected since;
+	// TickActiveCredits doesn't pay them
+	resting map[string]bool
 }
 
 type UserBalance struct {
@@ -50,7 +55,7 @@ func New(dbPath string) (*CreditService, error) {
 		return nil, err
 	}
 
-	cs := &CreditService{db: db}
+	cs := &CreditService{db: db, resting: make(map[string]bool)}
 	if err := cs.migrate(); err != nil {
 		return nil, err
 	}
@@ -78,6 +83,7 @@ func (cs *CreditService) migrate() error {
 			disconnected_at DATETIME,
 			uptime_hours REAL DEFAULT 0,
 			credits_earned REAL DEFAULT 0,
+			scheduled_off INTEGER DEFAULT 0,
 			FOREIGN KEY (user_id) REFERENCES users(user_id)
 		);
 
@@ -106,7 +112,16 @@ func (cs *CreditService) migrate() error {
 		CREATE INDEX IF NOT EXISTS idx_credit_log_user ON credit_log(user_id);
 		CREATE INDEX IF NOT EXISTS idx_proxy_usage_user ON proxy_usage(user_id);
 	`)
-	return err
+	if err != nil {
+		return err
+	}
+
+	// Databases created before scheduled downtime was tracked
+	_, err = cs.db.Exec("ALTER TABLE device_sessions ADD COLUMN scheduled_off INTEGER DEFAULT 0")
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return err
+	}
+	return nil
 }
 
 // ─── User Management ───────────────────────────────────────────────────────────
@@ -151,6 +166,7 @@ func (cs *CreditService) DeviceConnected(nodeID, userID string) error {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
+	delete(cs.resting, nodeID)
 	_, err := cs.db.Exec(
 		`INSERT INTO device_sessions (device_id, user_id, node_id, connected_at)
 		 VALUES (?, ?, ?, ?)`,
@@ -160,9 +176,27 @@ func (cs *CreditService) DeviceConnected(nodeID, userID string) error {
 }
 
 func (cs *CreditService) DeviceDisconnected(nodeID string) error {
+	return cs.closeSession(nodeID, false)
+}
+
+// DeviceScheduledOff closes the device's session because it went outside
+// its operator's sharing schedule or was paused. The session is marked
+// scheduled_off so it isn't mistaken for a dropped connection; the time
+// spent off earns nothing.
+func (cs *CreditService) DeviceScheduledOff(nodeID string) error {
+	return cs.closeSession(nodeID, true)
+}
+
+func (cs *CreditService) closeSession(nodeID string, scheduledOff bool) error {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
+	if scheduledOff {
+		cs.resting[nodeID] = true
+	} else {
+		delete(cs.resting, nodeID)
+	}
+
 	var sessionID int64
 	var connectedAt time.Time
 	var userID string
@@ -188,8 +222,8 @@ func (cs *CreditService) DeviceDisconnected(nodeID string) error {
 
 	// Close session
 	tx.Exec(
-		"UPDATE device_sessions SET disconnected_at = ?, uptime_hours = ?, credits_earned = ? WHERE id = ?",
-		now, hours, credits, sessionID,
+		"UPDATE device_sessions SET disconnected_at = ?, uptime_hours = ?, credits_earned = ?, scheduled_off = ? WHERE id = ?",
+		now, hours, credits, scheduledOff, sessionID,
 	)
 
 	// Add credits
@@ -297,6 +331,14 @@ func (cs *CreditService) TickActiveCredits() {
 		var connectedAt time.Time
 		rows.Scan(&id, &nodeID, &userID, &connectedAt)
 
+		// Scheduled off or paused: not sharing, so not earning
+		cs.mu.Lock()
+		resting := cs.resting[nodeID]
+		cs.mu.Unlock()
+		if resting {
+			continue
+		}
+
 		hours := now.Sub(connectedAt).Hours()
 		credits := cs.calculateCredits(userID, hours)
 
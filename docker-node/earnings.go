@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/iploop/docker-node/credits"
+)
+
+// ─── Uptime Credits ────────────────────────────────────────────────────────────
+//
+// With --credits-db the node keeps its own uptime ledger (credits package).
+// A credit session is open only while the node is connected and sharing:
+// going outside the schedule or being paused closes it as scheduled_off,
+// and becoming available again opens a new one.
+
+const creditTickInterval = time.Hour
+
+// openCredits opens the ledger at path and registers the token's user
+func openCredits(path, token string) (*credits.CreditService, string, error) {
+	cs, err := credits.New(path)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256([]byte(token))
+	userID := "user_" + hex.EncodeToString(sum[:8])
+	if err := cs.CreateUser(userID, token); err != nil {
+		cs.Close()
+		return nil, "", err
+	}
+	return cs, userID, nil
+}
+
+// syncCredits opens or closes the credit session to match availability
+func (a *NodeAgent) syncCredits(status string) {
+	if a.credits == nil {
+		return
+	}
+	if status == availabilityOn {
+		if a.creditOpen.CompareAndSwap(false, true) {
+			if err := a.credits.DeviceConnected(a.nodeID, a.creditUser); err != nil {
+				log.Printf("[CREDITS] open session: %v", err)
+			}
+		}
+		return
+	}
+	if a.creditOpen.CompareAndSwap(true, false) {
+		if err := a.credits.DeviceScheduledOff(a.nodeID); err != nil {
+			log.Printf("[CREDITS] close session (%s): %v", status, err)
+		}
+	}
+}
+
+// closeCredits ends the credit session when the gateway connection drops
+func (a *NodeAgent) closeCredits() {
+	if a.credits == nil || !a.creditOpen.CompareAndSwap(true, false) {
+		return
+	}
+	if err := a.credits.DeviceDisconnected(a.nodeID); err != nil {
+		log.Printf("[CREDITS] close session: %v", err)
+	}
+}
+
+// tickCredits updates the running totals of the open session hourly
+func (a *NodeAgent) tickCredits() {
+	ticker := time.NewTicker(creditTickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.credits.TickActiveCredits()
+		case <-a.done:
+			return
+		}
+	}
+}
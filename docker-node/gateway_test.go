@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ─── Gateway harness ───────────────────────────────────────────────────────────
+
+// hubConn is the gateway's end of an agent connection
+type hubConn struct {
+	conn *websocket.Conn
+	msgs chan map[string]interface{}
+	seen []string // types read so far, in order
+}
+
+// stubIPInfo serves the agent's IP lookup locally
+func stubIPInfo(t *testing.T) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"query":"203.0.113.7","countryCode":"DE","country":"Germany","city":"Berlin","regionName":"Berlin","isp":"Example ISP","as":"AS64500 Example"}`))
+	}))
+	saved := ipInfoURL
+	ipInfoURL = srv.URL
+	t.Cleanup(func() {
+		ipInfoURL = saved
+		srv.Close()
+	})
+}
+
+// connectAgent runs connect for a new agent against a gateway that sends
+// greeting as soon as the WebSocket is up. The returned channel gets
+// connect's result.
+func connectAgent(t *testing.T, greeting ...string) (*NodeAgent, *hubConn, <-chan error) {
+	t.Helper()
+	stubIPInfo(t)
+
+	conns := make(chan *hubConn, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		for _, msg := range greeting {
+			conn.WriteMessage(websocket.TextMessage, []byte(msg))
+		}
+		hc := &hubConn{conn: conn, msgs: make(chan map[string]interface{}, 64)}
+		conns <- hc
+		defer close(hc.msgs)
+		for {
+			msgType, raw, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var m map[string]interface{}
+			if msgType == websocket.TextMessage && json.Unmarshal(raw, &m) == nil {
+				hc.msgs <- m
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	egress, err := newEgressPolicy(egressConfig{AllowCIDRs: "127.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("egress policy: %v", err)
+	}
+	a := &NodeAgent{
+		nodeID:   "docker_test",
+		token:    "test-token",
+		gateway:  "ws" + strings.TrimPrefix(srv.URL, "http"),
+		identity: key,
+		egress:   egress,
+		caps:     newResourceCaps(capsConfig{}),
+		done:     make(chan struct{}),
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- a.connect() }()
+
+	select {
+	case hc := <-conns:
+		t.Cleanup(func() {
+			close(a.done)
+			hc.conn.Close()
+		})
+		return a, hc, errc
+	case err := <-errc:
+		t.Fatalf("connect: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent never connected")
+	}
+	return nil, nil, nil
+}
+
+// next returns the next message of the given type, skipping others
+func (hc *hubConn) next(t *testing.T, msgType string, timeout time.Duration) map[string]interface{} {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case m, ok := <-hc.msgs:
+			if !ok {
+				t.Fatalf("agent hung up waiting for %s (saw %v)", msgType, hc.seen)
+			}
+			typ, _ := m["type"].(string)
+			hc.seen = append(hc.seen, typ)
+			if typ == msgType {
+				return m
+			}
+		case <-deadline:
+			t.Fatalf("no %s from agent (saw %v)", msgType, hc.seen)
+		}
+	}
+}
+
+func (hc *hubConn) send(t *testing.T, raw string) {
+	t.Helper()
+	if err := hc.conn.WriteMessage(websocket.TextMessage, []byte(raw)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+}
+
+func dataOf(m map[string]interface{}) map[string]interface{} {
+	data, _ := m["data"].(map[string]interface{})
+	return data
+}
+
+// ─── Handshake ─────────────────────────────────────────────────────────────────
+
+func TestAgentAnswersChallengeBeforeRegistering(t *testing.T) {
+	// The hub challenges on connect, before the node's hello arrives
+	a, hub, _ := connectAgent(t, `{"type":"auth_challenge","data":{"nonce":"bm9uY2U=","mode":"required"}}`)
+
+	resp := dataOf(hub.next(t, "auth_response", 5*time.Second))
+	if resp["device_id"] != a.nodeID {
+		t.Fatalf("auth_response for %v, want %s", resp["device_id"], a.nodeID)
+	}
+	pub, _ := base64.StdEncoding.DecodeString(resp["public_key"].(string))
+	sig, _ := base64.StdEncoding.DecodeString(resp["signature"].(string))
+	if !ed25519.Verify(pub, []byte(authSignaturePrefix+"bm9uY2U=:"+a.nodeID), sig) {
+		t.Fatal("auth_response signature does not verify")
+	}
+
+	reg := dataOf(hub.next(t, "register", 5*time.Second))
+	if reg["device_id"] != a.nodeID || reg["country"] != "DE" {
+		t.Fatalf("register = %v", reg)
+	}
+	if hub.seen[0] != "hello" {
+		t.Errorf("first message %q, want hello", hub.seen[0])
+	}
+	if reg["half_close"] != true {
+		t.Errorf("register doesn't advertise half_close: %v", reg)
+	}
+
+	// The hub batches what it has queued into one array
+	hub.send(t, `[{"type":"registration_success","data":{"node_id":"n1","status":"registered"}},{"type":"pause","data":{"minutes":30}}]`)
+	avail := dataOf(hub.next(t, "availability", 5*time.Second))
+	if avail["status"] != availabilityPaused {
+		t.Fatalf("availability after pause = %v, want %s", avail["status"], availabilityPaused)
+	}
+}
+
+func TestAgentRegistersWithoutGreeting(t *testing.T) {
+	// A hub without identity checks sends nothing until the node registers
+	start := time.Now()
+	a, hub, errc := connectAgent(t)
+	reg := dataOf(hub.next(t, "register", greetingWait+5*time.Second))
+	if reg["device_id"] != a.nodeID {
+		t.Fatalf("register = %v", reg)
+	}
+	if waited := time.Since(start); waited < greetingWait {
+		t.Errorf("registered after %v, before the greeting wait of %v", waited, greetingWait)
+	}
+
+	hub.send(t, `{"type":"registration_success","data":{"node_id":"n1","status":"registered"}}`)
+	hub.send(t, `{"type":"resume"}`)
+	if avail := dataOf(hub.next(t, "availability", 5*time.Second)); avail["status"] != availabilityOn {
+		t.Fatalf("availability after resume = %v", avail["status"])
+	}
+	select {
+	case err := <-errc:
+		t.Fatalf("connection ended: %v", err)
+	default:
+	}
+}
+
+func TestAgentWelcomeStartsRegistration(t *testing.T) {
+	start := time.Now()
+	_, hub, _ := connectAgent(t, `{"type":"welcome","ping_interval":270}`)
+	hub.next(t, "register", 5*time.Second)
+	if waited := time.Since(start); waited >= greetingWait {
+		t.Errorf("registered after %v despite the welcome", waited)
+	}
+}
+
+func TestAgentCooldown(t *testing.T) {
+	_, _, errc := connectAgent(t, `{"type":"cooldown","reason":"too many reconnects","retry_after_sec":60}`)
+	select {
+	case err := <-errc:
+		if err == nil || !strings.Contains(err.Error(), "cooldown") {
+			t.Fatalf("connect = %v, want cooldown error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connect didn't return on cooldown")
+	}
+}
+
+func TestControlMessages(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{`{"type":"pause"}`, []string{`{"type":"pause"}`}},
+		{` [{"type":"a"},{"type":"b"}]`, []string{`{"type":"a"}`, `{"type":"b"}`}},
+		{`[]`, []string{}},
+		{`[{"type":"a"}`, nil}, // broken batch
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, raw := range controlMessages([]byte(tt.in)) {
+			got = append(got, string(raw))
+		}
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("controlMessages(%s) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// ─── Tunnels over JSON tunnel_data ─────────────────────────────────────────────
+
+// tunnelData decodes a tunnel_data message's payload
+func tunnelData(t *testing.T, m map[string]interface{}) []byte {
+	t.Helper()
+	encoded, _ := m["data"].(string)
+	payload, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("tunnel_data payload: %v", err)
+	}
+	return payload
+}
+
+func TestAgentHalfClosedTunnel(t *testing.T) {
+	// The target answers once its client has finished sending, like an
+	// HTTP/1.0 upload or an SMTP client that shuts down its write side
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		body, _ := io.ReadAll(conn)
+		fmt.Fprintf(conn, "got %d bytes: %s", len(body), body)
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	a, hub, _ := connectAgent(t, `{"type":"auth_challenge","data":{"nonce":"bm9uY2U="}}`)
+	hub.next(t, "register", 5*time.Second)
+	// No tunnel_protocol: the hub's JSON tunnel_data
+	hub.send(t, `{"type":"registration_success","data":{"node_id":"n1","status":"registered"}}`)
+
+	const id = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	hub.send(t, `{"type":"tunnel_open","data":{"tunnel_id":"`+id+`","host":"127.0.0.1","port":"`+port+`"}}`)
+	if resp := dataOf(hub.next(t, "tunnel_response", 5*time.Second)); resp["success"] != true {
+		t.Fatalf("tunnel_response = %v", resp)
+	}
+
+	// Client data, then the client's half-close
+	hub.send(t, `[{"type":"tunnel_data","data":{"tunnel_id":"`+id+`","data":"`+base64.StdEncoding.EncodeToString([]byte("ping"))+`"}},`+
+		`{"type":"tunnel_data","data":{"tunnel_id":"`+id+`","fin":true}}]`)
+
+	// The reply comes back after the FIN reached the target, then the
+	// target's own FIN
+	var reply []byte
+	for {
+		m := dataOf(hub.next(t, "tunnel_data", 5*time.Second))
+		if m["tunnel_id"] != id {
+			t.Fatalf("tunnel_data for %v", m["tunnel_id"])
+		}
+		if m["eof"] == true {
+			t.Fatalf("tunnel closed instead of half-closed after %q", reply)
+		}
+		if m["fin"] == true {
+			break
+		}
+		reply = append(reply, tunnelData(t, m)...)
+	}
+	if string(reply) != "got 4 bytes: ping" {
+		t.Fatalf("reply = %q", reply)
+	}
+
+	// Both sides are done: the hub's EOF closes the tunnel
+	if n := a.openTunnels.Load(); n != 1 {
+		t.Fatalf("%d open tunnels after the target's FIN, want 1", n)
+	}
+	hub.send(t, `{"type":"tunnel_data","data":{"tunnel_id":"`+id+`","eof":true}}`)
+	deadline := time.Now().Add(5 * time.Second)
+	for a.openTunnels.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel still open after the hub's EOF")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
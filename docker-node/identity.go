@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// ─── Node Identity ─────────────────────────────────────────────────────────────
+//
+// The node proves who it is with an Ed25519 key generated on first run and
+// kept in --identity (base64 seed, mode 0600). The gateway sends
+// auth_challenge {nonce}; the node answers auth_response with its public key
+// and a signature over "iploop-node-auth:v1:<nonce>:<device_id>". The gateway
+// pins the first key it sees to the device ID, so the key file must survive
+// container restarts: mount a volume on its directory.
+
+const (
+	defaultIdentityFile = "/var/lib/iploop/identity.key"
+	authSignaturePrefix = "iploop-node-auth:v1:"
+)
+
+// loadOrCreateIdentity reads the node's key, generating it on first run
+func loadOrCreateIdentity(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%s: not an identity key", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	seed := base64.StdEncoding.EncodeToString(key.Seed()) + "\n"
+	if err := os.WriteFile(path, []byte(seed), 0600); err != nil {
+		return nil, err
+	}
+	log.Printf("[NODE] Generated identity key %s", path)
+	return key, nil
+}
+
+// identityFingerprint matches the fingerprint the gateway's admin API shows
+func identityFingerprint(key ed25519.PrivateKey) string {
+	sum := sha256.Sum256(key.Public().(ed25519.PublicKey))
+	return hex.EncodeToString(sum[:8])
+}
+
+// answerChallenge signs an auth_challenge and sends auth_response
+func (a *NodeAgent) answerChallenge(data interface{}) {
+	challenge, _ := data.(map[string]interface{})
+	nonce, _ := challenge["nonce"].(string)
+	if nonce == "" {
+		return
+	}
+	sig := ed25519.Sign(a.identity, []byte(authSignaturePrefix+nonce+":"+a.nodeID))
+	resp, _ := json.Marshal(map[string]interface{}{
+		"type": "auth_response",
+		"data": map[string]interface{}{
+			"device_id":  a.nodeID,
+			"public_key": base64.StdEncoding.EncodeToString(a.identity.Public().(ed25519.PublicKey)),
+			"signature":  base64.StdEncoding.EncodeToString(sig),
+		},
+	})
+	a.safeWrite(websocket.TextMessage, resp)
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
@@ -13,22 +18,33 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"github.com/iploop/docker-node/credits"
 )
 
 const (
 	version     = "1.0.0"
-	gatewayURL  = "wss://gateway.iploop.io:9443/ws"
-	ipInfoURL   = "http://ip-api.com/json/"
+	gatewayURL  = "wss://gateway.iploop.io/ws" // node-registration hub
 	pingPeriod  = 4*time.Minute + 30*time.Second
 	maxTunnels  = 32
+
+	// How long registration waits for the gateway's first message. An
+	// auth_challenge has to be answered before registering; a hub that
+	// doesn't check identities sends nothing first.
+	greetingWait = 2 * time.Second
 )
 
+// ipInfoURL is a variable so tests can serve it
+var ipInfoURL = "http://ip-api.com/json/"
+
 // ─── Types ─────────────────────────────────────────────────────────────────────
 
 type IPInfo struct {
@@ -47,23 +63,69 @@ type TunnelOpen struct {
 	TunnelID string `json:"tunnel_id"`
 	Host     string `json:"host"`
 	Port     string `json:"port"`
+	StreamID uint32 `json:"stream_id,omitempty"` // set when the gateway uses mux frames
+	Window   int    `json:"window,omitempty"`
+	Priority uint8  `json:"priority,omitempty"`
 }
 
 type NodeAgent struct {
-	nodeID   string
-	token    string
-	gateway  string
-	conn     *websocket.Conn
-	writeMu  sync.Mutex
-	tunnels  sync.Map // tunnel_id -> net.Conn
-	done     chan struct{}
+	nodeID    string
+	token     string
+	gateway   string
+	conn      *websocket.Conn
+	writeMu   sync.Mutex
+	tunnels   sync.Map // tunnel_id -> net.Conn
+	streams   sync.Map // stream_id -> *muxStream
+	udpAssocs sync.Map // stream_id -> *udpAssociation
+	binds     sync.Map // stream_id -> *net.TCPListener awaiting its peer
+	egress    *egressPolicy
+	caps      *resourceCaps
+	identity  ed25519.PrivateKey
+	done      chan struct{}
+
+	// Remote config, see config.go
+	configKey     ed25519.PublicKey
+	configFile    string
+	config        atomic.Value // *remoteConfig
+	configVersion atomic.Int64
+	openTunnels   atomic.Int32
+
+	// The hub negotiates no frame protocol and sends tunnel data as JSON
+	// tunnel_data messages, which carry FIN; set from registration_success
+	jsonTunnels atomic.Bool
+
+	// Availability, see schedule.go
+	schedule         *weeklySchedule
+	pausedUntil      atomic.Int64 // unix nanos; -1 = until resumed
+	lastAvailability atomic.Value // status last sent to the gateway
+
+	// Uptime credits, see earnings.go; nil without --credits-db
+	credits    *credits.CreditService
+	creditUser string
+	creditOpen atomic.Bool
 }
 
 // ─── Main ──────────────────────────────────────────────────────────────────────
 
 func main() {
 	token := flag.String("token", os.Getenv("IPLOOP_TOKEN"), "Node authentication token")
-	gateway := flag.String("gateway", gatewayURL, "Gateway WebSocket URL")
+	gateway := flag.String("gateway", envOr("IPLOOP_GATEWAY", gatewayURL), "Gateway WebSocket URL")
+	identityFile := flag.String("identity", envOr("IPLOOP_IDENTITY_FILE", defaultIdentityFile), "Node identity key file, generated on first run")
+	policyFile := flag.String("policy", os.Getenv("IPLOOP_POLICY_FILE"), "Destination policy file (the gateway's DESTINATION_POLICY_FILE)")
+	denyPorts := flag.String("deny-ports", os.Getenv("IPLOOP_DENY_PORTS"), "Ports to refuse, comma-separated (e.g. 465,587,6660-6669); 25 is always refused")
+	denyDomains := flag.String("deny-domains", os.Getenv("IPLOOP_DENY_DOMAINS"), "Domains to refuse, with their subdomains, comma-separated")
+	denyCIDRs := flag.String("deny-cidrs", os.Getenv("IPLOOP_DENY_CIDRS"), "Addresses or CIDRs to refuse, comma-separated")
+	allowCIDRs := flag.String("allow-cidrs", os.Getenv("IPLOOP_ALLOW_CIDRS"), "Private or reserved ranges to allow despite the built-in blocks; metadata endpoints stay blocked")
+	targetRate := flag.Int("target-rate", envInt("IPLOOP_TARGET_RATE", defaultTargetRate), "Max new connections per minute to one host (0 = unlimited)")
+	maxUpMbps := flag.Float64("max-up-mbps", envFloat("IPLOOP_MAX_UP_MBPS", 0), "Max relay throughput to targets in Mbps (0 = unlimited)")
+	maxDownMbps := flag.Float64("max-down-mbps", envFloat("IPLOOP_MAX_DOWN_MBPS", 0), "Max relay throughput from targets in Mbps (0 = unlimited)")
+	dailyGB := flag.Float64("daily-gb", envFloat("IPLOOP_DAILY_GB", 0), "Max relayed GB per day (0 = unlimited)")
+	monthlyGB := flag.Float64("monthly-gb", envFloat("IPLOOP_MONTHLY_GB", 0), "Max relayed GB per calendar month (0 = unlimited)")
+	maxTunnelsFlag := flag.Int("max-tunnels", envInt("IPLOOP_MAX_TUNNELS", 0), "Max concurrent tunnels (0 = unlimited)")
+	scheduleSpec := flag.String("schedule", os.Getenv("IPLOOP_SCHEDULE"), "Weekly sharing hours, e.g. \"mon-fri 18:00-08:00; sat,sun 00:00-24:00\" (empty = always)")
+	timezone := flag.String("timezone", os.Getenv("IPLOOP_TIMEZONE"), "IANA time zone of --schedule (default local time)")
+	creditsDB := flag.String("credits-db", os.Getenv("IPLOOP_CREDITS_DB"), "SQLite file for the node's uptime credit ledger (empty = off)")
+	configKey := flag.String("config-key", os.Getenv("IPLOOP_CONFIG_KEY"), "Gateway public key that signs config_update (base64); remote config is refused without it")
 	flag.Parse()
 
 	if *token == "" {
@@ -76,6 +138,58 @@ func main() {
 		gateway: *gateway,
 		done:    make(chan struct{}),
 	}
+	key, err := loadOrCreateIdentity(*identityFile)
+	if err != nil {
+		log.Fatalf("Node identity: %v", err)
+	}
+	agent.identity = key
+
+	if agent.schedule, err = parseSchedule(*scheduleSpec, *timezone); err != nil {
+		log.Fatalf("Schedule: %v", err)
+	}
+	if agent.schedule != nil {
+		log.Printf("[NODE] Sharing schedule: %s (%s)", *scheduleSpec, agent.schedule.loc)
+	}
+
+	if *creditsDB != "" {
+		if agent.credits, agent.creditUser, err = openCredits(*creditsDB, *token); err != nil {
+			log.Fatalf("Credits: %v", err)
+		}
+		defer agent.credits.Close()
+		go agent.tickCredits()
+	}
+
+	if agent.configKey, err = parseConfigKey(*configKey); err != nil {
+		log.Fatalf("Config key: %v", err)
+	}
+	agent.configFile = defaultConfigFile(*identityFile)
+	agent.loadRemoteConfig()
+
+	egress, err := newEgressPolicy(egressConfig{
+		PolicyFile:  *policyFile,
+		DenyPorts:   *denyPorts,
+		DenyDomains: *denyDomains,
+		DenyCIDRs:   *denyCIDRs,
+		AllowCIDRs:  *allowCIDRs,
+		TargetRate:  *targetRate,
+	})
+	if err != nil {
+		log.Fatalf("Egress policy: %v", err)
+	}
+	agent.egress = egress
+
+	agent.caps = newResourceCaps(capsConfig{
+		MaxUpMbps:   *maxUpMbps,
+		MaxDownMbps: *maxDownMbps,
+		DailyGB:     *dailyGB,
+		MonthlyGB:   *monthlyGB,
+		MaxTunnels:  *maxTunnelsFlag,
+		UsageFile:   defaultUsageFile(*identityFile),
+	})
+	if agent.caps.cfg.limited() {
+		log.Printf("[NODE] Caps: up %g Mbps, down %g Mbps, %g GB/day, %g GB/month, %d tunnels (0 = unlimited)",
+			*maxUpMbps, *maxDownMbps, *dailyGB, *monthlyGB, *maxTunnelsFlag)
+	}
 
 	// Graceful shutdown
 	sigCh := make(chan os.Signal, 1)
@@ -88,6 +202,7 @@ func main() {
 
 	log.Printf("[NODE] IPLoop Docker Node v%s", version)
 	log.Printf("[NODE] ID: %s", agent.nodeID)
+	log.Printf("[NODE] Identity key: %s", identityFingerprint(agent.identity))
 	agent.runForever()
 }
 
@@ -143,9 +258,12 @@ func (a *NodeAgent) connect() error {
 		return fmt.Errorf("dial: %w", err)
 	}
 	a.conn = conn
+	a.jsonTunnels.Store(false)
 	defer func() {
+		a.closeCredits()
 		conn.Close()
 		a.conn = nil
+		a.closeTunnels()
 	}()
 
 	// TCP tuning
@@ -169,22 +287,17 @@ func (a *NodeAgent) connect() error {
 	if err := a.safeWrite(websocket.TextMessage, hello); err != nil {
 		return fmt.Errorf("hello: %w", err)
 	}
-
-	// Read welcome
-	_, msg, err := conn.ReadMessage()
-	if err != nil {
-		return fmt.Errorf("welcome: %w", err)
-	}
-	var welcome map[string]interface{}
-	json.Unmarshal(msg, &welcome)
-	if welcome["type"] == "cooldown" {
-		sec, _ := welcome["retry_after_sec"].(float64)
-		return fmt.Errorf("cooldown: retry after %vs", sec)
-	}
 	log.Printf("[NODE] Connected to gateway")
 
+	// ws-stability answers hello with welcome (or cooldown); the hub ignores
+	// it and, when it checks identities, has already sent auth_challenge.
+	// Both are read by the loop below; registration waits for either.
+	greeted := make(chan struct{})
+	var greetOnce sync.Once
+	greet := func() { greetOnce.Do(func() { close(greeted) }) }
+
 	// Send registration + IP info
-	go a.registerAndSendIPInfo()
+	go a.registerAndSendIPInfo(greeted)
 
 	// Pong handler
 	conn.SetPongHandler(func(string) error {
@@ -215,17 +328,24 @@ func (a *NodeAgent) connect() error {
 		}
 	}()
 	defer close(pingDone)
+	go a.reportCaps(pingDone)
+	go a.watchAvailability(pingDone)
 
 	// Keepalive ticker (every 5 min)
 	kaliveDone := make(chan struct{})
 	go func() {
-		ticker := time.NewTicker(5 * time.Minute)
+		interval := a.keepaliveInterval()
+		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
 				ka, _ := json.Marshal(map[string]string{"type": "keepalive"})
 				a.safeWrite(websocket.TextMessage, ka)
+				if next := a.keepaliveInterval(); next != interval {
+					interval = next
+					ticker.Reset(interval)
+				}
 			case <-kaliveDone:
 				return
 			case <-a.done:
@@ -255,46 +375,134 @@ func (a *NodeAgent) connect() error {
 			continue
 		}
 
-		var m map[string]interface{}
-		if json.Unmarshal(rawMsg, &m) != nil {
-			continue
+		for _, raw := range controlMessages(rawMsg) {
+			var m map[string]interface{}
+			if json.Unmarshal(raw, &m) != nil {
+				continue
+			}
+			if err := a.handleControl(m); err != nil {
+				return err
+			}
+			if m["type"] == "welcome" || m["type"] == "auth_challenge" {
+				greet()
+			}
 		}
+	}
+}
+
+// controlMessages splits a text frame into its messages: the hub sends what
+// it has queued as one JSON array
+func controlMessages(raw []byte) []json.RawMessage {
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+		var batch []json.RawMessage
+		json.Unmarshal(trimmed, &batch)
+		return batch
+	}
+	return []json.RawMessage{raw}
+}
 
-		switch m["type"] {
-		case "tunnel_open":
-			dataBytes, _ := json.Marshal(m["data"])
-			var req TunnelOpen
-			if json.Unmarshal(dataBytes, &req) == nil {
-				go a.handleTunnelOpen(req)
+// handleControl acts on a JSON message from the gateway; an error ends the
+// connection
+func (a *NodeAgent) handleControl(m map[string]interface{}) error {
+	switch m["type"] {
+	case "welcome":
+		// ws-stability accepted the hello
+	case "cooldown":
+		sec, _ := m["retry_after_sec"].(float64)
+		return fmt.Errorf("cooldown: retry after %vs", sec)
+	case "tunnel_open":
+		dataBytes, _ := json.Marshal(m["data"])
+		var req TunnelOpen
+		if json.Unmarshal(dataBytes, &req) == nil {
+			go a.handleTunnelOpen(req)
+		}
+	case "udp_open":
+		dataBytes, _ := json.Marshal(m["data"])
+		var req UDPOpen
+		if json.Unmarshal(dataBytes, &req) == nil {
+			go a.handleUDPOpen(req)
+		}
+	case "bind_open":
+		dataBytes, _ := json.Marshal(m["data"])
+		var req BindOpen
+		if json.Unmarshal(dataBytes, &req) == nil {
+			go a.handleBindOpen(req)
+		}
+	case "registration_success":
+		if data, ok := m["data"].(map[string]interface{}); ok {
+			proto, negotiated := data["tunnel_protocol"].(float64)
+			switch {
+			case !negotiated:
+				a.jsonTunnels.Store(true)
+				log.Printf("[NODE] Gateway uses JSON tunnel data")
+			case int(proto) >= tunnelProtoMux:
+				log.Printf("[NODE] Gateway negotiated mux tunnel protocol v%d", int(proto))
+			default:
+				log.Printf("[NODE] Gateway uses legacy tunnel frames")
 			}
-		case "keepalive_ack":
-			// OK
-		case "heartbeat_ack":
-			// OK
 		}
+	case "tunnel_data":
+		a.handleTunnelData(m["data"])
+	case "auth_challenge":
+		a.answerChallenge(m["data"])
+	case "config_update":
+		a.handleConfigUpdate(m["data"])
+	case "pause":
+		a.handlePause(m["data"])
+	case "resume":
+		a.handleResume()
+	case "auth_success":
+		log.Printf("[NODE] Identity verified by gateway")
+	case "auth_failed":
+		if data, ok := m["data"].(map[string]interface{}); ok {
+			log.Printf("[NODE] Identity rejected by gateway: %v", data["error"])
+		}
+	case "upgrade_required", "version_deprecated":
+		if data, ok := m["data"].(map[string]interface{}); ok {
+			log.Printf("[NODE] %v (latest %v, download: %v)", data["message"], data["latest_version"], data["download_url"])
+		}
+	case "keepalive_ack":
+		// OK
+	case "heartbeat_ack":
+		// OK
 	}
+	return nil
 }
 
 // ─── Tunnel Handling ───────────────────────────────────────────────────────────
 
 func (a *NodeAgent) handleTunnelOpen(req TunnelOpen) {
-	target := net.JoinHostPort(req.Host, req.Port)
-	
-	tcpConn, err := net.DialTimeout("tcp", target, 10*time.Second)
+	var tcpConn net.Conn
+	var err error
+	if err = a.refuseRelay(); err == nil {
+		tcpConn, err = a.dialTarget(req.Host, req.Port)
+	}
 	if err != nil {
+		data := map[string]interface{}{
+			"tunnel_id": req.TunnelID,
+			"success":   false,
+			"error":     err.Error(),
+		}
+		var denial *egressError
+		if errors.As(err, &denial) {
+			log.Printf("[NODE] Tunnel %s to %s:%s refused: %v", req.TunnelID, req.Host, req.Port, denial)
+			denial.addTo(data)
+		}
 		resp, _ := json.Marshal(map[string]interface{}{
 			"type": "tunnel_response",
-			"data": map[string]interface{}{
-				"tunnel_id": req.TunnelID,
-				"success":   false,
-				"error":     err.Error(),
-			},
+			"data": data,
 		})
 		a.safeWrite(websocket.TextMessage, resp)
 		return
 	}
 
-	a.tunnels.Store(req.TunnelID, tcpConn)
+	a.trackTunnel(req.TunnelID, tcpConn)
+
+	var stream *muxStream
+	if req.StreamID != 0 {
+		stream = newMuxStream(a, req, tcpConn)
+		a.streams.Store(req.StreamID, stream)
+	}
 
 	// Send success
 	resp, _ := json.Marshal(map[string]interface{}{
@@ -306,11 +514,20 @@ func (a *NodeAgent) handleTunnelOpen(req TunnelOpen) {
 	})
 	a.safeWrite(websocket.TextMessage, resp)
 
-	// Read from TCP → send to gateway as binary tunnel data
+	if stream != nil {
+		go stream.run()
+		return
+	}
+	if a.jsonTunnels.Load() {
+		go a.relayTunnelJSON(req.TunnelID, tcpConn)
+		return
+	}
+
+	// Legacy: read from TCP → send to gateway as binary tunnel data
 	go func() {
 		defer func() {
 			tcpConn.Close()
-			a.tunnels.Delete(req.TunnelID)
+			a.untrackTunnel(req.TunnelID)
 		}()
 
 		tunnelIDBytes := []byte(req.TunnelID)
@@ -318,10 +535,11 @@ func (a *NodeAgent) handleTunnelOpen(req TunnelOpen) {
 		idBuf := make([]byte, 36)
 		copy(idBuf, tunnelIDBytes)
 
-		buf := make([]byte, 32768)
+		buf := make([]byte, a.tunnelBufferSize())
 		for {
 			n, err := tcpConn.Read(buf)
 			if n > 0 {
+				a.caps.throttle(capDown, n)
 				// Binary frame: [36B tunnel_id][1B flags=0x00][payload]
 				frame := make([]byte, 37+n)
 				copy(frame[:36], idBuf)
@@ -341,7 +559,106 @@ func (a *NodeAgent) handleTunnelOpen(req TunnelOpen) {
 	}()
 }
 
+// trackTunnel and untrackTunnel keep openTunnels in step with a.tunnels;
+// untrack may run more than once for a tunnel
+func (a *NodeAgent) trackTunnel(id string, conn net.Conn) {
+	a.tunnels.Store(id, conn)
+	a.openTunnels.Add(1)
+}
+
+func (a *NodeAgent) untrackTunnel(id string) {
+	if _, ok := a.tunnels.LoadAndDelete(id); ok {
+		a.openTunnels.Add(-1)
+	}
+}
+
+// closeTunnels drops every target connection when the gateway connection
+// ends; tunnels don't survive a reconnect
+func (a *NodeAgent) closeTunnels() {
+	a.tunnels.Range(func(id, conn interface{}) bool {
+		conn.(net.Conn).Close()
+		a.untrackTunnel(id.(string))
+		return true
+	})
+}
+
+// relayTunnelJSON sends target data to a gateway that takes tunnel_data
+// messages. Target EOF goes back as FIN and the target stays open for the
+// gateway's data until its EOF.
+func (a *NodeAgent) relayTunnelJSON(tunnelID string, tcpConn net.Conn) {
+	buf := make([]byte, a.tunnelBufferSize())
+	for {
+		n, err := tcpConn.Read(buf)
+		if n > 0 {
+			a.caps.throttle(capDown, n)
+			a.sendTunnelData(map[string]interface{}{
+				"tunnel_id": tunnelID,
+				"data":      base64.StdEncoding.EncodeToString(buf[:n]),
+			})
+		}
+		if err == io.EOF {
+			a.sendTunnelData(map[string]interface{}{"tunnel_id": tunnelID, "fin": true})
+			return
+		}
+		if err != nil {
+			a.sendTunnelData(map[string]interface{}{"tunnel_id": tunnelID, "eof": true})
+			tcpConn.Close()
+			a.untrackTunnel(tunnelID)
+			return
+		}
+	}
+}
+
+func (a *NodeAgent) sendTunnelData(data map[string]interface{}) {
+	msg, _ := json.Marshal(map[string]interface{}{
+		"type": "tunnel_data",
+		"data": data,
+	})
+	a.safeWrite(websocket.TextMessage, msg)
+}
+
+// handleTunnelData applies a tunnel_data message: data for the target, FIN to
+// half-close it, EOF to close it
+func (a *NodeAgent) handleTunnelData(data interface{}) {
+	m, _ := data.(map[string]interface{})
+	tunnelID, _ := m["tunnel_id"].(string)
+	val, ok := a.tunnels.Load(tunnelID)
+	if !ok {
+		return
+	}
+	tcpConn := val.(net.Conn)
+
+	if eof, _ := m["eof"].(bool); eof {
+		tcpConn.Close()
+		a.untrackTunnel(tunnelID)
+		return
+	}
+	if fin, _ := m["fin"].(bool); fin {
+		if cw, ok := tcpConn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			tcpConn.Close()
+			a.untrackTunnel(tunnelID)
+		}
+		return
+	}
+
+	encoded, _ := m["data"].(string)
+	payload, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(payload) == 0 {
+		return
+	}
+	// Counted, not waited on: this is the WS read loop
+	a.caps.count(capUp, len(payload))
+	tcpConn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	tcpConn.Write(payload)
+}
+
 func (a *NodeAgent) handleBinaryTunnelData(raw []byte) {
+	if isMuxFrame(raw) {
+		a.handleMuxFrame(raw)
+		return
+	}
 	if len(raw) < 37 {
 		return
 	}
@@ -358,11 +675,13 @@ func (a *NodeAgent) handleBinaryTunnelData(raw []byte) {
 
 	if flags == 0x01 { // EOF
 		tcpConn.Close()
-		a.tunnels.Delete(tunnelID)
+		a.untrackTunnel(tunnelID)
 		return
 	}
 
 	if len(payload) > 0 {
+		// Counted, not waited on: this is the WS read loop
+		a.caps.count(capUp, len(payload))
 		tcpConn.SetWriteDeadline(time.Now().Add(30 * time.Second))
 		tcpConn.Write(payload)
 	}
@@ -370,7 +689,7 @@ func (a *NodeAgent) handleBinaryTunnelData(raw []byte) {
 
 // ─── IP Info ───────────────────────────────────────────────────────────────────
 
-func (a *NodeAgent) registerAndSendIPInfo() {
+func (a *NodeAgent) registerAndSendIPInfo(greeted <-chan struct{}) {
 	client := &http.Client{Timeout: 10 * time.Second}
 	resp, err := client.Get(ipInfoURL)
 	if err != nil {
@@ -400,7 +719,15 @@ func (a *NodeAgent) registerAndSendIPInfo() {
 	a.safeWrite(websocket.TextMessage, msg)
 	log.Printf("[NODE] IP: %s (%s, %s)", info.IP, info.Country, info.City)
 
+	select {
+	case <-greeted:
+	case <-time.After(greetingWait):
+	}
+
 	// Send register message (data wrapped for server parser)
+	availability := a.availabilityData()
+	a.lastAvailability.Store(availability["status"])
+	a.syncCredits(availability["status"].(string))
 	reg, _ := json.Marshal(map[string]interface{}{
 		"type": "register",
 		"data": map[string]interface{}{
@@ -415,6 +742,12 @@ func (a *NodeAgent) registerAndSendIPInfo() {
 			"connection_type": "wired",
 			"device_type":     "docker",
 			"sdk_version":     "2.0.0",
+			"tunnel_protocol": tunnelProtoMux,
+			"half_close":      true, // FIN in JSON tunnel_data, see handleTunnelData
+			"config_version":  a.configVersion.Load(),
+			"caps":            a.caps.report(int(a.openTunnels.Load()), a.tunnelLimit()),
+			"schedule":        a.schedule.describe(),
+			"availability":    availability,
 		},
 	})
 	a.safeWrite(websocket.TextMessage, reg)
@@ -433,6 +766,29 @@ func (a *NodeAgent) safeWrite(msgType int, data []byte) error {
 	return a.conn.WriteMessage(msgType, data)
 }
 
+// envOr reads a flag default from the environment
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt reads an integer flag default from the environment
+func envInt(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return n
+	}
+	return def
+}
+
+func envFloat(name string, def float64) float64 {
+	if f, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil {
+		return f
+	}
+	return def
+}
+
 func generateNodeID(token string) string {
 	// Deterministic node ID from token + hostname
 	hostname, _ := os.Hostname()
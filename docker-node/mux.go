@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ─── Mux Tunnel Frames (protocol v2) ───────────────────────────────────────────
+//
+// [1B version=0x02][1B type][1B flags][1B priority][4B stream_id BE][payload]
+//
+// Negotiated at registration. A tunnel_open carrying a stream_id uses these
+// frames; one without falls back to the legacy [36B id][1B flag] frame.
+// FIN is a half-close: it maps to TCP CloseWrite on the target, and target EOF
+// goes back as FIN. RST aborts both directions.
+
+const (
+	tunnelProtoLegacy = 1
+	tunnelProtoMux    = 2
+
+	muxFrameVersion = 0x02
+	muxHeaderSize   = 8
+
+	muxTypeData         = 0x00
+	muxTypeWindowUpdate = 0x01
+	muxTypeRST          = 0x02
+
+	muxFlagFIN = 0x01
+
+	muxDefaultWindow  = 256 * 1024
+	muxMaxDataPayload = 32 * 1024
+	muxWriteQueue     = 1024 // frames buffered per stream before the TCP writer
+)
+
+type muxFrame struct {
+	Type     byte
+	Flags    byte
+	Priority byte
+	StreamID uint32
+	Payload  []byte
+}
+
+func isMuxFrame(raw []byte) bool {
+	return len(raw) >= muxHeaderSize && raw[0] == muxFrameVersion
+}
+
+func encodeMuxFrame(f muxFrame) []byte {
+	frame := make([]byte, muxHeaderSize+len(f.Payload))
+	frame[0] = muxFrameVersion
+	frame[1] = f.Type
+	frame[2] = f.Flags
+	frame[3] = f.Priority
+	binary.BigEndian.PutUint32(frame[4:8], f.StreamID)
+	copy(frame[muxHeaderSize:], f.Payload)
+	return frame
+}
+
+func decodeMuxFrame(raw []byte) (muxFrame, error) {
+	if !isMuxFrame(raw) {
+		return muxFrame{}, fmt.Errorf("not a mux frame")
+	}
+	return muxFrame{
+		Type:     raw[1],
+		Flags:    raw[2],
+		Priority: raw[3],
+		StreamID: binary.BigEndian.Uint32(raw[4:8]),
+		Payload:  raw[muxHeaderSize:],
+	}, nil
+}
+
+// ─── Mux Stream ────────────────────────────────────────────────────────────────
+
+// muxStream is one multiplexed tunnel. Inbound data is queued and written to
+// the target by its own goroutine, so a slow target only stalls its own stream;
+// credit is returned to the gateway as the target actually accepts bytes.
+type muxStream struct {
+	agent    *NodeAgent
+	id       uint32
+	tunnelID string
+	priority uint8
+	window   int
+	conn     net.Conn
+	writeCh  chan []byte
+
+	mu          sync.Mutex
+	sendCredit  int
+	recvPending int
+	closed      bool
+	finSent     bool // target hit EOF, FIN sent to gateway
+	finRecv     bool // gateway FIN applied as TCP CloseWrite
+	creditCh    chan struct{}
+	closeCh     chan struct{}
+}
+
+func newMuxStream(a *NodeAgent, req TunnelOpen, conn net.Conn) *muxStream {
+	window := req.Window
+	if window <= 0 {
+		window = muxDefaultWindow
+	}
+	return &muxStream{
+		agent:      a,
+		id:         req.StreamID,
+		tunnelID:   req.TunnelID,
+		priority:   req.Priority,
+		window:     window,
+		conn:       conn,
+		writeCh:    make(chan []byte, muxWriteQueue),
+		sendCredit: window,
+		creditCh:   make(chan struct{}, 1),
+		closeCh:    make(chan struct{}),
+	}
+}
+
+// run pumps target → gateway within the granted credit and gateway → target via writeCh
+func (s *muxStream) run() {
+	go s.writeLoop()
+
+	buf := make([]byte, muxMaxDataPayload)
+	for {
+		granted, err := s.acquireCredit(len(buf))
+		if err != nil {
+			s.reset(err.Error())
+			return
+		}
+		n, err := s.conn.Read(buf[:granted])
+		if n > 0 {
+			s.agent.caps.throttle(capDown, n)
+			s.send(muxFrame{Type: muxTypeData, Priority: s.priority, StreamID: s.id, Payload: buf[:n]})
+		}
+		if n < granted {
+			s.refund(granted - n)
+		}
+		if err != nil {
+			if err != io.EOF {
+				s.reset(err.Error())
+				return
+			}
+			// Target finished sending — FIN the gateway but keep writing to the target
+			s.send(muxFrame{Type: muxTypeData, Flags: muxFlagFIN, Priority: s.priority, StreamID: s.id})
+			s.halfClosed(func() { s.finSent = true })
+			return
+		}
+	}
+}
+
+func (s *muxStream) writeLoop() {
+	for {
+		select {
+		case data := <-s.writeCh:
+			if data == nil {
+				// FIN from gateway, queued behind its data — half-close the target
+				if cw, ok := s.conn.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+				} else {
+					s.close()
+					return
+				}
+				s.halfClosed(func() { s.finRecv = true })
+				return
+			}
+			s.agent.caps.throttle(capUp, len(data))
+			s.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+			if _, err := s.conn.Write(data); err != nil {
+				s.reset(err.Error())
+				return
+			}
+			s.consumed(len(data))
+		case <-s.closeCh:
+			return
+		}
+	}
+}
+
+// deliver queues gateway data for the target without blocking the WS read loop
+func (s *muxStream) deliver(payload []byte) {
+	data := make([]byte, len(payload))
+	copy(data, payload)
+	select {
+	case s.writeCh <- data:
+	case <-s.closeCh:
+	default:
+		s.reset("window exceeded")
+	}
+}
+
+func (s *muxStream) acquireCredit(want int) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return 0, fmt.Errorf("stream closed")
+		}
+		if s.sendCredit > 0 {
+			n := want
+			if n > s.sendCredit {
+				n = s.sendCredit
+			}
+			s.sendCredit -= n
+			s.mu.Unlock()
+			return n, nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.creditCh:
+		case <-s.closeCh:
+			return 0, fmt.Errorf("stream closed")
+		case <-time.After(60 * time.Second):
+			return 0, fmt.Errorf("window stalled")
+		}
+	}
+}
+
+func (s *muxStream) addCredit(n int) {
+	s.mu.Lock()
+	s.sendCredit += n
+	s.mu.Unlock()
+	select {
+	case s.creditCh <- struct{}{}:
+	default:
+	}
+}
+
+// refund returns credit reserved for a read that came back short
+func (s *muxStream) refund(n int) {
+	s.mu.Lock()
+	s.sendCredit += n
+	s.mu.Unlock()
+}
+
+// consumed grants the gateway more credit once half the window has reached the target
+func (s *muxStream) consumed(n int) {
+	s.mu.Lock()
+	s.recvPending += n
+	grant := 0
+	if s.recvPending >= s.window/2 {
+		grant = s.recvPending
+		s.recvPending = 0
+	}
+	s.mu.Unlock()
+	if grant > 0 {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, uint32(grant))
+		s.send(muxFrame{Type: muxTypeWindowUpdate, StreamID: s.id, Payload: payload})
+	}
+}
+
+func (s *muxStream) send(f muxFrame) {
+	s.agent.safeWrite(websocket.BinaryMessage, encodeMuxFrame(f))
+}
+
+// halfClosed records one direction finishing and closes the stream once both have
+func (s *muxStream) halfClosed(mark func()) {
+	s.mu.Lock()
+	mark()
+	done := s.finSent && s.finRecv
+	s.mu.Unlock()
+	if done {
+		s.close()
+	}
+}
+
+// reset aborts the stream and tells the gateway why
+func (s *muxStream) reset(reason string) {
+	if s.close() {
+		s.send(muxFrame{Type: muxTypeRST, StreamID: s.id, Payload: []byte(reason)})
+	}
+}
+
+// close tears down local state; returns false if already closed
+func (s *muxStream) close() bool {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return false
+	}
+	s.closed = true
+	close(s.closeCh)
+	s.mu.Unlock()
+
+	s.conn.Close()
+	s.agent.streams.Delete(s.id)
+	s.agent.untrackTunnel(s.tunnelID)
+	return true
+}
+
+// ─── Mux Dispatch ──────────────────────────────────────────────────────────────
+
+func (a *NodeAgent) handleMuxFrame(raw []byte) {
+	frame, err := decodeMuxFrame(raw)
+	if err != nil {
+		return
+	}
+
+	if a.handleUDPFrame(frame) {
+		return
+	}
+	if frame.Type == muxTypeRST && a.cancelBind(frame.StreamID) {
+		return
+	}
+
+	val, ok := a.streams.Load(frame.StreamID)
+	if !ok {
+		// Unknown stream — only answer data so stray FIN/RST can't ping-pong
+		if frame.Type == muxTypeData && len(frame.Payload) > 0 {
+			a.safeWrite(websocket.BinaryMessage, encodeMuxFrame(muxFrame{
+				Type: muxTypeRST, StreamID: frame.StreamID, Payload: []byte("unknown stream"),
+			}))
+		}
+		return
+	}
+	s := val.(*muxStream)
+
+	switch frame.Type {
+	case muxTypeData:
+		if len(frame.Payload) > 0 {
+			s.deliver(frame.Payload)
+		}
+		if frame.Flags&muxFlagFIN != 0 {
+			select {
+			case s.writeCh <- nil:
+			default:
+				s.close()
+			}
+		}
+	case muxTypeWindowUpdate:
+		if len(frame.Payload) >= 4 {
+			s.addCredit(int(binary.BigEndian.Uint32(frame.Payload[:4])))
+		}
+	case muxTypeRST:
+		log.Printf("[NODE] Stream %d reset by gateway: %s", s.id, string(frame.Payload))
+		s.close()
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMuxFrameRoundTrip(t *testing.T) {
+	frames := []muxFrame{
+		{Type: muxTypeData, Priority: 3, StreamID: 1, Payload: []byte("hello")},
+		{Type: muxTypeData, Flags: muxFlagFIN, Priority: 7, StreamID: 0xdeadbeef},
+		{Type: muxTypeWindowUpdate, StreamID: 42, Payload: []byte{0, 4, 0, 0}},
+		{Type: muxTypeRST, StreamID: 1 << 31, Payload: []byte("window exceeded")},
+		{Type: muxTypeUDP, StreamID: 9, Payload: bytes.Repeat([]byte{0xff}, muxMaxDataPayload)},
+	}
+	for _, f := range frames {
+		raw := encodeMuxFrame(f)
+		if len(raw) != muxHeaderSize+len(f.Payload) {
+			t.Fatalf("stream %d: encoded %d bytes, want %d", f.StreamID, len(raw), muxHeaderSize+len(f.Payload))
+		}
+		if raw[0] != muxFrameVersion || raw[1] != f.Type || raw[2] != f.Flags || raw[3] != f.Priority {
+			t.Fatalf("stream %d: header % x", f.StreamID, raw[:4])
+		}
+		if id := binary.BigEndian.Uint32(raw[4:8]); id != f.StreamID {
+			t.Fatalf("stream id on the wire = %#x, want %#x (big-endian)", id, f.StreamID)
+		}
+		got, err := decodeMuxFrame(raw)
+		if err != nil {
+			t.Fatalf("stream %d: decode: %v", f.StreamID, err)
+		}
+		if got.Type != f.Type || got.Flags != f.Flags || got.Priority != f.Priority ||
+			got.StreamID != f.StreamID || !bytes.Equal(got.Payload, f.Payload) {
+			t.Fatalf("round trip = %+v, want %+v", got, f)
+		}
+	}
+}
+
+func TestMuxFrameRejectsLegacyAndShort(t *testing.T) {
+	legacy := append([]byte("6ba7b810-9dad-11d1-80b4-00c04fd430c8"), 0x00, 'x')
+	for _, raw := range [][]byte{nil, {muxFrameVersion}, {muxFrameVersion, 0, 0, 0, 0, 0, 0}, legacy} {
+		if isMuxFrame(raw) {
+			t.Fatalf("isMuxFrame(% x) = true", raw)
+		}
+		if _, err := decodeMuxFrame(raw); err == nil {
+			t.Fatalf("decodeMuxFrame(% x) succeeded", raw)
+		}
+	}
+}
+
+// ─── Stream harness ────────────────────────────────────────────────────────────
+
+// testGateway accepts the agent's WebSocket and hands every mux frame it sends to frames
+type testGateway struct {
+	frames chan muxFrame
+}
+
+func newTestAgent(t *testing.T) (*NodeAgent, *testGateway) {
+	t.Helper()
+	gw := &testGateway{frames: make(chan muxFrame, 64)}
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, raw, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if f, err := decodeMuxFrame(raw); err == nil {
+				gw.frames <- f
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial gateway: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	a := &NodeAgent{conn: conn, caps: newResourceCaps(capsConfig{}), done: make(chan struct{})}
+	return a, gw
+}
+
+// next waits for the next frame the agent sends
+func (gw *testGateway) next(t *testing.T) muxFrame {
+	t.Helper()
+	select {
+	case f := <-gw.frames:
+		return f
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame from agent")
+		return muxFrame{}
+	}
+}
+
+// quiet fails if the agent sends anything within d
+func (gw *testGateway) quiet(t *testing.T, d time.Duration) {
+	t.Helper()
+	select {
+	case f := <-gw.frames:
+		t.Fatalf("unexpected frame %+v", f)
+	case <-time.After(d):
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection, so CloseWrite works
+func tcpPair(t *testing.T) (local, remote *net.TCPConn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	t.Cleanup(func() { dialed.Close(); accepted.Close() })
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+func startStream(a *NodeAgent, id uint32, window int, conn net.Conn) *muxStream {
+	s := newMuxStream(a, TunnelOpen{TunnelID: "t1", StreamID: id, Window: window}, conn)
+	a.streams.Store(id, s)
+	a.trackTunnel(s.tunnelID, conn)
+	go s.run()
+	return s
+}
+
+func windowUpdate(id uint32, n int) []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(n))
+	return encodeMuxFrame(muxFrame{Type: muxTypeWindowUpdate, StreamID: id, Payload: payload})
+}
+
+// readData collects DATA payloads until n bytes have arrived
+func (gw *testGateway) readData(t *testing.T, n int) []byte {
+	t.Helper()
+	var got []byte
+	for len(got) < n {
+		f := gw.next(t)
+		if f.Type != muxTypeData || f.Flags&muxFlagFIN != 0 {
+			t.Fatalf("got %+v while waiting for data", f)
+		}
+		got = append(got, f.Payload...)
+	}
+	if len(got) != n {
+		t.Fatalf("received %d bytes, want %d", len(got), n)
+	}
+	return got
+}
+
+func TestMuxStreamStopsAtCreditExhaustion(t *testing.T) {
+	a, gw := newTestAgent(t)
+	local, remote := tcpPair(t)
+	startStream(a, 5, 4, local)
+
+	if _, err := remote.Write([]byte("0123456789")); err != nil {
+		t.Fatalf("target write: %v", err)
+	}
+	if got := gw.readData(t, 4); string(got) != "0123" {
+		t.Fatalf("first window = %q", got)
+	}
+	gw.quiet(t, 200*time.Millisecond)
+
+	a.handleMuxFrame(windowUpdate(5, 6))
+	if got := gw.readData(t, 6); string(got) != "456789" {
+		t.Fatalf("after window update = %q", got)
+	}
+
+	// Target EOF only turns into FIN once there is credit to read it
+	remote.CloseWrite()
+	gw.quiet(t, 200*time.Millisecond)
+	a.handleMuxFrame(windowUpdate(5, 1))
+	if f := gw.next(t); f.Type != muxTypeData || f.Flags&muxFlagFIN == 0 || len(f.Payload) != 0 {
+		t.Fatalf("got %+v, want FIN", f)
+	}
+}
+
+func TestMuxStreamGrantsCreditAsTargetConsumes(t *testing.T) {
+	a, gw := newTestAgent(t)
+	local, remote := tcpPair(t)
+	startStream(a, 6, 8, local)
+
+	a.handleMuxFrame(encodeMuxFrame(muxFrame{Type: muxTypeData, StreamID: 6, Payload: []byte("abc")}))
+	gw.quiet(t, 200*time.Millisecond)
+	a.handleMuxFrame(encodeMuxFrame(muxFrame{Type: muxTypeData, StreamID: 6, Payload: []byte("d")}))
+
+	f := gw.next(t)
+	if f.Type != muxTypeWindowUpdate || len(f.Payload) != 4 {
+		t.Fatalf("got %+v, want WINDOW_UPDATE", f)
+	}
+	if n := binary.BigEndian.Uint32(f.Payload); n != 4 {
+		t.Fatalf("granted %d, want 4 (half the window)", n)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != "abcd" {
+		t.Fatalf("target read %q, %v", buf, err)
+	}
+}
+
+func TestMuxStreamGatewayFINClosesOnlyTargetWrite(t *testing.T) {
+	a, gw := newTestAgent(t)
+	local, remote := tcpPair(t)
+	startStream(a, 7, 0, local)
+
+	a.handleMuxFrame(encodeMuxFrame(muxFrame{
+		Type: muxTypeData, Flags: muxFlagFIN, StreamID: 7, Payload: []byte("request"),
+	}))
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(remote)
+	if err != nil || string(got) != "request" {
+		t.Fatalf("target read %q, %v; want request then EOF", got, err)
+	}
+
+	// The target can still answer after the gateway's FIN
+	if _, err := remote.Write([]byte("response")); err != nil {
+		t.Fatalf("target write after FIN: %v", err)
+	}
+	if got := gw.readData(t, len("response")); string(got) != "response" {
+		t.Fatalf("gateway got %q", got)
+	}
+	if _, ok := a.streams.Load(uint32(7)); !ok {
+		t.Fatal("stream closed after one direction finished")
+	}
+
+	remote.CloseWrite()
+	if f := gw.next(t); f.Type != muxTypeData || f.Flags&muxFlagFIN == 0 {
+		t.Fatalf("got %+v, want FIN", f)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := a.streams.Load(uint32(7)); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream still open after both directions finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := a.openTunnels.Load(); n != 0 {
+		t.Fatalf("openTunnels = %d after close", n)
+	}
+}
+
+func TestMuxUnknownStreamDataGetsRST(t *testing.T) {
+	a, gw := newTestAgent(t)
+
+	a.handleMuxFrame(encodeMuxFrame(muxFrame{Type: muxTypeData, Flags: muxFlagFIN, StreamID: 99}))
+	a.handleMuxFrame(encodeMuxFrame(muxFrame{Type: muxTypeRST, StreamID: 99}))
+	gw.quiet(t, 100*time.Millisecond)
+
+	a.handleMuxFrame(encodeMuxFrame(muxFrame{Type: muxTypeData, StreamID: 99, Payload: []byte("x")}))
+	if f := gw.next(t); f.Type != muxTypeRST || f.StreamID != 99 {
+		t.Fatalf("got %+v, want RST for stream 99", f)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ─── Egress Policy ─────────────────────────────────────────────────────────────
+//
+// Every connection the gateway asks the node to make is checked here first, so
+// the operator's IP can't be used against their own network or for abuse:
+//
+//   - loopback, private, CGNAT, link-local and reserved ranges are blocked by
+//     default; --allow-cidrs lifts that for ranges the operator chooses
+//   - cloud metadata endpoints and SMTP (port 25) are always blocked
+//   - --deny-ports, --deny-domains and --deny-cidrs add operator rules, as does
+//     the gateway's destination policy file given with --policy ({"global":
+//     {"deny_domains": [...], "deny_cidrs": [...], "deny_ports": [...]}});
+//     categories and per-customer rules stay with the gateway
+//   - --target-rate caps new connections per minute to any one host
+//
+// Names are checked as requested, and every address the dialer actually
+// connects to is checked again, so a name resolving to a blocked address is
+// caught too. Denials go back in tunnel_response as error_code (egress_denied
+// or rate_limited), rule, match and, when rate limited, retry_after seconds.
+
+const (
+	egressDenied      = "egress_denied"
+	egressRateLimited = "rate_limited"
+
+	// defaultTargetRate is the default --target-rate, connections per minute
+	defaultTargetRate = 120
+	// targetLimiterSweep is how often idle per-target buckets are dropped
+	targetLimiterSweep = time.Minute
+)
+
+// builtinRanges are blocked unless an --allow-cidrs range covers the address.
+// Metadata ranges come first and can't be allowed.
+var builtinRanges = []struct {
+	cidr string
+	rule string
+}{
+	{"169.254.169.254/32", "metadata"}, // AWS, GCP, Azure, OpenStack, DigitalOcean
+	{"169.254.170.2/32", "metadata"},   // ECS task metadata
+	{"100.100.100.200/32", "metadata"}, // Alibaba Cloud
+	{"168.63.129.16/32", "metadata"},   // Azure WireServer
+	{"fd00:ec2::254/128", "metadata"},  // AWS IPv6
+
+	{"127.0.0.0/8", "loopback"},
+	{"::1/128", "loopback"},
+	{"10.0.0.0/8", "private"},
+	{"172.16.0.0/12", "private"},
+	{"192.168.0.0/16", "private"},
+	{"100.64.0.0/10", "private"}, // CGNAT
+	{"fc00::/7", "private"},
+	{"169.254.0.0/16", "link_local"},
+	{"fe80::/10", "link_local"},
+	{"0.0.0.0/8", "reserved"},
+	{"::/128", "reserved"},
+	{"224.0.0.0/4", "reserved"}, // multicast
+	{"240.0.0.0/4", "reserved"}, // incl. broadcast
+	{"ff00::/8", "reserved"},
+}
+
+// builtinDenyPorts are always blocked: SMTP is the classic spam relay
+var builtinDenyPorts = []string{"25"}
+
+type policyRules struct {
+	DenyDomains []string `json:"deny_domains"`
+	DenyCIDRs   []string `json:"deny_cidrs"`
+	DenyPorts   []string `json:"deny_ports"`
+}
+
+// egressConfig is the operator's egress settings, from flags or environment
+type egressConfig struct {
+	PolicyFile  string
+	DenyPorts   string // comma-separated, ports or ranges
+	DenyDomains string
+	DenyCIDRs   string
+	AllowCIDRs  string
+	TargetRate  int // connections per minute per host, 0 = unlimited
+}
+
+type blockedRange struct {
+	net  *net.IPNet
+	rule string
+}
+
+type egressPolicy struct {
+	builtin []blockedRange
+	allow   []*net.IPNet
+	domains map[string]bool
+	nets    []*net.IPNet
+	ports   [][2]int
+	limiter *targetLimiter // nil = unlimited
+}
+
+// egressError is a denial reported back to the gateway
+type egressError struct {
+	Code       string
+	Rule       string
+	Match      string
+	RetryAfter time.Duration
+}
+
+func (e *egressError) Error() string {
+	if e.Code == egressRateLimited {
+		return fmt.Sprintf("rate limited: too many connections to %s, retry after %ds", e.Match, e.retryAfterSeconds())
+	}
+	return fmt.Sprintf("blocked by egress policy: %s %s", e.Rule, e.Match)
+}
+
+func (e *egressError) retryAfterSeconds() int {
+	return int(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+// addTo puts the denial's fields into a tunnel_response
+func (e *egressError) addTo(data map[string]interface{}) {
+	data["error_code"] = e.Code
+	data["rule"] = e.Rule
+	data["match"] = e.Match
+	if e.RetryAfter > 0 {
+		data["retry_after"] = e.retryAfterSeconds()
+	}
+}
+
+func newEgressPolicy(cfg egressConfig) (*egressPolicy, error) {
+	p := &egressPolicy{domains: make(map[string]bool)}
+	for _, r := range builtinRanges {
+		_, ipnet, _ := net.ParseCIDR(r.cidr)
+		p.builtin = append(p.builtin, blockedRange{net: ipnet, rule: r.rule})
+	}
+
+	rules := policyRules{
+		DenyDomains: splitList(cfg.DenyDomains),
+		DenyCIDRs:   splitList(cfg.DenyCIDRs),
+		DenyPorts:   append(splitList(cfg.DenyPorts), builtinDenyPorts...),
+	}
+	if cfg.PolicyFile != "" {
+		file, err := loadDestinationPolicy(cfg.PolicyFile)
+		if err != nil {
+			return nil, err
+		}
+		rules.DenyDomains = append(rules.DenyDomains, file.DenyDomains...)
+		rules.DenyCIDRs = append(rules.DenyCIDRs, file.DenyCIDRs...)
+		rules.DenyPorts = append(rules.DenyPorts, file.DenyPorts...)
+	}
+
+	for _, d := range rules.DenyDomains {
+		if d = normalizeDomain(d); d != "" {
+			p.domains[d] = true
+		}
+	}
+	var err error
+	if p.nets, err = parseCIDRs(rules.DenyCIDRs); err != nil {
+		return nil, err
+	}
+	if p.allow, err = parseCIDRs(splitList(cfg.AllowCIDRs)); err != nil {
+		return nil, err
+	}
+	for _, s := range rules.DenyPorts {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(s), "-")
+		from, err := strconv.Atoi(lo)
+		to := from
+		if err == nil && isRange {
+			to, err = strconv.Atoi(hi)
+		}
+		if err != nil || from < 1 || to > 65535 || from > to {
+			return nil, fmt.Errorf("bad port %q", s)
+		}
+		p.ports = append(p.ports, [2]int{from, to})
+	}
+	if cfg.TargetRate > 0 {
+		p.limiter = newTargetLimiter(cfg.TargetRate)
+	}
+	return p, nil
+}
+
+// loadDestinationPolicy reads the global rules of a gateway policy file
+func loadDestinationPolicy(path string) (policyRules, error) {
+	var file struct {
+		Global policyRules `json:"global"`
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return file.Global, err
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return file.Global, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return file.Global, nil
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad CIDR %q", s)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// normalizeDomain lowercases a domain and drops wildcard and edge dots
+func normalizeDomain(d string) string {
+	d = strings.ToLower(strings.TrimSpace(d))
+	return strings.Trim(strings.TrimPrefix(d, "*"), ".")
+}
+
+// checkTarget vets the requested host and port before resolving
+func (p *egressPolicy) checkTarget(host, port string) error {
+	if n, err := strconv.Atoi(port); err == nil {
+		for _, r := range p.ports {
+			if n >= r[0] && n <= r[1] {
+				return &egressError{Code: egressDenied, Rule: "port", Match: port}
+			}
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.checkIP(ip)
+	}
+	for d := normalizeDomain(host); d != ""; {
+		if p.domains[d] {
+			return &egressError{Code: egressDenied, Rule: "domain", Match: d}
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	return nil
+}
+
+// checkIP vets an address about to be connected to
+func (p *egressPolicy) checkIP(ip net.IP) error {
+	if ip == nil {
+		return &egressError{Code: egressDenied, Rule: "address", Match: "invalid"}
+	}
+	for _, r := range p.builtin {
+		if r.net.Contains(ip) && (r.rule == "metadata" || !p.allowed(ip)) {
+			return &egressError{Code: egressDenied, Rule: r.rule, Match: ip.String()}
+		}
+	}
+	for _, ipnet := range p.nets {
+		if ipnet.Contains(ip) {
+			return &egressError{Code: egressDenied, Rule: "address", Match: ipnet.String()}
+		}
+	}
+	return nil
+}
+
+func (p *egressPolicy) allowed(ip net.IP) bool {
+	for _, ipnet := range p.allow {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRate takes one connection from the host's budget
+func (p *egressPolicy) checkRate(host string) error {
+	if p.limiter == nil {
+		return nil
+	}
+	target := normalizeDomain(host)
+	if ok, wait := p.limiter.take(target, time.Now()); !ok {
+		return &egressError{Code: egressRateLimited, Rule: "target_rate", Match: target, RetryAfter: wait}
+	}
+	return nil
+}
+
+// dialTarget connects to a tunnel target, applying the egress policy to the
+// name and to each address the dialer tries
+func (a *NodeAgent) dialTarget(host, port string) (net.Conn, error) {
+	if err := a.egress.checkTarget(host, port); err != nil {
+		return nil, err
+	}
+	if err := a.egress.checkRate(host); err != nil {
+		return nil, err
+	}
+	dialer := net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			ipStr, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return a.egress.checkIP(net.ParseIP(ipStr))
+		},
+	}
+	return dialer.Dial("tcp", net.JoinHostPort(host, port))
+}
+
+// ─── Per-Target Rate Limit ─────────────────────────────────────────────────────
+
+// targetLimiter is a token bucket per host: a full minute's allowance up
+// front, refilled continuously
+type targetLimiter struct {
+	perMinute float64
+
+	mu        sync.Mutex
+	buckets   map[string]*targetBucket
+	lastSweep time.Time
+}
+
+type targetBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTargetLimiter(perMinute int) *targetLimiter {
+	return &targetLimiter{
+		perMinute: float64(perMinute),
+		buckets:   make(map[string]*targetBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// take spends a token for target, or returns how long until one is available
+func (l *targetLimiter) take(target string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= targetLimiterSweep {
+		// A bucket left alone for a minute is full again
+		for key, b := range l.buckets {
+			if now.Sub(b.last) >= time.Minute {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b := l.buckets[target]
+	if b == nil {
+		b = &targetBucket{tokens: l.perMinute, last: now}
+		l.buckets[target] = b
+	}
+	b.tokens = math.Min(l.perMinute, b.tokens+now.Sub(b.last).Minutes()*l.perMinute)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.perMinute * float64(time.Minute))
+	}
+	b.tokens--
+	return true, 0
+}
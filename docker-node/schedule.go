@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // --timezone works in images without zoneinfo
+
+	"github.com/gorilla/websocket"
+)
+
+// ─── Availability Schedule ─────────────────────────────────────────────────────
+//
+// Operators choose when the node shares bandwidth with --schedule, a weekly
+// calendar in --timezone (IANA name, default the container's local zone):
+//
+//	--schedule "mon-fri 18:00-08:00; sat,sun 00:00-24:00"
+//
+// Windows ending at or before their start run past midnight. Outside them,
+// or while the gateway has paused the node (pause {until} / resume), the node
+// stays connected but refuses new relays and reports availability
+// scheduled_off or paused, so the gateway stops selecting it without
+// counting a disconnect.
+
+const (
+	availabilityOn           = "available"
+	availabilityScheduledOff = "scheduled_off"
+	availabilityPaused       = "paused"
+
+	minutesPerWeek            = 7 * 24 * 60
+	availabilityCheckInterval = 30 * time.Second
+)
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+type scheduleWindow struct {
+	Days  []string `json:"days"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+}
+
+// weeklySchedule is the operator's calendar; nil means always on
+type weeklySchedule struct {
+	loc     *time.Location
+	windows []scheduleWindow
+	on      [minutesPerWeek]bool // minute of week (from Sunday 00:00) → sharing
+}
+
+// parseSchedule reads --schedule and --timezone; an empty spec is nil
+func parseSchedule(spec, tz string) (*weeklySchedule, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	loc := time.Local
+	if tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("timezone %q: %v", tz, err)
+		}
+	}
+	s := &weeklySchedule{loc: loc}
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("schedule %q: want \"<days> <HH:MM>-<HH:MM>\"", entry)
+		}
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		span := strings.SplitN(fields[1], "-", 2)
+		if len(span) != 2 {
+			return nil, fmt.Errorf("schedule %q: want a <HH:MM>-<HH:MM> range", entry)
+		}
+		start, err := parseClock(span[0])
+		if err != nil {
+			return nil, err
+		}
+		if start == 24*60 {
+			return nil, fmt.Errorf("schedule %q: a window can't start at 24:00", entry)
+		}
+		end, err := parseClock(span[1])
+		if err != nil {
+			return nil, err
+		}
+		if end <= start {
+			end += 24 * 60 // runs past midnight
+		}
+
+		names := make([]string, 0, len(days))
+		for _, day := range days {
+			names = append(names, weekdayNames[day])
+			for m := start; m < end; m++ {
+				s.on[(day*24*60+m)%minutesPerWeek] = true
+			}
+		}
+		s.windows = append(s.windows, scheduleWindow{Days: names, Start: span[0], End: span[1]})
+	}
+	if len(s.windows) == 0 {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// parseDays reads "mon-fri", "sat,sun", "daily" or "*" as weekday numbers
+func parseDays(s string) ([]int, error) {
+	s = strings.ToLower(s)
+	if s == "daily" || s == "*" {
+		return []int{0, 1, 2, 3, 4, 5, 6}, nil
+	}
+	day := func(name string) (int, error) {
+		for i, n := range weekdayNames {
+			if strings.HasPrefix(name, n) {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("unknown weekday %q", name)
+	}
+	var days []int
+	for _, part := range strings.Split(s, ",") {
+		if from, to, ok := strings.Cut(part, "-"); ok {
+			a, err := day(from)
+			if err != nil {
+				return nil, err
+			}
+			b, err := day(to)
+			if err != nil {
+				return nil, err
+			}
+			for d := a; ; d = (d + 1) % 7 {
+				days = append(days, d)
+				if d == b {
+					break
+				}
+			}
+			continue
+		}
+		d, err := day(part)
+		if err != nil {
+			return nil, err
+		}
+		days = append(days, d)
+	}
+	return days, nil
+}
+
+// parseClock reads HH:MM (24:00 allowed) as minutes after midnight
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hour, err1 := strconv.Atoi(h)
+	minute, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return hour*60 + minute, nil
+}
+
+func (s *weeklySchedule) minuteOfWeek(t time.Time) int {
+	t = t.In(s.loc)
+	return int(t.Weekday())*24*60 + t.Hour()*60 + t.Minute()
+}
+
+// activeAt reports whether the node shares bandwidth at t
+func (s *weeklySchedule) activeAt(t time.Time) bool {
+	return s == nil || s.on[s.minuteOfWeek(t)]
+}
+
+// nextChange returns when the schedule next switches on or off, zero if
+// it never does. It steps through elapsed minutes, not calendar ones, so it
+// stays right across daylight saving changes.
+func (s *weeklySchedule) nextChange(t time.Time) time.Time {
+	if s == nil {
+		return time.Time{}
+	}
+	active := s.activeAt(t)
+	start := t.Truncate(time.Minute)
+	for i := 1; i <= minutesPerWeek+60; i++ {
+		next := start.Add(time.Duration(i) * time.Minute)
+		if s.activeAt(next) != active {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// describe is the schedule as advertised in registration
+func (s *weeklySchedule) describe() map[string]interface{} {
+	if s == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"timezone": s.loc.String(),
+		"windows":  s.windows,
+	}
+}
+
+// availability returns whether the node takes relays now and, when it
+// doesn't, until when (zero if unknown)
+func (a *NodeAgent) availability() (string, time.Time) {
+	now := time.Now()
+	if until := a.pausedUntil.Load(); until != 0 {
+		if until < 0 {
+			return availabilityPaused, time.Time{}
+		}
+		if now.UnixNano() < until {
+			return availabilityPaused, time.Unix(0, until)
+		}
+		a.pausedUntil.CompareAndSwap(until, 0)
+	}
+	if !a.schedule.activeAt(now) {
+		return availabilityScheduledOff, a.schedule.nextChange(now)
+	}
+	return availabilityOn, time.Time{}
+}
+
+// availabilityData is the body of availability messages and registration
+func (a *NodeAgent) availabilityData() map[string]interface{} {
+	status, until := a.availability()
+	data := map[string]interface{}{"status": status}
+	if !until.IsZero() {
+		data["until"] = until.UTC()
+	}
+	return data
+}
+
+// sendAvailability tells the gateway the node's availability if it changed
+// since it was last sent, or always with force
+func (a *NodeAgent) sendAvailability(force bool) {
+	data := a.availabilityData()
+	status := data["status"].(string)
+	a.syncCredits(status)
+	if !force && a.lastAvailability.Load() == status {
+		return
+	}
+	a.lastAvailability.Store(status)
+	log.Printf("[NODE] Availability: %s", status)
+	msg, _ := json.Marshal(map[string]interface{}{
+		"type": "availability",
+		"data": data,
+	})
+	a.safeWrite(websocket.TextMessage, msg)
+}
+
+// watchAvailability reports schedule changes and expired pauses while
+// connected
+func (a *NodeAgent) watchAvailability(stop <-chan struct{}) {
+	ticker := time.NewTicker(availabilityCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.sendAvailability(false)
+		case <-stop:
+			return
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// unavailable returns why relays are refused outside the schedule or while
+// paused, or nil
+func (a *NodeAgent) unavailable() error {
+	switch status, _ := a.availability(); status {
+	case availabilityPaused:
+		return fmt.Errorf("node paused")
+	case availabilityScheduledOff:
+		return fmt.Errorf("node outside its scheduled hours")
+	}
+	return nil
+}
+
+// handlePause pauses relaying until data.until (RFC 3339), for
+// data.minutes, or until resumed
+func (a *NodeAgent) handlePause(data interface{}) {
+	m, _ := data.(map[string]interface{})
+	until := int64(-1)
+	if s, ok := m["until"].(string); ok {
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			until = t.UnixNano()
+		}
+	} else if minutes, ok := m["minutes"].(float64); ok && minutes > 0 {
+		until = time.Now().Add(time.Duration(minutes * float64(time.Minute))).UnixNano()
+	}
+	a.pausedUntil.Store(until)
+	a.sendAvailability(true)
+}
+
+func (a *NodeAgent) handleResume() {
+	a.pausedUntil.Store(0)
+	a.sendAvailability(true)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// at parses an RFC 3339 time, failing the test on error
+func at(t *testing.T, s string) time.Time {
+	t.Helper()
+	tm, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatalf("parse %s: %v", s, err)
+	}
+	return tm
+}
+
+func mustSchedule(t *testing.T, spec, tz string) *weeklySchedule {
+	t.Helper()
+	s, err := parseSchedule(spec, tz)
+	if err != nil {
+		t.Fatalf("parseSchedule(%q, %q): %v", spec, tz, err)
+	}
+	if s == nil {
+		t.Fatalf("parseSchedule(%q, %q) = nil", spec, tz)
+	}
+	return s
+}
+
+func TestParseDays(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []int
+	}{
+		{"daily", []int{0, 1, 2, 3, 4, 5, 6}},
+		{"*", []int{0, 1, 2, 3, 4, 5, 6}},
+		{"mon", []int{1}},
+		{"Mon,WED", []int{1, 3}},
+		{"mon-fri", []int{1, 2, 3, 4, 5}},
+		{"sat,sun", []int{6, 0}},
+		{"fri-mon", []int{5, 6, 0, 1}}, // wraps past the end of the week
+		{"tuesday-thursday", []int{2, 3, 4}},
+		{"sun-sun", []int{0}},
+	}
+	for _, tt := range tests {
+		got, err := parseDays(tt.in)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseDays(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "funday", "mon-xyz", "mon,,tue", "m"} {
+		if days, err := parseDays(bad); err == nil {
+			t.Errorf("parseDays(%q) = %v, want error", bad, days)
+		}
+	}
+}
+
+func TestParseClock(t *testing.T) {
+	tests := map[string]int{"00:00": 0, "08:05": 485, "8:05": 485, "23:59": 1439, "24:00": 1440}
+	for in, want := range tests {
+		if got, err := parseClock(in); err != nil || got != want {
+			t.Errorf("parseClock(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, bad := range []string{"", "1200", "24:01", "12:60", "-1:00", "ab:cd", "12:"} {
+		if got, err := parseClock(bad); err == nil {
+			t.Errorf("parseClock(%q) = %d, want error", bad, got)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	tests := []struct{ spec, tz string }{
+		{"mon", ""},
+		{"mon 08:00", ""},
+		{"mon 08:00-", ""},
+		{"mon 08:00-09:00 extra", ""},
+		{"xyz 08:00-09:00", ""},
+		{"mon 25:00-09:00", ""},
+		{"mon 24:00-08:00", ""},
+		{"mon 08:00-09:00", "Mars/Olympus_Mons"},
+	}
+	for _, tt := range tests {
+		if s, err := parseSchedule(tt.spec, tt.tz); err == nil {
+			t.Errorf("parseSchedule(%q, %q) = %+v, want error", tt.spec, tt.tz, s)
+		}
+	}
+	for _, empty := range []string{"", "  ", ";", " ; ; "} {
+		if s, err := parseSchedule(empty, "UTC"); s != nil || err != nil {
+			t.Errorf("parseSchedule(%q) = %v, %v; want nil (always on)", empty, s, err)
+		}
+	}
+}
+
+func TestScheduleOvernight(t *testing.T) {
+	// 2026-10-12 is a Monday
+	s := mustSchedule(t, "mon-fri 18:00-08:00; sat,sun 00:00-24:00", "UTC")
+	tests := []struct {
+		at   string
+		want bool
+	}{
+		{"2026-10-12T07:00:00Z", false}, // Monday morning: Sunday's window ended at midnight
+		{"2026-10-12T17:59:59Z", false},
+		{"2026-10-12T18:00:00Z", true},
+		{"2026-10-13T03:00:00Z", true}, // Monday's window running into Tuesday
+		{"2026-10-13T07:59:00Z", true},
+		{"2026-10-13T08:00:00Z", false},
+		{"2026-10-17T07:59:00Z", true}, // Friday night into Saturday
+		{"2026-10-17T12:00:00Z", true},
+		{"2026-10-18T23:59:00Z", true},
+		{"2026-10-19T00:00:00Z", false},
+	}
+	for _, tt := range tests {
+		if got := s.activeAt(at(t, tt.at)); got != tt.want {
+			t.Errorf("activeAt(%s) = %v, want %v", tt.at, got, tt.want)
+		}
+	}
+
+	// Saturday night wraps into Sunday at the start of the week
+	s = mustSchedule(t, "sat 22:00-02:00", "UTC")
+	for at_, want := range map[string]bool{
+		"2026-10-17T21:59:00Z": false,
+		"2026-10-17T22:00:00Z": true,
+		"2026-10-18T01:59:00Z": true,
+		"2026-10-18T02:00:00Z": false,
+		"2026-10-11T01:00:00Z": true, // the Sunday before, from the previous Saturday
+	} {
+		if got := s.activeAt(at(t, at_)); got != want {
+			t.Errorf("sat 22:00-02:00: activeAt(%s) = %v, want %v", at_, got, want)
+		}
+	}
+
+	// Equal start and end is a full day from the start
+	s = mustSchedule(t, "wed 09:00-09:00", "UTC")
+	if !s.activeAt(at(t, "2026-10-15T08:59:00Z")) || s.activeAt(at(t, "2026-10-15T09:00:00Z")) ||
+		s.activeAt(at(t, "2026-10-14T08:59:00Z")) {
+		t.Error("wed 09:00-09:00 is not Wednesday 09:00 to Thursday 09:00")
+	}
+}
+
+func TestScheduleTimezone(t *testing.T) {
+	tests := []struct {
+		tz      string
+		on, off []string
+	}{
+		// EDT is UTC-4 in October
+		{"America/New_York", []string{"2026-10-12T13:00:00Z", "2026-10-12T20:59:00Z"},
+			[]string{"2026-10-12T12:59:00Z", "2026-10-12T21:00:00Z"}},
+		// IST is UTC+5:30
+		{"Asia/Kolkata", []string{"2026-10-12T03:30:00Z", "2026-10-12T11:29:00Z"},
+			[]string{"2026-10-12T03:29:00Z", "2026-10-12T11:30:00Z"}},
+		// Across the date line Monday 09:00 is still Sunday in UTC
+		{"Pacific/Auckland", []string{"2026-10-11T20:00:00Z"}, []string{"2026-10-12T20:00:00Z"}},
+	}
+	for _, tt := range tests {
+		spec := "daily 09:00-17:00"
+		if tt.tz == "Pacific/Auckland" {
+			spec = "mon 09:00-17:00"
+		}
+		s := mustSchedule(t, spec, tt.tz)
+		for _, on := range tt.on {
+			if !s.activeAt(at(t, on)) {
+				t.Errorf("%s: off at %s, want on", tt.tz, on)
+			}
+		}
+		for _, off := range tt.off {
+			if s.activeAt(at(t, off)) {
+				t.Errorf("%s: on at %s, want off", tt.tz, off)
+			}
+		}
+		if got := s.describe()["timezone"]; got != tt.tz {
+			t.Errorf("describe timezone = %v, want %s", got, tt.tz)
+		}
+	}
+}
+
+func TestScheduleNextChange(t *testing.T) {
+	var always *weeklySchedule
+	if !always.activeAt(time.Now()) || !always.nextChange(time.Now()).IsZero() {
+		t.Error("nil schedule is not always on")
+	}
+	if next := mustSchedule(t, "daily 00:00-24:00", "UTC").nextChange(time.Now()); !next.IsZero() {
+		t.Errorf("schedule that never changes: nextChange = %v, want zero", next)
+	}
+
+	s := mustSchedule(t, "mon-fri 09:00-17:00", "UTC")
+	tests := map[string]string{
+		"2026-10-12T12:34:56Z": "2026-10-12T17:00:00Z",
+		"2026-10-12T08:59:59Z": "2026-10-12T09:00:00Z",
+		"2026-10-16T17:00:00Z": "2026-10-19T09:00:00Z", // over the weekend
+	}
+	for from, want := range tests {
+		if got := s.nextChange(at(t, from)); !got.Equal(at(t, want)) {
+			t.Errorf("nextChange(%s) = %v, want %s", from, got.UTC(), want)
+		}
+	}
+}
+
+func TestScheduleDST(t *testing.T) {
+	// Europe/Berlin: clocks go 02:00 CET → 03:00 CEST on 2026-03-29 and
+	// 03:00 CEST → 02:00 CET on 2026-10-25
+	s := mustSchedule(t, "daily 08:00-20:00", "Europe/Berlin")
+	tests := []struct{ from, want string }{
+		// Saturday 21:00 CET to Sunday 08:00 CEST is 10 hours, not 11
+		{"2026-03-28T20:00:00Z", "2026-03-29T06:00:00Z"},
+		// Saturday 21:00 CEST to Sunday 08:00 CET is 12 hours, not 11
+		{"2026-10-24T19:00:00Z", "2026-10-25T07:00:00Z"},
+	}
+	for _, tt := range tests {
+		if got := s.nextChange(at(t, tt.from)); !got.Equal(at(t, tt.want)) {
+			t.Errorf("nextChange(%s) = %v, want %s", tt.from, got.UTC(), tt.want)
+		}
+	}
+	if !s.activeAt(at(t, "2026-03-29T06:30:00Z")) { // 08:30 CEST
+		t.Error("off at 08:30 CEST on the day clocks go forward")
+	}
+	if s.activeAt(at(t, "2026-10-25T06:30:00Z")) { // 07:30 CET
+		t.Error("on at 07:30 CET on the day clocks go back")
+	}
+
+	// A window starting in the skipped hour begins when the clocks jump
+	s = mustSchedule(t, "sun 02:30-04:00", "Europe/Berlin")
+	if got, want := s.nextChange(at(t, "2026-03-29T00:00:00Z")), at(t, "2026-03-29T01:00:00Z"); !got.Equal(want) {
+		t.Errorf("window in the skipped hour starts at %v, want %v", got.UTC(), want.UTC())
+	}
+	if got, want := s.nextChange(at(t, "2026-03-29T01:00:00Z")), at(t, "2026-03-29T02:00:00Z"); !got.Equal(want) {
+		t.Errorf("window in the skipped hour ends at %v, want %v", got.UTC(), want.UTC())
+	}
+
+	// Schedules follow the wall clock: when it goes back from 03:00 to 02:00
+	// the window is off again until the second 02:30
+	s = mustSchedule(t, "sun 02:30-05:00", "Europe/Berlin")
+	changes := []string{"2026-10-25T00:30:00Z", "2026-10-25T01:00:00Z", "2026-10-25T01:30:00Z", "2026-10-25T04:00:00Z"}
+	from := at(t, "2026-10-24T22:00:00Z")
+	for _, want := range changes {
+		got := s.nextChange(from)
+		if !got.Equal(at(t, want)) {
+			t.Fatalf("nextChange(%s) = %v, want %s", from.UTC().Format(time.RFC3339), got.UTC(), want)
+		}
+		from = got
+	}
+}
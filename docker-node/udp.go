@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ─── UDP Associations (SOCKS5 UDP ASSOCIATE) ───────────────────────────────────
+//
+// The gateway opens an association with a udp_open control message carrying a
+// stream_id; datagrams then travel as mux frames of type 0x03 on that stream.
+// Payload is the SOCKS5 UDP header without RSV/FRAG:
+//
+// [1B atyp][addr][2B port BE][data]
+//
+// Outbound the address is the destination, inbound it is the source. The
+// association closes with RST from either side or after idle_timeout seconds
+// without traffic.
+
+const (
+	muxTypeUDP = 0x03
+
+	udpAtypIPv4   = 0x01
+	udpAtypDomain = 0x03
+	udpAtypIPv6   = 0x04
+
+	udpDefaultIdleTimeout = 2 * time.Minute
+	udpMaxDatagram        = 65535
+	udpMaxRefusedLogged   = 256
+)
+
+type UDPOpen struct {
+	AssocID     string `json:"assoc_id"`
+	StreamID    uint32 `json:"stream_id"`
+	IdleTimeout int    `json:"idle_timeout,omitempty"` // seconds
+}
+
+type udpAssociation struct {
+	agent    *NodeAgent
+	id       uint32
+	assocID  string
+	conn     *net.UDPConn
+	idle     time.Duration
+	lastSeen int64 // unix nanos of the last datagram in either direction
+
+	refused map[string]bool // targets already logged as refused; read loop only
+
+	closeOnce sync.Once
+}
+
+func (a *NodeAgent) handleUDPOpen(req UDPOpen) {
+	respond := func(success bool, errMsg string) {
+		data := map[string]interface{}{
+			"assoc_id": req.AssocID,
+			"success":  success,
+		}
+		if errMsg != "" {
+			data["error"] = errMsg
+		}
+		resp, _ := json.Marshal(map[string]interface{}{
+			"type": "udp_response",
+			"data": data,
+		})
+		a.safeWrite(websocket.TextMessage, resp)
+	}
+
+	if req.StreamID == 0 {
+		respond(false, "udp requires mux stream")
+		return
+	}
+	if !a.featureEnabled("udp") {
+		respond(false, "udp disabled by node config")
+		return
+	}
+	if err := a.unavailable(); err != nil {
+		respond(false, err.Error())
+		return
+	}
+	if err := a.caps.exhausted(); err != nil {
+		respond(false, err.Error())
+		return
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		respond(false, err.Error())
+		return
+	}
+
+	idle := time.Duration(req.IdleTimeout) * time.Second
+	if idle <= 0 {
+		idle = udpDefaultIdleTimeout
+	}
+	u := &udpAssociation{
+		agent:    a,
+		id:       req.StreamID,
+		assocID:  req.AssocID,
+		conn:     conn,
+		idle:     idle,
+		lastSeen: time.Now().UnixNano(),
+	}
+	a.udpAssocs.Store(req.StreamID, u)
+
+	respond(true, "")
+	go u.run()
+}
+
+// run relays target → gateway datagrams and enforces the idle timeout
+func (u *udpAssociation) run() {
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		u.conn.SetReadDeadline(time.Now().Add(u.idle))
+		n, from, err := u.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if time.Since(time.Unix(0, atomic.LoadInt64(&u.lastSeen))) < u.idle {
+					continue
+				}
+				u.reset("idle timeout")
+				return
+			}
+			u.reset(err.Error())
+			return
+		}
+		u.touch()
+		u.agent.caps.throttle(capDown, n)
+		payload := appendUDPAddr(make([]byte, 0, n+19), from)
+		payload = append(payload, buf[:n]...)
+		u.agent.safeWrite(websocket.BinaryMessage, encodeMuxFrame(muxFrame{
+			Type: muxTypeUDP, StreamID: u.id, Payload: payload,
+		}))
+	}
+}
+
+// deliver sends one gateway datagram to its destination
+func (u *udpAssociation) deliver(payload []byte) {
+	host, port, data, err := parseUDPAddr(payload)
+	if err != nil {
+		return
+	}
+	if err := u.agent.egress.checkTarget(host, strconv.Itoa(port)); err != nil {
+		u.refuse(host, err)
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return
+	}
+	if err := u.agent.egress.checkIP(addr.IP); err != nil {
+		u.refuse(host, err)
+		return
+	}
+	u.touch()
+	u.agent.caps.count(capUp, len(data))
+	u.conn.WriteToUDP(data, addr)
+}
+
+// refuse drops a datagram the egress policy blocks, logging each target once
+func (u *udpAssociation) refuse(host string, err error) {
+	if u.refused == nil {
+		u.refused = make(map[string]bool)
+	}
+	if !u.refused[host] && len(u.refused) < udpMaxRefusedLogged {
+		u.refused[host] = true
+		log.Printf("[NODE] UDP association %s to %s refused: %v", u.assocID, host, err)
+	}
+}
+
+func (u *udpAssociation) touch() {
+	atomic.StoreInt64(&u.lastSeen, time.Now().UnixNano())
+}
+
+// reset closes the association and tells the gateway why
+func (u *udpAssociation) reset(reason string) {
+	if u.close() {
+		u.agent.safeWrite(websocket.BinaryMessage, encodeMuxFrame(muxFrame{
+			Type: muxTypeRST, StreamID: u.id, Payload: []byte(reason),
+		}))
+	}
+}
+
+// close tears down local state; returns false if already closed
+func (u *udpAssociation) close() bool {
+	closed := false
+	u.closeOnce.Do(func() {
+		closed = true
+		u.conn.Close()
+		u.agent.udpAssocs.Delete(u.id)
+	})
+	return closed
+}
+
+func (a *NodeAgent) handleUDPFrame(frame muxFrame) bool {
+	val, ok := a.udpAssocs.Load(frame.StreamID)
+	if !ok {
+		return false
+	}
+	u := val.(*udpAssociation)
+	switch frame.Type {
+	case muxTypeUDP:
+		u.deliver(frame.Payload)
+	case muxTypeRST:
+		log.Printf("[NODE] UDP association %s closed by gateway: %s", u.assocID, string(frame.Payload))
+		u.close()
+	}
+	return true
+}
+
+// ─── UDP Address Header ────────────────────────────────────────────────────────
+
+func parseUDPAddr(b []byte) (string, int, []byte, error) {
+	if len(b) < 1 {
+		return "", 0, nil, fmt.Errorf("short udp header")
+	}
+	var host string
+	off := 1
+	switch b[0] {
+	case udpAtypIPv4:
+		if len(b) < off+net.IPv4len+2 {
+			return "", 0, nil, fmt.Errorf("short udp header")
+		}
+		host = net.IP(b[off : off+net.IPv4len]).String()
+		off += net.IPv4len
+	case udpAtypIPv6:
+		if len(b) < off+net.IPv6len+2 {
+			return "", 0, nil, fmt.Errorf("short udp header")
+		}
+		host = net.IP(b[off : off+net.IPv6len]).String()
+		off += net.IPv6len
+	case udpAtypDomain:
+		if len(b) < 2 || len(b) < off+1+int(b[1])+2 {
+			return "", 0, nil, fmt.Errorf("short udp header")
+		}
+		host = string(b[off+1 : off+1+int(b[1])])
+		off += 1 + int(b[1])
+	default:
+		return "", 0, nil, fmt.Errorf("bad address type %d", b[0])
+	}
+	port := int(binary.BigEndian.Uint16(b[off : off+2]))
+	return host, port, b[off+2:], nil
+}
+
+func appendUDPAddr(b []byte, addr *net.UDPAddr) []byte {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b = append(b, udpAtypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, udpAtypIPv6)
+		b = append(b, addr.IP.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(addr.Port))
+}
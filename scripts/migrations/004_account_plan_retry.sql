@@ -0,0 +1,9 @@
+-- Per-plan retry policy for plain HTTP requests through proxy-gateway.
+-- Zero / empty values fall back to the gateway defaults
+-- (3 attempts, 20s budget, idempotent methods, 403/429/5xx/captcha).
+
+ALTER TABLE IF EXISTS account_plans
+    ADD COLUMN IF NOT EXISTS retry_max_attempts INTEGER DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS retry_budget_seconds INTEGER DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS retry_methods TEXT[] DEFAULT '{}',
+    ADD COLUMN IF NOT EXISTS retry_on TEXT[] DEFAULT '{}';
@@ -0,0 +1,6 @@
+-- Per-plan body size caps for plain HTTP through proxy-gateway.
+-- Zero falls back to the gateway defaults (32 MB request, 1024 MB response).
+
+ALTER TABLE IF EXISTS account_plans
+    ADD COLUMN IF NOT EXISTS max_request_body_mb INTEGER DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS max_response_body_mb INTEGER DEFAULT 0;
@@ -0,0 +1,9 @@
+-- How proxy-gateway enforces ip_reuse_cooldown_seconds.
+-- ip_reuse_scope: 'customer' (one ledger per customer) or 'domain'
+--   (per customer and target registrable domain).
+-- ip_reuse_fallback when every candidate IP is cooling down: 'wait' (up to
+--   10s for one to free up), 'relax' (ignore the cooldown) or 'fail'.
+
+ALTER TABLE IF EXISTS account_plans
+    ADD COLUMN IF NOT EXISTS ip_reuse_scope VARCHAR(20) DEFAULT 'customer',
+    ADD COLUMN IF NOT EXISTS ip_reuse_fallback VARCHAR(20) DEFAULT 'relax';
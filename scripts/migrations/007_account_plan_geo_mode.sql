@@ -0,0 +1,9 @@
+-- How far proxy-gateway may move away from a targeted city, region or
+-- country when nothing there is available. Requests override it with the
+-- fallback- username parameter.
+-- geo_fallback_mode: 'strict' (only the requested geo), 'fallback-region'
+--   (the city, then its region), 'fallback-country' (then the whole
+--   country) or 'any' (then any country the plan allows).
+
+ALTER TABLE IF EXISTS account_plans
+    ADD COLUMN IF NOT EXISTS geo_fallback_mode VARCHAR(20) DEFAULT 'fallback-country';
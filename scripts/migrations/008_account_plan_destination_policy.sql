@@ -0,0 +1,12 @@
+-- Per-customer destination rules, applied by proxy-gateway on top of the
+-- global DESTINATION_POLICY_FILE. Domains also match their subdomains;
+-- ports are single ports or ranges ('6660-6669'); categories name files in
+-- DESTINATION_CATEGORIES_DIR. A non-empty destination_allow_domains limits
+-- the customer to those domains.
+
+ALTER TABLE IF EXISTS account_plans
+    ADD COLUMN IF NOT EXISTS destination_allow_domains TEXT[] DEFAULT '{}',
+    ADD COLUMN IF NOT EXISTS destination_deny_domains TEXT[] DEFAULT '{}',
+    ADD COLUMN IF NOT EXISTS destination_deny_cidrs TEXT[] DEFAULT '{}',
+    ADD COLUMN IF NOT EXISTS destination_deny_ports TEXT[] DEFAULT '{}',
+    ADD COLUMN IF NOT EXISTS destination_deny_categories TEXT[] DEFAULT '{}';
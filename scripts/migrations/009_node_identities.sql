@@ -0,0 +1,18 @@
+-- Node identity: Ed25519 public keys pinned per device (node-registration)
+-- The first key a device proves on /ws is pinned; admins revoke or rotate it
+-- through /admin/identities.
+
+CREATE TABLE IF NOT EXISTS node_identities (
+    device_id VARCHAR(255) PRIMARY KEY,
+    public_key VARCHAR(64),
+    previous_key VARCHAR(64),
+    status VARCHAR(20) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'rotating', 'revoked')),
+    revoke_reason TEXT,
+    pinned_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    rotated_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_node_identities_status ON node_identities(status);
+CREATE INDEX IF NOT EXISTS idx_node_identities_updated_at ON node_identities(updated_at);
@@ -0,0 +1,29 @@
+-- SDK version policy for node-registration (VERSION_POLICY_DB=true).
+-- One row per platform (android, ios, windows, docker, ...); the '*' row is
+-- the default for platforms without one. enforce_percent stages a new
+-- min_version: only that share of devices is refused, the rest are warned.
+-- Reloaded every minute.
+
+CREATE TABLE IF NOT EXISTS sdk_version_policies (
+    platform VARCHAR(20) PRIMARY KEY,
+    min_version VARCHAR(20),
+    deprecated_below VARCHAR(20),
+    latest_version VARCHAR(20),
+    download_url VARCHAR(500),
+    enforce_percent INTEGER CHECK (enforce_percent BETWEEN 0 AND 100),
+    message TEXT,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Known-bad builds; platform '*' denies the version everywhere
+CREATE TABLE IF NOT EXISTS sdk_version_denylist (
+    platform VARCHAR(20) NOT NULL DEFAULT '*',
+    version VARCHAR(20) NOT NULL,
+    reason TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (platform, version)
+);
+
+INSERT INTO sdk_version_policies (platform, min_version)
+VALUES ('*', '1.0.62')
+ON CONFLICT (platform) DO NOTHING;
@@ -0,0 +1,26 @@
+-- Remote node configuration (node-registration, CONFIG_SIGNING_KEY).
+-- node_configs holds the signed documents: payload is the exact config JSON
+-- the Ed25519 signature covers ("iploop-node-config:v1:<version>:<payload>").
+-- A node runs the newest document whose target matches it.
+-- node_config_state records which version each device was sent and acked.
+
+CREATE TABLE IF NOT EXISTS node_configs (
+    version BIGSERIAL PRIMARY KEY,
+    payload TEXT NOT NULL,
+    signature VARCHAR(100) NOT NULL,
+    target JSONB NOT NULL DEFAULT '{}',
+    note TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS node_config_state (
+    device_id VARCHAR(255) PRIMARY KEY,
+    version BIGINT NOT NULL,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('pushed', 'applied', 'rejected')),
+    error TEXT,
+    pushed_at TIMESTAMP WITH TIME ZONE,
+    acked_at TIMESTAMP WITH TIME ZONE,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_node_config_state_version ON node_config_state(version, status);
@@ -0,0 +1,8 @@
+-- Node sharing schedules (docker-node --schedule, admin pause/resume).
+-- Nodes outside their operator's sharing hours are 'scheduled_off' and
+-- paused nodes 'paused': both stay connected and heartbeating but take no
+-- traffic, and are not counted as inactive.
+
+ALTER TABLE nodes DROP CONSTRAINT IF EXISTS nodes_status_check;
+ALTER TABLE nodes ADD CONSTRAINT nodes_status_check
+    CHECK (status IN ('available', 'busy', 'inactive', 'banned', 'scheduled_off', 'paused'));
@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -20,8 +24,12 @@ import (
 
 	"node-registration/internal/api"
 	"node-registration/internal/config"
+	"node-registration/internal/identity"
+	"node-registration/internal/ipintel"
 	"node-registration/internal/websocket"
+	"node-registration/internal/nodeconfig"
 	"node-registration/internal/nodemanager"
+	"node-registration/internal/versionpolicy"
 )
 
 // --- DDoS / abuse protection ---
@@ -109,6 +117,42 @@ func apiRateLimitMiddleware() gin.HandlerFunc {
 	}
 }
 
+// adminAuthMiddleware requires the ADMIN_API_TOKEN bearer token
+func adminAuthMiddleware(token string) gin.HandlerFunc {
+	expected := []byte("Bearer " + token)
+	return func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), expected) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "admin token required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// configError maps config store errors to HTTP responses
+func configError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, nodeconfig.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, nodeconfig.ErrBadConfig), errors.Is(err, nodeconfig.ErrBadTarget):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// identityError maps identity store errors to HTTP responses
+func identityError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, identity.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, identity.ErrBadKey):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
 func main() {
 	// Load environment variables
 	godotenv.Load()
@@ -161,11 +205,64 @@ func main() {
 
 	// Initialize node manager
 	nodeManager := nodemanager.NewNodeManager(db, rdb, logger)
+	if len(cfg.IPIntelFiles) > 0 {
+		intel, err := ipintel.NewDB(cfg.IPIntelFiles, logger)
+		if err != nil {
+			logger.Fatalf("Failed to load IP intelligence databases: %v", err)
+		}
+		intelStop := make(chan struct{})
+		defer close(intelStop)
+		go intel.Watch(intelStop)
+		nodeManager.SetIPIntel(intel)
+	}
 
 	// Initialize WebSocket hub
 	hub := websocket.NewHub(nodeManager, logger)
 	go hub.Run()
 
+	// Node identity: Ed25519 challenge-response on /ws, keys pinned per device
+	identities := identity.NewStore(db, rdb, logger)
+	identityMode, err := identity.ParseMode(cfg.NodeIdentityMode)
+	if err != nil {
+		logger.Fatalf("Invalid NODE_IDENTITY_MODE: %v", err)
+	}
+	hub.SetIdentityStore(identities, identityMode)
+	logger.Infof("Node identity mode: %s", identityMode)
+
+	// SDK version policy: per-platform minimums, deny list, deprecation
+	var policyDB *sql.DB
+	if cfg.VersionPolicyDB {
+		policyDB = db
+	}
+	versions, err := versionpolicy.New(cfg.VersionPolicyFile, policyDB, logger)
+	if err != nil {
+		logger.Fatalf("Failed to load SDK version policy: %v", err)
+	}
+	versionsStop := make(chan struct{})
+	defer close(versionsStop)
+	go versions.Watch(versionsStop)
+	hub.SetVersionPolicy(versions)
+
+	// Config push: signed config_update documents targeted by country,
+	// platform or SDK version
+	var configs *nodeconfig.Store
+	if cfg.ConfigSigningKey != "" {
+		key, err := nodeconfig.ParseSigningKey(cfg.ConfigSigningKey)
+		if err != nil {
+			logger.Fatalf("Config push: %v", err)
+		}
+		if configs, err = nodeconfig.NewStore(db, key, logger); err != nil {
+			logger.Fatalf("Failed to load node configs: %v", err)
+		}
+		configsStop := make(chan struct{})
+		defer close(configsStop)
+		go configs.Watch(configsStop)
+		hub.SetConfigStore(configs)
+		logger.Infof("Config push enabled, signing key %s", configs.Fingerprint())
+	} else {
+		logger.Warn("CONFIG_SIGNING_KEY not set, config push disabled")
+	}
+
 	// Initialize proxy manager and wire it up
 	proxyManager := websocket.NewProxyManager(hub, logger)
 	hub.SetProxyManager(proxyManager)
@@ -249,10 +346,14 @@ func main() {
 		})
 	})
 
-	// Node statistics endpoint
+	// Node statistics endpoint, with the SDK version distribution bucketed
+	// by the version policy
 	router.GET("/stats", func(c *gin.Context) {
 		stats := nodeManager.GetStatistics()
-		c.JSON(http.StatusOK, stats)
+		c.JSON(http.StatusOK, struct {
+			*nodemanager.Statistics
+			VersionPolicy map[string]int `json:"version_policy"`
+		}{stats, versions.Summary(stats.SDKVersions)})
 	})
 
 	// Connected nodes endpoint — returns only nodes with active WebSocket
@@ -283,6 +384,176 @@ func main() {
 		tunnelHandler.HandleTunnelStandby(c.Writer, c.Request)
 	})
 
+	// Internal UDP association endpoint (SOCKS5 UDP ASSOCIATE)
+	internal.GET("/internal/udp", func(c *gin.Context) {
+		tunnelHandler.HandleUDPWebSocket(c.Writer, c.Request)
+	})
+
+	// Internal bind endpoint (SOCKS5 BIND)
+	internal.GET("/internal/bind", func(c *gin.Context) {
+		tunnelHandler.HandleBindWebSocket(c.Writer, c.Request)
+	})
+
+	// Admin endpoints: node identity revocation and key rotation, node
+	// pause/resume, config push
+	if cfg.AdminToken != "" {
+		admin := router.Group("/admin")
+		admin.Use(apiRateLimitMiddleware(), adminAuthMiddleware(cfg.AdminToken))
+
+		admin.GET("/identities", func(c *gin.Context) {
+			limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+			if limit <= 0 || limit > 1000 {
+				limit = 100
+			}
+			list, err := identities.List(c.Query("status"), limit)
+			if err != nil {
+				identityError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"identities": list, "count": len(list)})
+		})
+
+		admin.GET("/identities/:device_id", func(c *gin.Context) {
+			id, err := identities.Get(c.Param("device_id"))
+			if err == nil && id == nil {
+				err = identity.ErrNotFound
+			}
+			if err != nil {
+				identityError(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, id)
+		})
+
+		// Revoke: the device is refused until its key is rotated
+		admin.POST("/identities/:device_id/revoke", func(c *gin.Context) {
+			var body struct {
+				Reason string `json:"reason"`
+			}
+			c.ShouldBindJSON(&body)
+			deviceID := c.Param("device_id")
+			id, err := identities.Revoke(deviceID, body.Reason)
+			if err != nil {
+				identityError(c, err)
+				return
+			}
+			disconnected := hub.DisconnectDevice(deviceID)
+			c.JSON(http.StatusOK, gin.H{"identity": id, "disconnected": disconnected})
+		})
+
+		// Rotate: pin public_key, or without one accept the next key the
+		// device proves. Open connections are closed to re-authenticate.
+		admin.POST("/identities/:device_id/rotate", func(c *gin.Context) {
+			var body struct {
+				PublicKey string `json:"public_key"`
+			}
+			c.ShouldBindJSON(&body)
+			deviceID := c.Param("device_id")
+			id, err := identities.Rotate(deviceID, body.PublicKey)
+			if err != nil {
+				identityError(c, err)
+				return
+			}
+			disconnected := hub.DisconnectDevice(deviceID)
+			c.JSON(http.StatusOK, gin.H{"identity": id, "disconnected": disconnected})
+		})
+
+		// Pause: the node stays connected but takes no traffic until
+		// resumed, for minutes, or until an RFC 3339 time
+		admin.POST("/nodes/:device_id/pause", func(c *gin.Context) {
+			var body struct {
+				Minutes int        `json:"minutes"`
+				Until   *time.Time `json:"until"`
+			}
+			c.ShouldBindJSON(&body)
+			until := body.Until
+			if until == nil && body.Minutes > 0 {
+				t := time.Now().Add(time.Duration(body.Minutes) * time.Minute)
+				until = &t
+			}
+			deviceID := c.Param("device_id")
+			if hub.PauseDevice(deviceID, until) == 0 {
+				c.JSON(http.StatusNotFound, gin.H{"error": "device not connected"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"device_id": deviceID, "status": nodemanager.StatusPaused, "until": until})
+		})
+
+		admin.POST("/nodes/:device_id/resume", func(c *gin.Context) {
+			deviceID := c.Param("device_id")
+			if hub.ResumeDevice(deviceID) == 0 {
+				c.JSON(http.StatusNotFound, gin.H{"error": "device not connected"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"device_id": deviceID, "resumed": true})
+		})
+
+		if configs != nil {
+			// Published documents, newest first, with how many devices run
+			// or were sent each, and the key nodes verify them with
+			admin.GET("/configs", func(c *gin.Context) {
+				counts, err := configs.Counts()
+				if err != nil {
+					configError(c, err)
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{
+					"documents":   configs.Documents(),
+					"nodes":       counts,
+					"public_key":  configs.PublicKey(),
+					"fingerprint": configs.Fingerprint(),
+				})
+			})
+
+			// Publish: sign the config as the next version and push it to
+			// the connected nodes it targets
+			admin.POST("/configs", func(c *gin.Context) {
+				var body struct {
+					Config json.RawMessage   `json:"config"`
+					Target nodeconfig.Target `json:"target"`
+					Note   string            `json:"note"`
+				}
+				if err := c.ShouldBindJSON(&body); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				doc, err := configs.Publish(body.Config, body.Target, body.Note)
+				if err != nil {
+					configError(c, err)
+					return
+				}
+				pushed := hub.PushConfig(doc)
+				c.JSON(http.StatusCreated, gin.H{"document": doc, "pushed": pushed})
+			})
+
+			// Which config version each node runs
+			admin.GET("/configs/nodes", func(c *gin.Context) {
+				limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+				if limit <= 0 || limit > 1000 {
+					limit = 100
+				}
+				version, _ := strconv.ParseInt(c.Query("version"), 10, 64)
+				states, err := configs.States(version, c.Query("status"), limit)
+				if err != nil {
+					configError(c, err)
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"nodes": states, "count": len(states)})
+			})
+
+			admin.GET("/configs/nodes/:device_id", func(c *gin.Context) {
+				st, err := configs.State(c.Param("device_id"))
+				if err != nil {
+					configError(c, err)
+					return
+				}
+				c.JSON(http.StatusOK, st)
+			})
+		}
+	} else {
+		logger.Warn("ADMIN_API_TOKEN not set, admin endpoints disabled")
+	}
+
 	server := &http.Server{
 		Addr:              ":" + cfg.Port,
 		Handler:           router,
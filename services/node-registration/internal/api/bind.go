@@ -0,0 +1,120 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// defaultBindTimeout applies when the proxy doesn't pass timeout
+	defaultBindTimeout = 30 * time.Second
+	// maxBindTimeout caps how long a node listener may wait for its peer
+	maxBindTimeout = 2 * time.Minute
+)
+
+// HandleBindWebSocket serves SOCKS5 BIND. Text frames report progress —
+// "bind_ready:<host:port>" once the node listens, "bind_accepted:<peer>" when
+// the inbound connection arrives — then binary frames relay that connection
+// exactly like /internal/tunnel, including half_close=1.
+func (h *TunnelHandler) HandleBindWebSocket(w http.ResponseWriter, r *http.Request) {
+	nodeID := r.URL.Query().Get("node_id")
+	halfClose := r.URL.Query().Get("half_close") == "1"
+	if nodeID == "" {
+		http.Error(w, "Missing node_id", http.StatusBadRequest)
+		return
+	}
+	timeout := defaultBindTimeout
+	if secs, err := strconv.Atoi(r.URL.Query().Get("timeout")); err == nil && secs > 0 {
+		timeout = time.Duration(secs) * time.Second
+	}
+	if timeout > maxBindTimeout {
+		timeout = maxBindTimeout
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		h.logger.Errorf("Bind WS upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	tunnel, err := h.tunnelManager.OpenBind(nodeID, timeout)
+	if err != nil {
+		h.logger.Errorf("Failed to open bind: %v", err)
+		conn.WriteMessage(websocket.TextMessage, []byte("error:"+err.Error()))
+		return
+	}
+	defer h.tunnelManager.CloseTunnel(tunnel.ID)
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("bind_ready:"+tunnel.BindAddr)); err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	// Proxy -> Node. Started before the accept so a proxy that gives up while
+	// the node is still listening tears the bind down.
+	go func() {
+		defer wg.Done()
+		defer h.tunnelManager.CloseTunnel(tunnel.ID)
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if halfClose && messageType == websocket.TextMessage && string(data) == tunnelFINMessage {
+				if err := tunnel.CloseWrite(); err != nil {
+					return // node can't half-close: close the bind as before
+				}
+				continue
+			}
+			if messageType == websocket.BinaryMessage {
+				if err := tunnel.Write(data); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	if err := h.tunnelManager.WaitBindAccept(tunnel, timeout); err != nil {
+		h.logger.Infof("Bind %s ended without a peer: %v", tunnel.ID, err)
+		conn.WriteMessage(websocket.TextMessage, []byte("error:"+err.Error()))
+		conn.Close()
+		wg.Wait()
+		return
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("bind_accepted:"+tunnel.BindPeer)); err != nil {
+		return
+	}
+
+	h.logger.Infof("Bind %s accepted %s, starting relay", tunnel.ID, tunnel.BindPeer)
+
+	// Node -> Proxy
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			data, err := tunnel.ReadWithTimeout(5 * time.Minute)
+			if err == io.EOF && halfClose {
+				conn.WriteMessage(websocket.TextMessage, []byte(tunnelFINMessage))
+				return
+			}
+			if err != nil {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	h.logger.Infof("Bind %s closed", tunnel.ID)
+}
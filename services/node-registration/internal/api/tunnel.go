@@ -36,6 +36,12 @@ func NewTunnelHandler(tm *ws.TunnelManager, logger *logrus.Entry) *TunnelHandler
 	}
 }
 
+// tunnelFINMessage is a text control frame on tunnel WebSockets opened with
+// half_close=1. From the proxy it means "client shut down its write side"
+// (CloseWrite on the tunnel); towards the proxy it means the target finished
+// sending. Callers that don't opt in keep getting a close frame instead.
+const tunnelFINMessage = "fin"
+
 // TunnelOpenPayload for HTTP tunnel open request
 type TunnelOpenPayload struct {
 	NodeID string `json:"node_id"`
@@ -49,6 +55,7 @@ func (h *TunnelHandler) HandleTunnelWebSocket(w http.ResponseWriter, r *http.Req
 	nodeID := r.URL.Query().Get("node_id")
 	host := r.URL.Query().Get("host")
 	port := r.URL.Query().Get("port")
+	halfClose := r.URL.Query().Get("half_close") == "1"
 
 	if nodeID == "" || host == "" || port == "" {
 		http.Error(w, "Missing required parameters: node_id, host, port", http.StatusBadRequest)
@@ -94,6 +101,18 @@ func (h *TunnelHandler) HandleTunnelWebSocket(w http.ResponseWriter, r *http.Req
 				return
 			}
 
+			if halfClose && messageType == websocket.TextMessage && string(data) == tunnelFINMessage {
+				h.logger.Debugf("Tunnel %s client half-closed", tunnel.ID)
+				if err := tunnel.CloseWrite(); err != nil {
+					// Node can't half-close (or the FIN didn't fit): close
+					// the whole tunnel as before half_close existed
+					h.logger.Debugf("Tunnel %s half-close failed, closing: %v", tunnel.ID, err)
+					h.tunnelManager.CloseTunnel(tunnel.ID)
+					return
+				}
+				continue
+			}
+
 			if messageType == websocket.BinaryMessage || messageType == websocket.TextMessage {
 				if err := tunnel.Write(data); err != nil {
 					h.logger.Debugf("Tunnel %s write error: %v", tunnel.ID, err)
@@ -109,6 +128,11 @@ func (h *TunnelHandler) HandleTunnelWebSocket(w http.ResponseWriter, r *http.Req
 		h.logger.Infof("Tunnel %s relay Node->Proxy started", tunnel.ID[:8])
 		for {
 			data, err := tunnel.ReadWithTimeout(30 * time.Second)
+			if err == io.EOF && halfClose {
+				h.logger.Debugf("Tunnel %s target half-closed", tunnel.ID)
+				conn.WriteMessage(websocket.TextMessage, []byte(tunnelFINMessage))
+				return
+			}
 			if err != nil {
 				h.logger.Infof("Tunnel %s relay read error: %v", tunnel.ID[:8], err)
 				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
@@ -134,6 +158,7 @@ func (h *TunnelHandler) HandleTunnelWebSocket(w http.ResponseWriter, r *http.Req
 // This enables pre-opened tunnel pools on the proxy-gateway side.
 func (h *TunnelHandler) HandleTunnelStandby(w http.ResponseWriter, r *http.Request) {
 	nodeID := r.URL.Query().Get("node_id")
+	halfClose := r.URL.Query().Get("half_close") == "1"
 	if nodeID == "" {
 		http.Error(w, "Missing node_id", http.StatusBadRequest)
 		return
@@ -221,6 +246,13 @@ func (h *TunnelHandler) HandleTunnelStandby(w http.ResponseWriter, r *http.Reque
 			if err != nil {
 				return
 			}
+			if halfClose && messageType == websocket.TextMessage && string(data) == tunnelFINMessage {
+				if err := tunnel.CloseWrite(); err != nil {
+					h.tunnelManager.CloseTunnel(tunnel.ID)
+					return
+				}
+				continue
+			}
 			if messageType == websocket.BinaryMessage || messageType == websocket.TextMessage {
 				if err := tunnel.Write(data); err != nil {
 					return
@@ -234,6 +266,10 @@ func (h *TunnelHandler) HandleTunnelStandby(w http.ResponseWriter, r *http.Reque
 		defer wg.Done()
 		for {
 			data, err := tunnel.ReadWithTimeout(30 * time.Second)
+			if err == io.EOF && halfClose {
+				conn.WriteMessage(websocket.TextMessage, []byte(tunnelFINMessage))
+				return
+			}
 			if err != nil {
 				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 				return
@@ -369,7 +405,10 @@ func (h *StreamingTunnelHandler) HandleStream(w http.ResponseWriter, r *http.Req
 		for {
 			n, err := bufrw.Read(buf)
 			if err != nil {
-				if err != io.EOF {
+				if err == io.EOF {
+					// Client half-closed — propagate to the target
+					tunnel.CloseWrite()
+				} else {
 					h.logger.Debugf("Read from client error: %v", err)
 				}
 				return
@@ -387,6 +426,12 @@ func (h *StreamingTunnelHandler) HandleStream(w http.ResponseWriter, r *http.Req
 		defer wg.Done()
 		for {
 			data, err := tunnel.ReadWithTimeout(30 * time.Second)
+			if err == io.EOF {
+				if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+				}
+				return
+			}
 			if err != nil {
 				return
 			}
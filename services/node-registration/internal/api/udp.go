@@ -0,0 +1,80 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// udpReadyMessage tells the proxy the node has bound a UDP socket
+const udpReadyMessage = "udp_ready"
+
+// defaultUDPIdleTimeout applies when the proxy doesn't pass idle_timeout
+const defaultUDPIdleTimeout = 2 * time.Minute
+
+// HandleUDPWebSocket relays a SOCKS5 UDP association. After "udp_ready" each
+// binary message is one datagram as [atyp][addr][port][data] — the SOCKS5 UDP
+// header without RSV/FRAG. The socket closes when either side goes idle.
+func (h *TunnelHandler) HandleUDPWebSocket(w http.ResponseWriter, r *http.Request) {
+	nodeID := r.URL.Query().Get("node_id")
+	if nodeID == "" {
+		http.Error(w, "Missing node_id", http.StatusBadRequest)
+		return
+	}
+	idle := defaultUDPIdleTimeout
+	if secs, err := strconv.Atoi(r.URL.Query().Get("idle_timeout")); err == nil && secs > 0 {
+		idle = time.Duration(secs) * time.Second
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		h.logger.Errorf("UDP WS upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	assoc, err := h.tunnelManager.OpenUDPAssociation(nodeID, idle)
+	if err != nil {
+		h.logger.Errorf("Failed to open UDP association: %v", err)
+		conn.WriteJSON(map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+	defer h.tunnelManager.CloseUDPAssociation(assoc.ID)
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(udpReadyMessage)); err != nil {
+		return
+	}
+
+	// Proxy -> Node
+	go func() {
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				h.tunnelManager.CloseUDPAssociation(assoc.ID)
+				return
+			}
+			if messageType == websocket.BinaryMessage {
+				if err := assoc.Send(data); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	// Node -> Proxy
+	for {
+		select {
+		case data := <-assoc.DataCh:
+			if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+				return
+			}
+		case <-assoc.CloseCh:
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
+	}
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"strings"
 	"time"
 )
 
@@ -14,6 +15,15 @@ type Config struct {
 	LogLevel           string
 	HeartbeatInterval  time.Duration
 	InactiveTimeout    time.Duration
+	IPIntelFiles       []string // offline IP databases (.mmdb or .csv), first wins
+
+	NodeIdentityMode string // off, optional or required, see identity.ParseMode
+	AdminToken       string // bearer token for /admin; admin endpoints are off without it
+
+	VersionPolicyFile string // SDK version policy file, see versionpolicy.File
+	VersionPolicyDB   bool   // read the policy from sdk_version_policies instead
+
+	ConfigSigningKey string // base64 Ed25519 seed signing config_update; config push is off without it
 }
 
 func Load() *Config {
@@ -26,7 +36,27 @@ func Load() *Config {
 		LogLevel:      getEnv("LOG_LEVEL", "info"),
 		HeartbeatInterval: parseDuration(getEnv("NODE_HEARTBEAT_INTERVAL", "30s")),
 		InactiveTimeout:   parseDuration(getEnv("NODE_INACTIVE_TIMEOUT", "90s")),
+		IPIntelFiles:      splitList(getEnv("IP_INTEL_FILES", "")),
+
+		NodeIdentityMode: getEnv("NODE_IDENTITY_MODE", "optional"),
+		AdminToken:       getEnv("ADMIN_API_TOKEN", ""),
+
+		VersionPolicyFile: getEnv("VERSION_POLICY_FILE", ""),
+		VersionPolicyDB:   getEnv("VERSION_POLICY_DB", "") == "true",
+
+		ConfigSigningKey: getEnv("CONFIG_SIGNING_KEY", ""),
+	}
+}
+
+// splitList splits a comma-separated setting, dropping empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
 	}
+	return list
 }
 
 func getEnv(key, defaultValue string) string {
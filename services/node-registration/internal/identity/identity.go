@@ -0,0 +1,348 @@
+package identity
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// Nodes prove their identity with an Ed25519 key: on /ws the hub sends an
+// auth_challenge nonce and the node answers with auth_response, signing
+// SignedMessage(nonce, device_id). The first key a new device proves is pinned
+// to it; from then on registrations for that device must be signed with it.
+// A device that registered before it had a key isn't pinned on first use,
+// since anyone who knows its ID could claim it: an admin pins its key, or
+// rotates it so the next key it proves is pinned.
+
+// Identity statuses
+const (
+	StatusActive   = "active"   // key pinned
+	StatusRotating = "rotating" // pin cleared by an admin; the next proven key is pinned
+	StatusRevoked  = "revoked"  // device refused until rotated
+)
+
+// Mode is how strictly registrations are checked
+type Mode string
+
+const (
+	// ModeOff skips the handshake
+	ModeOff Mode = "off"
+	// ModeOptional lets devices without a pinned key register unsigned, so
+	// SDKs without identity support keep working
+	ModeOptional Mode = "optional"
+	// ModeRequired refuses every unsigned registration
+	ModeRequired Mode = "required"
+)
+
+// ParseMode reads NODE_IDENTITY_MODE; empty is ModeOptional
+func ParseMode(s string) (Mode, error) {
+	switch mode := Mode(strings.ToLower(strings.TrimSpace(s))); mode {
+	case "":
+		return ModeOptional, nil
+	case ModeOff, ModeOptional, ModeRequired:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown node identity mode %q (want off, optional or required)", s)
+}
+
+const (
+	signaturePrefix = "iploop-node-auth:v1:"
+	nonceSize       = 32
+
+	cacheTTL     = 24 * time.Hour
+	cacheNoneTTL = 5 * time.Minute
+	cacheNone    = "-" // cached "no identity pinned"
+)
+
+var (
+	ErrBadKey       = errors.New("invalid public key")
+	ErrBadSignature = errors.New("invalid signature")
+	ErrKeyMismatch  = errors.New("public key does not match the key pinned to this device")
+	ErrWrongDevice  = errors.New("device_id differs from the verified identity")
+	ErrRevoked      = errors.New("device identity revoked")
+	ErrUnverified   = errors.New("device identity not verified")
+	ErrNotFound     = errors.New("no identity for device")
+	ErrNeedsPin     = errors.New("device registered before it had a key; an admin must pin or rotate it")
+)
+
+// Identity is the key pinned to a device
+type Identity struct {
+	DeviceID     string     `json:"device_id"`
+	PublicKey    string     `json:"public_key,omitempty"` // base64, 32 bytes
+	Fingerprint  string     `json:"fingerprint,omitempty"`
+	PreviousKey  string     `json:"previous_key,omitempty"`
+	Status       string     `json:"status"`
+	RevokeReason string     `json:"revoke_reason,omitempty"`
+	PinnedAt     time.Time  `json:"pinned_at"`
+	RotatedAt    *time.Time `json:"rotated_at,omitempty"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// NewChallenge returns a fresh nonce for auth_challenge
+func NewChallenge() (string, error) {
+	b := make([]byte, nonceSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// SignedMessage is what a node signs to answer a challenge
+func SignedMessage(nonce, deviceID string) []byte {
+	return []byte(signaturePrefix + nonce + ":" + deviceID)
+}
+
+// Verify checks a node's answer to a challenge
+func Verify(publicKey, nonce, deviceID, signature string) error {
+	key, err := decodeKey(publicKey)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return ErrBadSignature
+	}
+	if !ed25519.Verify(key, SignedMessage(nonce, deviceID), sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Fingerprint is a short hex digest of a public key, for logs and the admin API
+func Fingerprint(publicKey string) string {
+	key, err := decodeKey(publicKey)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func decodeKey(publicKey string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, ErrBadKey
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Store pins keys to devices in Postgres (node_identities), cached in Redis
+type Store struct {
+	db     *sql.DB
+	rdb    *redis.Client
+	logger *logrus.Entry
+}
+
+func NewStore(db *sql.DB, rdb *redis.Client, logger *logrus.Entry) *Store {
+	return &Store{
+		db:     db,
+		rdb:    rdb,
+		logger: logger.WithField("component", "node-identity"),
+	}
+}
+
+const identityColumns = `device_id, COALESCE(public_key, ''), COALESCE(previous_key, ''), status,
+	COALESCE(revoke_reason, ''), pinned_at, rotated_at, revoked_at, updated_at`
+
+func scanIdentity(row interface{ Scan(...interface{}) error }) (*Identity, error) {
+	var id Identity
+	var rotatedAt, revokedAt sql.NullTime
+	if err := row.Scan(&id.DeviceID, &id.PublicKey, &id.PreviousKey, &id.Status,
+		&id.RevokeReason, &id.PinnedAt, &rotatedAt, &revokedAt, &id.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if rotatedAt.Valid {
+		id.RotatedAt = &rotatedAt.Time
+	}
+	if revokedAt.Valid {
+		id.RevokedAt = &revokedAt.Time
+	}
+	id.Fingerprint = Fingerprint(id.PublicKey)
+	return &id, nil
+}
+
+func cacheKey(deviceID string) string {
+	return fmt.Sprintf("identity:%s", deviceID)
+}
+
+// Get returns the device's identity, or nil if it never pinned a key
+func (s *Store) Get(deviceID string) (*Identity, error) {
+	ctx := context.Background()
+	if cached, err := s.rdb.Get(ctx, cacheKey(deviceID)).Result(); err == nil {
+		if cached == cacheNone {
+			return nil, nil
+		}
+		var id Identity
+		if json.Unmarshal([]byte(cached), &id) == nil {
+			return &id, nil
+		}
+	}
+
+	id, err := scanIdentity(s.db.QueryRow(`SELECT `+identityColumns+` FROM node_identities WHERE device_id = $1`, deviceID))
+	if err == sql.ErrNoRows {
+		s.rdb.Set(ctx, cacheKey(deviceID), cacheNone, cacheNoneTTL)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.cache(id)
+	return id, nil
+}
+
+func (s *Store) cache(id *Identity) {
+	if data, err := json.Marshal(id); err == nil {
+		s.rdb.Set(context.Background(), cacheKey(id.DeviceID), data, cacheTTL)
+	}
+}
+
+// Authenticate checks a proven key against the device's pin, pinning it if
+// the device is new or rotating
+func (s *Store) Authenticate(deviceID, publicKey string) (*Identity, error) {
+	if _, err := decodeKey(publicKey); err != nil {
+		return nil, err
+	}
+	id, err := s.Get(deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case id == nil:
+		// First key seen for this device. Only a device that never registered
+		// is trusted on first use.
+		registered, err := s.registered(deviceID)
+		if err != nil {
+			return nil, err
+		}
+		if registered {
+			return nil, ErrNeedsPin
+		}
+		// Another instance may pin at the same moment; whichever insert wins
+		// is the pin.
+		if _, err := s.db.Exec(`INSERT INTO node_identities (device_id, public_key, status)
+			VALUES ($1, $2, $3) ON CONFLICT (device_id) DO NOTHING`, deviceID, publicKey, StatusActive); err != nil {
+			return nil, err
+		}
+		s.rdb.Del(context.Background(), cacheKey(deviceID))
+		if id, err = s.Get(deviceID); err != nil {
+			return nil, err
+		}
+		if id != nil && id.PublicKey == publicKey {
+			s.logger.Infof("Pinned key %s to device %s", id.Fingerprint, deviceID)
+		}
+	case id.Status == StatusRotating:
+		if id, err = s.update(deviceID, `previous_key = COALESCE(public_key, previous_key), public_key = $2,
+			status = 'active', rotated_at = NOW()`, publicKey); err != nil {
+			return nil, err
+		}
+		s.logger.Infof("Pinned rotated key %s to device %s", id.Fingerprint, deviceID)
+	}
+
+	if id == nil {
+		return nil, ErrNotFound
+	}
+	if id.Status == StatusRevoked {
+		return id, ErrRevoked
+	}
+	if id.PublicKey != publicKey {
+		return id, ErrKeyMismatch
+	}
+	return id, nil
+}
+
+// Revoke refuses the device until an admin rotates its key
+func (s *Store) Revoke(deviceID, reason string) (*Identity, error) {
+	// A device that never pinned a key can be revoked too
+	if _, err := s.db.Exec(`INSERT INTO node_identities (device_id, status, revoke_reason, revoked_at)
+		VALUES ($1, 'revoked', $2, NOW())
+		ON CONFLICT (device_id) DO UPDATE SET status = 'revoked', revoke_reason = $2,
+			revoked_at = NOW(), updated_at = NOW()`, deviceID, reason); err != nil {
+		return nil, err
+	}
+	s.rdb.Del(context.Background(), cacheKey(deviceID))
+	s.logger.Warnf("Revoked identity of device %s: %s", deviceID, reason)
+	return s.Get(deviceID)
+}
+
+// registered reports whether the device already has a node registration
+func (s *Store) registered(deviceID string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM nodes WHERE device_id = $1)`, deviceID).Scan(&exists)
+	return exists, err
+}
+
+// Rotate pins a new key to the device, or with publicKey "" clears the pin
+// so the next key the device proves is pinned. Either way a revoked device is
+// let back in. It is also how an admin approves the first key of a device
+// that registered before it had one.
+func (s *Store) Rotate(deviceID, publicKey string) (*Identity, error) {
+	if publicKey != "" {
+		if _, err := decodeKey(publicKey); err != nil {
+			return nil, err
+		}
+	}
+	status := StatusActive
+	if publicKey == "" {
+		status = StatusRotating
+	}
+	id, err := scanIdentity(s.db.QueryRow(`INSERT INTO node_identities (device_id, public_key, status, rotated_at)
+		VALUES ($1, NULLIF($2, ''), $3, NOW())
+		ON CONFLICT (device_id) DO UPDATE SET previous_key = COALESCE(node_identities.public_key, node_identities.previous_key),
+			public_key = EXCLUDED.public_key, status = EXCLUDED.status, revoke_reason = NULL, revoked_at = NULL,
+			rotated_at = NOW(), updated_at = NOW()
+		RETURNING `+identityColumns, deviceID, publicKey, status))
+	if err != nil {
+		return nil, err
+	}
+	s.cache(id)
+	s.logger.Infof("Rotated identity of device %s (status %s, key %s)", deviceID, id.Status, id.Fingerprint)
+	return id, nil
+}
+
+// update changes a device's row ($1 is the device ID) and refreshes the cache
+func (s *Store) update(deviceID, set string, args ...interface{}) (*Identity, error) {
+	id, err := scanIdentity(s.db.QueryRow(`UPDATE node_identities SET `+set+`, updated_at = NOW()
+		WHERE device_id = $1 RETURNING `+identityColumns, append([]interface{}{deviceID}, args...)...))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.cache(id)
+	return id, nil
+}
+
+// List returns identities, most recently changed first, optionally with one
+// status only
+func (s *Store) List(status string, limit int) ([]*Identity, error) {
+	rows, err := s.db.Query(`SELECT `+identityColumns+` FROM node_identities
+		WHERE $1 = '' OR status = $1 ORDER BY updated_at DESC LIMIT $2`, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	identities := make([]*Identity, 0)
+	for rows.Next() {
+		id, err := scanIdentity(rows)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, id)
+	}
+	return identities, rows.Err()
+}
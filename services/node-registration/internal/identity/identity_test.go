@@ -0,0 +1,281 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestStore(t *testing.T) (*Store, sqlmock.Sqlmock, *miniredis.Miniredis) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return NewStore(db, rdb, logrus.NewEntry(logger)), mock, mr
+}
+
+// newKey returns a base64 public key and its private key
+func newKey(t *testing.T) (string, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(pub), priv
+}
+
+// identityRows is a node_identities row as identityColumns selects it
+func identityRows(deviceID, publicKey, previousKey, status string) *sqlmock.Rows {
+	now := time.Now()
+	return sqlmock.NewRows([]string{"device_id", "public_key", "previous_key", "status",
+		"revoke_reason", "pinned_at", "rotated_at", "revoked_at", "updated_at"}).
+		AddRow(deviceID, publicKey, previousKey, status, "", now, nil, nil, now)
+}
+
+const (
+	selectIdentity = `SELECT .+ FROM node_identities WHERE device_id = \$1`
+	selectNode     = `SELECT EXISTS \(SELECT 1 FROM nodes WHERE device_id = \$1\)`
+	insertIdentity = `INSERT INTO node_identities \(device_id, public_key, status\)`
+)
+
+func TestAuthenticate(t *testing.T) {
+	key, _ := newKey(t)
+	other, _ := newKey(t)
+	tests := []struct {
+		name    string
+		cached  *Identity // put in Redis first
+		expect  func(sqlmock.Sqlmock)
+		key     string
+		want    error
+		wantKey string // pinned key after the call
+	}{
+		{
+			name: "trust on first use",
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(selectIdentity).WithArgs("dev").WillReturnError(sql.ErrNoRows)
+				m.ExpectQuery(selectNode).WithArgs("dev").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				m.ExpectExec(insertIdentity).WithArgs("dev", key, StatusActive).WillReturnResult(sqlmock.NewResult(0, 1))
+				m.ExpectQuery(selectIdentity).WithArgs("dev").WillReturnRows(identityRows("dev", key, "", StatusActive))
+			},
+			key:     key,
+			wantKey: key,
+		},
+		{
+			name: "another instance pinned first",
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(selectIdentity).WithArgs("dev").WillReturnError(sql.ErrNoRows)
+				m.ExpectQuery(selectNode).WithArgs("dev").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				m.ExpectExec(insertIdentity).WithArgs("dev", key, StatusActive).WillReturnResult(sqlmock.NewResult(0, 0))
+				m.ExpectQuery(selectIdentity).WithArgs("dev").WillReturnRows(identityRows("dev", other, "", StatusActive))
+			},
+			key:     key,
+			want:    ErrKeyMismatch,
+			wantKey: other,
+		},
+		{
+			name: "registered before it had a key",
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(selectIdentity).WithArgs("dev").WillReturnError(sql.ErrNoRows)
+				m.ExpectQuery(selectNode).WithArgs("dev").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+			},
+			key:  key,
+			want: ErrNeedsPin,
+		},
+		{
+			name:    "pinned key from the cache",
+			cached:  &Identity{DeviceID: "dev", PublicKey: key, Status: StatusActive},
+			expect:  func(sqlmock.Sqlmock) {},
+			key:     key,
+			wantKey: key,
+		},
+		{
+			name:    "different key",
+			cached:  &Identity{DeviceID: "dev", PublicKey: other, Status: StatusActive},
+			expect:  func(sqlmock.Sqlmock) {},
+			key:     key,
+			want:    ErrKeyMismatch,
+			wantKey: other,
+		},
+		{
+			name: "revoked",
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(selectIdentity).WithArgs("dev").WillReturnRows(identityRows("dev", key, "", StatusRevoked))
+			},
+			key:     key,
+			want:    ErrRevoked,
+			wantKey: key,
+		},
+		{
+			name: "rotating pins the next key",
+			expect: func(m sqlmock.Sqlmock) {
+				m.ExpectQuery(selectIdentity).WithArgs("dev").WillReturnRows(identityRows("dev", "", other, StatusRotating))
+				m.ExpectQuery(`UPDATE node_identities SET previous_key = .+ WHERE device_id = \$1 RETURNING`).
+					WithArgs("dev", key).WillReturnRows(identityRows("dev", key, other, StatusActive))
+			},
+			key:     key,
+			wantKey: key,
+		},
+		{
+			name:   "not a key",
+			expect: func(sqlmock.Sqlmock) {},
+			key:    "c2hvcnQ=",
+			want:   ErrBadKey,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, mock, mr := newTestStore(t)
+			if tt.cached != nil {
+				store.cache(tt.cached)
+			}
+			tt.expect(mock)
+
+			id, err := store.Authenticate("dev", tt.key)
+			if err != tt.want {
+				t.Fatalf("Authenticate = %v, want %v", err, tt.want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantKey == "" {
+				return
+			}
+			if id == nil || id.PublicKey != tt.wantKey {
+				t.Fatalf("identity %+v, want key %s", id, tt.wantKey)
+			}
+			// The pin is cached for the next registration
+			var cached Identity
+			if data, err := mr.Get(cacheKey("dev")); err != nil || json.Unmarshal([]byte(data), &cached) != nil || cached.PublicKey != tt.wantKey {
+				t.Fatalf("cache holds %q (%v), want key %s", data, err, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestGetCachesMissingIdentity(t *testing.T) {
+	store, mock, mr := newTestStore(t)
+	mock.ExpectQuery(selectIdentity).WithArgs("dev").WillReturnError(sql.ErrNoRows)
+	for i := 0; i < 2; i++ {
+		if id, err := store.Get("dev"); id != nil || err != nil {
+			t.Fatalf("Get = %+v, %v; want nil, nil", id, err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := mr.Get(cacheKey("dev")); data != cacheNone {
+		t.Fatalf("cache holds %q, want %q", data, cacheNone)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	key, _ := newKey(t)
+	old, _ := newKey(t)
+	tests := []struct {
+		name       string
+		key        string
+		wantStatus string
+	}{
+		{"new key", key, StatusActive},
+		{"clear the pin", "", StatusRotating},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, mock, _ := newTestStore(t)
+			mock.ExpectQuery(`INSERT INTO node_identities .+ ON CONFLICT \(device_id\) DO UPDATE .+ RETURNING`).
+				WithArgs("dev", tt.key, tt.wantStatus).
+				WillReturnRows(identityRows("dev", tt.key, old, tt.wantStatus))
+			id, err := store.Rotate("dev", tt.key)
+			if err != nil || id.Status != tt.wantStatus || id.PreviousKey != old {
+				t.Fatalf("Rotate = %+v, %v", id, err)
+			}
+			// Served from the cache afterwards
+			if cached, err := store.Get("dev"); err != nil || cached.Status != tt.wantStatus {
+				t.Fatalf("Get after Rotate = %+v, %v", cached, err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	store, _, _ := newTestStore(t)
+	if _, err := store.Rotate("dev", "bm90IGEga2V5"); err != ErrBadKey {
+		t.Fatalf("Rotate with a bad key = %v, want ErrBadKey", err)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	key, _ := newKey(t)
+	store, mock, mr := newTestStore(t)
+	store.cache(&Identity{DeviceID: "dev", PublicKey: key, Status: StatusActive})
+
+	mock.ExpectExec(`INSERT INTO node_identities \(device_id, status, revoke_reason, revoked_at\)`).
+		WithArgs("dev", "stolen").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(selectIdentity).WithArgs("dev").WillReturnRows(identityRows("dev", key, "", StatusRevoked))
+	id, err := store.Revoke("dev", "stolen")
+	if err != nil || id.Status != StatusRevoked {
+		t.Fatalf("Revoke = %+v, %v", id, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stale cached pin is gone: the device is refused even with its key
+	if _, err := store.Authenticate("dev", key); err != ErrRevoked {
+		t.Fatalf("Authenticate after Revoke = %v, want ErrRevoked", err)
+	}
+	if !mr.Exists(cacheKey("dev")) {
+		t.Fatal("revoked identity not cached")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	key, priv := newKey(t)
+	other, _ := newKey(t)
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, SignedMessage("nonce", "dev")))
+	tests := []struct {
+		name                       string
+		key, nonce, device, signed string
+		want                       error
+	}{
+		{"valid", key, "nonce", "dev", sig, nil},
+		{"other nonce", key, "nonce2", "dev", sig, ErrBadSignature},
+		{"other device", key, "nonce", "dev2", sig, ErrBadSignature},
+		{"other key", other, "nonce", "dev", sig, ErrBadSignature},
+		{"short signature", key, "nonce", "dev", "c2ln", ErrBadSignature},
+		{"bad key", "!!", "nonce", "dev", sig, ErrBadKey},
+	}
+	for _, tt := range tests {
+		if err := Verify(tt.key, tt.nonce, tt.device, tt.signed); err != tt.want {
+			t.Errorf("%s: Verify = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for in, want := range map[string]Mode{"": ModeOptional, " Required ": ModeRequired, "off": ModeOff, "optional": ModeOptional} {
+		if got, err := ParseMode(in); err != nil || got != want {
+			t.Errorf("ParseMode(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseMode("strict"); err == nil {
+		t.Error("ParseMode(strict) accepted")
+	}
+}
@@ -0,0 +1,133 @@
+package ipintel
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CSV databases have a header row naming their columns. Ranges are given as
+// a CIDR in "network" or as "start_ip" and "end_ip"; the other recognized
+// columns are asn ("AS7922" or "7922"), isp, connection_type, carrier,
+// country, city, region, postal (or zip), latitude and longitude. Ranges must
+// not overlap.
+//
+//	network,asn,isp,connection_type,carrier,country
+//	203.0.113.0/24,AS64500,Example Mobile,cellular,Example Mobile,US
+
+type csvRange struct {
+	start, end net.IP // 16-byte form
+	rec        *Record
+}
+
+type csvSource struct {
+	ranges []csvRange // sorted by start
+}
+
+func parseCSV(data []byte) (*csvSource, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	cols := make(map[string]int, len(header))
+	for i, name := range header {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	_, hasNetwork := cols["network"]
+	_, hasStart := cols["start_ip"]
+	if !hasNetwork && !hasStart {
+		return nil, fmt.Errorf("no network or start_ip column")
+	}
+
+	src := &csvSource{}
+	for line := 2; ; line++ {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		field := func(name string) string {
+			if i, ok := cols[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+
+		var start, end net.IP
+		if network := field("network"); network != "" {
+			_, ipNet, err := net.ParseCIDR(network)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			start, end = ipNet.IP.To16(), lastIP(ipNet)
+		} else {
+			start, end = net.ParseIP(field("start_ip")).To16(), net.ParseIP(field("end_ip")).To16()
+			if start == nil || end == nil {
+				return nil, fmt.Errorf("line %d: bad start_ip/end_ip", line)
+			}
+		}
+
+		rec := &Record{
+			ISP:            field("isp"),
+			ConnectionType: NormalizeConnectionType(field("connection_type")),
+			Carrier:        field("carrier"),
+			Country:        strings.ToUpper(field("country")),
+			City:           field("city"),
+			Region:         field("region"),
+			PostalCode:     field("postal"),
+		}
+		if rec.PostalCode == "" {
+			rec.PostalCode = field("zip")
+		}
+		rec.Latitude, _ = strconv.ParseFloat(field("latitude"), 64)
+		rec.Longitude, _ = strconv.ParseFloat(field("longitude"), 64)
+		if asn := field("asn"); asn != "" {
+			rec.ASN, _ = strconv.Atoi(strings.TrimPrefix(strings.ToUpper(asn), "AS"))
+		}
+		src.ranges = append(src.ranges, csvRange{start: start, end: end, rec: rec})
+	}
+
+	sort.Slice(src.ranges, func(i, j int) bool {
+		return bytes.Compare(src.ranges[i].start, src.ranges[j].start) < 0
+	})
+	return src, nil
+}
+
+func (s *csvSource) lookup(ip net.IP) *Record {
+	ip = ip.To16()
+	// Last range starting at or before ip
+	i := sort.Search(len(s.ranges), func(i int) bool {
+		return bytes.Compare(s.ranges[i].start, ip) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(ip, s.ranges[i].end) > 0 {
+		return nil
+	}
+	rec := *s.ranges[i].rec
+	return &rec
+}
+
+// lastIP returns the last address of a network in 16-byte form
+func lastIP(n *net.IPNet) net.IP {
+	ip := n.IP.To16()
+	mask := n.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+	last := make(net.IP, net.IPv6len)
+	for i := range ip {
+		last[i] = ip[i] | ^mask[i]
+	}
+	return last
+}
@@ -0,0 +1,220 @@
+// Package ipintel answers network questions about node IPs (ASN, ISP,
+// connection type, carrier and, when the files carry it, location and postal
+// code) from
+// offline databases on disk instead of live lookup APIs.
+package ipintel
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reloadInterval is how often the database files are checked for changes
+const reloadInterval = time.Minute
+
+// Connection types nodes are classified into
+const (
+	ConnMobile      = "mobile"
+	ConnResidential = "residential"
+	ConnDatacenter  = "datacenter"
+)
+
+// Record is what the databases know about an IP. Empty fields are unknown.
+type Record struct {
+	ASN            int     `json:"asn,omitempty"`
+	ISP            string  `json:"isp,omitempty"`
+	ConnectionType string  `json:"connection_type,omitempty"` // one of the Conn* types
+	Carrier        string  `json:"carrier,omitempty"`
+	Country        string  `json:"country,omitempty"`
+	City           string  `json:"city,omitempty"`
+	Region         string  `json:"region,omitempty"`
+	PostalCode     string  `json:"postal_code,omitempty"`
+	Latitude       float64 `json:"latitude,omitempty"`
+	Longitude      float64 `json:"longitude,omitempty"`
+}
+
+// merge fills r's unknown fields from o
+func (r *Record) merge(o *Record) {
+	if r.ASN == 0 {
+		r.ASN = o.ASN
+	}
+	if r.ISP == "" {
+		r.ISP = o.ISP
+	}
+	if r.ConnectionType == "" {
+		r.ConnectionType = o.ConnectionType
+	}
+	if r.Carrier == "" {
+		r.Carrier = o.Carrier
+	}
+	if r.Country == "" {
+		r.Country, r.City, r.Region, r.PostalCode = o.Country, o.City, o.Region, o.PostalCode
+		r.Latitude, r.Longitude = o.Latitude, o.Longitude
+	}
+}
+
+// source is one loaded database file
+type source interface {
+	lookup(ip net.IP) *Record
+}
+
+// DB serves lookups from a set of MaxMind-format (.mmdb) or CSV files,
+// consulted in order with earlier files winning, and picks up replaced files
+// without a restart. A failed reload keeps the previous data.
+type DB struct {
+	files  []string
+	logger *logrus.Entry
+
+	mu      sync.RWMutex
+	sources []source
+	modTime time.Time
+}
+
+func NewDB(files []string, logger *logrus.Entry) (*DB, error) {
+	db := &DB{
+		files:  files,
+		logger: logger.WithField("component", "ipintel"),
+	}
+	if err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload reads every database file
+func (db *DB) Reload() error {
+	modTime := latestModTime(db.files...)
+	sources := make([]source, 0, len(db.files))
+	for _, file := range db.files {
+		src, err := load(file)
+		if err != nil {
+			return fmt.Errorf("load %s: %w", file, err)
+		}
+		sources = append(sources, src)
+	}
+
+	db.mu.Lock()
+	db.sources = sources
+	db.modTime = modTime
+	db.mu.Unlock()
+
+	db.logger.Infof("Loaded %d IP intelligence databases", len(sources))
+	return nil
+}
+
+func load(file string) (source, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".mmdb":
+		return openMMDB(data)
+	case ".csv":
+		return parseCSV(data)
+	}
+	return nil, fmt.Errorf("unknown database format (want .mmdb or .csv)")
+}
+
+// Lookup returns what the databases know about ip, or nil
+func (db *DB) Lookup(ip string) *Record {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil
+	}
+	db.mu.RLock()
+	sources := db.sources
+	db.mu.RUnlock()
+
+	var rec *Record
+	for _, src := range sources {
+		found := src.lookup(parsed)
+		if found == nil {
+			continue
+		}
+		if rec == nil {
+			rec = found
+		} else {
+			rec.merge(found)
+		}
+	}
+	return rec
+}
+
+// Watch reloads the files whenever one changes, until stop is closed
+func (db *DB) Watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			db.mu.RLock()
+			seen := db.modTime
+			db.mu.RUnlock()
+			if !latestModTime(db.files...).After(seen) {
+				continue
+			}
+			if err := db.Reload(); err != nil {
+				db.logger.Errorf("IP intelligence reload failed, keeping previous: %v", err)
+			}
+		}
+	}
+}
+
+// latestModTime returns the newest modification time among files that exist
+func latestModTime(files ...string) time.Time {
+	var latest time.Time
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+// NormalizeConnectionType maps the connection and user types used by the
+// database vendors and SDKs onto the Conn* types, or "" when it doesn't say
+func NormalizeConnectionType(s string) string {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "mobile", "cellular", "wireless", "3g", "4g", "5g", "lte":
+		return ConnMobile
+	case "residential", "cable/dsl", "cable", "dsl", "fiber", "isp", "satellite", "consumer":
+		return ConnResidential
+	case "datacenter", "data center", "hosting", "dc", "content_delivery_network", "cdn":
+		return ConnDatacenter
+	}
+	return ""
+}
+
+// ispStopWords are left out of ISP tokens: legal forms and filler
+var ispStopWords = map[string]bool{
+	"llc": true, "inc": true, "ltd": true, "limited": true, "corp": true,
+	"corporation": true, "co": true, "company": true, "ag": true, "gmbh": true,
+	"sa": true, "plc": true, "srl": true, "bv": true, "the": true, "of": true,
+	"and": true,
+}
+
+// ISPTokens splits an ISP or carrier name into the lowercase words isp-
+// targeting matches on, so "Comcast Cable Communications, LLC" is found by
+// isp-comcast and isp-comcast.cable
+func ISPTokens(name string) []string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	})
+	tokens := words[:0]
+	for _, w := range words {
+		if len(w) >= 2 && !ispStopWords[w] {
+			tokens = append(tokens, w)
+		}
+	}
+	return tokens
+}
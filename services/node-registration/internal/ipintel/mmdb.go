@@ -0,0 +1,336 @@
+package ipintel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// A reader for MaxMind DB files (https://maxmind.github.io/MaxMind-DB/), enough
+// for the GeoLite2/GeoIP2 ASN, ISP, Connection-Type and City databases and the
+// ipinfo.io MMDB exports.
+
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+type mmdbReader struct {
+	tree       []byte
+	data       mmdbDecoder
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint // node reached after the 96 zero bits of ::/96
+}
+
+func openMMDB(buf []byte) (*mmdbReader, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("not a MaxMind DB file")
+	}
+	meta, _, err := mmdbDecoder(buf[i+len(mmdbMetadataMarker):]).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %w", err)
+	}
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("metadata is not a map")
+	}
+
+	r := &mmdbReader{
+		nodeCount:  uint(toUint(m["node_count"])),
+		recordSize: uint(toUint(m["record_size"])),
+		ipVersion:  uint(toUint(m["ip_version"])),
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+	treeSize := r.recordSize * 2 / 8 * r.nodeCount
+	if treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("search tree larger than file")
+	}
+	r.tree = buf[:treeSize]
+	r.data = mmdbDecoder(buf[treeSize+16 : i])
+
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for n := 0; n < 96 && node < r.nodeCount; n++ {
+			node = r.readNode(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+func (r *mmdbReader) readNode(node, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		b := r.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(r.tree[node*8+bit*4:]))
+	}
+}
+
+func (r *mmdbReader) lookup(ip net.IP) *Record {
+	bits := ip.To4()
+	node := uint(0)
+	switch {
+	case bits != nil && r.ipVersion == 6:
+		node = r.ipv4Start
+	case bits == nil && r.ipVersion == 4:
+		return nil
+	case bits == nil:
+		bits = ip.To16()
+	}
+
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		bit := uint(bits[i>>3]>>(7-uint(i&7))) & 1
+		node = r.readNode(node, bit)
+	}
+	if node <= r.nodeCount {
+		return nil // not in the database
+	}
+	v, _, err := r.data.decode(node - r.nodeCount - 16)
+	if err != nil {
+		return nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return recordFromMMDB(m)
+}
+
+// recordFromMMDB picks the fields we use out of the vendors' layouts
+func recordFromMMDB(m map[string]interface{}) *Record {
+	rec := &Record{}
+	fields := m
+	if traits, ok := m["traits"].(map[string]interface{}); ok {
+		// GeoIP2 Enterprise/Insights keep network data under traits
+		fields = traits
+		rec.ConnectionType = NormalizeConnectionType(toString(traits["user_type"]))
+	}
+
+	rec.ASN = int(toUint(fields["autonomous_system_number"]))
+	if asn := toString(fields["asn"]); rec.ASN == 0 && asn != "" {
+		rec.ASN, _ = strconv.Atoi(strings.TrimPrefix(strings.ToUpper(asn), "AS"))
+	}
+	for _, key := range []string{"isp", "autonomous_system_organization", "organization", "as_name", "name"} {
+		if rec.ISP = toString(fields[key]); rec.ISP != "" {
+			break
+		}
+	}
+	if rec.ConnectionType == "" {
+		rec.ConnectionType = NormalizeConnectionType(toString(fields["connection_type"]))
+	}
+	if rec.ConnectionType == "" {
+		rec.ConnectionType = NormalizeConnectionType(toString(fields["type"]))
+	}
+	rec.Carrier = toString(fields["carrier"])
+	if _, mobile := fields["mobile_network_code"]; mobile {
+		// GeoIP2-ISP marks carrier networks with their MCC/MNC
+		if rec.Carrier == "" {
+			rec.Carrier = rec.ISP
+		}
+		rec.ConnectionType = ConnMobile
+	}
+
+	if country, ok := m["country"].(map[string]interface{}); ok {
+		rec.Country = toString(country["iso_code"])
+	} else if code := toString(m["country_code"]); code != "" {
+		rec.Country = code
+	}
+	if city, ok := m["city"].(map[string]interface{}); ok {
+		if names, ok := city["names"].(map[string]interface{}); ok {
+			rec.City = toString(names["en"])
+		}
+	}
+	if subs, ok := m["subdivisions"].([]interface{}); ok && len(subs) > 0 {
+		if sub, ok := subs[0].(map[string]interface{}); ok {
+			// Names, like the live lookups report
+			if names, ok := sub["names"].(map[string]interface{}); ok {
+				rec.Region = toString(names["en"])
+			}
+			if rec.Region == "" {
+				rec.Region = toString(sub["iso_code"])
+			}
+		}
+	}
+	if postal, ok := m["postal"].(map[string]interface{}); ok {
+		rec.PostalCode = toString(postal["code"])
+	} else {
+		rec.PostalCode = toString(m["postal_code"])
+	}
+	if loc, ok := m["location"].(map[string]interface{}); ok {
+		rec.Latitude, _ = loc["latitude"].(float64)
+		rec.Longitude, _ = loc["longitude"].(float64)
+	}
+	return rec
+}
+
+// mmdbDecoder decodes the data section (or the metadata, which uses the same
+// encoding). Offsets are relative to the start of the section.
+type mmdbDecoder []byte
+
+func (d mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	if offset >= uint(len(d)) {
+		return nil, 0, fmt.Errorf("offset %d past end of data", offset)
+	}
+	ctrl := d[offset]
+	offset++
+	typ := ctrl >> 5
+
+	if typ == 1 {
+		ptr, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ptr < uint(len(d)) && d[ptr]>>5 == 1 {
+			return nil, 0, fmt.Errorf("pointer to pointer at %d", ptr)
+		}
+		v, _, err := d.decode(ptr)
+		return v, next, err
+	}
+	if typ == 0 {
+		if offset >= uint(len(d)) {
+			return nil, 0, fmt.Errorf("truncated extended type")
+		}
+		typ = 7 + d[offset]
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d)) {
+			return nil, 0, fmt.Errorf("truncated size")
+		}
+		b := d[offset : offset+n]
+		switch n {
+		case 1:
+			size = 29 + uint(b[0])
+		case 2:
+			size = 285 + (uint(b[0])<<8 | uint(b[1]))
+		case 3:
+			size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		}
+		offset += n
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			v, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[toString(k)] = v
+			offset = next
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case 14: // boolean, value in the size
+		return size != 0, offset, nil
+	case 12, 13: // data cache container, end marker
+		return nil, offset, nil
+	}
+
+	if offset+size > uint(len(d)) {
+		return nil, 0, fmt.Errorf("value past end of data")
+	}
+	b := d[offset : offset+size]
+	offset += size
+	switch typ {
+	case 2: // UTF-8 string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, fmt.Errorf("bad double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, fmt.Errorf("bad float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case 4: // bytes
+		return []byte(b), offset, nil
+	case 5, 6, 9, 10: // uint16, uint32, uint64, uint128 (low 64 bits)
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, offset, nil
+	case 8: // int32
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unknown data type %d", typ)
+}
+
+// pointer reads a pointer's target offset, returning it and the offset after
+// the pointer
+func (d mmdbDecoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	n := uint(ctrl>>3&0x3) + 1
+	if offset+n > uint(len(d)) {
+		return 0, 0, fmt.Errorf("truncated pointer")
+	}
+	b := d[offset : offset+n]
+	v := uint(ctrl & 0x7)
+	var ptr uint
+	switch n {
+	case 1:
+		ptr = v<<8 | uint(b[0])
+	case 2:
+		ptr = (v<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+	case 3:
+		ptr = (v<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+	case 4:
+		ptr = uint(binary.BigEndian.Uint32(b))
+	}
+	return ptr, offset + n, nil
+}
+
+func toUint(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int64:
+		if n > 0 {
+			return uint64(n)
+		}
+	}
+	return 0
+}
+
+func toString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
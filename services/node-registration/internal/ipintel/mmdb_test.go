@@ -0,0 +1,431 @@
+package ipintel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ─── Test encoder ──────────────────────────────────────────────────────────────
+//
+// Just enough of the MaxMind DB writer side to build files for the reader.
+
+// mmCtrl encodes a control byte with extended type and size bytes as needed
+func mmCtrl(typ byte, size int) []byte {
+	var first byte
+	var ext []byte
+	if typ <= 7 {
+		first = typ << 5
+	} else {
+		ext = []byte{typ - 7}
+	}
+	var sizeBytes []byte
+	switch {
+	case size < 29:
+		first |= byte(size)
+	case size < 285:
+		first |= 29
+		sizeBytes = []byte{byte(size - 29)}
+	case size < 65821:
+		first |= 30
+		n := size - 285
+		sizeBytes = []byte{byte(n >> 8), byte(n)}
+	default:
+		first |= 31
+		n := size - 65821
+		sizeBytes = []byte{byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+	out := append([]byte{first}, ext...)
+	return append(out, sizeBytes...)
+}
+
+func mmString(s string) []byte {
+	return append(mmCtrl(2, len(s)), s...)
+}
+
+// mmUint encodes v as a uint16 (5), uint32 (6) or uint64 (9) with leading zeros dropped
+func mmUint(typ byte, v uint64) []byte {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	return append(mmCtrl(typ, len(b)), b...)
+}
+
+func mmDouble(f float64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(f))
+	return append(mmCtrl(3, 8), b...)
+}
+
+// mmMap encodes alternating already-encoded keys and values
+func mmMap(kv ...[]byte) []byte {
+	out := mmCtrl(7, len(kv)/2)
+	for _, b := range kv {
+		out = append(out, b...)
+	}
+	return out
+}
+
+// mmPointer encodes a pointer to offset using the smallest form
+func mmPointer(offset int) []byte {
+	switch {
+	case offset < 2048:
+		return []byte{0x20 | byte(offset>>8), byte(offset)}
+	case offset < 526336:
+		n := offset - 2048
+		return []byte{0x28 | byte(n>>16), byte(n >> 8), byte(n)}
+	case offset < 134744064:
+		n := offset - 526336
+		return []byte{0x30 | byte(n>>24), byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+	b := []byte{0x38, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], uint32(offset))
+	return b
+}
+
+// testTree is a search tree under construction. Child values >= 0 are nodes,
+// -1 is empty and <= -2 is data offset -(v+2).
+type testTree struct {
+	nodes [][2]int
+}
+
+func (t *testTree) insert(bits []byte, dataOffset int) {
+	if len(t.nodes) == 0 {
+		t.nodes = append(t.nodes, [2]int{-1, -1})
+	}
+	node := 0
+	for i, bit := range bits {
+		if i == len(bits)-1 {
+			t.nodes[node][bit] = -(dataOffset + 2)
+			return
+		}
+		next := t.nodes[node][bit]
+		if next < 0 {
+			t.nodes = append(t.nodes, [2]int{-1, -1})
+			next = len(t.nodes) - 1
+			t.nodes[node][bit] = next
+		}
+		node = next
+	}
+}
+
+// encode writes the tree with the given record size
+func (t *testTree) encode(recordSize int) []byte {
+	count := len(t.nodes)
+	value := func(v int) uint32 {
+		switch {
+		case v >= 0:
+			return uint32(v)
+		case v == -1:
+			return uint32(count)
+		}
+		return uint32(count + 16 - (v + 2))
+	}
+	var out []byte
+	for _, n := range t.nodes {
+		l, r := value(n[0]), value(n[1])
+		switch recordSize {
+		case 24:
+			out = append(out, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			out = append(out, byte(l>>16), byte(l>>8), byte(l), byte(l>>24)<<4|byte(r>>24)&0x0F,
+				byte(r>>16), byte(r>>8), byte(r))
+		case 32:
+			out = binary.BigEndian.AppendUint32(out, l)
+			out = binary.BigEndian.AppendUint32(out, r)
+		}
+	}
+	return out
+}
+
+// prefixBits returns the leading bits of cidr's network, 16-byte form for IPv6 databases
+func prefixBits(t *testing.T, cidr string, ipVersion int) []byte {
+	t.Helper()
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("parse %s: %v", cidr, err)
+	}
+	ones, _ := network.Mask.Size()
+	addr := network.IP.To4()
+	if addr == nil || ipVersion == 6 {
+		if addr != nil {
+			// IPv4 networks live under ::/96 in IPv6 databases
+			addr = append(make([]byte, 12), addr...)
+			ones += 96
+		} else {
+			addr = network.IP.To16()
+		}
+	}
+	bits := make([]byte, ones)
+	for i := range bits {
+		bits[i] = addr[i/8] >> (7 - uint(i%8)) & 1
+	}
+	return bits
+}
+
+// buildMMDB assembles a database file from networks mapped to data offsets
+func buildMMDB(t *testing.T, ipVersion, recordSize int, data []byte, networks map[string]int) []byte {
+	t.Helper()
+	tree := &testTree{}
+	for cidr, offset := range networks {
+		tree.insert(prefixBits(t, cidr, ipVersion), offset)
+	}
+	return assembleMMDB(tree.encode(recordSize), data, len(tree.nodes), recordSize, ipVersion)
+}
+
+// assembleMMDB lays out tree, data and metadata, which need not agree
+func assembleMMDB(tree, data []byte, nodeCount, recordSize, ipVersion int) []byte {
+	var file []byte
+	file = append(file, tree...)
+	file = append(file, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, mmdbMetadataMarker...)
+	file = append(file, mmMap(
+		mmString("node_count"), mmUint(6, uint64(nodeCount)),
+		mmString("record_size"), mmUint(5, uint64(recordSize)),
+		mmString("ip_version"), mmUint(5, uint64(ipVersion)),
+		mmString("database_type"), mmString("Test-ISP"),
+	)...)
+	return file
+}
+
+// ─── Decoder ───────────────────────────────────────────────────────────────────
+
+func TestMMDBDecodeTypes(t *testing.T) {
+	negative := []byte{0x04, 0x01, 0xFF, 0xFF, 0xFF, 0xFE} // int32 -2
+	float := []byte{0x04, 0x08, 0x3F, 0xC0, 0x00, 0x00}    // float 1.5
+	uint128 := append([]byte{0x10, 0x03}, bytes.Repeat([]byte{0xAB}, 16)...)
+	tests := []struct {
+		name string
+		enc  []byte
+		want interface{}
+	}{
+		{"string", mmString("Comcast"), "Comcast"},
+		{"empty string", mmString(""), ""},
+		{"size 29", mmString(strings.Repeat("a", 29)), strings.Repeat("a", 29)},
+		{"size 284", mmString(strings.Repeat("b", 284)), strings.Repeat("b", 284)},
+		{"size 285", mmString(strings.Repeat("c", 285)), strings.Repeat("c", 285)},
+		{"size 65821", mmString(strings.Repeat("d", 65821)), strings.Repeat("d", 65821)},
+		{"double", mmDouble(-33.8688), -33.8688},
+		{"float", float, 1.5},
+		{"bytes", append(mmCtrl(4, 3), 1, 2, 3), []byte{1, 2, 3}},
+		{"uint16", mmUint(5, 443), uint64(443)},
+		{"uint32 zero", mmUint(6, 0), uint64(0)},
+		{"uint64", mmUint(9, 1<<40), uint64(1 << 40)},
+		{"uint128 low bits", uint128, uint64(0xABABABABABABABAB)},
+		{"int32 negative", negative, int64(-2)},
+		{"boolean true", mmCtrl(14, 1), true},
+		{"boolean false", mmCtrl(14, 0), false},
+		{"array", append(mmCtrl(11, 2), append(mmString("a"), mmUint(5, 7)...)...), []interface{}{"a", uint64(7)}},
+		{"map", mmMap(mmString("iso_code"), mmString("DE")), map[string]interface{}{"iso_code": "DE"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, next, err := mmdbDecoder(tt.enc).decode(0)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("decode = %#v, want %#v", got, tt.want)
+			}
+			if next != uint(len(tt.enc)) {
+				t.Fatalf("next offset = %d, want %d", next, len(tt.enc))
+			}
+		})
+	}
+}
+
+func TestMMDBDecodePointers(t *testing.T) {
+	// Targets for each of the four pointer sizes; the 32-bit form is a plain offset
+	targets := []int{0x123, 3000, 600000, 40}
+	data := make([]byte, targets[2]+16)
+	for i, off := range targets {
+		copy(data[off:], mmString(string(rune('A'+i))))
+	}
+
+	tests := []struct {
+		ptr  []byte
+		want string
+	}{
+		{[]byte{0x21, 0x23}, "A"},                   // size 0: 0x123
+		{[]byte{0x28, 0x03, 0xB8}, "B"},             // size 1: 952 + 2048
+		{[]byte{0x30, 0x01, 0x1F, 0xC0}, "C"},       // size 2: 73664 + 526336
+		{[]byte{0x38, 0x00, 0x00, 0x00, 0x28}, "D"}, // size 3: raw 32 bits
+	}
+	for i, tt := range tests {
+		if got := mmPointer(targets[i]); i < 3 && !bytes.Equal(got, tt.ptr) {
+			t.Fatalf("test encoder: pointer to %d = % x, want % x", targets[i], got, tt.ptr)
+		}
+		d := append([]byte(nil), data...)
+		at := 8 // free space at the start of data
+		copy(d[at:], tt.ptr)
+		v, next, err := mmdbDecoder(d).decode(uint(at))
+		if err != nil {
+			t.Fatalf("pointer % x: %v", tt.ptr, err)
+		}
+		if v != tt.want {
+			t.Fatalf("pointer % x = %v, want %s", tt.ptr, v, tt.want)
+		}
+		// Decoding continues after the pointer, not after what it points at
+		if next != uint(at+len(tt.ptr)) {
+			t.Fatalf("pointer % x: next = %d, want %d", tt.ptr, next, at+len(tt.ptr))
+		}
+	}
+}
+
+func TestMMDBDecodePointerInMap(t *testing.T) {
+	var d []byte
+	d = append(d, mmString("isp")...)
+	ispAt := len(d)
+	d = append(d, mmString("Example ISP")...)
+	mapAt := len(d)
+	d = append(d, mmMap(mmPointer(0), mmPointer(ispAt), mmString("asn"), mmString("AS64500"))...)
+
+	v, next, err := mmdbDecoder(d).decode(uint(mapAt))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	want := map[string]interface{}{"isp": "Example ISP", "asn": "AS64500"}
+	if !reflect.DeepEqual(v, want) {
+		t.Fatalf("decode = %#v, want %#v", v, want)
+	}
+	if next != uint(len(d)) {
+		t.Fatalf("next = %d, want %d", next, len(d))
+	}
+}
+
+func TestMMDBDecodeErrors(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":              nil,
+		"pointer to pointer": append(mmPointer(2), mmPointer(0)...),
+		"truncated pointer":  {0x38, 0x00},
+		"pointer past end":   {0x20, 0x40},
+		"truncated size":     {0x5D},
+		"truncated string":   {0x45, 'a', 'b'},
+		"truncated extended": {0x00},
+		"bad double":         {0x64, 0, 0, 0, 0},
+		"truncated map":      mmCtrl(7, 2),
+		"unknown type":       {0x00, 0x10},
+	}
+	for name, enc := range tests {
+		if v, _, err := mmdbDecoder(enc).decode(0); err == nil {
+			t.Errorf("%s: decoded %#v, want error", name, v)
+		}
+	}
+}
+
+// ─── Search tree ───────────────────────────────────────────────────────────────
+
+// testData is a data section where the records share strings through pointers
+func testData() (data []byte, geoRec, hostingRec int) {
+	data = append(data, mmString("isp")...)
+	ispAt := len(data)
+	data = append(data, mmString("Example Cable")...)
+
+	geoRec = len(data)
+	data = append(data, mmMap(
+		mmString("autonomous_system_number"), mmUint(6, 64500),
+		mmPointer(0), mmPointer(ispAt),
+		mmString("connection_type"), mmString("Cable/DSL"),
+		mmString("country"), mmMap(mmString("iso_code"), mmString("US")),
+		mmString("city"), mmMap(mmString("names"), mmMap(mmString("en"), mmString("Denver"))),
+		mmString("location"), mmMap(mmString("latitude"), mmDouble(39.7392), mmString("longitude"), mmDouble(-104.9903)),
+	)...)
+
+	hostingRec = len(data)
+	data = append(data, mmMap(
+		mmString("traits"), mmMap(
+			mmString("autonomous_system_number"), mmUint(6, 64501),
+			mmPointer(0), mmString("Example Hosting"),
+			mmString("user_type"), mmString("hosting"),
+		),
+	)...)
+	return data, geoRec, hostingRec
+}
+
+func TestMMDBLookup(t *testing.T) {
+	data, geoRec, hostingRec := testData()
+	for _, ipVersion := range []int{4, 6} {
+		for _, recordSize := range []int{24, 28, 32} {
+			networks := map[string]int{
+				"198.51.100.0/24":  geoRec,
+				"203.0.113.128/25": hostingRec,
+			}
+			if ipVersion == 6 {
+				networks["2001:db8::/32"] = hostingRec
+			}
+			r, err := openMMDB(buildMMDB(t, ipVersion, recordSize, data, networks))
+			if err != nil {
+				t.Fatalf("v%d/%d: open: %v", ipVersion, recordSize, err)
+			}
+
+			rec := r.lookup(net.ParseIP("198.51.100.7"))
+			want := &Record{
+				ASN: 64500, ISP: "Example Cable", ConnectionType: ConnResidential,
+				Country: "US", City: "Denver", Latitude: 39.7392, Longitude: -104.9903,
+			}
+			if !reflect.DeepEqual(rec, want) {
+				t.Fatalf("v%d/%d: 198.51.100.7 = %+v, want %+v", ipVersion, recordSize, rec, want)
+			}
+
+			rec = r.lookup(net.ParseIP("203.0.113.200"))
+			if rec == nil || rec.ASN != 64501 || rec.ISP != "Example Hosting" || rec.ConnectionType != ConnDatacenter {
+				t.Fatalf("v%d/%d: 203.0.113.200 = %+v", ipVersion, recordSize, rec)
+			}
+
+			for _, ip := range []string{"203.0.113.127", "198.51.101.1", "8.8.8.8"} {
+				if rec := r.lookup(net.ParseIP(ip)); rec != nil {
+					t.Fatalf("v%d/%d: %s = %+v, want not found", ipVersion, recordSize, ip, rec)
+				}
+			}
+
+			rec = r.lookup(net.ParseIP("2001:db8::1"))
+			if ipVersion == 4 && rec != nil {
+				t.Fatalf("v4/%d: IPv6 lookup = %+v, want nil", recordSize, rec)
+			}
+			if ipVersion == 6 && (rec == nil || rec.ASN != 64501) {
+				t.Fatalf("v6/%d: 2001:db8::1 = %+v", recordSize, rec)
+			}
+		}
+	}
+}
+
+func TestMMDBLargeRecordValues(t *testing.T) {
+	// Push the data offset past 24 bits so 28-bit records need their shared nibble
+	data := make([]byte, 1<<24+128)
+	copy(data[len(data)-64:], mmMap(mmString("asn"), mmString("AS64502")))
+	r, err := openMMDB(buildMMDB(t, 4, 28, data, map[string]int{"192.0.2.0/24": len(data) - 64}))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if rec := r.lookup(net.ParseIP("192.0.2.1")); rec == nil || rec.ASN != 64502 {
+		t.Fatalf("192.0.2.1 = %+v, want ASN 64502", rec)
+	}
+}
+
+func TestOpenMMDBRejectsBadFiles(t *testing.T) {
+	data, geoRec, _ := testData()
+	tree := &testTree{}
+	tree.insert(prefixBits(t, "198.51.100.0/24", 4), geoRec)
+	nodes := tree.encode(24)
+
+	good := assembleMMDB(nodes, data, len(tree.nodes), 24, 4)
+	if _, err := openMMDB(good); err != nil {
+		t.Fatalf("open good file: %v", err)
+	}
+	marker := bytes.LastIndex(good, mmdbMetadataMarker)
+	if _, err := openMMDB(good[:marker+4]); err == nil {
+		t.Fatal("opened a file without the metadata marker")
+	}
+	if _, err := openMMDB(assembleMMDB(nodes, data, len(tree.nodes), 20, 4)); err == nil {
+		t.Fatal("opened a file with record size 20")
+	}
+	if _, err := openMMDB(assembleMMDB(nodes, data, 1<<20, 24, 4)); err == nil {
+		t.Fatal("opened a file whose tree is larger than the file")
+	}
+}
@@ -0,0 +1,363 @@
+// Package nodeconfig pushes configuration to nodes over the control channel.
+// An admin publishes a config document (tunnel buffer sizes, keepalive
+// interval, concurrency, feature flags) with a target; the gateway signs it
+// with its Ed25519 key and sends config_update to matching nodes, which
+// verify it against the key they were deployed with, apply it and answer
+// config_ack. Documents are numbered; a node runs the newest one targeting it.
+package nodeconfig
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"node-registration/internal/identity"
+	"node-registration/internal/versionpolicy"
+)
+
+// reloadInterval is how often documents published by other instances are
+// picked up
+const reloadInterval = time.Minute
+
+// signaturePrefix starts every signed config: prefix + version + ":" + payload
+const signaturePrefix = "iploop-node-config:v1:"
+
+// Node config states
+const (
+	StatusPushed   = "pushed"   // sent, not acknowledged yet
+	StatusApplied  = "applied"  // node runs this version
+	StatusRejected = "rejected" // node refused it (bad signature, invalid value...)
+)
+
+var (
+	ErrBadKey    = errors.New("CONFIG_SIGNING_KEY must be a base64 Ed25519 seed (32 bytes)")
+	ErrBadConfig = errors.New("config must be a JSON object")
+	ErrBadTarget = errors.New("invalid target SDK version")
+	ErrNotFound  = errors.New("no config state for device")
+)
+
+// Target selects the nodes a document applies to. Empty fields match every
+// node; SDK bounds are inclusive.
+type Target struct {
+	Countries     []string `json:"countries,omitempty"`
+	Platforms     []string `json:"platforms,omitempty"`
+	MinSDKVersion string   `json:"min_sdk_version,omitempty"`
+	MaxSDKVersion string   `json:"max_sdk_version,omitempty"`
+}
+
+// Matches reports whether a node with this country, platform and SDK version
+// is targeted
+func (t Target) Matches(country, platform, sdkVersion string) bool {
+	if len(t.Countries) > 0 && !containsFold(t.Countries, country) {
+		return false
+	}
+	if len(t.Platforms) > 0 && !containsFold(t.Platforms, platform) {
+		return false
+	}
+	if t.MinSDKVersion == "" && t.MaxSDKVersion == "" {
+		return true
+	}
+	v, ok := versionpolicy.Parse(sdkVersion)
+	if !ok {
+		return false
+	}
+	if min, ok := versionpolicy.Parse(t.MinSDKVersion); ok && versionpolicy.Compare(v, min) < 0 {
+		return false
+	}
+	if max, ok := versionpolicy.Parse(t.MaxSDKVersion); ok && versionpolicy.Compare(v, max) > 0 {
+		return false
+	}
+	return true
+}
+
+func (t Target) validate() error {
+	for _, v := range []string{t.MinSDKVersion, t.MaxSDKVersion} {
+		if _, ok := versionpolicy.Parse(v); v != "" && !ok {
+			return ErrBadTarget
+		}
+	}
+	return nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(strings.TrimSpace(item), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Document is one published config. Payload is the exact JSON the signature
+// covers; nodes verify it before parsing.
+type Document struct {
+	Version   int64           `json:"version"`
+	Config    json.RawMessage `json:"config"`
+	Payload   string          `json:"-"`
+	Signature string          `json:"signature"` // base64
+	Target    Target          `json:"target"`
+	Note      string          `json:"note,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// NodeState is the config a device was last sent or reported running
+type NodeState struct {
+	DeviceID  string     `json:"device_id"`
+	Version   int64      `json:"version"`
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	PushedAt  *time.Time `json:"pushed_at,omitempty"`
+	AckedAt   *time.Time `json:"acked_at,omitempty"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// ParseSigningKey reads CONFIG_SIGNING_KEY
+func ParseSigningKey(s string) (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, ErrBadKey
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// SignedMessage is what the gateway signs for a document
+func SignedMessage(version int64, payload string) []byte {
+	return []byte(signaturePrefix + strconv.FormatInt(version, 10) + ":" + payload)
+}
+
+// Store keeps documents in node_configs and per-device state in
+// node_config_state, with the documents cached in memory
+type Store struct {
+	db     *sql.DB
+	key    ed25519.PrivateKey
+	logger *logrus.Entry
+
+	mu   sync.RWMutex
+	docs []*Document // newest first
+}
+
+// NewStore loads the published documents
+func NewStore(db *sql.DB, key ed25519.PrivateKey, logger *logrus.Entry) (*Store, error) {
+	s := &Store{
+		db:     db,
+		key:    key,
+		logger: logger.WithField("component", "node-config"),
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// PublicKey is the base64 key nodes verify documents with (--config-key)
+func (s *Store) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey))
+}
+
+// Fingerprint identifies the signing key in config_update and the admin API
+func (s *Store) Fingerprint() string {
+	return identity.Fingerprint(s.PublicKey())
+}
+
+// Reload reads the documents again
+func (s *Store) Reload() error {
+	rows, err := s.db.Query(`SELECT version, payload, signature, target, COALESCE(note, ''), created_at
+		FROM node_configs ORDER BY version DESC`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	docs := make([]*Document, 0)
+	for rows.Next() {
+		var doc Document
+		var target []byte
+		if err := rows.Scan(&doc.Version, &doc.Payload, &doc.Signature, &target, &doc.Note, &doc.CreatedAt); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(target, &doc.Target); err != nil {
+			s.logger.Warnf("Config %d has an unreadable target, skipping: %v", doc.Version, err)
+			continue
+		}
+		doc.Config = json.RawMessage(doc.Payload)
+		docs = append(docs, &doc)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.docs = docs
+	s.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the documents every reloadInterval until stop is closed
+func (s *Store) Watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := s.Reload(); err != nil {
+				s.logger.Errorf("Config reload failed, keeping previous: %v", err)
+			}
+		}
+	}
+}
+
+// Documents returns the published documents, newest first
+func (s *Store) Documents() []*Document {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*Document(nil), s.docs...)
+}
+
+// Publish signs config as the next version and stores it
+func (s *Store) Publish(config json.RawMessage, target Target, note string) (*Document, error) {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, config); err != nil || compact.Len() == 0 || compact.Bytes()[0] != '{' {
+		return nil, ErrBadConfig
+	}
+	if err := target.validate(); err != nil {
+		return nil, err
+	}
+	targetJSON, err := json.Marshal(target)
+	if err != nil {
+		return nil, err
+	}
+
+	// The version is part of what's signed, so take it before inserting
+	doc := &Document{Payload: compact.String(), Target: target, Note: note}
+	if err := s.db.QueryRow(`SELECT nextval(pg_get_serial_sequence('node_configs', 'version'))`).Scan(&doc.Version); err != nil {
+		return nil, err
+	}
+	doc.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, SignedMessage(doc.Version, doc.Payload)))
+	doc.Config = json.RawMessage(doc.Payload)
+	if err := s.db.QueryRow(`INSERT INTO node_configs (version, payload, signature, target, note)
+		VALUES ($1, $2, $3, $4, NULLIF($5, '')) RETURNING created_at`,
+		doc.Version, doc.Payload, doc.Signature, targetJSON, note).Scan(&doc.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.docs = append([]*Document{doc}, s.docs...)
+	sort.Slice(s.docs, func(i, j int) bool { return s.docs[i].Version > s.docs[j].Version })
+	s.mu.Unlock()
+	s.logger.Infof("Published config version %d (target %s)", doc.Version, targetJSON)
+	return doc, nil
+}
+
+// ForNode returns the newest document targeting the node, or nil
+func (s *Store) ForNode(country, platform, sdkVersion string) *Document {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, doc := range s.docs {
+		if doc.Target.Matches(country, platform, sdkVersion) {
+			return doc
+		}
+	}
+	return nil
+}
+
+// MarkPushed records that version was sent to the device
+func (s *Store) MarkPushed(deviceID string, version int64) error {
+	_, err := s.db.Exec(`INSERT INTO node_config_state (device_id, version, status, pushed_at)
+		VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (device_id) DO UPDATE SET version = $2, status = $3, error = NULL,
+			pushed_at = NOW(), updated_at = NOW()`, deviceID, version, StatusPushed)
+	return err
+}
+
+// Ack records the device's answer to a config_update, or the version it
+// reported running when it registered
+func (s *Store) Ack(deviceID string, version int64, status, errMsg string) error {
+	if status != StatusRejected {
+		status = StatusApplied
+	}
+	_, err := s.db.Exec(`INSERT INTO node_config_state (device_id, version, status, error, acked_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NOW())
+		ON CONFLICT (device_id) DO UPDATE SET version = $2, status = $3, error = NULLIF($4, ''),
+			acked_at = NOW(), updated_at = NOW()`, deviceID, version, status, errMsg)
+	return err
+}
+
+const stateColumns = `device_id, version, status, COALESCE(error, ''), pushed_at, acked_at, updated_at`
+
+func scanState(row interface{ Scan(...interface{}) error }) (*NodeState, error) {
+	var st NodeState
+	var pushedAt, ackedAt sql.NullTime
+	if err := row.Scan(&st.DeviceID, &st.Version, &st.Status, &st.Error, &pushedAt, &ackedAt, &st.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if pushedAt.Valid {
+		st.PushedAt = &pushedAt.Time
+	}
+	if ackedAt.Valid {
+		st.AckedAt = &ackedAt.Time
+	}
+	return &st, nil
+}
+
+// State returns the config state of one device
+func (s *Store) State(deviceID string) (*NodeState, error) {
+	st, err := scanState(s.db.QueryRow(`SELECT `+stateColumns+` FROM node_config_state WHERE device_id = $1`, deviceID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return st, err
+}
+
+// States lists device states, most recently changed first, optionally for
+// one version (0 = any) or status only
+func (s *Store) States(version int64, status string, limit int) ([]*NodeState, error) {
+	rows, err := s.db.Query(`SELECT `+stateColumns+` FROM node_config_state
+		WHERE ($1 = 0 OR version = $1) AND ($2 = '' OR status = $2)
+		ORDER BY updated_at DESC LIMIT $3`, version, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	states := make([]*NodeState, 0)
+	for rows.Next() {
+		st, err := scanState(rows)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, st)
+	}
+	return states, rows.Err()
+}
+
+// Counts returns how many devices are in each status per version
+func (s *Store) Counts() (map[int64]map[string]int, error) {
+	rows, err := s.db.Query(`SELECT version, status, COUNT(*) FROM node_config_state GROUP BY version, status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[int64]map[string]int)
+	for rows.Next() {
+		var version int64
+		var status string
+		var n int
+		if err := rows.Scan(&version, &status, &n); err != nil {
+			return nil, err
+		}
+		if counts[version] == nil {
+			counts[version] = make(map[string]int)
+		}
+		counts[version][status] = n
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,48 @@
+package nodemanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// NodeCaps are the limits an operator set on the node agent and how close
+// the node is to them. Zero limits are unlimited. The proxy gateway reads
+// them from the node record to avoid nodes near a cap.
+type NodeCaps struct {
+	MaxUpMbps   float64 `json:"max_up_mbps,omitempty"`
+	MaxDownMbps float64 `json:"max_down_mbps,omitempty"`
+	DailyGB     float64 `json:"daily_gb,omitempty"`
+	MonthlyGB   float64 `json:"monthly_gb,omitempty"`
+	MaxTunnels  int     `json:"max_tunnels,omitempty"`
+
+	UpMbps       float64   `json:"up_mbps"`
+	DownMbps     float64   `json:"down_mbps"`
+	DailyBytes   int64     `json:"daily_bytes"`
+	MonthlyBytes int64     `json:"monthly_bytes"`
+	OpenTunnels  int       `json:"open_tunnels"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Limited reports whether any cap is set
+func (c *NodeCaps) Limited() bool {
+	return c != nil && (c.MaxUpMbps > 0 || c.MaxDownMbps > 0 || c.DailyGB > 0 || c.MonthlyGB > 0 || c.MaxTunnels > 0)
+}
+
+// UpdateCaps replaces the node's caps and usage from a caps_usage report.
+// Redis only, like heartbeats.
+func (nm *NodeManager) UpdateCaps(nodeID string, caps *NodeCaps) error {
+	ctx := context.Background()
+	nodeData, err := nm.rdb.Get(ctx, nm.getRedisNodeKey(nodeID)).Result()
+	if err != nil {
+		return fmt.Errorf("node not found: %s", nodeID)
+	}
+	var node Node
+	if err := json.Unmarshal([]byte(nodeData), &node); err != nil {
+		return fmt.Errorf("failed to parse node data: %v", err)
+	}
+	caps.UpdatedAt = time.Now()
+	node.Caps = caps
+	return nm.storeNodeInRedis(&node)
+}
@@ -0,0 +1,122 @@
+package nodemanager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"node-registration/internal/ipintel"
+)
+
+// Secondary indexes the gateway narrows asn-, isp- and conn- targeting with:
+// Redis sets of node IDs, expiring with the node keys unless refreshed
+const (
+	asnIndexPrefix  = "nodes:asn:"
+	ispIndexPrefix  = "nodes:isp:"  // one set per ISP/carrier name token
+	connIndexPrefix = "nodes:conn:" // ipintel connection types
+	nodeIndexTTL    = 6 * time.Minute
+)
+
+// SetIPIntel makes registrations take network data from an offline IP
+// database instead of trusting the SDK and live lookups alone
+func (nm *NodeManager) SetIPIntel(db *ipintel.DB) {
+	nm.intel = db
+}
+
+// LookupIPIntel returns what the offline IP database knows about ip, or nil
+func (nm *NodeManager) LookupIPIntel(ip string) *ipintel.Record {
+	if nm.intel == nil {
+		return nil
+	}
+	return nm.intel.Lookup(ip)
+}
+
+// applyIPIntel fills a node's network data from the offline IP database. The
+// database wins for ASN, ISP, connection type and carrier; location is only
+// filled in when the node has none, and coordinates and postal code when the
+// database agrees on the country.
+func (nm *NodeManager) applyIPIntel(node *Node) {
+	rec := nm.LookupIPIntel(node.IPAddress)
+	if rec == nil {
+		return
+	}
+	if rec.ASN != 0 {
+		node.ASN = rec.ASN
+	}
+	if rec.ISP != "" {
+		node.ISP = rec.ISP
+	}
+	if rec.ConnectionType != "" {
+		node.ConnectionType = rec.ConnectionType
+	}
+	if rec.Carrier != "" {
+		node.Carrier = rec.Carrier
+	}
+	if node.Country == "" && rec.Country != "" {
+		node.Country, node.CountryName = rec.Country, rec.Country
+		node.City, node.Region = rec.City, rec.Region
+		node.Latitude, node.Longitude = rec.Latitude, rec.Longitude
+		node.PostalCode = rec.PostalCode
+		return
+	}
+	if rec.Country != node.Country {
+		return
+	}
+	if node.Latitude == 0 && node.Longitude == 0 {
+		node.Latitude, node.Longitude = rec.Latitude, rec.Longitude
+	}
+	if node.PostalCode == "" {
+		node.PostalCode = rec.PostalCode
+	}
+}
+
+// nodeIndexKeys returns the secondary index sets a node belongs in
+func nodeIndexKeys(node *Node) []string {
+	var keys []string
+	if node.ASN > 0 {
+		keys = append(keys, fmt.Sprintf("%s%d", asnIndexPrefix, node.ASN))
+	}
+	seen := make(map[string]bool)
+	for _, name := range []string{node.ISP, node.Carrier} {
+		for _, token := range ipintel.ISPTokens(name) {
+			if !seen[token] {
+				seen[token] = true
+				keys = append(keys, ispIndexPrefix+token)
+			}
+		}
+	}
+	if conn := ipintel.NormalizeConnectionType(node.ConnectionType); conn != "" {
+		keys = append(keys, connIndexPrefix+conn)
+	}
+	return keys
+}
+
+// indexNode adds the node to its index sets
+func (nm *NodeManager) indexNode(node *Node) {
+	ctx := context.Background()
+	pipe := nm.rdb.Pipeline()
+	for _, key := range nodeIndexKeys(node) {
+		pipe.SAdd(ctx, key, node.ID)
+		pipe.Expire(ctx, key, nodeIndexTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		nm.logger.Warnf("Failed to index node %s: %v", node.ID, err)
+	}
+}
+
+// unindexNode removes the node from the index sets it was in, except those
+// in keep (its sets after a re-registration)
+func (nm *NodeManager) unindexNode(node *Node, keep []string) {
+	ctx := context.Background()
+	kept := make(map[string]bool, len(keep))
+	for _, key := range keep {
+		kept[key] = true
+	}
+	pipe := nm.rdb.Pipeline()
+	for _, key := range nodeIndexKeys(node) {
+		if !kept[key] {
+			pipe.SRem(ctx, key, node.ID)
+		}
+	}
+	pipe.Exec(ctx)
+}
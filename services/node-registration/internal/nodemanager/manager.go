@@ -11,6 +11,8 @@ import (
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+
+	"node-registration/internal/ipintel"
 )
 
 type NodeManager struct {
@@ -21,6 +23,9 @@ type NodeManager struct {
 	// Batch sync: collect dirty node IDs, flush to Postgres periodically
 	dirtyMu    sync.Mutex
 	dirtyNodes map[string]bool // node IDs that need Postgres sync
+
+	// Offline IP intelligence, see SetIPIntel
+	intel *ipintel.DB
 }
 
 type Node struct {
@@ -33,6 +38,7 @@ type Node struct {
 	Region         string    `json:"region"`
 	Latitude       float64   `json:"latitude"`
 	Longitude      float64   `json:"longitude"`
+	PostalCode     string    `json:"postal_code,omitempty"`
 	ASN            int       `json:"asn"`
 	ISP            string    `json:"isp"`
 	Carrier        string    `json:"carrier"`
@@ -48,6 +54,11 @@ type Node struct {
 	ConnectedSince time.Time `json:"connected_since"`
 	CreatedAt      time.Time `json:"created_at"`
 	UpdatedAt      time.Time `json:"updated_at"`
+
+	Caps *NodeCaps `json:"caps,omitempty"` // operator caps and usage, see UpdateCaps
+
+	Schedule    *NodeSchedule `json:"schedule,omitempty"`     // operator sharing hours, see SetAvailability
+	AvailableAt *time.Time    `json:"available_at,omitempty"` // when a scheduled-off or paused node comes back
 }
 
 type NodeRegistration struct {
@@ -59,24 +70,33 @@ type NodeRegistration struct {
 	Region         string  `json:"region"`
 	Latitude       float64 `json:"latitude"`
 	Longitude      float64 `json:"longitude"`
+	PostalCode     string  `json:"postal_code,omitempty"`
 	ASN            int     `json:"asn"`
 	ISP            string  `json:"isp"`
 	Carrier        string  `json:"carrier"`
 	ConnectionType string  `json:"connection_type"`
 	DeviceType     string  `json:"device_type"`
 	SDKVersion     string  `json:"sdk_version"`
+
+	Caps *NodeCaps `json:"caps,omitempty"`
+
+	Schedule     *NodeSchedule     `json:"schedule,omitempty"`
+	Availability *NodeAvailability `json:"availability,omitempty"`
 }
 
 type Statistics struct {
 	TotalNodes      int            `json:"total_nodes"`
 	ActiveNodes     int            `json:"active_nodes"`
 	InactiveNodes   int            `json:"inactive_nodes"`
+	ScheduledOffNodes int          `json:"scheduled_off_nodes"` // connected but outside sharing hours or paused
 	CountryBreakdown map[string]int `json:"country_breakdown"`
 	DeviceTypes     map[string]int `json:"device_types"`
 	ConnectionTypes map[string]int `json:"connection_types"`
 	AverageQuality  float64        `json:"average_quality"`
 	TotalBandwidth  int64          `json:"total_bandwidth_mb"`
 	UpdatedAt       time.Time      `json:"updated_at"`
+
+	SDKVersions map[string]map[string]int `json:"sdk_versions"` // device type -> SDK version -> nodes
 }
 
 func NewNodeManager(db *sql.DB, rdb *redis.Client, logger *logrus.Entry) *NodeManager {
@@ -160,8 +180,11 @@ func (nm *NodeManager) RegisterNode(registration *NodeRegistration) (*Node, erro
 		}
 	}
 
+	var prev *Node
 	if node != nil {
 		// Update existing node
+		previous := *node
+		prev = &previous
 		node.IPAddress = registration.IPAddress
 		node.Country = registration.Country
 		node.CountryName = registration.CountryName
@@ -169,13 +192,14 @@ func (nm *NodeManager) RegisterNode(registration *NodeRegistration) (*Node, erro
 		node.Region = registration.Region
 		node.Latitude = registration.Latitude
 		node.Longitude = registration.Longitude
+		node.PostalCode = registration.PostalCode
 		node.ASN = registration.ASN
 		node.ISP = registration.ISP
 		node.Carrier = registration.Carrier
 		node.ConnectionType = registration.ConnectionType
 		node.DeviceType = registration.DeviceType
 		node.SDKVersion = registration.SDKVersion
-		node.Status = "available"
+		node.Status = registration.Availability.status()
 		node.LastHeartbeat = now
 		node.ConnectedSince = now
 		node.UpdatedAt = now
@@ -191,13 +215,14 @@ func (nm *NodeManager) RegisterNode(registration *NodeRegistration) (*Node, erro
 			Region:         registration.Region,
 			Latitude:       registration.Latitude,
 			Longitude:      registration.Longitude,
+			PostalCode:     registration.PostalCode,
 			ASN:            registration.ASN,
 			ISP:            registration.ISP,
 			Carrier:        registration.Carrier,
 			ConnectionType: registration.ConnectionType,
 			DeviceType:     registration.DeviceType,
 			SDKVersion:     registration.SDKVersion,
-			Status:         "available",
+			Status:         registration.Availability.status(),
 			QualityScore:   100,
 			BandwidthUsed:  0,
 			TotalRequests:  0,
@@ -209,10 +234,25 @@ func (nm *NodeManager) RegisterNode(registration *NodeRegistration) (*Node, erro
 		}
 	}
 
+	node.Schedule = registration.Schedule
+	node.AvailableAt = registration.Availability.until()
+
+	if registration.Caps.Limited() {
+		registration.Caps.UpdatedAt = now
+		node.Caps = registration.Caps
+	} else {
+		node.Caps = nil
+	}
+
+	nm.applyIPIntel(node)
+
 	// Store in Redis immediately (this is the hot path)
 	if err := nm.storeNodeInRedis(node); err != nil {
 		nm.logger.Warnf("Failed to store node in Redis: %v", err)
 	}
+	if prev != nil {
+		nm.unindexNode(prev, nodeIndexKeys(node))
+	}
 
 	// Store device→node mapping in Redis
 	nm.rdb.Set(ctx, fmt.Sprintf("device:%s", node.DeviceID), node.ID, 24*time.Hour)
@@ -241,7 +281,9 @@ func (nm *NodeManager) UpdateHeartbeat(nodeID string) error {
 			return fmt.Errorf("node not found: %s", nodeID)
 		}
 		node.LastHeartbeat = now
-		node.Status = "available"
+		if !scheduledDown(node.Status) {
+			node.Status = StatusAvailable
+		}
 		nm.storeNodeInRedis(node)
 		return nil
 	}
@@ -252,7 +294,9 @@ func (nm *NodeManager) UpdateHeartbeat(nodeID string) error {
 	}
 
 	node.LastHeartbeat = now
-	node.Status = "available"
+	if !scheduledDown(node.Status) {
+		node.Status = StatusAvailable
+	}
 	node.UpdatedAt = now
 
 	// Update Redis only — no Postgres write
@@ -277,6 +321,7 @@ func (nm *NodeManager) DisconnectNode(nodeID string) error {
 			if node.City != "" {
 				nm.rdb.Del(ctx, fmt.Sprintf("node:%s:%s:%s", node.Country, node.City, node.ID))
 			}
+			nm.unindexNode(&node, nil)
 		}
 	}
 
@@ -453,19 +498,22 @@ func (nm *NodeManager) GetStatistics() *Statistics {
 		DeviceTypes:     make(map[string]int),
 		ConnectionTypes: make(map[string]int),
 		UpdatedAt:       time.Now(),
+		SDKVersions:     make(map[string]map[string]int),
 	}
 
 	query := `
 		SELECT 
 			COUNT(*) as total,
 			COUNT(CASE WHEN status = 'available' AND last_heartbeat > NOW() - INTERVAL '6 minutes' THEN 1 END) as active,
+			COUNT(CASE WHEN status IN ('scheduled_off', 'paused') AND last_heartbeat > NOW() - INTERVAL '6 minutes' THEN 1 END) as scheduled_off,
 			AVG(quality_score) as avg_quality,
 			SUM(bandwidth_used_mb) as total_bandwidth,
 			country,
 			device_type,
-			connection_type
+			connection_type,
+			COALESCE(sdk_version, '')
 		FROM nodes
-		GROUP BY country, device_type, connection_type
+		GROUP BY country, device_type, connection_type, sdk_version
 	`
 
 	rows, err := nm.db.Query(query)
@@ -476,19 +524,20 @@ func (nm *NodeManager) GetStatistics() *Statistics {
 	defer rows.Close()
 
 	for rows.Next() {
-		var total, active int
+		var total, active, scheduledOff int
 		var avgQuality float64
 		var totalBandwidth int64
-		var country, deviceType, connectionType string
+		var country, deviceType, connectionType, sdkVersion string
 
-		err := rows.Scan(&total, &active, &avgQuality, &totalBandwidth,
-			&country, &deviceType, &connectionType)
+		err := rows.Scan(&total, &active, &scheduledOff, &avgQuality, &totalBandwidth,
+			&country, &deviceType, &connectionType, &sdkVersion)
 		if err != nil {
 			continue
 		}
 
 		stats.TotalNodes += total
 		stats.ActiveNodes += active
+		stats.ScheduledOffNodes += scheduledOff
 		stats.TotalBandwidth += totalBandwidth
 
 		if avgQuality > 0 {
@@ -498,9 +547,13 @@ func (nm *NodeManager) GetStatistics() *Statistics {
 		stats.CountryBreakdown[country] += total
 		stats.DeviceTypes[deviceType] += total
 		stats.ConnectionTypes[connectionType] += total
+		if stats.SDKVersions[deviceType] == nil {
+			stats.SDKVersions[deviceType] = make(map[string]int)
+		}
+		stats.SDKVersions[deviceType][sdkVersion] += total
 	}
 
-	stats.InactiveNodes = stats.TotalNodes - stats.ActiveNodes
+	stats.InactiveNodes = stats.TotalNodes - stats.ActiveNodes - stats.ScheduledOffNodes
 	return stats
 }
 
@@ -577,6 +630,9 @@ func (nm *NodeManager) storeNodeInRedis(node *Node) error {
 		nm.rdb.Set(ctx, cityKey, nodeJSON, 6*time.Minute)
 	}
 
+	// ASN/ISP/connection type indexes
+	nm.indexNode(node)
+
 	return nil
 }
 
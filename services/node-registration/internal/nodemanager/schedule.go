@@ -0,0 +1,87 @@
+package nodemanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Node statuses. Scheduled-off and paused nodes stay connected and keep
+// heartbeating but take no traffic; they are not disconnects.
+const (
+	StatusAvailable    = "available"
+	StatusScheduledOff = "scheduled_off" // outside the operator's sharing hours
+	StatusPaused       = "paused"        // paused by the operator or an admin
+)
+
+// ScheduleWindow is one entry of a weekly sharing calendar; windows whose
+// end is at or before their start run past midnight
+type ScheduleWindow struct {
+	Days  []string `json:"days"`  // sun, mon, ... sat
+	Start string   `json:"start"` // HH:MM
+	End   string   `json:"end"`   // HH:MM, 24:00 allowed
+}
+
+// NodeSchedule is the weekly calendar an operator shares bandwidth on, as
+// the node agent advertises it. The agent enforces it and reports changes
+// with availability messages.
+type NodeSchedule struct {
+	Timezone string           `json:"timezone"`
+	Windows  []ScheduleWindow `json:"windows"`
+}
+
+// NodeAvailability is an availability report: whether the node takes
+// traffic and, when it doesn't, until when if known
+type NodeAvailability struct {
+	Status string     `json:"status"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+// scheduledDown reports whether status is a scheduled-off or paused node
+func scheduledDown(status string) bool {
+	return status == StatusScheduledOff || status == StatusPaused
+}
+
+// status is the node status the report asks for; anything unknown is
+// available so older agents keep working
+func (a *NodeAvailability) status() string {
+	if a != nil && scheduledDown(a.Status) {
+		return a.Status
+	}
+	return StatusAvailable
+}
+
+// until is when a scheduled-off or paused node expects to come back
+func (a *NodeAvailability) until() *time.Time {
+	if a == nil || !scheduledDown(a.Status) {
+		return nil
+	}
+	return a.Until
+}
+
+// SetAvailability records an availability report. The status reaches
+// Postgres with the next batch sync; the node stays connected.
+func (nm *NodeManager) SetAvailability(nodeID string, availability *NodeAvailability) error {
+	ctx := context.Background()
+	nodeData, err := nm.rdb.Get(ctx, nm.getRedisNodeKey(nodeID)).Result()
+	if err != nil {
+		return fmt.Errorf("node not found: %s", nodeID)
+	}
+	var node Node
+	if err := json.Unmarshal([]byte(nodeData), &node); err != nil {
+		return fmt.Errorf("failed to parse node data: %v", err)
+	}
+	changed := node.Status != availability.status()
+	node.Status = availability.status()
+	node.AvailableAt = availability.until()
+	node.UpdatedAt = time.Now()
+	if err := nm.storeNodeInRedis(&node); err != nil {
+		return err
+	}
+	if changed {
+		nm.markDirty(nodeID)
+		nm.logger.Infof("Node %s is now %s", nodeID, node.Status)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package nodemanager
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNodeScheduleDecode(t *testing.T) {
+	// As the node agent advertises it at registration
+	raw := `{"timezone":"Europe/Berlin","windows":[
+		{"days":["mon","tue","wed","thu","fri"],"start":"18:00","end":"08:00"},
+		{"days":["sat","sun"],"start":"00:00","end":"24:00"}]}`
+	var s NodeSchedule
+	if err := json.Unmarshal([]byte(raw), &s); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	want := NodeSchedule{
+		Timezone: "Europe/Berlin",
+		Windows: []ScheduleWindow{
+			{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "18:00", End: "08:00"},
+			{Days: []string{"sat", "sun"}, Start: "00:00", End: "24:00"},
+		},
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Fatalf("decoded %+v, want %+v", s, want)
+	}
+}
+
+func TestNodeAvailability(t *testing.T) {
+	until := time.Date(2026, 3, 29, 6, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		raw        string
+		status     string
+		wantsUntil bool
+	}{
+		{"available", `{"status":"available"}`, StatusAvailable, false},
+		{"scheduled off", `{"status":"scheduled_off","until":"2026-03-29T06:00:00Z"}`, StatusScheduledOff, true},
+		{"paused until", `{"status":"paused","until":"2026-03-29T08:00:00+02:00"}`, StatusPaused, true},
+		{"paused until resumed", `{"status":"paused"}`, StatusPaused, false},
+		{"until ignored when available", `{"status":"available","until":"2026-03-29T06:00:00Z"}`, StatusAvailable, false},
+		{"unknown status", `{"status":"sleeping","until":"2026-03-29T06:00:00Z"}`, StatusAvailable, false},
+		{"no status", `{}`, StatusAvailable, false},
+	}
+	for _, tt := range tests {
+		var a NodeAvailability
+		if err := json.Unmarshal([]byte(tt.raw), &a); err != nil {
+			t.Fatalf("%s: decode: %v", tt.name, err)
+		}
+		if got := a.status(); got != tt.status {
+			t.Errorf("%s: status = %q, want %q", tt.name, got, tt.status)
+		}
+		got := a.until()
+		if tt.wantsUntil != (got != nil) {
+			t.Errorf("%s: until = %v", tt.name, got)
+		}
+		if got != nil && !got.Equal(until) {
+			t.Errorf("%s: until = %v, want %v", tt.name, got, until)
+		}
+	}
+
+	var none *NodeAvailability
+	if none.status() != StatusAvailable || none.until() != nil {
+		t.Error("missing availability is not available")
+	}
+}
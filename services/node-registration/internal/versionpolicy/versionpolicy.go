@@ -0,0 +1,401 @@
+// Package versionpolicy decides which SDK builds may register: minimum
+// versions per platform, deny lists of known-bad builds and soft deprecation,
+// with minimums rolled out to a share of devices at a time.
+package versionpolicy
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// reloadInterval is how often the policy file or tables are checked
+const reloadInterval = time.Minute
+
+// Verdict actions
+const (
+	ActionAllow           = "allow"
+	ActionDeprecated      = "deprecated"       // allowed, but told to upgrade
+	ActionUpgradeRequired = "upgrade_required" // refused
+)
+
+// Verdict reasons, also the buckets of Summary
+const (
+	ReasonCurrent        = "current"
+	ReasonDeprecated     = "deprecated"
+	ReasonBelowMinimum   = "below_minimum"
+	ReasonDenied         = "denied"
+	ReasonInvalidVersion = "invalid_version"
+)
+
+// DefaultMinVersion is the minimum when no policy is configured
+const DefaultMinVersion = "1.0.62"
+
+// Rule is the policy for one platform. Empty fields fall back to the
+// default rule.
+type Rule struct {
+	MinVersion      string `json:"min_version,omitempty"`
+	DeprecatedBelow string `json:"deprecated_below,omitempty"`
+	LatestVersion   string `json:"latest_version,omitempty"`
+	DownloadURL     string `json:"download_url,omitempty"`
+	// EnforcePercent stages a new min_version: only this share of devices
+	// (by device ID hash) is refused, the rest are warned. nil = 100.
+	EnforcePercent *int   `json:"enforce_percent,omitempty"`
+	Message        string `json:"message,omitempty"`
+}
+
+// File is the policy document (VERSION_POLICY_FILE):
+//
+//	{"default": {"min_version": "1.0.62"},
+//	 "platforms": {"android": {"min_version": "1.0.70", "deprecated_below": "1.0.75",
+//	                           "latest_version": "1.0.78", "download_url": "https://...",
+//	                           "enforce_percent": 25}},
+//	 "deny": ["1.0.71", "windows:2.1.0"]}
+type File struct {
+	Default   Rule            `json:"default"`
+	Platforms map[string]Rule `json:"platforms,omitempty"`
+	Deny      []string        `json:"deny,omitempty"` // "version" or "platform:version"
+}
+
+// Verdict is the decision for one registration
+type Verdict struct {
+	Action        string `json:"action"`
+	Reason        string `json:"reason"`
+	Platform      string `json:"platform"`
+	Version       string `json:"version"`
+	MinVersion    string `json:"min_version,omitempty"`
+	LatestVersion string `json:"latest_version,omitempty"`
+	DownloadURL   string `json:"download_url,omitempty"`
+	Message       string `json:"message,omitempty"`
+}
+
+// Allowed reports whether the node may register
+func (v Verdict) Allowed() bool {
+	return v.Action != ActionUpgradeRequired
+}
+
+// Policy serves verdicts from a file, the sdk_version_policies and
+// sdk_version_denylist tables, or the built-in default, reloading as they
+// change. A failed reload keeps the previous policy.
+type Policy struct {
+	path   string
+	db     *sql.DB
+	logger *logrus.Entry
+
+	mu      sync.RWMutex
+	file    File
+	denied  map[string]bool
+	modTime time.Time
+}
+
+// New loads the policy from path, or from db when path is "", or falls back
+// to DefaultMinVersion for every platform when neither is given
+func New(path string, db *sql.DB, logger *logrus.Entry) (*Policy, error) {
+	p := &Policy{
+		path:   path,
+		db:     db,
+		logger: logger.WithField("component", "version-policy"),
+	}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload reads the policy again
+func (p *Policy) Reload() error {
+	var file File
+	var modTime time.Time
+	switch {
+	case p.path != "":
+		fi, err := os.Stat(p.path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(p.path)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return fmt.Errorf("parse %s: %w", p.path, err)
+		}
+		modTime = fi.ModTime()
+	case p.db != nil:
+		var err error
+		if file, err = loadTables(p.db); err != nil {
+			return err
+		}
+	}
+	if file.Default.MinVersion == "" {
+		file.Default.MinVersion = DefaultMinVersion
+	}
+
+	denied := make(map[string]bool, len(file.Deny))
+	for _, d := range file.Deny {
+		denied[strings.ToLower(strings.TrimSpace(d))] = true
+	}
+	platforms := make(map[string]Rule, len(file.Platforms))
+	for name, rule := range file.Platforms {
+		platforms[strings.ToLower(name)] = rule
+	}
+	file.Platforms = platforms
+
+	p.mu.Lock()
+	p.file = file
+	p.denied = denied
+	p.modTime = modTime
+	p.mu.Unlock()
+	return nil
+}
+
+// loadTables reads the policy from Postgres; the platform '*' row is the
+// default rule
+func loadTables(db *sql.DB) (File, error) {
+	file := File{Platforms: make(map[string]Rule)}
+	rows, err := db.Query(`SELECT platform, COALESCE(min_version, ''), COALESCE(deprecated_below, ''),
+		COALESCE(latest_version, ''), COALESCE(download_url, ''), enforce_percent, COALESCE(message, '')
+		FROM sdk_version_policies`)
+	if err != nil {
+		return file, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var platform string
+		var rule Rule
+		var percent sql.NullInt64
+		if err := rows.Scan(&platform, &rule.MinVersion, &rule.DeprecatedBelow,
+			&rule.LatestVersion, &rule.DownloadURL, &percent, &rule.Message); err != nil {
+			return file, err
+		}
+		if percent.Valid {
+			n := int(percent.Int64)
+			rule.EnforcePercent = &n
+		}
+		if platform == "*" {
+			file.Default = rule
+		} else {
+			file.Platforms[platform] = rule
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return file, err
+	}
+
+	var deny pq.StringArray
+	if err := db.QueryRow(`SELECT COALESCE(array_agg(CASE WHEN platform = '*' THEN version
+		ELSE platform || ':' || version END), '{}') FROM sdk_version_denylist`).Scan(&deny); err != nil {
+		return file, err
+	}
+	file.Deny = deny
+	return file, nil
+}
+
+// Watch reloads the policy when the file changes, or every reloadInterval
+// from the database, until stop is closed
+func (p *Policy) Watch(stop <-chan struct{}) {
+	if p.path == "" && p.db == nil {
+		return
+	}
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if p.path != "" {
+				p.mu.RLock()
+				seen := p.modTime
+				p.mu.RUnlock()
+				if fi, err := os.Stat(p.path); err != nil || !fi.ModTime().After(seen) {
+					continue
+				}
+			}
+			if err := p.Reload(); err != nil {
+				p.logger.Errorf("Version policy reload failed, keeping previous: %v", err)
+			}
+		}
+	}
+}
+
+// rule returns the platform's rule with the default filled in. A nil policy
+// only has the default minimum.
+func (p *Policy) rule(platform string) Rule {
+	if p == nil {
+		return Rule{MinVersion: DefaultMinVersion}
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	rule := p.file.Default
+	if r, ok := p.file.Platforms[platform]; ok {
+		if r.MinVersion != "" {
+			rule.MinVersion = r.MinVersion
+		}
+		if r.DeprecatedBelow != "" {
+			rule.DeprecatedBelow = r.DeprecatedBelow
+		}
+		if r.LatestVersion != "" {
+			rule.LatestVersion = r.LatestVersion
+		}
+		if r.DownloadURL != "" {
+			rule.DownloadURL = r.DownloadURL
+		}
+		if r.EnforcePercent != nil {
+			rule.EnforcePercent = r.EnforcePercent
+		}
+		if r.Message != "" {
+			rule.Message = r.Message
+		}
+	}
+	return rule
+}
+
+func (p *Policy) isDenied(platform, version string) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.denied[version] || p.denied[platform+":"+version]
+}
+
+// Check decides whether a build may register. deviceID places the device in
+// a staged rollout; "" counts as enforced.
+func (p *Policy) Check(platform, version, deviceID string) Verdict {
+	platform = strings.ToLower(strings.TrimSpace(platform))
+	version = strings.TrimSpace(version)
+	rule := p.rule(platform)
+	v := Verdict{
+		Action:        ActionAllow,
+		Reason:        ReasonCurrent,
+		Platform:      platform,
+		Version:       version,
+		MinVersion:    rule.MinVersion,
+		LatestVersion: rule.LatestVersion,
+		DownloadURL:   rule.DownloadURL,
+		Message:       rule.Message,
+	}
+
+	parsed, ok := Parse(version)
+	switch {
+	case !ok:
+		v.Action, v.Reason = ActionUpgradeRequired, ReasonInvalidVersion
+	case p.isDenied(platform, strings.ToLower(version)):
+		v.Action, v.Reason = ActionUpgradeRequired, ReasonDenied
+	case belowVersion(parsed, rule.MinVersion):
+		v.Action, v.Reason = ActionUpgradeRequired, ReasonBelowMinimum
+		if deviceID != "" && !enforced(deviceID, rule.EnforcePercent) {
+			v.Action = ActionDeprecated
+		}
+	case belowVersion(parsed, rule.DeprecatedBelow):
+		v.Action, v.Reason = ActionDeprecated, ReasonDeprecated
+	}
+	if v.Message == "" && v.Action != ActionAllow {
+		v.Message = defaultMessage(v)
+	}
+	return v
+}
+
+// Summary buckets a platform → version → count distribution by verdict
+// reason, ignoring staged rollouts
+func (p *Policy) Summary(dist map[string]map[string]int) map[string]int {
+	summary := map[string]int{
+		ReasonCurrent:        0,
+		ReasonDeprecated:     0,
+		ReasonBelowMinimum:   0,
+		ReasonDenied:         0,
+		ReasonInvalidVersion: 0,
+	}
+	for platform, versions := range dist {
+		for version, n := range versions {
+			summary[p.Check(platform, version, "").Reason] += n
+		}
+	}
+	return summary
+}
+
+func defaultMessage(v Verdict) string {
+	switch v.Reason {
+	case ReasonDenied:
+		return fmt.Sprintf("SDK %s has a known problem and can't be used. Please upgrade.", v.Version)
+	case ReasonInvalidVersion:
+		return "SDK version not recognised. Please upgrade."
+	case ReasonBelowMinimum:
+		if v.Action == ActionDeprecated {
+			return fmt.Sprintf("SDK %s will soon be refused. Minimum required: %s", v.Version, v.MinVersion)
+		}
+		return fmt.Sprintf("SDK version too old. Minimum required: %s", v.MinVersion)
+	}
+	return fmt.Sprintf("SDK %s is deprecated. Please upgrade.", v.Version)
+}
+
+// enforced places a device inside or outside a staged rollout
+func enforced(deviceID string, percent *int) bool {
+	if percent == nil || *percent >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(deviceID))
+	return int(h.Sum32()%100) < *percent
+}
+
+// Parse reads a dotted version, ignoring a prefix such as "v" or "docker-"
+// and a suffix such as "-beta"
+func Parse(version string) ([]int, bool) {
+	version = strings.TrimSpace(version)
+	if i := strings.IndexAny(version, "0123456789"); i > 0 {
+		version = version[i:]
+	}
+	if i := strings.IndexAny(version, "-+ "); i >= 0 {
+		version = version[:i]
+	}
+	parts := strings.Split(version, ".")
+	if len(parts) < 2 || len(parts) > 4 {
+		return nil, false
+	}
+	parsed := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		parsed[i] = n
+	}
+	return parsed, true
+}
+
+// Compare orders two parsed versions; missing components count as 0
+func Compare(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// belowVersion reports whether v is older than limit; an empty or invalid
+// limit never is
+func belowVersion(v []int, limit string) bool {
+	l, ok := Parse(limit)
+	return ok && Compare(v, l) < 0
+}
@@ -0,0 +1,216 @@
+package versionpolicy
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() *logrus.Entry {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logrus.NewEntry(logger)
+}
+
+// filePolicy loads a policy from a JSON document
+func filePolicy(t *testing.T, doc string) *Policy {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(doc), 0o644); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+	p, err := New(path, nil, testLogger())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return p
+}
+
+// rolloutDevice returns a device ID inside or outside a staged rollout
+func rolloutDevice(t *testing.T, percent int, inside bool) string {
+	t.Helper()
+	for _, id := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l", "m", "n"} {
+		if enforced(id, &percent) == inside {
+			return id
+		}
+	}
+	t.Fatalf("no device %v the %d%% rollout", inside, percent)
+	return ""
+}
+
+func TestParseAndCompare(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []int
+	}{
+		{"1.0.62", []int{1, 0, 62}},
+		{"v2.1", []int{2, 1}},
+		{"docker-1.0.0", []int{1, 0, 0}},
+		{"1.0.70-beta", []int{1, 0, 70}},
+		{" 3.2.1.4 ", []int{3, 2, 1, 4}},
+		{"1.0.0+build5", []int{1, 0, 0}},
+	}
+	for _, tt := range tests {
+		if got, ok := Parse(tt.in); !ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q) = %v, %v; want %v", tt.in, got, ok, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "1", "1.x", "1.2.3.4.5", "latest", "1..2"} {
+		if got, ok := Parse(bad); ok {
+			t.Errorf("Parse(%q) = %v, want invalid", bad, got)
+		}
+	}
+
+	for _, tt := range []struct {
+		a, b []int
+		want int
+	}{
+		{[]int{1, 0, 62}, []int{1, 0, 62}, 0},
+		{[]int{1, 0}, []int{1, 0, 0}, 0},
+		{[]int{1, 0, 9}, []int{1, 0, 10}, -1},
+		{[]int{2}, []int{1, 99, 99}, 1},
+	} {
+		if got := Compare(tt.a, tt.b); got != tt.want {
+			t.Errorf("Compare(%v, %v) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	p := filePolicy(t, `{
+		"default": {"min_version": "1.0.62", "latest_version": "1.0.80"},
+		"platforms": {
+			"Android": {"min_version": "1.0.70", "deprecated_below": "1.0.75", "download_url": "https://example.com/apk"},
+			"windows": {"min_version": "2.0.0", "enforce_percent": 30, "message": "Update from the tray menu"}
+		},
+		"deny": ["1.0.71", "windows:2.1.0"]
+	}`)
+	in, out := rolloutDevice(t, 30, true), rolloutDevice(t, 30, false)
+
+	tests := []struct {
+		platform, version, device string
+		action, reason            string
+	}{
+		{"android", "1.0.78", "d", ActionAllow, ReasonCurrent},
+		{"ANDROID", "1.0.72", "d", ActionDeprecated, ReasonDeprecated},
+		{"android", "1.0.69", "d", ActionUpgradeRequired, ReasonBelowMinimum},
+		{"android", "1.0.71", "d", ActionUpgradeRequired, ReasonDenied}, // denied everywhere
+		{"ios", "1.0.71", "d", ActionUpgradeRequired, ReasonDenied},
+		{"ios", "1.0.62", "d", ActionAllow, ReasonCurrent}, // default rule
+		{"ios", "1.0.61", "d", ActionUpgradeRequired, ReasonBelowMinimum},
+		{"windows", "2.1.0", "d", ActionUpgradeRequired, ReasonDenied}, // denied on windows only
+		{"linux", "2.1.0", "d", ActionAllow, ReasonCurrent},
+		{"windows", "1.9.0", in, ActionUpgradeRequired, ReasonBelowMinimum},
+		{"windows", "1.9.0", out, ActionDeprecated, ReasonBelowMinimum}, // outside the staged rollout
+		{"windows", "1.9.0", "", ActionUpgradeRequired, ReasonBelowMinimum},
+		{"android", "unknown", "d", ActionUpgradeRequired, ReasonInvalidVersion},
+	}
+	for _, tt := range tests {
+		v := p.Check(tt.platform, tt.version, tt.device)
+		if v.Action != tt.action || v.Reason != tt.reason {
+			t.Errorf("Check(%s, %s, %q) = %s/%s, want %s/%s", tt.platform, tt.version, tt.device, v.Action, v.Reason, tt.action, tt.reason)
+		}
+		if v.Allowed() != (tt.action != ActionUpgradeRequired) {
+			t.Errorf("Check(%s, %s).Allowed() = %v", tt.platform, tt.version, v.Allowed())
+		}
+	}
+
+	// Platform rules fill in over the default, messages default by reason
+	v := p.Check("android", "1.0.69", "d")
+	if v.MinVersion != "1.0.70" || v.LatestVersion != "1.0.80" || v.DownloadURL != "https://example.com/apk" ||
+		v.Message != "SDK version too old. Minimum required: 1.0.70" {
+		t.Errorf("android verdict = %+v", v)
+	}
+	if v := p.Check("windows", "1.9.0", out); v.Message != "Update from the tray menu" {
+		t.Errorf("windows message = %q", v.Message)
+	}
+	if v := p.Check("android", "1.0.78", "d"); v.Message != "" {
+		t.Errorf("allowed build got message %q", v.Message)
+	}
+}
+
+func TestCheckWithoutPolicy(t *testing.T) {
+	var nilPolicy *Policy
+	empty, err := New("", nil, testLogger())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for _, p := range []*Policy{nilPolicy, empty} {
+		if v := p.Check("android", "1.0.61", "d"); v.Allowed() || v.MinVersion != DefaultMinVersion {
+			t.Errorf("below the default minimum: %+v", v)
+		}
+		if v := p.Check("android", DefaultMinVersion, "d"); v.Action != ActionAllow {
+			t.Errorf("at the default minimum: %+v", v)
+		}
+	}
+}
+
+func TestEnforced(t *testing.T) {
+	zero, half, all := 0, 50, 100
+	if !enforced("d", nil) || !enforced("d", &all) || enforced("d", &zero) {
+		t.Error("nil/100% must enforce and 0% must not")
+	}
+	inside := 0
+	for i := 0; i < 1000; i++ {
+		if enforced(string(rune('a'+i%26))+string(rune('a'+i/26)), &half) {
+			inside++
+		}
+	}
+	if inside < 400 || inside > 600 {
+		t.Errorf("%d of 1000 devices inside a 50%% rollout", inside)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	p := filePolicy(t, `{"default": {"min_version": "1.0.62", "deprecated_below": "1.0.70"}, "deny": ["1.0.65"]}`)
+	got := p.Summary(map[string]map[string]int{
+		"android": {"1.0.75": 10, "1.0.66": 4, "1.0.65": 2, "1.0.50": 3},
+		"docker":  {"docker-1.0.0": 1, "garbage": 5},
+	})
+	want := map[string]int{
+		ReasonCurrent:        10,
+		ReasonDeprecated:     4,
+		ReasonDenied:         2,
+		ReasonBelowMinimum:   4,
+		ReasonInvalidVersion: 5,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Summary = %v, want %v", got, want)
+	}
+}
+
+func TestLoadTables(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+	mock.ExpectQuery(`SELECT platform, .+ FROM sdk_version_policies`).WillReturnRows(
+		sqlmock.NewRows([]string{"platform", "min_version", "deprecated_below", "latest_version", "download_url", "enforce_percent", "message"}).
+			AddRow("*", "1.0.62", "", "1.0.80", "", nil, "").
+			AddRow("android", "1.0.70", "", "", "", 25, ""))
+	mock.ExpectQuery(`FROM sdk_version_denylist`).WillReturnRows(
+		sqlmock.NewRows([]string{"array_agg"}).AddRow("{1.0.71,ios:1.0.72}"))
+
+	p, err := New("", db, testLogger())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if rule := p.rule("android"); rule.MinVersion != "1.0.70" || rule.LatestVersion != "1.0.80" || rule.EnforcePercent == nil || *rule.EnforcePercent != 25 {
+		t.Errorf("android rule = %+v", rule)
+	}
+	if v := p.Check("ios", "1.0.72", "d"); v.Reason != ReasonDenied {
+		t.Errorf("ios 1.0.72 = %s, want denied", v.Reason)
+	}
+	if v := p.Check("android", "1.0.72", "d"); v.Reason != ReasonCurrent {
+		t.Errorf("android 1.0.72 = %s, want current", v.Reason)
+	}
+}
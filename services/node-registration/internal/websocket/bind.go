@@ -0,0 +1,142 @@
+package websocket
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// BindOpenRequest asks a node to listen for one inbound connection (SOCKS5 BIND)
+type BindOpenRequest struct {
+	TunnelID string `json:"tunnel_id"`
+	Timeout  int    `json:"timeout,omitempty"` // Seconds the node keeps the listener open
+}
+
+// BindResponse from node once its listener is up
+type BindResponse struct {
+	TunnelID  string `json:"tunnel_id"`
+	Success   bool   `json:"success"`
+	Error     string `json:"error,omitempty"`
+	BoundPort int    `json:"bound_port,omitempty"`
+}
+
+// BindAccepted from node when the inbound connection arrives or the listener times out
+type BindAccepted struct {
+	TunnelID   string `json:"tunnel_id"`
+	Success    bool   `json:"success"`
+	Error      string `json:"error,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+}
+
+// OpenBind asks the node to listen and waits for the bound address. The
+// returned tunnel carries no data until WaitBindAccept succeeds; after that it
+// behaves like any tunnel_data tunnel.
+func (tm *TunnelManager) OpenBind(nodeID string, timeout time.Duration) (*Tunnel, error) {
+	client := tm.hub.GetClientByNodeID(nodeID)
+	if client == nil {
+		return nil, ErrNodeNotConnected
+	}
+
+	tunnel := &Tunnel{
+		ID:         uuid.New().String(),
+		NodeID:     nodeID,
+		Client:     client,
+		DataCh:     make(chan []byte, 256),
+		WriteCh:    make(chan []byte, 256),
+		CloseCh:    make(chan struct{}),
+		ReadyCh:    make(chan bool, 1),
+		readDoneCh: make(chan struct{}),
+		acceptCh:   make(chan bool, 1),
+		CreatedAt:  time.Now(),
+	}
+
+	tm.mu.Lock()
+	tm.tunnels[tunnel.ID] = tunnel
+	tm.mu.Unlock()
+
+	client.sendMessage(&Message{
+		Type: "bind_open",
+		Data: &BindOpenRequest{
+			TunnelID: tunnel.ID,
+			Timeout:  int(timeout / time.Second),
+		},
+	})
+
+	select {
+	case success := <-tunnel.ReadyCh:
+		if !success {
+			tm.dropTunnel(tunnel.ID)
+			return nil, &TunnelError{tunnel.readyErr}
+		}
+	case <-time.After(6 * time.Second):
+		tm.dropTunnel(tunnel.ID)
+		return nil, ErrTunnelTimeout
+	}
+
+	tm.logger.Infof("Bind %s listening on %s via node %s", tunnel.ID, tunnel.BindAddr, nodeID)
+	return tunnel, nil
+}
+
+// WaitBindAccept blocks until the node reports its inbound connection, then
+// starts the tunnel writer. The node enforces the timeout; ours is a backstop.
+func (tm *TunnelManager) WaitBindAccept(tunnel *Tunnel, timeout time.Duration) error {
+	select {
+	case success := <-tunnel.acceptCh:
+		if !success {
+			tm.dropTunnel(tunnel.ID)
+			return &TunnelError{tunnel.readyErr}
+		}
+	case <-tunnel.CloseCh:
+		return ErrTunnelClosed
+	case <-time.After(timeout + 5*time.Second):
+		tm.CloseTunnel(tunnel.ID)
+		return ErrTunnelTimeout
+	}
+	go tm.tunnelWriter(tunnel)
+	return nil
+}
+
+// HandleBindResponse handles the node's answer to bind_open
+func (tm *TunnelManager) HandleBindResponse(resp *BindResponse) {
+	tunnel := tm.GetTunnel(resp.TunnelID)
+	if tunnel == nil {
+		return
+	}
+	tunnel.mu.Lock()
+	tunnel.readyErr = resp.Error
+	if resp.Success {
+		tunnel.BindAddr = net.JoinHostPort(tunnel.Client.clientIP, strconv.Itoa(resp.BoundPort))
+	}
+	tunnel.mu.Unlock()
+
+	select {
+	case tunnel.ReadyCh <- resp.Success:
+	default:
+	}
+}
+
+// HandleBindAccepted handles the node reporting its inbound connection
+func (tm *TunnelManager) HandleBindAccepted(msg *BindAccepted) {
+	tunnel := tm.GetTunnel(msg.TunnelID)
+	if tunnel == nil || tunnel.acceptCh == nil {
+		return
+	}
+	tunnel.mu.Lock()
+	tunnel.readyErr = msg.Error
+	tunnel.BindPeer = msg.RemoteAddr
+	tunnel.mu.Unlock()
+
+	select {
+	case tunnel.acceptCh <- msg.Success:
+	default:
+	}
+}
+
+// dropTunnel forgets a tunnel that never became active
+func (tm *TunnelManager) dropTunnel(tunnelID string) {
+	tm.mu.Lock()
+	delete(tm.tunnels, tunnelID)
+	tm.mu.Unlock()
+}
@@ -0,0 +1,27 @@
+package websocket
+
+import (
+	"encoding/json"
+
+	"node-registration/internal/nodemanager"
+)
+
+// handleCapsUsage stores a node's periodic caps_usage report on its record,
+// where the proxy gateway's node selection sees it
+func (c *Client) handleCapsUsage(message *Message) {
+	if c.nodeID == "" {
+		return
+	}
+	dataBytes, err := json.Marshal(message.Data)
+	if err != nil {
+		return
+	}
+	var caps nodemanager.NodeCaps
+	if err := json.Unmarshal(dataBytes, &caps); err != nil {
+		c.logger.Warnf("Invalid caps_usage from node %s: %v", c.nodeID, err)
+		return
+	}
+	if err := c.hub.nodeManager.UpdateCaps(c.nodeID, &caps); err != nil {
+		c.logger.Warnf("Failed to update caps of node %s: %v", c.nodeID, err)
+	}
+}
@@ -0,0 +1,101 @@
+package websocket
+
+import (
+	"encoding/json"
+	"time"
+
+	"node-registration/internal/nodeconfig"
+)
+
+// ConfigAck answers a config_update
+type ConfigAck struct {
+	Version int64  `json:"version"`
+	Status  string `json:"status"` // applied or rejected
+	Error   string `json:"error,omitempty"`
+}
+
+// SetConfigStore enables config push: registering nodes get the newest
+// document targeting them and answer config_ack
+func (h *Hub) SetConfigStore(store *nodeconfig.Store) {
+	h.configs = store
+}
+
+// PushConfig sends doc to every registered node it targets that has no
+// newer document; returns how many were sent
+func (h *Hub) PushConfig(doc *nodeconfig.Document) int {
+	if h.configs == nil {
+		return 0
+	}
+	h.clientsMu.RLock()
+	targets := make([]*Client, 0)
+	for client := range h.clients {
+		client.mu.RLock()
+		targeted := client.deviceID != "" && h.configs.ForNode(client.country, client.platform, client.sdkVersion) == doc
+		client.mu.RUnlock()
+		if targeted {
+			targets = append(targets, client)
+		}
+	}
+	h.clientsMu.RUnlock()
+
+	// Sending records state in the database, so not under the lock
+	for _, client := range targets {
+		client.sendConfig(doc)
+	}
+	return len(targets)
+}
+
+// pushConfig sends a newly registered node its config unless it already
+// runs it
+func (c *Client) pushConfig(running int64) {
+	if c.hub.configs == nil {
+		return
+	}
+	doc := c.hub.configs.ForNode(c.country, c.platform, c.sdkVersion)
+	if doc == nil || running >= doc.Version {
+		if running > 0 {
+			if err := c.hub.configs.Ack(c.deviceID, running, nodeconfig.StatusApplied, ""); err != nil {
+				c.logger.Errorf("Failed to record config version of device %s: %v", c.deviceID, err)
+			}
+		}
+		return
+	}
+	c.sendConfig(doc)
+}
+
+func (c *Client) sendConfig(doc *nodeconfig.Document) {
+	c.sendMessage(&Message{
+		Type: "config_update",
+		Data: map[string]interface{}{
+			"version":   doc.Version,
+			"payload":   doc.Payload,
+			"signature": doc.Signature,
+			"key_id":    c.hub.configs.Fingerprint(),
+			"timestamp": time.Now().UTC(),
+		},
+	})
+	if err := c.hub.configs.MarkPushed(c.deviceID, doc.Version); err != nil {
+		c.logger.Errorf("Failed to record config push to device %s: %v", c.deviceID, err)
+	}
+}
+
+func (c *Client) handleConfigAck(message *Message) {
+	if c.hub.configs == nil || c.deviceID == "" {
+		return
+	}
+	dataBytes, err := json.Marshal(message.Data)
+	if err != nil {
+		return
+	}
+	var ack ConfigAck
+	if err := json.Unmarshal(dataBytes, &ack); err != nil || ack.Version <= 0 {
+		c.logger.Warnf("Invalid config_ack from device %s", c.deviceID)
+		return
+	}
+	if ack.Status == nodeconfig.StatusRejected {
+		c.logger.Warnf("Device %s rejected config version %d: %s", c.deviceID, ack.Version, ack.Error)
+	}
+	if err := c.hub.configs.Ack(c.deviceID, ack.Version, ack.Status, ack.Error); err != nil {
+		c.logger.Errorf("Failed to record config ack from device %s: %v", c.deviceID, err)
+	}
+}
@@ -13,7 +13,10 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
 
+	"node-registration/internal/identity"
+	"node-registration/internal/nodeconfig"
 	"node-registration/internal/nodemanager"
+	"node-registration/internal/versionpolicy"
 )
 
 var upgrader = websocket.Upgrader{
@@ -30,30 +33,11 @@ type IPGeoInfo struct {
 	Region      string  `json:"regionName"`
 	Latitude    float64 `json:"lat"`
 	Longitude   float64 `json:"lon"`
+	Zip         string  `json:"zip"`
 	ISP         string  `json:"isp"`
 	ASN         string  `json:"as"`
 }
 
-// isSDKVersionAllowed checks if SDK version is >= 1.0.62
-func isSDKVersionAllowed(version string) bool {
-	// Parse "1.0.62" format
-	parts := strings.Split(strings.TrimSpace(version), ".")
-	if len(parts) != 3 {
-		return false
-	}
-	var major, minor, patch int
-	fmt.Sscanf(parts[0], "%d", &major)
-	fmt.Sscanf(parts[1], "%d", &minor)
-	fmt.Sscanf(parts[2], "%d", &patch)
-
-	// Minimum: 1.0.62
-	if major > 1 { return true }
-	if major < 1 { return false }
-	if minor > 0 { return true }
-	if minor < 0 { return false }
-	return patch >= 62
-}
-
 // lookupIPGeo fetches geolocation for an IP address
 func lookupIPGeo(ip string) (*IPGeoInfo, error) {
 	// Skip private/local IPs
@@ -115,6 +99,16 @@ type Hub struct {
 	proxyManager  *ProxyManager
 	tunnelManager *TunnelManager
 	logger        *logrus.Entry
+
+	// Node identity handshake, see SetIdentityStore
+	identities   *identity.Store
+	identityMode identity.Mode
+
+	// SDK version policy, see SetVersionPolicy
+	versions *versionpolicy.Policy
+
+	// Config push, see SetConfigStore
+	configs *nodeconfig.Store
 }
 
 type Client struct {
@@ -125,6 +119,33 @@ type Client struct {
 	deviceID  string
 	clientIP  string
 	logger    *logrus.Entry
+
+	challenge string // nonce of the pending auth_challenge
+
+	// mu guards what the hub reads from other goroutines (DisconnectDevice,
+	// PushConfig, sendToDevice, tunnels): deviceID, verifiedDevice and the
+	// registration details config push and half-close depend on. The client's
+	// own goroutine writes them under mu and may read them without it.
+	mu             sync.RWMutex
+	verifiedDevice string // device ID proven by auth_response
+	country        string
+	platform       string
+	sdkVersion     string
+	halfClose      bool // registered with half_close
+}
+
+// devices returns the registered and the verified device IDs
+func (c *Client) devices() (deviceID, verifiedDevice string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.deviceID, c.verifiedDevice
+}
+
+// supportsHalfClose reports whether the node registered with half_close
+func (c *Client) supportsHalfClose() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.halfClose
 }
 
 type Message struct {
@@ -155,7 +176,23 @@ type RegistrationMessage struct {
 	// Fields from ipinfo.io (sent by SDK v1.0.62+)
 	Loc            string  `json:"loc"`      // "lat,lng" format
 	Org            string  `json:"org"`      // "AS12345 ISP Name" format
+	Postal         string  `json:"postal"`
 	Timezone       string  `json:"timezone"`
+
+	// Config document version the node runs, 0 if none
+	ConfigVersion int64 `json:"config_version"`
+
+	// Node applies FIN in tunnel_data as a half-close of the target
+	// connection; nodes without it are never sent FIN
+	HalfClose bool `json:"half_close"`
+
+	// Operator caps and usage (docker-node), see caps_usage
+	Caps *nodemanager.NodeCaps `json:"caps,omitempty"`
+
+	// Operator sharing hours and current availability (docker-node), see
+	// availability
+	Schedule     *nodemanager.NodeSchedule     `json:"schedule,omitempty"`
+	Availability *nodemanager.NodeAvailability `json:"availability,omitempty"`
 }
 
 func NewHub(nodeManager *nodemanager.NodeManager, logger *logrus.Entry) *Hub {
@@ -273,6 +310,7 @@ func HandleNodeConnection(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	}
 
 	client.hub.register <- client
+	client.sendChallenge()
 
 	// Start goroutines for handling read and write
 	go client.writePump()
@@ -365,14 +403,29 @@ func (c *Client) handleMessage(message *Message) {
 	switch message.Type {
 	case "register":
 		c.handleRegistration(message)
-	case "heartbeat":
+	case "auth_response":
+		c.handleAuthResponse(message)
+	case "config_ack":
+		c.handleConfigAck(message)
+	case "caps_usage":
+		c.handleCapsUsage(message)
+	case "availability":
+		c.handleAvailability(message)
+	case "heartbeat", "keepalive": // docker-node sends keepalive
 		c.handleHeartbeat(message)
+	case "hello", "ip_info":
+		// docker-node's greeting and IP lookup; the registration carries
+		// what the hub needs
 	case "proxy_response":
 		c.handleProxyResponse(message)
 	case "tunnel_response":
 		c.handleTunnelResponse(message)
 	case "tunnel_data":
 		c.handleTunnelData(message)
+	case "bind_response", "bind_accepted":
+		c.handleBindMessage(message)
+	case "udp_response", "udp_data", "udp_close":
+		c.handleUDPMessage(message)
 	default:
 		c.logger.Warnf("Unknown message type: %s", message.Type)
 	}
@@ -432,6 +485,59 @@ func (c *Client) handleTunnelData(message *Message) {
 	}
 }
 
+func (c *Client) handleBindMessage(message *Message) {
+	if c.hub.tunnelManager == nil {
+		return
+	}
+	dataBytes, err := json.Marshal(message.Data)
+	if err != nil {
+		c.logger.Errorf("Failed to marshal %s: %v", message.Type, err)
+		return
+	}
+
+	switch message.Type {
+	case "bind_response":
+		var resp BindResponse
+		if err := json.Unmarshal(dataBytes, &resp); err == nil {
+			c.hub.tunnelManager.HandleBindResponse(&resp)
+		}
+	case "bind_accepted":
+		var msg BindAccepted
+		if err := json.Unmarshal(dataBytes, &msg); err == nil {
+			c.hub.tunnelManager.HandleBindAccepted(&msg)
+		}
+	}
+}
+
+func (c *Client) handleUDPMessage(message *Message) {
+	if c.hub.tunnelManager == nil {
+		return
+	}
+	dataBytes, err := json.Marshal(message.Data)
+	if err != nil {
+		c.logger.Errorf("Failed to marshal %s: %v", message.Type, err)
+		return
+	}
+
+	switch message.Type {
+	case "udp_response":
+		var resp UDPOpenResponse
+		if err := json.Unmarshal(dataBytes, &resp); err == nil {
+			c.hub.tunnelManager.HandleUDPResponse(&resp)
+		}
+	case "udp_data":
+		var data UDPDataMessage
+		if err := json.Unmarshal(dataBytes, &data); err == nil {
+			c.hub.tunnelManager.HandleUDPData(&data)
+		}
+	case "udp_close":
+		var msg UDPCloseMessage
+		if err := json.Unmarshal(dataBytes, &msg); err == nil {
+			c.hub.tunnelManager.HandleUDPClose(&msg)
+		}
+	}
+}
+
 func (c *Client) handleRegistration(message *Message) {
 	dataBytes, err := json.Marshal(message.Data)
 	if err != nil {
@@ -449,10 +555,18 @@ func (c *Client) handleRegistration(message *Message) {
 	c.logger.Infof("Registration data: device_id=%s, device_type=%s, connection_type=%s, sdk_version=%s",
 		regData.DeviceID, regData.DeviceType, regData.ConnectionType, regData.SDKVersion)
 
-	// Reject old SDK versions (before 1.0.62)
-	if !isSDKVersionAllowed(regData.SDKVersion) {
-		c.logger.Warnf("Rejected old SDK %s from device %s", regData.SDKVersion, regData.DeviceID)
-		c.sendError("SDK version too old. Minimum required: 1.0.62")
+	// Refuse SDK builds the version policy doesn't allow
+	verdict := c.hub.versions.Check(regData.DeviceType, regData.SDKVersion, regData.DeviceID)
+	if !verdict.Allowed() {
+		c.logger.Warnf("Rejected SDK %s (%s) from device %s: %s", regData.SDKVersion, regData.DeviceType, regData.DeviceID, verdict.Reason)
+		c.sendVersionNotice("upgrade_required", verdict)
+		c.sendError(verdict.Message)
+		return
+	}
+
+	if err := c.checkIdentity(regData.DeviceID); err != nil {
+		c.logger.Warnf("Rejected registration of device %s: %v", regData.DeviceID, err)
+		c.sendError(fmt.Sprintf("Identity check failed: %v", err))
 		return
 	}
 
@@ -488,6 +602,16 @@ func (c *Client) handleRegistration(message *Message) {
 			regData.CountryName = regData.Country
 		}
 		c.logger.Infof("SDK provided geo: %s, %s (sdk_version=%s)", regData.Country, regData.City, regData.SDKVersion)
+	} else if rec := c.hub.nodeManager.LookupIPIntel(c.clientIP); rec != nil && rec.Country != "" {
+		// No geo from SDK — the offline IP database has it
+		regData.Country = rec.Country
+		regData.CountryName = rec.Country
+		regData.City = rec.City
+		regData.Region = rec.Region
+		regData.Latitude = rec.Latitude
+		regData.Longitude = rec.Longitude
+		regData.Postal = rec.PostalCode
+		c.logger.Infof("Offline geo lookup: %s -> %s, %s", c.clientIP, regData.Country, regData.City)
 	} else {
 		// No geo from SDK — fall back to server-side lookup
 		geo, err := lookupIPGeo(c.clientIP)
@@ -498,6 +622,7 @@ func (c *Client) handleRegistration(message *Message) {
 			regData.Region = geo.Region
 			regData.Latitude = geo.Latitude
 			regData.Longitude = geo.Longitude
+			regData.Postal = geo.Zip
 			regData.ISP = geo.ISP
 			if geo.ASN != "" {
 				var asn int
@@ -520,12 +645,16 @@ func (c *Client) handleRegistration(message *Message) {
 		Region:         regData.Region,
 		Latitude:       regData.Latitude,
 		Longitude:      regData.Longitude,
+		PostalCode:     regData.Postal,
 		ASN:            regData.ASN,
 		ISP:            regData.ISP,
 		Carrier:        regData.Carrier,
 		ConnectionType: regData.ConnectionType,
 		DeviceType:     regData.DeviceType,
 		SDKVersion:     regData.SDKVersion,
+		Caps:           regData.Caps,
+		Schedule:       regData.Schedule,
+		Availability:   regData.Availability,
 	}
 
 	node, err := c.hub.nodeManager.RegisterNode(registration)
@@ -537,7 +666,13 @@ func (c *Client) handleRegistration(message *Message) {
 
 	// Store node information in client
 	c.nodeID = node.ID
+	c.mu.Lock()
 	c.deviceID = node.DeviceID
+	c.country = regData.Country
+	c.platform = regData.DeviceType
+	c.sdkVersion = regData.SDKVersion
+	c.halfClose = regData.HalfClose
+	c.mu.Unlock()
 
 	// Send registration success
 	response := Message{
@@ -551,6 +686,10 @@ func (c *Client) handleRegistration(message *Message) {
 	}
 
 	c.sendMessage(&response)
+	if verdict.Action == versionpolicy.ActionDeprecated {
+		c.sendVersionNotice("version_deprecated", verdict)
+	}
+	c.pushConfig(regData.ConfigVersion)
 	c.logger.Infof("Node registered: %s (device: %s, ip: %s, country: %s)", 
 		node.ID, node.DeviceID, c.clientIP, regData.Country)
 }
@@ -0,0 +1,260 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+
+	"node-registration/internal/nodemanager"
+)
+
+// newTestHub runs a hub and tunnel manager over an in-memory Redis. Postgres
+// is a mock with no expectations: the node manager treats its errors as
+// "not found" and keeps going on Redis.
+func newTestHub(t *testing.T) (*Hub, *TunnelManager, string) {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	entry := logrus.NewEntry(logger)
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	hub := NewHub(nodemanager.NewNodeManager(db, rdb, entry), entry)
+	go hub.Run()
+	tm := NewTunnelManager(hub, entry)
+	hub.SetTunnelManager(tm)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HandleNodeConnection(hub, w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return hub, tm, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// testNode speaks to the hub the way docker-node does
+type testNode struct {
+	conn *websocket.Conn
+	msgs chan *Message
+}
+
+func dialTestNode(t *testing.T, url string) *testNode {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial hub: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	n := &testNode{conn: conn, msgs: make(chan *Message, 256)}
+	go func() {
+		defer close(n.msgs)
+		for {
+			_, raw, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			// writePump batches queued messages into an array
+			var batch []*Message
+			if bytes.HasPrefix(raw, []byte("[")) {
+				json.Unmarshal(raw, &batch)
+			} else {
+				var m Message
+				if json.Unmarshal(raw, &m) == nil {
+					batch = append(batch, &m)
+				}
+			}
+			for _, m := range batch {
+				n.msgs <- m
+			}
+		}
+	}()
+	return n
+}
+
+func (n *testNode) send(t *testing.T, msgType string, data interface{}) {
+	t.Helper()
+	if err := n.conn.WriteJSON(map[string]interface{}{"type": msgType, "data": data}); err != nil {
+		t.Fatalf("send %s: %v", msgType, err)
+	}
+}
+
+// next returns the next message of the given type; an error message fails
+// the test
+func (n *testNode) next(t *testing.T, msgType string) map[string]interface{} {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case m, ok := <-n.msgs:
+			if !ok {
+				t.Fatalf("hub hung up waiting for %s", msgType)
+			}
+			data, _ := m.Data.(map[string]interface{})
+			if m.Type == msgType {
+				return data
+			}
+			if m.Type == "error" {
+				t.Fatalf("hub sent error %v waiting for %s", data["error"], msgType)
+			}
+		case <-deadline:
+			t.Fatalf("no %s from hub", msgType)
+		}
+	}
+}
+
+// register sends docker-node's hello, ip_info and register and returns the
+// node ID the hub assigned
+func (n *testNode) register(t *testing.T, deviceID string, extra map[string]interface{}) string {
+	t.Helper()
+	if err := n.conn.WriteJSON(map[string]interface{}{
+		"type": "hello", "node_id": deviceID, "sdk_version": "docker-1.0.0", "os": "docker", "token": "test",
+	}); err != nil {
+		t.Fatalf("hello: %v", err)
+	}
+	if err := n.conn.WriteJSON(map[string]interface{}{
+		"type": "ip_info", "ip_info": map[string]interface{}{"countryCode": "DE", "city": "Berlin"},
+	}); err != nil {
+		t.Fatalf("ip_info: %v", err)
+	}
+	reg := map[string]interface{}{
+		"device_id":       deviceID,
+		"country":         "DE",
+		"country_name":    "Germany",
+		"city":            "Berlin",
+		"connection_type": "wired",
+		"device_type":     "docker",
+		"sdk_version":     "2.0.0",
+		"tunnel_protocol": 2,
+	}
+	for k, v := range extra {
+		reg[k] = v
+	}
+	n.send(t, "register", reg)
+	nodeID, _ := n.next(t, "registration_success")["node_id"].(string)
+	if nodeID == "" {
+		t.Fatal("registration_success without node_id")
+	}
+	return nodeID
+}
+
+func TestHubRegistersDockerNode(t *testing.T) {
+	hub, _, url := newTestHub(t)
+	node := dialTestNode(t, url)
+
+	// Without identity checks the hub sends nothing first: the node registers
+	// after its greeting wait and gets registration_success
+	nodeID := node.register(t, "docker_test1", map[string]interface{}{
+		"availability": map[string]interface{}{"status": "available"},
+	})
+	if client := hub.GetClientByNodeID(nodeID); client == nil {
+		t.Fatalf("node %s not connected after registration", nodeID)
+	}
+
+	// docker-node's keepalive is its heartbeat
+	node.send(t, "keepalive", nil)
+	if ack := node.next(t, "heartbeat_ack"); ack["node_id"] != nodeID {
+		t.Fatalf("heartbeat_ack for %v, want %s", ack["node_id"], nodeID)
+	}
+}
+
+func TestHubHalfClosedTunnel(t *testing.T) {
+	_, tm, url := newTestHub(t)
+	node := dialTestNode(t, url)
+	nodeID := node.register(t, "docker_test2", map[string]interface{}{"half_close": true})
+
+	opened := make(chan *Tunnel, 1)
+	go func() {
+		tunnel, err := tm.OpenTunnel(nodeID, "example.com", "25")
+		if err != nil {
+			t.Errorf("OpenTunnel: %v", err)
+		}
+		opened <- tunnel
+	}()
+	open := node.next(t, "tunnel_open")
+	tunnelID, _ := open["tunnel_id"].(string)
+	node.send(t, "tunnel_response", map[string]interface{}{"tunnel_id": tunnelID, "success": true})
+	tunnel := <-opened
+	if tunnel == nil {
+		t.FailNow()
+	}
+
+	// The client sends a request and shuts down its write side: the node gets
+	// the data, then FIN
+	if err := tunnel.Write([]byte("QUIT\r\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := tunnel.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	data := node.next(t, "tunnel_data")
+	if payload, _ := base64.StdEncoding.DecodeString(data["data"].(string)); string(payload) != "QUIT\r\n" {
+		t.Fatalf("node got %q", payload)
+	}
+	if fin := node.next(t, "tunnel_data"); fin["fin"] != true || fin["eof"] == true {
+		t.Fatalf("after the data the node got %v, want FIN", fin)
+	}
+	if err := tunnel.Write([]byte("more")); err != ErrTunnelWriteClosed {
+		t.Fatalf("Write after CloseWrite = %v", err)
+	}
+
+	// The target still answers, then finishes: Read drains the reply and ends
+	// with EOF, and the hub closes the tunnel
+	node.send(t, "tunnel_data", map[string]interface{}{"tunnel_id": tunnelID, "data": base64.StdEncoding.EncodeToString([]byte("221 Bye\r\n"))})
+	node.send(t, "tunnel_data", map[string]interface{}{"tunnel_id": tunnelID, "fin": true})
+	reply, err := tunnel.ReadWithTimeout(5 * time.Second)
+	if err != nil || string(reply) != "221 Bye\r\n" {
+		t.Fatalf("Read = %q, %v", reply, err)
+	}
+	if _, err := tunnel.ReadWithTimeout(5 * time.Second); err != io.EOF {
+		t.Fatalf("Read after the node's FIN = %v, want io.EOF", err)
+	}
+	if eof := node.next(t, "tunnel_data"); eof["eof"] != true {
+		t.Fatalf("node got %v, want EOF once both sides finished", eof)
+	}
+	if tm.GetTunnel(tunnelID) != nil {
+		t.Fatal("tunnel still registered after both sides finished")
+	}
+}
+
+func TestHubHalfCloseUnsupported(t *testing.T) {
+	// A node registering without half_close is never sent FIN
+	_, tm, url := newTestHub(t)
+	node := dialTestNode(t, url)
+	nodeID := node.register(t, "docker_test3", nil)
+
+	opened := make(chan *Tunnel, 1)
+	go func() {
+		tunnel, _ := tm.OpenTunnel(nodeID, "example.com", "80")
+		opened <- tunnel
+	}()
+	tunnelID, _ := node.next(t, "tunnel_open")["tunnel_id"].(string)
+	node.send(t, "tunnel_response", map[string]interface{}{"tunnel_id": tunnelID, "success": true})
+	tunnel := <-opened
+	if tunnel == nil {
+		t.Fatal("OpenTunnel failed")
+	}
+	if err := tunnel.CloseWrite(); err != ErrHalfCloseUnsupported {
+		t.Fatalf("CloseWrite = %v, want ErrHalfCloseUnsupported", err)
+	}
+	if err := tunnel.Write([]byte("still open")); err != nil {
+		t.Fatalf("Write after a refused CloseWrite: %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package websocket
+
+import (
+	"encoding/json"
+	"time"
+
+	"node-registration/internal/identity"
+)
+
+// AuthResponse answers an auth_challenge: the node's Ed25519 public key and
+// its signature over identity.SignedMessage(nonce, device_id), both base64
+type AuthResponse struct {
+	DeviceID  string `json:"device_id"`
+	PublicKey string `json:"public_key"`
+	Signature string `json:"signature"`
+}
+
+// SetIdentityStore enables the identity handshake: every connection gets an
+// auth_challenge and registrations are checked against pinned keys
+func (h *Hub) SetIdentityStore(store *identity.Store, mode identity.Mode) {
+	h.identities = store
+	h.identityMode = mode
+}
+
+// DisconnectDevice closes the connections of a device, e.g. after its
+// identity is revoked or rotated; returns how many were closed
+func (h *Hub) DisconnectDevice(deviceID string) int {
+	h.clientsMu.RLock()
+	defer h.clientsMu.RUnlock()
+	closed := 0
+	for client := range h.clients {
+		if registered, verified := client.devices(); registered == deviceID || verified == deviceID {
+			client.conn.Close()
+			closed++
+		}
+	}
+	return closed
+}
+
+// identityEnabled reports whether the hub checks node identities
+func (h *Hub) identityEnabled() bool {
+	return h.identities != nil && h.identityMode != identity.ModeOff
+}
+
+// sendChallenge sends a new connection its auth_challenge
+func (c *Client) sendChallenge() {
+	if !c.hub.identityEnabled() {
+		return
+	}
+	nonce, err := identity.NewChallenge()
+	if err != nil {
+		c.logger.Errorf("Failed to create identity challenge: %v", err)
+		return
+	}
+	c.challenge = nonce
+	c.sendMessage(&Message{
+		Type: "auth_challenge",
+		Data: map[string]interface{}{
+			"nonce":     nonce,
+			"mode":      c.hub.identityMode,
+			"timestamp": time.Now().UTC(),
+		},
+	})
+}
+
+func (c *Client) handleAuthResponse(message *Message) {
+	if !c.hub.identityEnabled() {
+		return
+	}
+	dataBytes, err := json.Marshal(message.Data)
+	if err != nil {
+		c.sendError("Failed to parse auth response")
+		return
+	}
+	var resp AuthResponse
+	if err := json.Unmarshal(dataBytes, &resp); err != nil || resp.DeviceID == "" {
+		c.sendError("Invalid auth response format")
+		return
+	}
+
+	// A challenge answers once
+	nonce := c.challenge
+	c.challenge = ""
+	if nonce == "" {
+		c.authFailed(resp.DeviceID, "no pending challenge")
+		return
+	}
+	if err := identity.Verify(resp.PublicKey, nonce, resp.DeviceID, resp.Signature); err != nil {
+		c.authFailed(resp.DeviceID, err.Error())
+		return
+	}
+	id, err := c.hub.identities.Authenticate(resp.DeviceID, resp.PublicKey)
+	if err != nil {
+		c.authFailed(resp.DeviceID, err.Error())
+		return
+	}
+
+	c.mu.Lock()
+	c.verifiedDevice = resp.DeviceID
+	c.mu.Unlock()
+	c.sendMessage(&Message{
+		Type: "auth_success",
+		Data: map[string]interface{}{
+			"device_id":   resp.DeviceID,
+			"fingerprint": id.Fingerprint,
+			"timestamp":   time.Now().UTC(),
+		},
+	})
+	c.logger.Infof("Device %s proved key %s", resp.DeviceID, id.Fingerprint)
+}
+
+func (c *Client) authFailed(deviceID, reason string) {
+	c.logger.Warnf("Identity check failed for device %s: %s", deviceID, reason)
+	c.sendMessage(&Message{
+		Type: "auth_failed",
+		Data: map[string]interface{}{
+			"device_id": deviceID,
+			"error":     reason,
+			"timestamp": time.Now().UTC(),
+		},
+	})
+}
+
+// checkIdentity decides whether a registration for deviceID may proceed
+func (c *Client) checkIdentity(deviceID string) error {
+	if !c.hub.identityEnabled() {
+		return nil
+	}
+	if c.verifiedDevice != "" {
+		if c.verifiedDevice != deviceID {
+			return identity.ErrWrongDevice
+		}
+		return nil
+	}
+	if c.hub.identityMode == identity.ModeRequired {
+		return identity.ErrUnverified
+	}
+
+	// Optional: unsigned only while the device has no key pinned
+	id, err := c.hub.identities.Get(deviceID)
+	if err != nil {
+		return err
+	}
+	if id == nil {
+		return nil
+	}
+	if id.Status == identity.StatusRevoked {
+		return identity.ErrRevoked
+	}
+	return identity.ErrUnverified
+}
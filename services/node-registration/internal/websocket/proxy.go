@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/base64"
 	"errors"
+	"io"
 	"sync"
 	"time"
 
@@ -180,6 +181,11 @@ type StreamTunnel struct {
 	DataCh    chan []byte
 	CloseCh   chan struct{}
 	pm        *ProxyManager
+
+	// Half-close state: writeDoneCh closed by CloseWrite, readDoneCh by the node's FIN
+	halfMu      sync.Mutex
+	writeDoneCh chan struct{}
+	readDoneCh  chan struct{}
 }
 
 // TunnelRequest for opening a TCP tunnel
@@ -194,6 +200,7 @@ type TunnelData struct {
 	RequestID string `json:"request_id"`
 	Data      string `json:"data"` // Base64 encoded
 	EOF       bool   `json:"eof"`
+	FIN       bool   `json:"fin,omitempty"` // Half-close: sender done writing
 }
 
 // OpenTunnel opens a TCP tunnel through a node
@@ -209,9 +216,11 @@ func (pm *ProxyManager) OpenTunnel(ctx context.Context, nodeID string, host, por
 		RequestID: requestID,
 		NodeID:    nodeID,
 		Client:    client,
-		DataCh:    make(chan []byte, 100),
-		CloseCh:   make(chan struct{}),
-		pm:        pm,
+		DataCh:      make(chan []byte, 100),
+		CloseCh:     make(chan struct{}),
+		pm:          pm,
+		writeDoneCh: make(chan struct{}),
+		readDoneCh:  make(chan struct{}),
 	}
 
 	// Register tunnel for receiving data
@@ -244,6 +253,8 @@ func (t *StreamTunnel) Write(data []byte) error {
 	select {
 	case <-t.CloseCh:
 		return errors.New("tunnel closed")
+	case <-t.writeDoneCh:
+		return errors.New("tunnel write side closed")
 	default:
 	}
 
@@ -260,6 +271,73 @@ func (t *StreamTunnel) Write(data []byte) error {
 	return nil
 }
 
+// CloseWrite half-closes the tunnel: the node shuts down its write side to the
+// target while data keeps flowing back until the node sends FIN. Nodes that
+// didn't register with half_close get ErrHalfCloseUnsupported.
+func (t *StreamTunnel) CloseWrite() error {
+	if !t.Client.supportsHalfClose() {
+		return ErrHalfCloseUnsupported
+	}
+	t.halfMu.Lock()
+	select {
+	case <-t.CloseCh:
+		t.halfMu.Unlock()
+		return errors.New("tunnel closed")
+	case <-t.writeDoneCh:
+		t.halfMu.Unlock()
+		return nil
+	default:
+		close(t.writeDoneCh)
+	}
+	t.halfMu.Unlock()
+
+	t.Client.sendMessage(&Message{
+		Type: "tunnel_data",
+		Data: &TunnelData{
+			RequestID: t.RequestID,
+			FIN:       true,
+		},
+	})
+
+	if t.isReadClosed() {
+		return t.Close()
+	}
+	return nil
+}
+
+// HandleFIN marks the node side as finished; Read returns io.EOF once drained
+func (t *StreamTunnel) HandleFIN() {
+	t.halfMu.Lock()
+	select {
+	case <-t.readDoneCh:
+	default:
+		close(t.readDoneCh)
+	}
+	t.halfMu.Unlock()
+
+	if t.isWriteClosed() {
+		t.Close()
+	}
+}
+
+func (t *StreamTunnel) isReadClosed() bool {
+	select {
+	case <-t.readDoneCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *StreamTunnel) isWriteClosed() bool {
+	select {
+	case <-t.writeDoneCh:
+		return true
+	default:
+		return false
+	}
+}
+
 // Close closes the tunnel
 func (t *StreamTunnel) Close() error {
 	select {
@@ -293,6 +371,13 @@ func (t *StreamTunnel) Read() ([]byte, error) {
 	select {
 	case data := <-t.DataCh:
 		return data, nil
+	case <-t.readDoneCh:
+		select {
+		case data := <-t.DataCh:
+			return data, nil
+		default:
+			return nil, io.EOF
+		}
 	case <-t.CloseCh:
 		return nil, errors.New("tunnel closed")
 	}
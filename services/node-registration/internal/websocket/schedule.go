@@ -0,0 +1,64 @@
+package websocket
+
+import (
+	"encoding/json"
+	"time"
+
+	"node-registration/internal/nodemanager"
+)
+
+// handleAvailability records a node going outside its sharing schedule,
+// being paused or coming back. The node stays connected throughout.
+func (c *Client) handleAvailability(message *Message) {
+	if c.nodeID == "" {
+		return
+	}
+	dataBytes, err := json.Marshal(message.Data)
+	if err != nil {
+		return
+	}
+	var availability nodemanager.NodeAvailability
+	if err := json.Unmarshal(dataBytes, &availability); err != nil {
+		c.logger.Warnf("Invalid availability from node %s: %v", c.nodeID, err)
+		return
+	}
+	if err := c.hub.nodeManager.SetAvailability(c.nodeID, &availability); err != nil {
+		c.logger.Warnf("Failed to update availability of node %s: %v", c.nodeID, err)
+	}
+}
+
+// PauseDevice asks a device's connections to stop taking traffic until
+// until, or until resumed when until is nil; returns how many were sent.
+// The node answers with an availability message.
+func (h *Hub) PauseDevice(deviceID string, until *time.Time) int {
+	data := map[string]interface{}{"timestamp": time.Now().UTC()}
+	if until != nil {
+		data["until"] = until.UTC()
+	}
+	return h.sendToDevice(deviceID, &Message{Type: "pause", Data: data})
+}
+
+// ResumeDevice lifts a pause; returns how many connections were sent it
+func (h *Hub) ResumeDevice(deviceID string) int {
+	return h.sendToDevice(deviceID, &Message{
+		Type: "resume",
+		Data: map[string]interface{}{"timestamp": time.Now().UTC()},
+	})
+}
+
+func (h *Hub) sendToDevice(deviceID string, message *Message) int {
+	h.clientsMu.RLock()
+	targets := make([]*Client, 0, 1)
+	for client := range h.clients {
+		if registered, _ := client.devices(); registered == deviceID {
+			targets = append(targets, client)
+		}
+	}
+	h.clientsMu.RUnlock()
+
+	// sendMessage may unregister a stuck client, so not under the lock
+	for _, client := range targets {
+		client.sendMessage(message)
+	}
+	return len(targets)
+}
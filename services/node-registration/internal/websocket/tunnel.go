@@ -2,6 +2,7 @@ package websocket
 
 import (
 	"encoding/base64"
+	"io"
 	"sync"
 	"time"
 
@@ -11,10 +12,11 @@ import (
 
 // TunnelManager manages bidirectional TCP tunnels through WebSocket
 type TunnelManager struct {
-	hub      *Hub
-	tunnels  map[string]*Tunnel
-	mu       sync.RWMutex
-	logger   *logrus.Entry
+	hub     *Hub
+	tunnels map[string]*Tunnel
+	udp     map[string]*UDPAssociation
+	mu      sync.RWMutex
+	logger  *logrus.Entry
 }
 
 // Tunnel represents an active TCP tunnel through a node
@@ -24,15 +26,25 @@ type Tunnel struct {
 	Host      string
 	Port      string
 	Client    *Client
-	DataCh    chan []byte    // Data from node to proxy
-	WriteCh   chan []byte    // Data from proxy to node
+	DataCh    chan []byte // Data from node to proxy
+	WriteCh   chan []byte // Data from proxy to node
 	CloseCh   chan struct{}
-	ReadyCh   chan bool      // Signals when tunnel is ready (SDK confirmed)
+	ReadyCh   chan bool // Signals when tunnel is ready (SDK confirmed)
 	CreatedAt time.Time
 	mu        sync.Mutex
 	closed    bool
 	ready     bool
 	readyErr  string
+
+	// Half-close state: writeClosed = FIN sent to node, readClosed = FIN received from node
+	writeClosed bool
+	readClosed  bool
+	readDoneCh  chan struct{}
+
+	// SOCKS5 BIND: the node's listener address and the peer that connected to it
+	BindAddr string
+	BindPeer string
+	acceptCh chan bool
 }
 
 // TunnelOpenRequest is sent to node to open a tunnel
@@ -49,11 +61,16 @@ type TunnelOpenResponse struct {
 	Error    string `json:"error,omitempty"`
 }
 
-// TunnelDataMessage for sending/receiving data
+// finSendTimeout bounds how long CloseWrite waits for room in WriteCh
+const finSendTimeout = 5 * time.Second
+
+// TunnelDataMessage for sending/receiving data. FIN is only sent to nodes
+// that registered with half_close.
 type TunnelDataMessage struct {
 	TunnelID string `json:"tunnel_id"`
-	Data     string `json:"data"` // Base64 encoded
-	EOF      bool   `json:"eof"`  // End of stream
+	Data     string `json:"data"`          // Base64 encoded
+	EOF      bool   `json:"eof"`           // End of stream
+	FIN      bool   `json:"fin,omitempty"` // Sender done writing, still reading (half-close)
 }
 
 // NewTunnelManager creates a new tunnel manager
@@ -66,6 +83,7 @@ func NewTunnelManager(hub *Hub, logger *logrus.Entry) *TunnelManager {
 	tm := &TunnelManager{
 		hub:     hub,
 		tunnels: make(map[string]*Tunnel),
+		udp:     make(map[string]*UDPAssociation),
 		logger:  logger.WithField("component", "tunnel-manager"),
 	}
 
@@ -85,16 +103,17 @@ func (tm *TunnelManager) OpenTunnel(nodeID, host, port string) (*Tunnel, error)
 	tunnelID := uuid.New().String()
 
 	tunnel := &Tunnel{
-		ID:        tunnelID,
-		NodeID:    nodeID,
-		Host:      host,
-		Port:      port,
-		Client:    client,
-		DataCh:    make(chan []byte, 256),
-		WriteCh:   make(chan []byte, 256),
-		CloseCh:   make(chan struct{}),
-		ReadyCh:   make(chan bool, 1),
-		CreatedAt: time.Now(),
+		ID:         tunnelID,
+		NodeID:     nodeID,
+		Host:       host,
+		Port:       port,
+		Client:     client,
+		DataCh:     make(chan []byte, 256),
+		WriteCh:    make(chan []byte, 256),
+		CloseCh:    make(chan struct{}),
+		ReadyCh:    make(chan bool, 1),
+		readDoneCh: make(chan struct{}),
+		CreatedAt:  time.Now(),
 	}
 
 	tm.mu.Lock()
@@ -142,6 +161,17 @@ func (tm *TunnelManager) tunnelWriter(tunnel *Tunnel) {
 	for {
 		select {
 		case data := <-tunnel.WriteCh:
+			if data == nil {
+				// CloseWrite marker — FIN goes out after everything queued before it
+				tunnel.Client.sendMessage(&Message{
+					Type: "tunnel_data",
+					Data: &TunnelDataMessage{TunnelID: tunnel.ID, FIN: true},
+				})
+				if tunnel.bothClosed() {
+					go tm.CloseTunnel(tunnel.ID)
+				}
+				return
+			}
 			msg := &Message{
 				Type: "tunnel_data",
 				Data: &TunnelDataMessage{
@@ -151,7 +181,7 @@ func (tm *TunnelManager) tunnelWriter(tunnel *Tunnel) {
 				},
 			}
 			tunnel.Client.sendMessage(msg)
-			
+
 		case <-tunnel.CloseCh:
 			return
 		}
@@ -186,7 +216,7 @@ func (tm *TunnelManager) CloseTunnel(tunnelID string) {
 			},
 		}
 		tunnel.Client.sendMessage(msg)
-		
+
 		tm.logger.Infof("Closed tunnel %s", tunnelID)
 	}
 }
@@ -233,6 +263,15 @@ func (tm *TunnelManager) HandleTunnelData(data *TunnelDataMessage) {
 		return
 	}
 
+	if data.FIN {
+		tm.logger.Infof("Tunnel %s received FIN from SDK", data.TunnelID)
+		tunnel.closeRead()
+		if tunnel.bothClosed() {
+			tm.CloseTunnel(data.TunnelID)
+		}
+		return
+	}
+
 	// Decode and forward data
 	decoded, err := base64.StdEncoding.DecodeString(data.Data)
 	if err != nil {
@@ -271,11 +310,83 @@ func (t *Tunnel) IsClosed() bool {
 	return t.closed
 }
 
+// CloseWrite half-closes the tunnel: the node shuts down the write side of its
+// target connection once queued data is flushed, and Read keeps working until
+// the node sends its own FIN. Nodes that didn't register with half_close get
+// ErrHalfCloseUnsupported and the tunnel stays open both ways.
+func (t *Tunnel) CloseWrite() error {
+	if !t.Client.supportsHalfClose() {
+		return ErrHalfCloseUnsupported
+	}
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return ErrTunnelClosed
+	}
+	if t.writeClosed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.writeClosed = true
+	t.mu.Unlock()
+
+	// nil is the FIN marker for tunnelWriter. It must not be dropped, or the
+	// node never sees EOF: wait for room, and if none comes reopen the write
+	// side so the caller can retry or close.
+	timer := time.NewTimer(finSendTimeout)
+	defer timer.Stop()
+	select {
+	case t.WriteCh <- nil:
+		return nil
+	case <-t.CloseCh:
+		return ErrTunnelClosed
+	case <-timer.C:
+		t.mu.Lock()
+		t.writeClosed = false
+		t.mu.Unlock()
+		return ErrTunnelFull
+	}
+}
+
+// closeRead marks the node side as finished; Read returns io.EOF once drained
+func (t *Tunnel) closeRead() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.readClosed {
+		return
+	}
+	t.readClosed = true
+	close(t.readDoneCh)
+}
+
+// IsWriteClosed returns true once CloseWrite has been called
+func (t *Tunnel) IsWriteClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.writeClosed
+}
+
+// IsReadClosed returns true once the node has sent FIN
+func (t *Tunnel) IsReadClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.readClosed
+}
+
+func (t *Tunnel) bothClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.writeClosed && t.readClosed
+}
+
 // Write sends data through the tunnel to the target
 func (t *Tunnel) Write(data []byte) error {
 	if t.IsClosed() {
 		return ErrTunnelClosed
 	}
+	if t.IsWriteClosed() {
+		return ErrTunnelWriteClosed
+	}
 
 	select {
 	case t.WriteCh <- data:
@@ -287,13 +398,16 @@ func (t *Tunnel) Write(data []byte) error {
 	}
 }
 
-// Read receives data from the target through the tunnel
+// Read receives data from the target through the tunnel.
+// Returns io.EOF after the node's FIN once buffered data is drained.
 func (t *Tunnel) Read() ([]byte, error) {
 	select {
 	case data := <-t.DataCh:
 		return data, nil
+	case <-t.readDoneCh:
+		return t.drainAfterFIN()
 	case <-t.CloseCh:
-		return nil, ErrTunnelClosed
+		return t.readAfterClose()
 	}
 }
 
@@ -302,13 +416,33 @@ func (t *Tunnel) ReadWithTimeout(timeout time.Duration) ([]byte, error) {
 	select {
 	case data := <-t.DataCh:
 		return data, nil
+	case <-t.readDoneCh:
+		return t.drainAfterFIN()
 	case <-t.CloseCh:
-		return nil, ErrTunnelClosed
+		return t.readAfterClose()
 	case <-time.After(timeout):
 		return nil, ErrTunnelTimeout
 	}
 }
 
+// readAfterClose is Read on a closed tunnel: one closed after both sides
+// sent FIN still hands out what the node sent, then io.EOF
+func (t *Tunnel) readAfterClose() ([]byte, error) {
+	if t.IsReadClosed() {
+		return t.drainAfterFIN()
+	}
+	return nil, ErrTunnelClosed
+}
+
+func (t *Tunnel) drainAfterFIN() ([]byte, error) {
+	select {
+	case data := <-t.DataCh:
+		return data, nil
+	default:
+		return nil, io.EOF
+	}
+}
+
 // cleanupExpiredTunnels removes old tunnels
 func (tm *TunnelManager) cleanupExpiredTunnels() {
 	ticker := time.NewTicker(30 * time.Second)
@@ -331,10 +465,13 @@ func (tm *TunnelManager) cleanupExpiredTunnels() {
 
 // Errors
 var (
-	ErrNodeNotConnected = &TunnelError{"node not connected"}
-	ErrTunnelClosed     = &TunnelError{"tunnel closed"}
-	ErrTunnelFull       = &TunnelError{"tunnel buffer full"}
-	ErrTunnelTimeout    = &TunnelError{"tunnel read timeout"}
+	ErrNodeNotConnected  = &TunnelError{"node not connected"}
+	ErrTunnelClosed      = &TunnelError{"tunnel closed"}
+	ErrTunnelWriteClosed = &TunnelError{"tunnel write side closed"}
+	ErrTunnelFull        = &TunnelError{"tunnel buffer full"}
+	ErrTunnelTimeout     = &TunnelError{"tunnel read timeout"}
+
+	ErrHalfCloseUnsupported = &TunnelError{"node does not support half-close"}
 )
 
 type TunnelError struct {
@@ -0,0 +1,188 @@
+package websocket
+
+import (
+	"encoding/base64"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UDPAssociation relays SOCKS5 UDP ASSOCIATE datagrams through a node.
+// Datagrams carry the SOCKS5 UDP header without RSV/FRAG:
+// [1B atyp][addr][2B port BE][data] — destination outbound, source inbound.
+type UDPAssociation struct {
+	ID        string
+	NodeID    string
+	Client    *Client
+	DataCh    chan []byte // Datagrams from node to proxy
+	CloseCh   chan struct{}
+	ReadyCh   chan bool
+	CreatedAt time.Time
+
+	BytesSent int64
+	BytesRecv int64
+
+	readyErr  string
+	closeOnce sync.Once
+}
+
+// UDPOpenRequest is sent to node to open a UDP association
+type UDPOpenRequest struct {
+	AssocID     string `json:"assoc_id"`
+	IdleTimeout int    `json:"idle_timeout,omitempty"` // Seconds without traffic before the node closes it
+}
+
+// UDPOpenResponse from node
+type UDPOpenResponse struct {
+	AssocID string `json:"assoc_id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// UDPDataMessage carries one datagram in either direction
+type UDPDataMessage struct {
+	AssocID string `json:"assoc_id"`
+	Data    string `json:"data"` // Base64 encoded [atyp][addr][port][data]
+}
+
+// UDPCloseMessage ends an association from either side
+type UDPCloseMessage struct {
+	AssocID string `json:"assoc_id"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// OpenUDPAssociation asks the node for a UDP socket and waits for confirmation
+func (tm *TunnelManager) OpenUDPAssociation(nodeID string, idleTimeout time.Duration) (*UDPAssociation, error) {
+	client := tm.hub.GetClientByNodeID(nodeID)
+	if client == nil {
+		return nil, ErrNodeNotConnected
+	}
+
+	assoc := &UDPAssociation{
+		ID:        uuid.New().String(),
+		NodeID:    nodeID,
+		Client:    client,
+		DataCh:    make(chan []byte, 256),
+		CloseCh:   make(chan struct{}),
+		ReadyCh:   make(chan bool, 1),
+		CreatedAt: time.Now(),
+	}
+
+	tm.mu.Lock()
+	tm.udp[assoc.ID] = assoc
+	tm.mu.Unlock()
+
+	client.sendMessage(&Message{
+		Type: "udp_open",
+		Data: &UDPOpenRequest{
+			AssocID:     assoc.ID,
+			IdleTimeout: int(idleTimeout / time.Second),
+		},
+	})
+
+	select {
+	case success := <-assoc.ReadyCh:
+		if !success {
+			tm.forgetUDP(assoc.ID)
+			return nil, &TunnelError{assoc.readyErr}
+		}
+	case <-time.After(6 * time.Second):
+		tm.forgetUDP(assoc.ID)
+		return nil, ErrTunnelTimeout
+	}
+
+	tm.logger.Infof("UDP association %s open via node %s", assoc.ID, nodeID)
+	return assoc, nil
+}
+
+// GetUDPAssociation returns an open association by ID
+func (tm *TunnelManager) GetUDPAssociation(assocID string) *UDPAssociation {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.udp[assocID]
+}
+
+// CloseUDPAssociation tears down an association and tells the node
+func (tm *TunnelManager) CloseUDPAssociation(assocID string) {
+	assoc := tm.forgetUDP(assocID)
+	if assoc == nil {
+		return
+	}
+	assoc.Client.sendMessage(&Message{
+		Type: "udp_close",
+		Data: &UDPCloseMessage{AssocID: assocID},
+	})
+	tm.logger.Infof("UDP association %s closed (sent=%d recv=%d)", assocID,
+		atomic.LoadInt64(&assoc.BytesSent), atomic.LoadInt64(&assoc.BytesRecv))
+}
+
+// forgetUDP drops an association without signalling the node.
+// Returns nil if it was already gone.
+func (tm *TunnelManager) forgetUDP(assocID string) *UDPAssociation {
+	tm.mu.Lock()
+	assoc, ok := tm.udp[assocID]
+	delete(tm.udp, assocID)
+	tm.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	assoc.closeOnce.Do(func() { close(assoc.CloseCh) })
+	return assoc
+}
+
+// HandleUDPResponse handles the node's answer to udp_open
+func (tm *TunnelManager) HandleUDPResponse(resp *UDPOpenResponse) {
+	assoc := tm.GetUDPAssociation(resp.AssocID)
+	if assoc == nil {
+		return
+	}
+	assoc.readyErr = resp.Error
+	select {
+	case assoc.ReadyCh <- resp.Success:
+	default:
+	}
+}
+
+// HandleUDPData queues a datagram from the node, dropping it if the proxy is behind
+func (tm *TunnelManager) HandleUDPData(data *UDPDataMessage) {
+	assoc := tm.GetUDPAssociation(data.AssocID)
+	if assoc == nil {
+		return
+	}
+	payload, err := base64.StdEncoding.DecodeString(data.Data)
+	if err != nil {
+		return
+	}
+	select {
+	case assoc.DataCh <- payload:
+		atomic.AddInt64(&assoc.BytesRecv, int64(len(payload)))
+	default:
+	}
+}
+
+// HandleUDPClose handles the node closing an association (idle timeout, socket error)
+func (tm *TunnelManager) HandleUDPClose(msg *UDPCloseMessage) {
+	if tm.forgetUDP(msg.AssocID) != nil {
+		tm.logger.Infof("UDP association %s closed by node: %s", msg.AssocID, msg.Reason)
+	}
+}
+
+// Send forwards one datagram to the node
+func (a *UDPAssociation) Send(payload []byte) error {
+	select {
+	case <-a.CloseCh:
+		return ErrTunnelClosed
+	default:
+	}
+	a.Client.sendMessage(&Message{
+		Type: "udp_data",
+		Data: &UDPDataMessage{
+			AssocID: a.ID,
+			Data:    base64.StdEncoding.EncodeToString(payload),
+		},
+	})
+	atomic.AddInt64(&a.BytesSent, int64(len(payload)))
+	return nil
+}
@@ -0,0 +1,31 @@
+package websocket
+
+import (
+	"time"
+
+	"node-registration/internal/versionpolicy"
+)
+
+// SetVersionPolicy sets the policy registrations are checked against.
+// Without one the default minimum applies to every platform.
+func (h *Hub) SetVersionPolicy(p *versionpolicy.Policy) {
+	h.versions = p
+}
+
+// sendVersionNotice tells the node its build must (upgrade_required) or
+// should (version_deprecated) be upgraded, and where to get a new one
+func (c *Client) sendVersionNotice(msgType string, v versionpolicy.Verdict) {
+	c.sendMessage(&Message{
+		Type: msgType,
+		Data: map[string]interface{}{
+			"platform":       v.Platform,
+			"version":        v.Version,
+			"reason":         v.Reason,
+			"min_version":    v.MinVersion,
+			"latest_version": v.LatestVersion,
+			"download_url":   v.DownloadURL,
+			"message":        v.Message,
+			"timestamp":      time.Now().UTC(),
+		},
+	})
+}
@@ -242,6 +242,10 @@ func subscribeToEvents(ctx context.Context, rdb *redis.Client, emailSender *emai
 			go emailSender.SendPaymentFailed(event.Email, event.Name)
 			go webhookDispatcher.Dispatch(ctx, event.CustomerID, webhooks.EventPaymentFailed, event.Data)
 
+		case string(webhooks.EventSessionRotated):
+			// Sent by the proxy gateway with the old and new exit IP
+			go webhookDispatcher.Dispatch(ctx, event.CustomerID, webhooks.EventSessionRotated, event.Data)
+
 		case "api_key_created":
 			keyName := event.Data["key_name"].(string)
 			apiKey := event.Data["api_key"].(string)
@@ -24,6 +24,7 @@ const (
 	EventNodeOffline      EventType = "node.offline"
 	EventRequestCompleted EventType = "request.completed"
 	EventRequestFailed    EventType = "request.failed"
+	EventSessionRotated   EventType = "session.rotated"
 	EventQuotaWarning     EventType = "quota.warning"
 	EventQuotaExceeded    EventType = "quota.exceeded"
 	EventAPIKeyCreated    EventType = "api_key.created"
@@ -283,6 +284,7 @@ func GetEventTypes() []EventType {
 		EventNodeOffline,
 		EventRequestCompleted,
 		EventRequestFailed,
+		EventSessionRotated,
 		EventQuotaWarning,
 		EventQuotaExceeded,
 		EventAPIKeyCreated,
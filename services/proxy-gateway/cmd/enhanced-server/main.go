@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -22,6 +23,7 @@ import (
 	"proxy-gateway/internal/headers"
 	"proxy-gateway/internal/metrics"
 	"proxy-gateway/internal/nodepool"
+	"proxy-gateway/internal/policy"
 	"proxy-gateway/internal/proxy"
 	"proxy-gateway/internal/session"
 )
@@ -36,6 +38,7 @@ type EnhancedProxyGateway struct {
 	headerManager  *headers.HeaderManager
 	analytics      *analytics.AnalyticsManager
 	metrics        *metrics.Collector
+	destinations   *policy.Engine
 	logger         *logrus.Entry
 
 	// Proxy servers
@@ -82,6 +85,12 @@ type Config struct {
 	MetricsPort  string
 	NodeRegURL   string
 	Environment  string
+	AdminToken   string // bearer token for /api/v1/admin; admin routes are off without it
+
+	// Destination policy, see policy.Engine
+	DestinationPolicyFile    string
+	DestinationCategoriesDir string
+	DestinationAuditLog      string
 }
 
 func loadConfig() *Config {
@@ -94,6 +103,23 @@ func loadConfig() *Config {
 		MetricsPort: getEnv("METRICS_PORT", "8091"),
 		NodeRegURL:  getEnv("NODE_REGISTRATION_URL", "http://node-registration:8001"),
 		Environment: getEnv("ENVIRONMENT", "development"),
+		AdminToken:  getEnv("ADMIN_API_TOKEN", ""),
+
+		DestinationPolicyFile:    getEnv("DESTINATION_POLICY_FILE", ""),
+		DestinationCategoriesDir: getEnv("DESTINATION_CATEGORIES_DIR", ""),
+		DestinationAuditLog:      getEnv("DESTINATION_AUDIT_LOG", ""),
+	}
+}
+
+// adminAuthMiddleware requires the ADMIN_API_TOKEN bearer token
+func adminAuthMiddleware(token string) gin.HandlerFunc {
+	expected := []byte("Bearer " + token)
+	return func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), expected) != 1 {
+			c.AbortWithStatusJSON(401, gin.H{"error": "admin token required"})
+			return
+		}
+		c.Next()
 	}
 }
 
@@ -137,6 +163,18 @@ func NewEnhancedProxyGateway(config *Config, logger *logrus.Entry) (*EnhancedPro
 		authenticator, nodePool, wsNodePool, sessionManager, 
 		headerManager, metricsCollector, logger)
 
+	// Destination policy, enforced by both proxies
+	auditLog, err := policy.NewAuditLog(config.DestinationAuditLog, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open destination audit log: %v", err)
+	}
+	destinations, err := policy.NewEngine(config.DestinationPolicyFile, config.DestinationCategoriesDir, auditLog, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load destination policy: %v", err)
+	}
+	httpProxy.SetDestinationPolicy(destinations)
+	socks5Proxy.SetDestinationPolicy(destinations)
+
 	gateway := &EnhancedProxyGateway{
 		db:             db,
 		rdb:            rdb,
@@ -147,13 +185,14 @@ func NewEnhancedProxyGateway(config *Config, logger *logrus.Entry) (*EnhancedPro
 		headerManager:  headerManager,
 		analytics:      analyticsManager,
 		metrics:        metricsCollector,
+		destinations:   destinations,
 		logger:         logger,
 		httpProxy:      httpProxy,
 		socks5Proxy:    socks5Proxy,
 	}
 
 	// Setup API server
-	gateway.setupAPIServer()
+	gateway.setupAPIServer(config.AdminToken)
 
 	return gateway, nil
 }
@@ -209,7 +248,7 @@ func (g *EnhancedProxyGateway) Start(config *Config) error {
 	return nil
 }
 
-func (g *EnhancedProxyGateway) setupAPIServer() {
+func (g *EnhancedProxyGateway) setupAPIServer(adminToken string) {
 	if g.logger.Logger.Level == logrus.DebugLevel {
 		gin.SetMode(gin.DebugMode)
 	} else {
@@ -252,6 +291,19 @@ func (g *EnhancedProxyGateway) setupAPIServer() {
 		v1.GET("/sessions/:id", g.handleGetSession)
 		v1.DELETE("/sessions/:id", g.handleDeleteSession)
 		v1.POST("/sessions/:id/rotate", g.handleRotateSession)
+		v1.GET("/sessions/:id/history", g.handleGetSessionHistory)
+		
+		// Admin endpoints: session handoff between deployments, destination
+		// policy audit and reload
+		if adminToken != "" {
+			admin := v1.Group("/admin", adminAuthMiddleware(adminToken))
+			admin.GET("/sessions/export", g.handleExportSessions)
+			admin.POST("/sessions/import", g.handleImportSessions)
+			admin.GET("/policy/audit", g.handleGetPolicyAudit)
+			admin.POST("/policy/reload", g.handleReloadPolicy)
+		} else {
+			g.logger.Warn("ADMIN_API_TOKEN not set, admin endpoints disabled")
+		}
 		
 		// Analytics
 		v1.GET("/analytics/metrics", g.handleGetMetrics)
@@ -266,6 +318,7 @@ func (g *EnhancedProxyGateway) setupAPIServer() {
 		// Node management
 		v1.GET("/nodes", g.handleGetNodes)
 		v1.GET("/nodes/:id", g.handleGetNode)
+		v1.GET("/nodes/:id/availability", g.handleGetNodeAvailability)
 		
 		// Configuration
 		v1.GET("/profiles", g.handleGetProfiles)
@@ -324,6 +377,7 @@ func (g *EnhancedProxyGateway) handleCreateSession(c *gin.Context) {
 		City          string `json:"city"`
 		SessionType   string `json:"session_type"`
 		Lifetime      string `json:"lifetime"`
+		RotateSchedule string `json:"rotate_schedule"` // cron spec, e.g. "0 * * * *"
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -340,6 +394,14 @@ func (g *EnhancedProxyGateway) handleCreateSession(c *gin.Context) {
 		SessionType: req.SessionType,
 		Lifetime:    30 * time.Minute, // Parse req.Lifetime
 	}
+	if req.RotateSchedule != "" {
+		if _, err := session.ParseSchedule(req.RotateSchedule); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		enhancedAuth.RotateMode = auth.RotateOnSchedule
+		enhancedAuth.RotateSchedule = req.RotateSchedule
+	}
 
 	session, err := g.sessionManager.GetOrCreateSession(enhancedAuth)
 	if err != nil {
@@ -377,17 +439,120 @@ func (g *EnhancedProxyGateway) handleDeleteSession(c *gin.Context) {
 	c.JSON(200, gin.H{"deleted": true})
 }
 
+// customerSession loads the session in the path for the customer named by
+// Proxy-Authorization. Someone else's session is reported as not found.
+func (g *EnhancedProxyGateway) customerSession(c *gin.Context) (*session.Session, bool) {
+	header := c.GetHeader("Proxy-Authorization")
+	if header == "" {
+		c.JSON(407, gin.H{"error": "proxy authentication required"})
+		return nil, false
+	}
+	enhancedAuth, err := g.authenticator.ParseEnhancedAuth(header, c.ClientIP())
+	if err != nil {
+		c.JSON(407, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	
+	sess, err := g.sessionManager.GetSessionStats(c.Param("id"))
+	if err != nil || sess == nil || sess.CustomerID != enhancedAuth.Customer.ID {
+		c.JSON(404, gin.H{"error": "session not found"})
+		return nil, false
+	}
+	return sess, true
+}
+
+// handleRotateSession moves a session to a new node now. Needs
+// Proxy-Authorization from the customer owning the session.
 func (g *EnhancedProxyGateway) handleRotateSession(c *gin.Context) {
 	sessionID := c.Param("id")
+	if _, ok := g.customerSession(c); !ok {
+		return
+	}
 	
-	// Implementation would rotate the node for this session
+	sess, err := g.sessionManager.RotateSession(sessionID)
+	if err == session.ErrSessionNotFound {
+		c.JSON(404, gin.H{"error": "session not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
 	c.JSON(200, gin.H{
 		"rotated": true,
 		"session_id": sessionID,
+		"current_node_ip": sess.CurrentNodeIP,
 		"timestamp": time.Now(),
 	})
 }
 
+// handleGetSessionHistory lists the nodes a session has used. Needs
+// Proxy-Authorization from the customer owning the session.
+func (g *EnhancedProxyGateway) handleGetSessionHistory(c *gin.Context) {
+	sessionID := c.Param("id")
+	
+	sess, ok := g.customerSession(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"session_id": sessionID,
+		"history": sess.NodeHistory,
+		"rotate_mode": sess.RotateMode,
+		"rotate_schedule": sess.RotateSchedule,
+		"next_rotation": sess.NextRotation,
+		"last_rotation": sess.LastRotation,
+	})
+}
+
+// Session handoff endpoints
+func (g *EnhancedProxyGateway) handleExportSessions(c *gin.Context) {
+	sessions, err := g.sessionManager.ExportSessions()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"sessions": sessions,
+		"total": len(sessions),
+		"exported_at": time.Now(),
+	})
+}
+
+func (g *EnhancedProxyGateway) handleGetPolicyAudit(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	audit := g.destinations.Audit()
+	c.JSON(200, gin.H{
+		"entries": audit.Recent(c.Query("customer"), limit),
+		"total": audit.Total(),
+	})
+}
+
+func (g *EnhancedProxyGateway) handleReloadPolicy(c *gin.Context) {
+	if err := g.destinations.Reload(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"status": "reloaded"})
+}
+
+func (g *EnhancedProxyGateway) handleImportSessions(c *gin.Context) {
+	var req struct {
+		Sessions []*session.Session `json:"sessions"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "invalid request"})
+		return
+	}
+
+	result := g.sessionManager.ImportSessions(req.Sessions, c.Query("replace") == "true")
+	c.JSON(200, result)
+}
+
 // Analytics endpoints
 func (g *EnhancedProxyGateway) handleGetMetrics(c *gin.Context) {
 	customerID := c.Query("customer_id")
@@ -495,6 +660,24 @@ func (g *EnhancedProxyGateway) handleGetNode(c *gin.Context) {
 	})
 }
 
+// handleGetNodeAvailability reports whether a node (by ID or exit IP) could
+// take a pinned request now. Needs Proxy-Authorization; the plan limits apply.
+func (g *EnhancedProxyGateway) handleGetNodeAvailability(c *gin.Context) {
+	header := c.GetHeader("Proxy-Authorization")
+	if header == "" {
+		c.JSON(407, gin.H{"error": "proxy authentication required"})
+		return
+	}
+	enhancedAuth, err := g.authenticator.ParseEnhancedAuth(header, c.ClientIP())
+	if err != nil {
+		c.JSON(407, gin.H{"error": err.Error()})
+		return
+	}
+	proxyAuth := &auth.ProxyAuth{Customer: enhancedAuth.Customer, Plan: enhancedAuth.Plan}
+	
+	c.JSON(200, g.nodePool.Availability(proxy.PinnedSelection(proxyAuth, c.Param("id"))))
+}
+
 // Profile management endpoints
 func (g *EnhancedProxyGateway) handleGetProfiles(c *gin.Context) {
 	profiles := g.headerManager.GetProfileList()
@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"database/sql"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -22,6 +25,8 @@ import (
 	"proxy-gateway/internal/nodepool"
 	"proxy-gateway/internal/config"
 	"proxy-gateway/internal/metrics"
+	"proxy-gateway/internal/notify"
+	"proxy-gateway/internal/policy"
 )
 
 func main() {
@@ -90,8 +95,26 @@ func main() {
 	httpProxy := proxy.NewHTTPProxy(authenticator, nodePool, wsNodePool, metricsCollector, logger)
 	httpProxy.SetWarmPool(warmPool)
 	httpProxy.SetTunnelPool(tunnelPool)
+	burnTTL, err := time.ParseDuration(cfg.BlockBurnTTL)
+	if err != nil {
+		logger.Warnf("Invalid BLOCK_BURN_TTL %q, using %v", cfg.BlockBurnTTL, proxy.DefaultBlockBurnTTL)
+	}
+	httpProxy.SetBlockHandling(burnTTL, notify.NewPublisher(rdb, logger))
 	socksProxy := proxy.NewSOCKS5Proxy(authenticator, nodePool, wsNodePool, metricsCollector, logger)
 
+	// Destination policy: global rules and categories, re-read on SIGHUP
+	auditLog, err := policy.NewAuditLog(cfg.DestinationAuditLog, logger)
+	if err != nil {
+		logger.Fatalf("Failed to open destination audit log: %v", err)
+	}
+	defer auditLog.Close()
+	destinations, err := policy.NewEngine(cfg.DestinationPolicyFile, cfg.DestinationCategoriesDir, auditLog, logger)
+	if err != nil {
+		logger.Fatalf("Failed to load destination policy: %v", err)
+	}
+	httpProxy.SetDestinationPolicy(destinations)
+	socksProxy.SetDestinationPolicy(destinations)
+
 	// Start HTTP proxy server
 	httpListener, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.HTTPPort))
 	if err != nil {
@@ -106,6 +129,113 @@ func main() {
 		}
 	}()
 
+	// Certificates and tenant files are re-read on change and on SIGHUP
+	reloadStop := make(chan struct{})
+	defer close(reloadStop)
+	reloaders := []func() error{destinations.Reload}
+
+	// Postal code locations for zip- targeting, re-read on SIGHUP
+	if cfg.PostalCodesFile != "" {
+		if err := nodePool.LoadPostalCodes(cfg.PostalCodesFile); err != nil {
+			logger.Fatalf("Failed to load postal codes: %v", err)
+		}
+		reloaders = append(reloaders, func() error {
+			return nodePool.LoadPostalCodes(cfg.PostalCodesFile)
+		})
+	}
+
+	// Start HTTPS proxy and SOCKS5-over-TLS servers (TLS-wrapped, credentials
+	// never cross the wire in cleartext). Plaintext ports stay available.
+	var httpsServer *http.Server
+	if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
+		certs, err := proxy.NewCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile, logger)
+		if err != nil {
+			logger.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		go certs.Watch(reloadStop)
+		reloaders = append(reloaders, certs.Reload)
+
+		if cfg.SNITenantsFile != "" {
+			tenants, err := proxy.NewTenantRouter(cfg.SNITenantsFile, logger)
+			if err != nil {
+				logger.Fatalf("Failed to load SNI tenants: %v", err)
+			}
+			go tenants.Watch(reloadStop)
+			reloaders = append(reloaders, tenants.Reload)
+			httpProxy.SetTenantRouter(tenants)
+		}
+
+		if cfg.HTTPSPort != "" {
+			httpsListener, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.HTTPSPort))
+			if err != nil {
+				logger.Fatalf("Failed to listen on HTTPS port %s: %v", cfg.HTTPSPort, err)
+			}
+			httpsTLS := certs.TLSConfig()
+			httpsTLS.NextProtos = []string{"http/1.1"}
+			httpsServer = &http.Server{
+				Handler:   httpProxy,
+				TLSConfig: httpsTLS,
+			}
+
+			go func() {
+				logger.Infof("HTTPS proxy server starting on port %s", cfg.HTTPSPort)
+				if err := httpsServer.Serve(tls.NewListener(httpsListener, httpsTLS)); err != nil && err != http.ErrServerClosed {
+					logger.Errorf("HTTPS proxy server error: %v", err)
+				}
+			}()
+		}
+
+		if cfg.SOCKSTLSPort != "" {
+			socksTLSListener, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.SOCKSTLSPort))
+			if err != nil {
+				logger.Fatalf("Failed to listen on SOCKS5 TLS port %s: %v", cfg.SOCKSTLSPort, err)
+			}
+			defer socksTLSListener.Close()
+
+			go func() {
+				logger.Infof("SOCKS5 over TLS server starting on port %s", cfg.SOCKSTLSPort)
+				if err := socksProxy.Serve(tls.NewListener(socksTLSListener, certs.TLSConfig())); err != nil {
+					logger.Errorf("SOCKS5 TLS server error: %v", err)
+				}
+			}()
+		}
+	}
+
+	// Start HTTP/2 proxy server (TLS-ALPN when a certificate is configured, h2c otherwise)
+	var http2Server *http.Server
+	if cfg.HTTP2Port != "" {
+		var tlsConfig *tls.Config
+		if cfg.HTTP2CertFile != "" && cfg.HTTP2KeyFile != "" {
+			certs, err := proxy.NewCertReloader(cfg.HTTP2CertFile, cfg.HTTP2KeyFile, logger)
+			if err != nil {
+				logger.Fatalf("Failed to load HTTP/2 TLS certificate: %v", err)
+			}
+			go certs.Watch(reloadStop)
+			reloaders = append(reloaders, certs.Reload)
+			tlsConfig = certs.TLSConfig()
+		}
+
+		http2Server, err = httpProxy.NewHTTP2Server(tlsConfig)
+		if err != nil {
+			logger.Fatalf("Failed to configure HTTP/2 proxy server: %v", err)
+		}
+
+		http2Listener, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.HTTP2Port))
+		if err != nil {
+			logger.Fatalf("Failed to listen on HTTP/2 port %s: %v", cfg.HTTP2Port, err)
+		}
+		if tlsConfig != nil {
+			http2Listener = tls.NewListener(http2Listener, http2Server.TLSConfig)
+		}
+
+		go func() {
+			logger.Infof("HTTP/2 proxy server starting on port %s (tls=%v)", cfg.HTTP2Port, tlsConfig != nil)
+			if err := http2Server.Serve(http2Listener); err != nil && err != http.ErrServerClosed {
+				logger.Errorf("HTTP/2 proxy server error: %v", err)
+			}
+		}()
+	}
+
 	// Start SOCKS5 proxy server
 	socksListener, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.SOCKSPort))
 	if err != nil {
@@ -176,6 +306,36 @@ func main() {
 		c.JSON(http.StatusOK, stats)
 	})
 
+	// Destinations blocked by policy, newest first (?customer=&limit=).
+	// Admin only: entries name customers and what they tried to reach.
+	if cfg.AdminToken != "" {
+		router.GET("/policy/audit", adminAuthMiddleware(cfg.AdminToken), func(c *gin.Context) {
+			limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+			c.JSON(http.StatusOK, gin.H{
+				"total":   auditLog.Total(),
+				"entries": auditLog.Recent(c.Query("customer"), limit),
+			})
+		})
+	} else {
+		logger.Warn("ADMIN_API_TOKEN not set, /policy/audit disabled")
+	}
+
+	// Pinned node availability, for customers waiting on an ip-/node- pin.
+	// Needs Proxy-Authorization; the customer's plan limits apply.
+	router.GET("/api/v1/nodes/:id/availability", func(c *gin.Context) {
+		header := c.GetHeader("Proxy-Authorization")
+		if header == "" {
+			c.JSON(http.StatusProxyAuthRequired, gin.H{"error": "proxy authentication required"})
+			return
+		}
+		proxyAuth, err := authenticator.ParseProxyAuth(header)
+		if err != nil {
+			c.JSON(http.StatusProxyAuthRequired, gin.H{"error": "authentication failed"})
+			return
+		}
+		c.JSON(http.StatusOK, nodePool.Availability(proxy.PinnedSelection(proxyAuth, c.Param("id"))))
+	})
+
 	// WebSocket endpoint for node connections
 	router.GET("/node/connect", func(c *gin.Context) {
 		wsNodePool.HandleNodeConnection(c.Writer, c.Request)
@@ -193,6 +353,19 @@ func main() {
 		}
 	}()
 
+	// Reload certificates and tenants on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			for _, reload := range reloaders {
+				if err := reload(); err != nil {
+					logger.Errorf("Reload failed: %v", err)
+				}
+			}
+		}
+	}()
+
 	// Graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -207,6 +380,28 @@ func main() {
 	if err := healthServer.Shutdown(shutdownCtx); err != nil {
 		logger.Errorf("Health server forced to shutdown: %v", err)
 	}
+	if httpsServer != nil {
+		if err := httpsServer.Shutdown(shutdownCtx); err != nil {
+			logger.Errorf("HTTPS proxy server forced to shutdown: %v", err)
+		}
+	}
+	if http2Server != nil {
+		if err := http2Server.Shutdown(shutdownCtx); err != nil {
+			logger.Errorf("HTTP/2 proxy server forced to shutdown: %v", err)
+		}
+	}
 
 	logger.Info("Proxy gateway stopped")
-}
\ No newline at end of file
+}
+
+// adminAuthMiddleware requires the ADMIN_API_TOKEN bearer token
+func adminAuthMiddleware(token string) gin.HandlerFunc {
+	expected := []byte("Bearer " + token)
+	return func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), expected) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "admin token required"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -32,12 +34,73 @@ type ProxyAuth struct {
 	Customer     *Customer
 	Country      string
 	City         string
+	Region       string // state or region, as nodes report it (region-california)
+	GeoMode      string // geo fallback mode override (fallback-strict), see nodepool.ParseGeoMode
 	SessionID    string
 	SessionType  string // "sticky", "rotating", "per-request"
+	SessionScope string // "domain" binds the session per target eTLD+1
 	Plan         *AccountPlan
+	Retry        *RetryPolicy // per-request override, see ResolveRetryPolicy
+	Strategy     string       // node selection strategy override
+	Debug        bool         // report the node selection trace to the client
+	RotateMode   string       // RotateOnBlock, or "" to keep the node on blocks
+	PinNode      string       // exit through this node ID only (node-<id>)
+	PinIP        string       // exit through the node holding this IP only (ip-<addr>)
+	ASN          int          // exit through this ASN only (asn-7922)
+	ISP          string       // exit through this ISP or carrier (isp-comcast.cable)
+	ConnType     string       // exit through this connection type (conn-mobile)
+	Near         NearTarget   // exit close to a point or postal code (lat-/lon-/radius-/zip-)
 	OriginalAuth string
 }
 
+// Rotation modes beyond the basic request/time/manual ones
+const (
+	// RotateOnBlock rotates the exit node when the target blocks,
+	// rate-limits or challenges it, and burns the node for that site
+	RotateOnBlock = "rotate-on-block"
+	// RotateOnSchedule rotates on a wall-clock schedule, see rotatecron
+	RotateOnSchedule = "schedule"
+)
+
+// parseRotateMode reads the rotate parameter. Values can't contain dashes, so
+// rotate-block (or rotate-onblock) stands for RotateOnBlock.
+func parseRotateMode(value string) string {
+	value = strings.ToLower(value)
+	switch value {
+	case "block", "onblock":
+		return RotateOnBlock
+	}
+	return value
+}
+
+// parseASN reads the asn parameter, with or without the AS prefix
+func parseASN(value string) int {
+	asn, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(value), "AS"))
+	if err != nil || asn < 0 {
+		return 0
+	}
+	return asn
+}
+
+// parsePinNode reads the node parameter. Node IDs are UUIDs, whose dashes
+// can't appear in a value, so they are written without them and restored here.
+func parsePinNode(value string) string {
+	value = strings.ToLower(value)
+	if len(value) != 32 || strings.Trim(value, "0123456789abcdef") != "" {
+		return value
+	}
+	return value[:8] + "-" + value[8:12] + "-" + value[12:16] + "-" + value[16:20] + "-" + value[20:]
+}
+
+// parsePinIP reads the ip parameter, normalizing the address so it matches
+// the one nodes register with
+func parsePinIP(value string) string {
+	if ip := net.ParseIP(value); ip != nil {
+		return ip.String()
+	}
+	return value
+}
+
 func NewAuthenticator(db *sql.DB, rdb *redis.Client) *Authenticator {
 	return &Authenticator{
 		db:         db,
@@ -95,10 +158,36 @@ func (a *Authenticator) ParseProxyAuth(authHeader string) (*ProxyAuth, error) {
 				auth.Country = strings.ToUpper(value)
 			case "city":
 				auth.City = strings.ToLower(value)
+			case "region", "state":
+				auth.Region = strings.ToLower(value)
+			case "fallback", "geomode":
+				auth.GeoMode = strings.ToLower(value)
 			case "session":
 				auth.SessionID = value
 			case "sesstype", "stype":
 				auth.SessionType = value
+			case "scope":
+				auth.SessionScope = strings.ToLower(value)
+			case "strategy", "select":
+				auth.Strategy = strings.ToLower(value)
+			case "debug":
+				auth.Debug = value == "1" || value == "true"
+			case "rotate", "rot":
+				auth.RotateMode = parseRotateMode(value)
+			case "node", "nodeid":
+				auth.PinNode = parsePinNode(value)
+			case "ip":
+				auth.PinIP = parsePinIP(value)
+			case "asn":
+				auth.ASN = parseASN(value)
+			case "isp", "carrier":
+				auth.ISP = strings.ToLower(value)
+			case "conn", "conntype":
+				auth.ConnType = strings.ToLower(value)
+			default:
+				if !auth.Near.parseParam(param, value) {
+					a.parseRetryParam(&auth.Retry, param, value)
+				}
 			}
 		}
 
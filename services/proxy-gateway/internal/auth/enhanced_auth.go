@@ -21,16 +21,30 @@ type EnhancedProxyAuth struct {
 	Country      string
 	City         string
 	Region       string
+	GeoMode      string // geo fallback mode override, see nodepool.ParseGeoMode
+	
+	// Network targeting: ASN, ISP/carrier name words, connection type
 	ASN          int
+	ISP          string
+	ConnType     string
+	
+	// Radius targeting around a point or postal code
+	Near         NearTarget
+	
+	// Exit pinning: only this node, or the node holding this IP
+	PinNode      string
+	PinIP        string
 	
 	// Session management  
 	SessionID    string
 	SessionType  string // "sticky", "rotating", "per-request"
+	SessionScope string // "domain" binds the session per target eTLD+1
 	Lifetime     time.Duration
 	
 	// Rotation control
-	RotateMode   string // "request", "time", "manual", "ip-change"
+	RotateMode   string // "request", "time", "manual", "ip-change", RotateOnBlock, RotateOnSchedule
 	RotateInterval time.Duration
+	RotateSchedule string // cron spec or descriptor for RotateOnSchedule
 	
 	// Protocol preferences
 	Profile      string // "chrome-win", "firefox-mac", "mobile-ios", "custom"
@@ -45,6 +59,9 @@ type EnhancedProxyAuth struct {
 	Headers      map[string]string
 	WhitelistIPs []string
 	Debug        bool
+	Retry        *RetryPolicy // per-request override, see ResolveRetryPolicy
+	Strategy     string       // node selection strategy override
+	Plan         *AccountPlan
 	
 	OriginalAuth string
 }
@@ -79,21 +96,35 @@ func (a *Authenticator) ParseEnhancedAuth(authHeader string, clientIP string) (*
 	
 	// Check for IP whitelist authentication
 	if strings.HasPrefix(authHeader, "ip:") {
-		return a.parseIPAuth(authHeader[3:], clientIP, auth)
+		return a.withPlan(a.parseIPAuth(authHeader[3:], clientIP, auth))
 	}
 	
 	// Check for token authentication  
 	if strings.HasPrefix(authHeader, "token:") {
-		return a.parseTokenAuth(authHeader[6:], auth)
+		return a.withPlan(a.parseTokenAuth(authHeader[6:], auth))
 	}
 	
 	// Check for signature authentication
 	if strings.HasPrefix(authHeader, "sig:") {
-		return a.parseSignatureAuth(authHeader[4:], auth)
+		return a.withPlan(a.parseSignatureAuth(authHeader[4:], auth))
 	}
 	
 	// Default: Basic authentication
-	return a.parseBasicAuth(authHeader, auth)
+	return a.withPlan(a.parseBasicAuth(authHeader, auth))
+}
+
+// withPlan attaches the customer's account plan to a parsed auth
+func (a *Authenticator) withPlan(auth *EnhancedProxyAuth, err error) (*EnhancedProxyAuth, error) {
+	if err != nil || auth == nil || auth.Customer == nil || a.planLoader == nil {
+		return auth, err
+	}
+	plan, planErr := a.planLoader.LoadPlan(auth.Customer.UserID)
+	if planErr != nil {
+		fmt.Printf("[AUTH] Warning: failed to load plan for user %s: %v\n", auth.Customer.UserID, planErr)
+		return auth, nil
+	}
+	auth.Plan = plan
+	return auth, nil
 }
 
 func (a *Authenticator) parseBasicAuth(authStr string, auth *EnhancedProxyAuth) (*EnhancedProxyAuth, error) {
@@ -210,10 +241,18 @@ func (a *Authenticator) parseParameters(params []string, auth *EnhancedProxyAuth
 			auth.City = strings.ToLower(value)
 		case "region", "state":
 			auth.Region = strings.ToUpper(value)
+		case "fallback", "geomode":
+			auth.GeoMode = strings.ToLower(value)
 		case "asn":
-			if asn, err := strconv.Atoi(value); err == nil {
-				auth.ASN = asn
-			}
+			auth.ASN = parseASN(value)
+		case "isp", "carrier":
+			auth.ISP = strings.ToLower(value)
+		case "conn", "conntype":
+			auth.ConnType = strings.ToLower(value)
+		case "node", "nodeid":
+			auth.PinNode = parsePinNode(value)
+		case "ip":
+			auth.PinIP = parsePinIP(value)
 		case "session", "sess":
 			auth.SessionID = value
 		case "sesstype", "stype":
@@ -221,9 +260,12 @@ func (a *Authenticator) parseParameters(params []string, auth *EnhancedProxyAuth
 		case "lifetime", "life", "ttl":
 			auth.Lifetime = a.parseDuration(value)
 		case "rotate", "rot":
-			auth.RotateMode = value
+			auth.RotateMode = parseRotateMode(value)
 		case "rotateint", "rint":
 			auth.RotateInterval = a.parseDuration(value)
+		case "rotatecron", "rcron":
+			auth.RotateSchedule = parseRotateSchedule(value)
+			auth.RotateMode = RotateOnSchedule
 		case "profile", "prof":
 			auth.Profile = value
 		case "ua", "useragent":
@@ -240,12 +282,20 @@ func (a *Authenticator) parseParameters(params []string, auth *EnhancedProxyAuth
 			auth.Protocol = value
 		case "debug":
 			auth.Debug = value == "1" || value == "true"
+		case "scope":
+			auth.SessionScope = strings.ToLower(value)
+		case "strategy", "select":
+			auth.Strategy = strings.ToLower(value)
 		case "header":
 			// Format: header-Name:Value
 			if strings.Contains(value, ":") {
 				parts := strings.SplitN(value, ":", 2)
 				auth.Headers[parts[0]] = parts[1]
 			}
+		default:
+			if !auth.Near.parseParam(key, value) {
+				a.parseRetryParam(&auth.Retry, key, value)
+			}
 		}
 	}
 	
@@ -257,6 +307,20 @@ func (a *Authenticator) parseParameters(params []string, auth *EnhancedProxyAuth
 	return auth, nil
 }
 
+// parseRotateSchedule reads the rotatecron parameter. Values can't hold
+// spaces or dashes, so cron fields are dot-separated (0.*.*.*.* is hourly on
+// the hour) and descriptors drop the @ (hourly, daily, every15m).
+func parseRotateSchedule(value string) string {
+	value = strings.ToLower(value)
+	switch {
+	case strings.HasPrefix(value, "every"):
+		return "@every " + strings.TrimPrefix(value, "every")
+	case strings.Trim(value, "abcdefghijklmnopqrstuvwxyz") == "":
+		return "@" + value
+	}
+	return strings.ReplaceAll(value, ".", " ")
+}
+
 func (a *Authenticator) parseDuration(durationStr string) time.Duration {
 	// Parse: 30m, 1h, 60s, 120 (seconds)
 	re := regexp.MustCompile(`^(\d+)([smhd]?)$`)
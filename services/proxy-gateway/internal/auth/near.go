@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"strconv"
+	"strings"
+)
+
+// NearTarget asks for exits close to a point or a postal code:
+// lat-40.7128-lon-74.006w-radius-25 or zip-10001-radius-10mi. Values can't
+// contain dashes, so southern and western coordinates carry an S or W.
+type NearTarget struct {
+	Lat      float64
+	Lon      float64
+	HasLat   bool
+	HasLon   bool
+	RadiusKm float64 // 0 leaves the pool default
+	Zip      string  // uppercase, without spaces
+}
+
+// IsSet reports whether the request asked for radius targeting
+func (n *NearTarget) IsSet() bool {
+	return n.HasLat && n.HasLon || n.Zip != ""
+}
+
+// parseParam reads lat, lon, radius and zip, reporting whether param was one
+// of them
+func (n *NearTarget) parseParam(param, value string) bool {
+	switch param {
+	case "lat", "latitude":
+		n.Lat, n.HasLat = parseCoordinate(value, 'n', 's', 90)
+	case "lon", "lng", "longitude":
+		n.Lon, n.HasLon = parseCoordinate(value, 'e', 'w', 180)
+	case "radius", "rad":
+		n.RadiusKm = parseRadius(value)
+	case "zip", "postal":
+		n.Zip = NormalizePostalCode(value)
+	default:
+		return false
+	}
+	return true
+}
+
+// parseCoordinate reads a degree value with an optional hemisphere letter
+// before or after it, e.g. 33.86s or w74.006
+func parseCoordinate(value string, pos, neg byte, limit float64) (float64, bool) {
+	value = strings.ToLower(value)
+	sign := 1.0
+	if value != "" {
+		for _, i := range []int{0, len(value) - 1} {
+			switch value[i] {
+			case pos:
+				value = value[:i] + value[i+1:]
+			case neg:
+				value = value[:i] + value[i+1:]
+				sign = -1
+			default:
+				continue
+			}
+			break
+		}
+	}
+	deg, err := strconv.ParseFloat(value, 64)
+	if err != nil || deg < 0 || deg > limit {
+		return 0, false
+	}
+	return sign * deg, true
+}
+
+// parseRadius reads a radius in km, or in miles with an mi suffix
+func parseRadius(value string) float64 {
+	value = strings.ToLower(value)
+	scale := 1.0
+	switch {
+	case strings.HasSuffix(value, "mi"):
+		value, scale = strings.TrimSuffix(value, "mi"), 1.609344
+	case strings.HasSuffix(value, "km"):
+		value = strings.TrimSuffix(value, "km")
+	}
+	r, err := strconv.ParseFloat(value, 64)
+	if err != nil || r <= 0 {
+		return 0
+	}
+	return r * scale
+}
+
+// NormalizePostalCode uppercases a postal code and drops its spaces, so
+// "sw1a1aa" and "SW1A 1AA" match
+func NormalizePostalCode(value string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(value), " ", ""))
+}
@@ -27,10 +27,25 @@ type AccountPlan struct {
 	AllowedCountries       []string `json:"allowed_countries"`
 	BlockedCountries       []string `json:"blocked_countries"`
 	IPReuseCooldownSeconds int      `json:"ip_reuse_cooldown_seconds"`
+	IPReuseScope           string   `json:"ip_reuse_scope"`    // "customer" or "domain"
+	IPReuseFallback        string   `json:"ip_reuse_fallback"` // "wait", "relax" or "fail"
 	StickySessionsEnabled  bool     `json:"sticky_sessions_enabled"`
 	GeoTargetingEnabled    bool     `json:"geo_targeting_enabled"`
 	CityTargetingEnabled   bool     `json:"city_targeting_enabled"`
+	GeoFallbackMode        string   `json:"geo_fallback_mode"` // see nodepool.ParseGeoMode, "" = fallback-country
 	IsActive               bool     `json:"is_active"`
+	RetryMaxAttempts       int      `json:"retry_max_attempts"`
+	RetryBudgetSeconds     int      `json:"retry_budget_seconds"`
+	RetryMethods           []string `json:"retry_methods"`
+	RetryOn                []string `json:"retry_on"`
+	MaxRequestBodyMB       int      `json:"max_request_body_mb"`
+	MaxResponseBodyMB      int      `json:"max_response_body_mb"`
+	// Destination rules on top of the global policy, see policy.Rules
+	DestinationAllowDomains   []string `json:"destination_allow_domains"`
+	DestinationDenyDomains    []string `json:"destination_deny_domains"`
+	DestinationDenyCIDRs      []string `json:"destination_deny_cidrs"`
+	DestinationDenyPorts      []string `json:"destination_deny_ports"`
+	DestinationDenyCategories []string `json:"destination_deny_categories"`
 }
 
 // PlanLoader handles loading and caching of account plans
@@ -50,6 +65,12 @@ func NewPlanLoader(db *sql.DB, rdb *redis.Client) *PlanLoader {
 const planCacheTTL = 5 * time.Minute
 const planCachePrefix = "account_plan:"
 
+// Body size caps for plain HTTP when the plan doesn't set its own
+const (
+	DefaultMaxRequestBodyMB  = 32
+	DefaultMaxResponseBodyMB = 1024
+)
+
 // LoadPlan loads a user's account plan, using Redis cache first
 func (pl *PlanLoader) LoadPlan(userID string) (*AccountPlan, error) {
 	ctx := context.Background()
@@ -96,13 +117,23 @@ func (pl *PlanLoader) loadPlanFromDB(userID string) (*AccountPlan, error) {
 			max_concurrency, bandwidth_cap_daily_mb, bandwidth_cap_monthly_mb,
 			allowed_countries, blocked_countries,
 			ip_reuse_cooldown_seconds,
+			COALESCE(ip_reuse_scope, 'customer'), COALESCE(ip_reuse_fallback, 'relax'),
 			sticky_sessions_enabled, geo_targeting_enabled, city_targeting_enabled,
-			is_active
+			COALESCE(geo_fallback_mode, ''),
+			is_active,
+			COALESCE(retry_max_attempts, 0), COALESCE(retry_budget_seconds, 0),
+			COALESCE(retry_methods, '{}'), COALESCE(retry_on, '{}'),
+			COALESCE(max_request_body_mb, 0), COALESCE(max_response_body_mb, 0),
+			COALESCE(destination_allow_domains, '{}'), COALESCE(destination_deny_domains, '{}'),
+			COALESCE(destination_deny_cidrs, '{}'), COALESCE(destination_deny_ports, '{}'),
+			COALESCE(destination_deny_categories, '{}')
 		FROM account_plans
 		WHERE user_id = $1
 	`
 
 	var allowedCountries, blockedCountries pq.StringArray
+	var retryMethods, retryOn pq.StringArray
+	var allowDomains, denyDomains, denyCIDRs, denyPorts, denyCategories pq.StringArray
 
 	err := pl.db.QueryRow(query, userID).Scan(
 		&plan.ID, &plan.UserID, &plan.PlanName,
@@ -111,8 +142,16 @@ func (pl *PlanLoader) loadPlanFromDB(userID string) (*AccountPlan, error) {
 		&plan.MaxConcurrency, &plan.BandwidthCapDailyMB, &plan.BandwidthCapMonthlyMB,
 		&allowedCountries, &blockedCountries,
 		&plan.IPReuseCooldownSeconds,
+		&plan.IPReuseScope, &plan.IPReuseFallback,
 		&plan.StickySessionsEnabled, &plan.GeoTargetingEnabled, &plan.CityTargetingEnabled,
+		&plan.GeoFallbackMode,
 		&plan.IsActive,
+		&plan.RetryMaxAttempts, &plan.RetryBudgetSeconds,
+		&retryMethods, &retryOn,
+		&plan.MaxRequestBodyMB, &plan.MaxResponseBodyMB,
+		&allowDomains, &denyDomains,
+		&denyCIDRs, &denyPorts,
+		&denyCategories,
 	)
 
 	if err != nil {
@@ -121,6 +160,13 @@ func (pl *PlanLoader) loadPlanFromDB(userID string) (*AccountPlan, error) {
 
 	plan.AllowedCountries = []string(allowedCountries)
 	plan.BlockedCountries = []string(blockedCountries)
+	plan.RetryMethods = []string(retryMethods)
+	plan.RetryOn = []string(retryOn)
+	plan.DestinationAllowDomains = []string(allowDomains)
+	plan.DestinationDenyDomains = []string(denyDomains)
+	plan.DestinationDenyCIDRs = []string(denyCIDRs)
+	plan.DestinationDenyPorts = []string(denyPorts)
+	plan.DestinationDenyCategories = []string(denyCategories)
 
 	return plan, nil
 }
@@ -140,6 +186,8 @@ func (pl *PlanLoader) defaultPlan(userID string) *AccountPlan {
 		AllowedCountries:       []string{},
 		BlockedCountries:       []string{},
 		IPReuseCooldownSeconds: 0,
+		IPReuseScope:           "customer",
+		IPReuseFallback:        "relax",
 		StickySessionsEnabled:  true,
 		GeoTargetingEnabled:    true,
 		CityTargetingEnabled:   true,
@@ -181,7 +229,7 @@ func CheckPlanLimits(auth *ProxyAuth, plan *AccountPlan) error {
 	}
 
 	// Check geo targeting permission
-	if auth.Country != "" && !plan.GeoTargetingEnabled {
+	if (auth.Country != "" || auth.Region != "") && !plan.GeoTargetingEnabled {
 		return fmt.Errorf("geo targeting is not enabled for this account")
 	}
 
@@ -220,3 +268,26 @@ func CheckPlanLimits(auth *ProxyAuth, plan *AccountPlan) error {
 
 	return nil
 }
+
+// GeoMode returns the geo fallback mode of a request: its own fallback-
+// parameter, else the plan's. Pools read "" as their default.
+func GeoMode(requested string, plan *AccountPlan) string {
+	if requested == "" && plan != nil {
+		return plan.GeoFallbackMode
+	}
+	return requested
+}
+
+// BodyLimits returns the plan's request and response body caps in bytes
+func BodyLimits(plan *AccountPlan) (request, response int64) {
+	reqMB, respMB := DefaultMaxRequestBodyMB, DefaultMaxResponseBodyMB
+	if plan != nil {
+		if plan.MaxRequestBodyMB > 0 {
+			reqMB = plan.MaxRequestBodyMB
+		}
+		if plan.MaxResponseBodyMB > 0 {
+			respMB = plan.MaxResponseBodyMB
+		}
+	}
+	return int64(reqMB) << 20, int64(respMB) << 20
+}
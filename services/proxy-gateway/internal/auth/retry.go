@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetryAttempts = 3
+	defaultRetryBudget   = 20 * time.Second
+	maxRetryAttempts     = 10
+	maxRetryBudget       = 2 * time.Minute
+)
+
+// Failure classes accepted in RetryPolicy.RetryOn besides literal status codes
+const (
+	RetryOn4xx     = "4xx"
+	RetryOn5xx     = "5xx"
+	RetryOnCaptcha = "captcha"
+)
+
+// defaultRetryMethods are the idempotent methods of RFC 9110 §9.2.2. Others
+// are only replayed when the account plan lists them.
+var defaultRetryMethods = []string{"GET", "HEAD", "OPTIONS", "PUT", "DELETE", "TRACE"}
+var defaultRetryOn = []string{"403", "429", RetryOn5xx, RetryOnCaptcha}
+
+// RetryPolicy controls transparent node failover for plain HTTP requests.
+// Zero fields are unset: an AccountPlan or per-request override only replaces
+// what it sets.
+type RetryPolicy struct {
+	MaxAttempts int           `json:"max_attempts,omitempty"` // total attempts including the first
+	Budget      time.Duration `json:"budget,omitempty"`       // wall-clock limit across all attempts, dials and response heads included
+	Methods     []string      `json:"methods,omitempty"`      // methods safe to replay, or "*"
+	RetryOn     []string      `json:"retry_on,omitempty"`     // "403", "5xx", "captcha", ...
+
+	planMethods []string // non-idempotent methods need to be listed here too
+}
+
+// ResolveRetryPolicy layers plan settings and a per-request override over
+// the defaults. An override can narrow the methods but not opt into
+// replaying non-idempotent ones; only the plan can.
+func ResolveRetryPolicy(plan *AccountPlan, override *RetryPolicy) *RetryPolicy {
+	rp := &RetryPolicy{
+		MaxAttempts: defaultRetryAttempts,
+		Budget:      defaultRetryBudget,
+		Methods:     defaultRetryMethods,
+		RetryOn:     defaultRetryOn,
+	}
+	if plan != nil {
+		rp.merge(&RetryPolicy{
+			MaxAttempts: plan.RetryMaxAttempts,
+			Budget:      time.Duration(plan.RetryBudgetSeconds) * time.Second,
+			Methods:     plan.RetryMethods,
+			RetryOn:     plan.RetryOn,
+		})
+		rp.planMethods = plan.RetryMethods
+	}
+	rp.merge(override)
+
+	if rp.MaxAttempts < 1 {
+		rp.MaxAttempts = 1
+	}
+	if rp.MaxAttempts > maxRetryAttempts {
+		rp.MaxAttempts = maxRetryAttempts
+	}
+	if rp.Budget > maxRetryBudget {
+		rp.Budget = maxRetryBudget
+	}
+	return rp
+}
+
+func (rp *RetryPolicy) merge(o *RetryPolicy) {
+	if o == nil {
+		return
+	}
+	if o.MaxAttempts != 0 {
+		rp.MaxAttempts = o.MaxAttempts
+	}
+	if o.Budget != 0 {
+		rp.Budget = o.Budget
+	}
+	if len(o.Methods) > 0 {
+		rp.Methods = o.Methods
+	}
+	if len(o.RetryOn) > 0 {
+		rp.RetryOn = o.RetryOn
+	}
+}
+
+// AllowsMethod reports whether requests with this method may be replayed
+func (rp *RetryPolicy) AllowsMethod(method string) bool {
+	if !listsMethod(rp.Methods, method) {
+		return false
+	}
+	return listsMethod(defaultRetryMethods, method) || listsMethod(rp.planMethods, method)
+}
+
+func listsMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == "*" || strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryOnStatus reports whether a response status counts as a failure
+func (rp *RetryPolicy) RetryOnStatus(code int) bool {
+	s := strconv.Itoa(code)
+	for _, c := range rp.RetryOn {
+		switch {
+		case c == s:
+			return true
+		case c == RetryOn4xx && code >= 400 && code < 500:
+			return true
+		case c == RetryOn5xx && code >= 500 && code < 600:
+			return true
+		}
+	}
+	return false
+}
+
+// RetryOnCaptcha reports whether captcha/challenge pages count as failures
+func (rp *RetryPolicy) RetryOnCaptcha() bool {
+	for _, c := range rp.RetryOn {
+		if c == RetryOnCaptcha {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRetryParam handles the retry username parameters; returns false for
+// other keys. Lists are dot-separated since dashes delimit parameters:
+//
+//	retry-3                  max attempts (retry-off or retry-1 disables)
+//	retrytime-30s            total time budget
+//	retryon-403.429.5xx      failure statuses, plus "captcha"
+//	retrymethods-GET.POST    replayable methods ("all" for any), non-idempotent
+//	                         ones only if the plan allows them
+func (a *Authenticator) parseRetryParam(rp **RetryPolicy, key, value string) bool {
+	switch key {
+	case "retry", "retries", "retrytime", "rtime", "retryon", "retrymethods":
+	default:
+		return false
+	}
+	if *rp == nil {
+		*rp = &RetryPolicy{}
+	}
+	p := *rp
+
+	switch key {
+	case "retry", "retries":
+		if value == "off" || value == "0" {
+			p.MaxAttempts = 1
+		} else if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			p.MaxAttempts = n
+		}
+	case "retrytime", "rtime":
+		p.Budget = a.parseDuration(value)
+	case "retryon":
+		p.RetryOn = strings.Split(strings.ToLower(value), ".")
+	case "retrymethods":
+		if value == "all" {
+			p.Methods = []string{"*"}
+		} else {
+			p.Methods = strings.Split(strings.ToUpper(value), ".")
+		}
+	}
+	return true
+}
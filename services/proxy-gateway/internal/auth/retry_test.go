@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResolveRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		plan     *AccountPlan
+		override *RetryPolicy
+		want     RetryPolicy
+	}{
+		{"defaults", nil, nil,
+			RetryPolicy{MaxAttempts: 3, Budget: 20 * time.Second, Methods: defaultRetryMethods, RetryOn: defaultRetryOn}},
+		{"plan replaces what it sets",
+			&AccountPlan{RetryMaxAttempts: 5, RetryOn: []string{"5xx"}}, nil,
+			RetryPolicy{MaxAttempts: 5, Budget: 20 * time.Second, Methods: defaultRetryMethods, RetryOn: []string{"5xx"}}},
+		{"override over the plan",
+			&AccountPlan{RetryMaxAttempts: 5, RetryBudgetSeconds: 60},
+			&RetryPolicy{MaxAttempts: 2, RetryOn: []string{"403"}},
+			RetryPolicy{MaxAttempts: 2, Budget: time.Minute, Methods: defaultRetryMethods, RetryOn: []string{"403"}}},
+		{"clamped", nil, &RetryPolicy{MaxAttempts: 50, Budget: time.Hour},
+			RetryPolicy{MaxAttempts: 10, Budget: 2 * time.Minute, Methods: defaultRetryMethods, RetryOn: defaultRetryOn}},
+		{"at least one attempt", &AccountPlan{RetryMaxAttempts: -1}, nil,
+			RetryPolicy{MaxAttempts: 1, Budget: 20 * time.Second, Methods: defaultRetryMethods, RetryOn: defaultRetryOn}},
+	}
+	for _, tt := range tests {
+		got := ResolveRetryPolicy(tt.plan, tt.override)
+		got.planMethods = nil
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, *got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyAllowsMethod(t *testing.T) {
+	tests := []struct {
+		name     string
+		plan     *AccountPlan
+		override *RetryPolicy
+		allowed  []string
+		refused  []string
+	}{
+		{"idempotent by default", nil, nil,
+			[]string{"GET", "head", "OPTIONS", "PUT", "DELETE", "TRACE"}, []string{"POST", "PATCH", "CONNECT"}},
+		{"override can't opt into POST", nil, &RetryPolicy{Methods: []string{"GET", "POST"}},
+			[]string{"GET"}, []string{"POST", "PUT"}},
+		{"override all stays idempotent", nil, &RetryPolicy{Methods: []string{"*"}},
+			[]string{"GET", "DELETE"}, []string{"POST", "PATCH"}},
+		{"plan opts into POST", &AccountPlan{RetryMethods: []string{"GET", "POST"}}, nil,
+			[]string{"GET", "POST"}, []string{"PUT", "PATCH"}},
+		{"override narrows the plan", &AccountPlan{RetryMethods: []string{"GET", "POST"}}, &RetryPolicy{Methods: []string{"GET"}},
+			[]string{"GET"}, []string{"POST"}},
+		{"override all under a plan opting into everything", &AccountPlan{RetryMethods: []string{"*"}}, &RetryPolicy{Methods: []string{"*"}},
+			[]string{"GET", "POST", "PATCH"}, nil},
+		{"plan all, override picks POST", &AccountPlan{RetryMethods: []string{"*"}}, &RetryPolicy{Methods: []string{"POST"}},
+			[]string{"POST"}, []string{"GET"}},
+	}
+	for _, tt := range tests {
+		rp := ResolveRetryPolicy(tt.plan, tt.override)
+		for _, m := range tt.allowed {
+			if !rp.AllowsMethod(m) {
+				t.Errorf("%s: %s not replayed", tt.name, m)
+			}
+		}
+		for _, m := range tt.refused {
+			if rp.AllowsMethod(m) {
+				t.Errorf("%s: %s replayed", tt.name, m)
+			}
+		}
+	}
+}
+
+func TestRetryOnStatus(t *testing.T) {
+	rp := &RetryPolicy{RetryOn: []string{"403", RetryOn5xx}}
+	for code, want := range map[int]bool{403: true, 404: false, 429: false, 500: true, 599: true, 200: false} {
+		if got := rp.RetryOnStatus(code); got != want {
+			t.Errorf("RetryOnStatus(%d) = %v, want %v", code, got, want)
+		}
+	}
+	if rp.RetryOnCaptcha() {
+		t.Error("RetryOnCaptcha without captcha in RetryOn")
+	}
+	rp = &RetryPolicy{RetryOn: []string{RetryOn4xx, RetryOnCaptcha}}
+	if !rp.RetryOnStatus(451) || rp.RetryOnStatus(502) || !rp.RetryOnCaptcha() {
+		t.Errorf("4xx.captcha policy: %+v", rp)
+	}
+}
+
+func TestParseRetryParam(t *testing.T) {
+	tests := []struct {
+		params [][2]string
+		want   *RetryPolicy
+	}{
+		{[][2]string{{"retry", "5"}}, &RetryPolicy{MaxAttempts: 5}},
+		{[][2]string{{"retries", "off"}}, &RetryPolicy{MaxAttempts: 1}},
+		{[][2]string{{"retry", "0"}}, &RetryPolicy{MaxAttempts: 1}},
+		{[][2]string{{"retry", "x"}}, &RetryPolicy{}},
+		{[][2]string{{"retrytime", "30s"}, {"rtime", "2m"}}, &RetryPolicy{Budget: 2 * time.Minute}},
+		{[][2]string{{"retryon", "403.5XX.Captcha"}}, &RetryPolicy{RetryOn: []string{"403", "5xx", "captcha"}}},
+		{[][2]string{{"retrymethods", "get.post"}}, &RetryPolicy{Methods: []string{"GET", "POST"}}},
+		{[][2]string{{"retrymethods", "all"}, {"retry", "2"}}, &RetryPolicy{MaxAttempts: 2, Methods: []string{"*"}}},
+		{[][2]string{{"country", "us"}}, nil},
+	}
+	a := &Authenticator{}
+	for _, tt := range tests {
+		var rp *RetryPolicy
+		for _, kv := range tt.params {
+			handled := a.parseRetryParam(&rp, kv[0], kv[1])
+			if handled != (tt.want != nil) {
+				t.Errorf("parseRetryParam(%s-%s) handled = %v", kv[0], kv[1], handled)
+			}
+		}
+		if !reflect.DeepEqual(rp, tt.want) {
+			t.Errorf("%v: got %+v, want %+v", tt.params, rp, tt.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package nodepool
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	burnKeyPrefix = "burned:"
+	// maxBurnTTL caps how long a node stays burned for a domain
+	maxBurnTTL = 24 * time.Hour
+)
+
+// BurnList records node/domain pairs where the target blocked the node's exit
+// IP, in Redis sorted sets (node ID → expiry, unix ms) per registrable domain.
+// A burned node stays selectable for every other site.
+type BurnList struct {
+	rdb *redis.Client
+
+	burns   int64 // pairs recorded
+	skipped int64 // candidates skipped because they were burned
+}
+
+func newBurnList(rdb *redis.Client) *BurnList {
+	return &BurnList{rdb: rdb}
+}
+
+// Burned returns the IDs of nodes currently burned for domain
+func (b *BurnList) Burned(domain string) map[string]bool {
+	if domain == "" {
+		return nil
+	}
+	ctx := context.Background()
+	ids, err := b.rdb.ZRangeByScore(ctx, burnKeyPrefix+domain, &redis.ZRangeBy{
+		Min: strconv.FormatInt(time.Now().UnixMilli(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil || len(ids) == 0 {
+		return nil
+	}
+	burned := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		burned[id] = true
+	}
+	return burned
+}
+
+// Burn marks nodeID as burned for domain until ttl has passed, trimming
+// entries that already expired
+func (b *BurnList) Burn(nodeID, domain string, ttl time.Duration) {
+	if nodeID == "" || domain == "" || ttl <= 0 {
+		return
+	}
+	if ttl > maxBurnTTL {
+		ttl = maxBurnTTL
+	}
+	ctx := context.Background()
+	key := burnKeyPrefix + domain
+	now := time.Now()
+	pipe := b.rdb.Pipeline()
+	pipe.ZAdd(ctx, key, &redis.Z{Score: float64(now.Add(ttl).UnixMilli()), Member: nodeID})
+	pipe.ZRemRangeByScore(ctx, key, "-inf", fmt.Sprintf("(%d", now.UnixMilli()))
+	// Every member expires within maxBurnTTL, so the set never outlives it
+	pipe.Expire(ctx, key, maxBurnTTL)
+	pipe.Exec(ctx)
+	atomic.AddInt64(&b.burns, 1)
+}
+
+// Stats reports burn activity
+func (b *BurnList) Stats() map[string]int64 {
+	return map[string]int64{
+		"burns":   atomic.LoadInt64(&b.burns),
+		"skipped": atomic.LoadInt64(&b.skipped),
+	}
+}
+
+// BurnNode records that target blocked the node, so selections for the same
+// registrable domain avoid it for ttl
+func (np *NodePool) BurnNode(nodeID, target string, ttl time.Duration) {
+	domain := RegistrableDomain(target)
+	np.burns.Burn(nodeID, domain, ttl)
+	np.logger.Infof("Node %s burned for %s for %v", nodeID, domain, ttl)
+}
+
+// BurnedNodes returns the nodes currently burned for target's registrable
+// domain, for NodeSelection.Burned
+func (np *NodePool) BurnedNodes(target string) map[string]bool {
+	return np.burns.Burned(RegistrableDomain(target))
+}
@@ -0,0 +1,61 @@
+package nodepool
+
+import "time"
+
+// capHeadroom is the share of a cap past which a node is skipped, leaving
+// room for the traffic already on it
+const capHeadroom = 0.9
+
+// capUsageMaxAge is how old a throughput report may be before it's ignored;
+// quotas and tunnel counts only grow until the node reports again
+const capUsageMaxAge = 2 * time.Minute
+
+// NodeCaps are the limits the node's operator set (docker-node --max-up-mbps,
+// --daily-gb, ...) and its usage, as last reported to node-registration.
+// Zero limits are unlimited.
+type NodeCaps struct {
+	MaxUpMbps   float64 `json:"max_up_mbps,omitempty"`
+	MaxDownMbps float64 `json:"max_down_mbps,omitempty"`
+	DailyGB     float64 `json:"daily_gb,omitempty"`
+	MonthlyGB   float64 `json:"monthly_gb,omitempty"`
+	MaxTunnels  int     `json:"max_tunnels,omitempty"`
+
+	UpMbps       float64   `json:"up_mbps"`
+	DownMbps     float64   `json:"down_mbps"`
+	DailyBytes   int64     `json:"daily_bytes"`
+	MonthlyBytes int64     `json:"monthly_bytes"`
+	OpenTunnels  int       `json:"open_tunnels"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// NearCap returns which cap the node is near ("" if none): within
+// capHeadroom of its quota, throughput or tunnel limit
+func (c *NodeCaps) NearCap() string {
+	if c == nil {
+		return ""
+	}
+	near := func(used, limit float64) bool {
+		return limit > 0 && used >= limit*capHeadroom
+	}
+	switch {
+	case near(float64(c.DailyBytes), c.DailyGB*1e9):
+		return "daily"
+	case near(float64(c.MonthlyBytes), c.MonthlyGB*1e9):
+		return "monthly"
+	case c.MaxTunnels > 0 && c.OpenTunnels >= c.MaxTunnels:
+		return "tunnels"
+	case time.Since(c.UpdatedAt) > capUsageMaxAge:
+		return ""
+	case near(c.UpMbps, c.MaxUpMbps):
+		return "up-mbps"
+	case near(c.DownMbps, c.MaxDownMbps):
+		return "down-mbps"
+	}
+	return ""
+}
+
+// nearCap reports whether a cached node is near one of its operator's caps
+func (np *NodePool) nearCap(nodeID string) bool {
+	node := np.getCachedNode(nodeID)
+	return node != nil && node.Caps.NearCap() != ""
+}
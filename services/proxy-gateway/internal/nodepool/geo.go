@@ -0,0 +1,345 @@
+package nodepool
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Geo match levels of a targeted selection, closest first. Selection falls
+// back from one to the next, as far as its GeoPolicy allows, when no eligible
+// node is left.
+const (
+	GeoMatchRadius  = "radius"  // within the requested radius
+	GeoMatchCity    = "city"    // in the target's city
+	GeoMatchRegion  = "region"  // in the target's region
+	GeoMatchCountry = "country" // anywhere in the target's country
+	GeoMatchAny     = "any"     // outside the target, see GeoModeAny
+)
+
+const (
+	// DefaultGeoRadiusKm applies when lat-/lon- or zip- come without radius-
+	DefaultGeoRadiusKm = 25.0
+	// MaxGeoRadiusKm caps radius- and bounds the search for the nearest node
+	// that names the target's city and region
+	MaxGeoRadiusKm = 500.0
+
+	earthRadiusKm = 6371.0
+	kmPerDegree   = earthRadiusKm * math.Pi / 180
+
+	// Nodes are indexed under geohash prefixes of these lengths (cells of
+	// about 1250x625 km down to 5x5 km); searches use the longest prefix
+	// that covers the radius in at most maxGeoCells cells
+	geohashMinPrecision = 2
+	geohashMaxPrecision = 5
+	maxGeoCells         = 64
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// GeoTarget asks for exits close to a point or a postal code
+type GeoTarget struct {
+	Lat      float64 `json:"lat,omitempty"`
+	Lon      float64 `json:"lon,omitempty"`
+	HasPoint bool    `json:"has_point,omitempty"`
+	RadiusKm float64 `json:"radius_km,omitempty"` // 0 = DefaultGeoRadiusKm
+	Zip      string  `json:"zip,omitempty"`
+}
+
+// String renders the target for logs and errors
+func (t *GeoTarget) String() string {
+	radius := t.RadiusKm
+	if radius <= 0 {
+		radius = DefaultGeoRadiusKm
+	}
+	if t.HasPoint {
+		return fmt.Sprintf("%.4f,%.4f r=%gkm", t.Lat, t.Lon, radius)
+	}
+	return fmt.Sprintf("zip %s r=%gkm", t.Zip, radius)
+}
+
+// geoArea is a GeoTarget resolved against the node cache and postal codes:
+// the point to measure from and the city, region and country to fall back to
+type geoArea struct {
+	lat, lon float64
+	hasPoint bool
+	radiusKm float64
+	country  string
+	region   string
+	city     string
+}
+
+// nearNode is a node found by nodesNear
+type nearNode struct {
+	id string
+	km float64
+}
+
+// geoLevel is one fallback step of a radius-targeted selection
+type geoLevel struct {
+	name string
+	ids  []string // sorted
+}
+
+// geohash encodes a point at the given precision
+func geohash(lat, lon float64, precision int) string {
+	buf := make([]byte, 0, precision)
+	latLo, latHi, lonLo, lonHi := -90.0, 90.0, -180.0, 180.0
+	even, bits, ch := true, 0, 0
+	for len(buf) < precision {
+		if even {
+			mid := (lonLo + lonHi) / 2
+			if lon >= mid {
+				ch, lonLo = ch<<1|1, mid
+			} else {
+				ch, lonHi = ch<<1, mid
+			}
+		} else {
+			mid := (latLo + latHi) / 2
+			if lat >= mid {
+				ch, latLo = ch<<1|1, mid
+			} else {
+				ch, latHi = ch<<1, mid
+			}
+		}
+		even = !even
+		if bits++; bits == 5 {
+			buf = append(buf, geohashAlphabet[ch])
+			bits, ch = 0, 0
+		}
+	}
+	return string(buf)
+}
+
+// geohashCellSize returns the height and width in degrees of a geohash cell
+func geohashCellSize(precision int) (float64, float64) {
+	bits := 5 * precision
+	return 180 / math.Ldexp(1, bits/2), 360 / math.Ldexp(1, (bits+1)/2)
+}
+
+// haversineKm is the great-circle distance between two points
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat, dLon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// hasLocation reports whether a node registered coordinates
+func (n *Node) hasLocation() bool {
+	return n.Latitude != 0 || n.Longitude != 0
+}
+
+// indexGeo adds a node to the geohash and postal code indexes being built
+func indexGeo(byGeohash, byPostal map[string][]string, node *Node) {
+	if node.hasLocation() {
+		hash := geohash(node.Latitude, node.Longitude, geohashMaxPrecision)
+		for p := geohashMinPrecision; p <= geohashMaxPrecision; p++ {
+			byGeohash[hash[:p]] = append(byGeohash[hash[:p]], node.ID)
+		}
+	}
+	if postal := normalizePostalCode(node.PostalCode); postal != "" {
+		country := strings.ToUpper(node.Country)
+		byPostal[country+":"+postal] = append(byPostal[country+":"+postal], node.ID)
+		byPostal[":"+postal] = append(byPostal[":"+postal], node.ID)
+	}
+}
+
+// nodesNear returns the cached nodes within radiusKm of a point, in the
+// country if one is given, closest first
+func (np *NodePool) nodesNear(lat, lon, radiusKm float64, country string) []nearNode {
+	// Bounding box of the circle; when it takes in a pole, every longitude
+	dLat := radiusKm / kmPerDegree
+	dLon := 180.0
+	if s := math.Sin(radiusKm/earthRadiusKm) / math.Cos(lat*math.Pi/180); s < 1 {
+		dLon = math.Asin(s) * 180 / math.Pi
+	}
+
+	precision := geohashMinPrecision
+	for p := geohashMaxPrecision; p > geohashMinPrecision; p-- {
+		cellLat, cellLon := geohashCellSize(p)
+		if (2*dLat/cellLat+2)*(2*dLon/cellLon+2) <= maxGeoCells {
+			precision = p
+			break
+		}
+	}
+
+	// Every cell the bounding box touches
+	cellLat, cellLon := geohashCellSize(precision)
+	cells := make(map[string]bool)
+	for y := lat - dLat; ; y += cellLat {
+		cy := math.Max(-90, math.Min(90, math.Min(y, lat+dLat)))
+		for x := lon - dLon; ; x += cellLon {
+			cx := math.Min(x, lon+dLon)
+			if cx < -180 {
+				cx += 360
+			} else if cx > 180 {
+				cx -= 360
+			}
+			cells[geohash(cy, cx, precision)] = true
+			if x >= lon+dLon {
+				break
+			}
+		}
+		if y >= lat+dLat {
+			break
+		}
+	}
+
+	np.nodeCacheMu.RLock()
+	defer np.nodeCacheMu.RUnlock()
+	var found []nearNode
+	for cell := range cells {
+		for _, id := range np.geoIndex[cell] {
+			node := np.nodeCache[id]
+			if node == nil || country != "" && !strings.EqualFold(node.Country, country) {
+				continue
+			}
+			if km := haversineKm(lat, lon, node.Latitude, node.Longitude); km <= radiusKm {
+				found = append(found, nearNode{id: id, km: km})
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].km < found[j].km })
+	return found
+}
+
+// resolveGeo works out where a radius-targeted selection is aiming: the point
+// from lat-/lon- or the postal code, and the city, region and country to fall
+// back to, taken from the request, the postal code or the nearest node
+func (np *NodePool) resolveGeo(selection *NodeSelection) *geoArea {
+	t := selection.Near
+	area := &geoArea{
+		radiusKm: t.RadiusKm,
+		country:  strings.ToUpper(selection.Country),
+		region:   selection.Region,
+		city:     selection.City,
+	}
+	if area.radiusKm <= 0 {
+		area.radiusKm = DefaultGeoRadiusKm
+	}
+	area.radiusKm = math.Min(area.radiusKm, MaxGeoRadiusKm)
+	if t.HasPoint {
+		area.lat, area.lon, area.hasPoint = t.Lat, t.Lon, true
+	}
+
+	if t.Zip != "" {
+		if place, ok := np.lookupPostalCode(area.country, t.Zip); ok {
+			area.fill(place.lat, place.lon, place.country, place.region, place.city)
+		} else if node, lat, lon := np.postalCentroid(area.country, t.Zip); node != nil {
+			area.fill(lat, lon, node.Country, node.Region, node.City)
+		}
+	}
+
+	if area.hasPoint && (area.city == "" || area.region == "") {
+		if near := np.nodesNear(area.lat, area.lon, MaxGeoRadiusKm, area.country); len(near) > 0 {
+			if node := np.getCachedNode(near[0].id); node != nil {
+				area.fill(area.lat, area.lon, node.Country, node.Region, node.City)
+			}
+		}
+	}
+	return area
+}
+
+// fill sets whatever the area doesn't know yet
+func (a *geoArea) fill(lat, lon float64, country, region, city string) {
+	if !a.hasPoint && (lat != 0 || lon != 0) {
+		a.lat, a.lon, a.hasPoint = lat, lon, true
+	}
+	if a.country == "" {
+		a.country = strings.ToUpper(country)
+	}
+	if a.region == "" {
+		a.region = region
+	}
+	if a.city == "" {
+		a.city = city
+	}
+}
+
+// postalCentroid locates a postal code from the nodes registered in it,
+// returning one of them and their mean position
+func (np *NodePool) postalCentroid(country, zip string) (*Node, float64, float64) {
+	np.nodeCacheMu.RLock()
+	defer np.nodeCacheMu.RUnlock()
+	var first *Node
+	var lat, lon float64
+	located := 0
+	for _, id := range np.postalIndex[country+":"+normalizePostalCode(zip)] {
+		node := np.nodeCache[id]
+		if node == nil {
+			continue
+		}
+		if first == nil {
+			first = node
+		}
+		if node.hasLocation() {
+			lat += node.Latitude
+			lon += node.Longitude
+			located++
+		}
+	}
+	if located == 0 {
+		return first, 0, 0
+	}
+	return first, lat / float64(located), lon / float64(located)
+}
+
+// geoLevels lists the candidate pools selection goes through: the nodes
+// within the radius for radius targeting, then the steps of the geo policy.
+// Untargeted selections get one unnamed level.
+func (np *NodePool) geoLevels(selection *NodeSelection) []geoLevel {
+	policy, area := np.geoPolicyFor(selection)
+	var levels []geoLevel
+	if area != nil && area.hasPoint {
+		near := np.nodesNear(area.lat, area.lon, area.radiusKm, area.country)
+		ids := make([]string, len(near))
+		for i, n := range near {
+			ids[i] = n.id
+		}
+		sort.Strings(ids)
+		levels = append(levels, geoLevel{name: GeoMatchRadius, ids: ids})
+		if policy.mode() == GeoModeStrict {
+			return levels
+		}
+	}
+	if !policy.Targeted() && area == nil {
+		return []geoLevel{{ids: np.scopeIDs(GeoScope{})}}
+	}
+	for _, scope := range policy.Scopes() {
+		levels = append(levels, geoLevel{name: scope.Level, ids: np.scopeIDs(scope)})
+	}
+	return levels
+}
+
+// geoPolicyFor returns the selection's geo policy. For radius targeting it
+// also returns the resolved area, whose city, region and country fill in
+// what the request left out.
+func (np *NodePool) geoPolicyFor(selection *NodeSelection) (GeoPolicy, *geoArea) {
+	policy := selection.GeoPolicy()
+	if selection.Near == nil {
+		return policy, nil
+	}
+	area := np.resolveGeo(selection)
+	policy.Country, policy.Region, policy.City = area.country, area.region, area.city
+	return policy, area
+}
+
+// GeoMatch reports how closely a node matches a geo-targeted selection (one
+// of the GeoMatch* levels), or "" when the selection isn't targeted or the
+// node is outside its policy
+func (np *NodePool) GeoMatch(selection *NodeSelection, node *Node) string {
+	if node == nil {
+		return ""
+	}
+	policy, area := np.geoPolicyFor(selection)
+	if area != nil && area.hasPoint && node.hasLocation() && haversineKm(area.lat, area.lon, node.Latitude, node.Longitude) <= area.radiusKm {
+		return GeoMatchRadius
+	}
+	if !policy.Targeted() && area == nil {
+		return ""
+	}
+	return policy.Match(node)
+}
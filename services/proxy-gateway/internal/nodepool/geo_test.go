@@ -0,0 +1,193 @@
+package nodepool
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestGeohashEncode(t *testing.T) {
+	tests := []struct {
+		lat, lon  float64
+		precision int
+		want      string
+	}{
+		{57.64911, 10.40744, 11, "u4pruydqqvj"},
+		{42.6, -5.6, 5, "ezs42"},
+		{0, 0, 5, "s0000"},
+		{-90, -180, 5, "00000"},
+		{90, 180, 5, "zzzzz"},
+		{90, -180, 5, "bpbpb"},
+		{-90, 180, 5, "pbpbp"},
+		{0, 179.99, 3, "xbp"},
+		{0, -179.99, 3, "800"},
+	}
+	for _, tt := range tests {
+		if got := geohash(tt.lat, tt.lon, tt.precision); got != tt.want {
+			t.Errorf("geohash(%v, %v, %d) = %q, want %q", tt.lat, tt.lon, tt.precision, got, tt.want)
+		}
+	}
+}
+
+func TestGeohashPrefixes(t *testing.T) {
+	// A longer hash refines the shorter one, so the index can use its prefixes
+	for _, p := range [][2]float64{{51.5074, -0.1278}, {-33.8688, 151.2093}, {89.99, 0}, {0, -179.999}} {
+		long := geohash(p[0], p[1], geohashMaxPrecision)
+		for precision := geohashMinPrecision; precision < geohashMaxPrecision; precision++ {
+			if short := geohash(p[0], p[1], precision); !strings.HasPrefix(long, short) {
+				t.Errorf("%v: %q is not a prefix of %q", p, short, long)
+			}
+		}
+	}
+}
+
+func TestGeohashCellSize(t *testing.T) {
+	tests := []struct {
+		precision     int
+		height, width float64
+	}{
+		{1, 45, 45},
+		{2, 5.625, 11.25},
+		{3, 180.0 / 128, 360.0 / 256},
+		{5, 180.0 / 4096, 360.0 / 8192},
+	}
+	for _, tt := range tests {
+		height, width := geohashCellSize(tt.precision)
+		if height != tt.height || width != tt.width {
+			t.Errorf("geohashCellSize(%d) = %v x %v, want %v x %v", tt.precision, height, width, tt.height, tt.width)
+		}
+	}
+
+	// Points one cell apart get different hashes, points within a cell the same
+	height, width := geohashCellSize(4)
+	// The middle of the cell holding 40,-74
+	lat := math.Floor((40+90)/height)*height - 90 + height/2
+	lon := math.Floor((-74+180)/width)*width - 180 + width/2
+	base := geohash(lat, lon, 4)
+	if geohash(lat+height/3, lon-width/3, 4) != base {
+		t.Error("point inside the cell hashed to a different cell")
+	}
+	for _, d := range [][2]float64{{height, 0}, {-height, 0}, {0, width}, {0, -width}} {
+		if geohash(lat+d[0], lon+d[1], 4) == base {
+			t.Errorf("neighbour at %v hashed to the same cell %q", d, base)
+		}
+	}
+}
+
+func TestHaversineKm(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		want                   float64
+	}{
+		{"same point", 48.8566, 2.3522, 48.8566, 2.3522, 0},
+		{"one degree of latitude", 10, 20, 11, 20, kmPerDegree},
+		{"across the antimeridian", 0, 179.5, 0, -179.5, kmPerDegree},
+		{"over the north pole", 89, 0, 89, 180, 2 * kmPerDegree},
+		{"antipodes", 0, 0, 0, 180, math.Pi * earthRadiusKm},
+		{"London to Paris", 51.5074, -0.1278, 48.8566, 2.3522, 343.6},
+	}
+	for _, tt := range tests {
+		if got := haversineKm(tt.lat1, tt.lon1, tt.lat2, tt.lon2); math.Abs(got-tt.want) > 0.5 {
+			t.Errorf("%s: %.2f km, want %.2f", tt.name, got, tt.want)
+		}
+	}
+}
+
+// geoTestPool caches nodes at the given points, indexed like refreshNodeCache does
+func geoTestPool(nodes ...*Node) *NodePool {
+	np := &NodePool{
+		nodeCache:   make(map[string]*Node),
+		geoIndex:    make(map[string][]string),
+		postalIndex: make(map[string][]string),
+	}
+	for _, node := range nodes {
+		np.nodeCache[node.ID] = node
+		indexGeo(np.geoIndex, np.postalIndex, node)
+	}
+	return np
+}
+
+func nearIDs(found []nearNode) []string {
+	ids := make([]string, len(found))
+	for i, n := range found {
+		ids[i] = n.id
+	}
+	return ids
+}
+
+func TestNodesNear(t *testing.T) {
+	np := geoTestPool(
+		&Node{ID: "nyc", Country: "US", Latitude: 40.7128, Longitude: -74.0060},
+		&Node{ID: "newark", Country: "US", Latitude: 40.7357, Longitude: -74.1724},
+		&Node{ID: "philly", Country: "US", Latitude: 39.9526, Longitude: -75.1652},
+		&Node{ID: "toronto", Country: "CA", Latitude: 43.6532, Longitude: -79.3832},
+	)
+
+	if got := nearIDs(np.nodesNear(40.7128, -74.0060, 25, "")); strings.Join(got, ",") != "nyc,newark" {
+		t.Errorf("25 km of NYC = %v, want nyc,newark closest first", got)
+	}
+	if got := nearIDs(np.nodesNear(40.7128, -74.0060, 150, "US")); strings.Join(got, ",") != "nyc,newark,philly" {
+		t.Errorf("150 km of NYC in US = %v", got)
+	}
+	if got := nearIDs(np.nodesNear(40.7128, -74.0060, 600, "ca")); strings.Join(got, ",") != "toronto" {
+		t.Errorf("600 km of NYC in CA = %v, want toronto", got)
+	}
+	if got := np.nodesNear(0.5, 0.5, 100, ""); len(got) != 0 {
+		t.Errorf("nodes near an empty area = %v", nearIDs(got))
+	}
+}
+
+func TestNodesNearAntimeridian(t *testing.T) {
+	np := geoTestPool(
+		&Node{ID: "west", Country: "FJ", Latitude: -16.5, Longitude: 179.95},
+		&Node{ID: "east", Country: "FJ", Latitude: -16.5, Longitude: -179.95},
+		&Node{ID: "far", Country: "FJ", Latitude: -16.5, Longitude: 178.5},
+	)
+	for _, lon := range []float64{179.99, -179.99, 180, -180} {
+		got := nearIDs(np.nodesNear(-16.5, lon, 25, ""))
+		sort.Strings(got)
+		if strings.Join(got, ",") != "east,west" {
+			t.Errorf("25 km of -16.5,%v = %v, want east and west of the antimeridian", lon, got)
+		}
+	}
+}
+
+func TestNodesNearPoles(t *testing.T) {
+	for _, pole := range []float64{90, -90} {
+		sign := math.Copysign(1, pole)
+		np := geoTestPool(
+			&Node{ID: "near", Latitude: sign * 89.9, Longitude: 10},
+			&Node{ID: "across", Latitude: sign * 89.5, Longitude: -170}, // other side of the pole
+			&Node{ID: "sideways", Latitude: sign * 89.8, Longitude: 100},
+			&Node{ID: "far", Latitude: sign * 88, Longitude: 10},
+		)
+		// 11 km from the pole: the circle takes in every longitude
+		got := nearIDs(np.nodesNear(sign*89.9, 10, 100, ""))
+		if strings.Join(got, ",") != "near,sideways,across" {
+			t.Errorf("pole %v: 100 km = %v, want near,sideways,across", pole, got)
+		}
+		got = nearIDs(np.nodesNear(pole, 0, 100, ""))
+		sort.Strings(got)
+		if strings.Join(got, ",") != "across,near,sideways" {
+			t.Errorf("at pole %v: 100 km = %v", pole, got)
+		}
+	}
+}
+
+func TestNodesNearHighLatitudeEdge(t *testing.T) {
+	// The circle's widest longitude is asin(sin r / cos lat), wider than r / cos lat
+	const lat, radius = 80.0, MaxGeoRadiusKm
+	r := radius / earthRadiusKm
+	edgeLat := math.Asin(math.Sin(lat*math.Pi/180)/math.Cos(r)) * 180 / math.Pi
+	edgeLon := math.Asin(math.Sin(r)/math.Cos(lat*math.Pi/180))*180/math.Pi - 0.05
+	edge := &Node{ID: "edge", Latitude: edgeLat, Longitude: edgeLon}
+	if km := haversineKm(lat, 0, edge.Latitude, edge.Longitude); km > radius {
+		t.Fatalf("test node is %.1f km out, outside the radius", km)
+	}
+	np := geoTestPool(edge)
+	if got := nearIDs(np.nodesNear(lat, 0, radius, "")); len(got) != 1 {
+		t.Errorf("node at the widest point of the circle not found: %v", got)
+	}
+}
@@ -0,0 +1,166 @@
+package nodepool
+
+import (
+	"strings"
+)
+
+// Geo resolution modes: how far selection may move away from the requested
+// city, region or country when nothing there is available. Every pool
+// (NodePool, WebSocketNodePool, WarmPool, TunnelPool) resolves geo through a
+// GeoPolicy, so they agree on what a request may get.
+const (
+	GeoModeStrict          = "strict"           // only the requested geo
+	GeoModeFallbackRegion  = "fallback-region"  // the city, then its region
+	GeoModeFallbackCountry = "fallback-country" // city, region, then the whole country
+	GeoModeAny             = "any"              // ...then any country the plan allows
+
+	// DefaultGeoMode never leaves the requested country
+	DefaultGeoMode = GeoModeFallbackCountry
+)
+
+// ParseGeoMode reads a mode from a plan or the fallback- username parameter,
+// returning "" for unknown modes. Username values can't contain dashes, so
+// the short forms (fallback-region, fallback-country) are accepted too.
+func ParseGeoMode(s string) string {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "strict", "none", "off", "exact":
+		return GeoModeStrict
+	case "fallback-region", "fallbackregion", "region":
+		return GeoModeFallbackRegion
+	case "fallback-country", "fallbackcountry", "country":
+		return GeoModeFallbackCountry
+	case "any", "anywhere", "global":
+		return GeoModeAny
+	}
+	return ""
+}
+
+// GeoPolicy is the geo a request targets and how far selection may fall back
+// from it
+type GeoPolicy struct {
+	Mode    string // GeoMode*, "" = DefaultGeoMode
+	Country string
+	Region  string
+	City    string
+	// Plan country limits, which also bind GeoModeAny fallbacks
+	AllowedCountries []string
+	BlockedCountries []string
+}
+
+// GeoScope is one step of a GeoPolicy. Nodes matching a scope are tried
+// before moving on to the next one.
+type GeoScope struct {
+	Level   string // GeoMatch* level reported for nodes found here
+	Country string
+	Region  string
+	City    string
+}
+
+// GeoPolicy returns the selection's geo policy
+func (s *NodeSelection) GeoPolicy() GeoPolicy {
+	return GeoPolicy{
+		Mode:             s.GeoMode,
+		Country:          strings.ToUpper(s.Country),
+		Region:           s.Region,
+		City:             s.City,
+		AllowedCountries: s.AllowedCountries,
+		BlockedCountries: s.BlockedCountries,
+	}
+}
+
+// mode returns the effective mode
+func (p GeoPolicy) mode() string {
+	if mode := ParseGeoMode(p.Mode); mode != "" {
+		return mode
+	}
+	return DefaultGeoMode
+}
+
+// Targeted reports whether the request asked for any geo
+func (p GeoPolicy) Targeted() bool {
+	return p.Country != "" || p.Region != "" || p.City != ""
+}
+
+// Exact narrows the policy to the requested geo. The warm and tunnel pool
+// shortcuts use it: falling back is left to SelectNode, which sees the whole
+// pool and may still have an exact match.
+func (p GeoPolicy) Exact() GeoPolicy {
+	p.Mode = GeoModeStrict
+	return p
+}
+
+// Scopes lists the steps selection goes through, most specific first
+func (p GeoPolicy) Scopes() []GeoScope {
+	mode := p.mode()
+	var scopes []GeoScope
+	if p.City != "" {
+		scopes = append(scopes, GeoScope{Level: GeoMatchCity, Country: p.Country, Region: p.Region, City: p.City})
+	}
+	if p.Region != "" && (len(scopes) == 0 || mode != GeoModeStrict) {
+		scopes = append(scopes, GeoScope{Level: GeoMatchRegion, Country: p.Country, Region: p.Region})
+	}
+	if p.Country != "" && (len(scopes) == 0 || mode == GeoModeFallbackCountry || mode == GeoModeAny) {
+		scopes = append(scopes, GeoScope{Level: GeoMatchCountry, Country: p.Country})
+	}
+	if len(scopes) == 0 || mode == GeoModeAny {
+		scopes = append(scopes, GeoScope{Level: GeoMatchAny})
+	}
+	return scopes
+}
+
+// Matches reports whether a node is inside the scope and the plan's countries
+func (s GeoScope) Matches(node *Node, p GeoPolicy) bool {
+	if s.Country != "" && !strings.EqualFold(node.Country, s.Country) {
+		return false
+	}
+	if s.Region != "" && normalizeCity(node.Region) != normalizeCity(s.Region) {
+		return false
+	}
+	if s.City != "" && normalizeCity(node.City) != normalizeCity(s.City) {
+		return false
+	}
+	return countryAllowed(node.Country, p.AllowedCountries, p.BlockedCountries)
+}
+
+// Match returns the level at which a node satisfies the policy, or "" when
+// the node is outside it
+func (p GeoPolicy) Match(node *Node) string {
+	for _, scope := range p.Scopes() {
+		if scope.Matches(node, p) {
+			return scope.Level
+		}
+	}
+	return ""
+}
+
+// geoIndexKey keys the city and region indexes; country "" indexes every
+// country
+func geoIndexKey(country, name string) string {
+	return strings.ToUpper(country) + ":" + normalizeCity(name)
+}
+
+// scopeIDs returns the sorted IDs of the cached nodes in a scope's geo. Plan
+// country limits are left to eligibleNode.
+func (np *NodePool) scopeIDs(scope GeoScope) []string {
+	np.nodeCacheMu.RLock()
+	defer np.nodeCacheMu.RUnlock()
+	switch {
+	case scope.City != "":
+		ids := np.cityIndex[geoIndexKey(scope.Country, scope.City)]
+		if scope.Region == "" {
+			return ids
+		}
+		var kept []string
+		for _, id := range ids {
+			if node := np.nodeCache[id]; node != nil && normalizeCity(node.Region) == normalizeCity(scope.Region) {
+				kept = append(kept, id)
+			}
+		}
+		return kept
+	case scope.Region != "":
+		return np.regionIndex[geoIndexKey(scope.Country, scope.Region)]
+	case scope.Country != "":
+		return np.countryIndex[scope.Country]
+	}
+	return np.nodeIDs
+}
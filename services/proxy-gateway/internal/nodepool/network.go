@@ -0,0 +1,128 @@
+package nodepool
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Secondary indexes node-registration keeps from its offline IP database:
+// Redis sets of node IDs per ASN, ISP/carrier name token and connection type
+const (
+	asnIndexPrefix  = "nodes:asn:"
+	ispIndexPrefix  = "nodes:isp:"
+	connIndexPrefix = "nodes:conn:"
+)
+
+// Connection types nodes are classified into
+const (
+	ConnMobile      = "mobile"
+	ConnResidential = "residential"
+	ConnDatacenter  = "datacenter"
+)
+
+// targetsNetwork reports whether the selection asks for an ASN, ISP or
+// connection type
+func (s *NodeSelection) targetsNetwork() bool {
+	return s.ASN != 0 || s.ISP != "" || s.ConnectionType != ""
+}
+
+// networkIndexKeys names the index sets a node must be in for the selection
+func networkIndexKeys(selection *NodeSelection) []string {
+	var keys []string
+	if selection.ASN != 0 {
+		keys = append(keys, fmt.Sprintf("%s%d", asnIndexPrefix, selection.ASN))
+	}
+	for _, token := range ispTokens(selection.ISP) {
+		keys = append(keys, ispIndexPrefix+token)
+	}
+	if conn := normalizeConnectionType(selection.ConnectionType); conn != "" {
+		keys = append(keys, connIndexPrefix+conn)
+	}
+	return keys
+}
+
+// networkCandidates narrows the sorted candidate IDs to the nodes in the
+// selection's index sets. If Redis can't answer, the candidates are left as
+// they are and eligibleNode filters them one by one.
+func (np *NodePool) networkCandidates(selection *NodeSelection, ids []string) []string {
+	keys := networkIndexKeys(selection)
+	if len(keys) == 0 {
+		return ids
+	}
+	members, err := np.rdb.SInter(context.Background(), keys...).Result()
+	if err != nil {
+		np.logger.Warnf("Network index lookup failed: %v", err)
+		return ids
+	}
+	sort.Strings(members)
+	narrowed := make([]string, 0, len(members))
+	for _, id := range members {
+		if i := sort.SearchStrings(ids, id); i < len(ids) && ids[i] == id {
+			narrowed = append(narrowed, id)
+		}
+	}
+	return narrowed
+}
+
+// matchesNetwork checks a node against the selection's ASN, ISP and
+// connection type
+func matchesNetwork(node *Node, selection *NodeSelection) bool {
+	if selection.ASN != 0 && node.ASN != selection.ASN {
+		return false
+	}
+	if conn := normalizeConnectionType(selection.ConnectionType); conn != "" && normalizeConnectionType(node.ConnectionType) != conn {
+		return false
+	}
+	if selection.ISP == "" {
+		return true
+	}
+	have := make(map[string]bool)
+	for _, token := range append(ispTokens(node.ISP), ispTokens(node.Carrier)...) {
+		have[token] = true
+	}
+	for _, token := range ispTokens(selection.ISP) {
+		if !have[token] {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeConnectionType maps vendor and SDK connection types onto the
+// Conn* types, as node-registration's ipintel does when it indexes nodes
+func normalizeConnectionType(s string) string {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "mobile", "cellular", "wireless", "3g", "4g", "5g", "lte":
+		return ConnMobile
+	case "residential", "cable/dsl", "cable", "dsl", "fiber", "isp", "satellite", "consumer":
+		return ConnResidential
+	case "datacenter", "data center", "hosting", "dc", "content_delivery_network", "cdn":
+		return ConnDatacenter
+	}
+	return ""
+}
+
+// ispStopWords are left out of ISP tokens: legal forms and filler
+var ispStopWords = map[string]bool{
+	"llc": true, "inc": true, "ltd": true, "limited": true, "corp": true,
+	"corporation": true, "co": true, "company": true, "ag": true, "gmbh": true,
+	"sa": true, "plc": true, "srl": true, "bv": true, "the": true, "of": true,
+	"and": true,
+}
+
+// ispTokens splits an ISP name into the lowercase words the isp index is
+// keyed by; must match node-registration's ipintel.ISPTokens
+func ispTokens(name string) []string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	})
+	tokens := words[:0]
+	for _, w := range words {
+		if len(w) >= 2 && !ispStopWords[w] {
+			tokens = append(tokens, w)
+		}
+	}
+	return tokens
+}
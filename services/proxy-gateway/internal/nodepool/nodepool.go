@@ -6,13 +6,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/websocket"
@@ -36,7 +38,27 @@ type NodePool struct {
 
 	// In-memory node cache (avoids Redis roundtrips on every SelectNode)
 	nodeCacheMu   sync.RWMutex
-	nodeCache     map[string]*Node // node ID → cached node data
+	nodeCache     map[string]*Node    // node ID → cached node data
+	nodeIDs       []string            // sorted IDs of every cached node
+	countryIndex  map[string][]string // country → sorted node IDs
+	cityIndex     map[string][]string // geoIndexKey(country, city) → sorted node IDs
+	regionIndex   map[string][]string // geoIndexKey(country, region) → sorted node IDs
+	geoIndex      map[string][]string // geohash prefix → node IDs, see nodesNear
+	postalIndex   map[string][]string // "<country>:<postal code>" and ":<postal code>" → node IDs
+
+	// Postal code locations for zip- targeting, see LoadPostalCodes
+	postalMu    sync.RWMutex
+	postalCodes map[string]postalPlace
+
+	// Selection strategies and the load/latency they weigh
+	selectors map[string]Selector
+	stats     *nodeStats
+
+	// Exit IP reuse ledger for plan cooldowns
+	reuse *ReuseLedger
+
+	// Node/domain pairs burned by block detection
+	burns *BurnList
 }
 
 type Node struct {
@@ -47,6 +69,9 @@ type Node struct {
 	CountryName    string    `json:"country_name"`
 	City           string    `json:"city"`
 	Region         string    `json:"region"`
+	Latitude       float64   `json:"latitude"`
+	Longitude      float64   `json:"longitude"`
+	PostalCode     string    `json:"postal_code,omitempty"`
 	ASN            int       `json:"asn"`
 	ISP            string    `json:"isp"`
 	Carrier        string    `json:"carrier"`
@@ -58,17 +83,63 @@ type Node struct {
 	BandwidthUsed  int64     `json:"bandwidth_used_mb"`
 	LastHeartbeat  time.Time `json:"last_heartbeat"`
 	ConnectedSince time.Time `json:"connected_since"`
+
+	Caps *NodeCaps `json:"caps,omitempty"` // operator caps and usage, see NearCap
+
+	AvailableAt *time.Time `json:"available_at,omitempty"` // when a scheduled-off or paused node comes back
 }
 
 type NodeSelection struct {
-	Country       string
-	City          string
-	ASN           int    // Target ASN/ISP
-	MinSpeed      int    // Minimum speed in Mbps
-	MaxLatency    int    // Maximum latency in ms
-	SessionID     string
-	RotateAfter   int    // Rotate IP after N requests (0 = no rotation)
-	RotateOnError bool   // Rotate IP on error/timeout
+	Country         string
+	City            string
+	ASN             int             // Target ASN
+	ISP             string          // Target ISP or carrier, dot-separated name words
+	ConnectionType  string          // Target connection type, see Conn*
+	MinSpeed        int             // Minimum speed in Mbps
+	MaxLatency      int             // Maximum latency in ms
+	SessionID       string
+	RotateAfter     int             // Rotate IP after N requests (0 = no rotation)
+	RotateOnError   bool            // Rotate IP on error/timeout
+	MinQualityScore int             // Minimum node quality score (pool tier)
+	Strategy        string          // Selection strategy, see Strategy* ("" = random)
+	Trace           *SelectionTrace // If set, SelectNode records its decisions here
+	Reuse           *ReuseCooldown  // Skip exit IPs the customer used recently
+	SessionDomain   string          // Scope the sticky binding to this eTLD+1
+	Burned          map[string]bool // Node IDs burned for the target domain, see BurnedNodes
+	Pin             *NodePin        // Use only this node, see CheckPin
+	Near            *GeoTarget      // Prefer the nodes closest to a point or postal code
+	Region          string          // Target region, see GeoPolicy
+	GeoMode         string          // How far to fall back from the target geo, see GeoMode* ("" = DefaultGeoMode)
+	AllowedCountries []string       // Plan country limits, which geo fallbacks must respect
+	BlockedCountries []string
+}
+
+// StickyBinding names the sticky binding for a session, or for one of its
+// target domains when the session is domain-scoped
+func StickyBinding(sessionID, domain string) string {
+	if domain == "" {
+		return sessionID
+	}
+	return sessionID + "@" + domain
+}
+
+// TierMinQualityScore maps an AccountPlan pool quality tier to the lowest node
+// quality score it admits. Unknown tiers and "standard" admit every node.
+func TierMinQualityScore(tier string) int {
+	switch strings.ToLower(tier) {
+	case "premium":
+		return 70
+	case "dedicated", "elite":
+		return 85
+	}
+	return 0
+}
+
+// UsesDefaultPool reports whether any node the default strategy returns will
+// do, so callers may take one from the tier-agnostic warm or tunnel pools
+// instead of calling SelectNode
+func (s *NodeSelection) UsesDefaultPool() bool {
+	return s.MinQualityScore == 0 && s.Reuse == nil && len(s.Burned) == 0 && s.Pin == nil && s.Near == nil && !s.targetsNetwork() && (s.Strategy == "" || s.Strategy == StrategyRandom)
 }
 
 type SessionState struct {
@@ -95,7 +166,12 @@ func NewNodePool(rdb *redis.Client, logger *logrus.Entry) *NodePool {
 		connectedNodes: make(map[string]bool),
 		provenNodes:    make(map[string]time.Time),
 		nodeCache:      make(map[string]*Node),
+		countryIndex:   make(map[string][]string),
+		stats:          newNodeStats(),
 	}
+	pool.selectors = newSelectors(pool)
+	pool.reuse = newReuseLedger(rdb)
+	pool.burns = newBurnList(rdb)
 
 	// Start background routines
 	go pool.cleanupInactiveNodes()
@@ -219,9 +295,43 @@ func (np *NodePool) buildNodeCache() {
 		}
 	}
 
+	ids := make([]string, 0, len(newCache))
+	byCountry := make(map[string][]string)
+	byCity := make(map[string][]string)
+	byRegion := make(map[string][]string)
+	byGeohash := make(map[string][]string)
+	byPostal := make(map[string][]string)
+	for id, node := range newCache {
+		ids = append(ids, id)
+		country := strings.ToUpper(node.Country)
+		byCountry[country] = append(byCountry[country], id)
+		if node.City != "" {
+			byCity[geoIndexKey(country, node.City)] = append(byCity[geoIndexKey(country, node.City)], id)
+			byCity[geoIndexKey("", node.City)] = append(byCity[geoIndexKey("", node.City)], id)
+		}
+		if node.Region != "" {
+			byRegion[geoIndexKey(country, node.Region)] = append(byRegion[geoIndexKey(country, node.Region)], id)
+			byRegion[geoIndexKey("", node.Region)] = append(byRegion[geoIndexKey("", node.Region)], id)
+		}
+		indexGeo(byGeohash, byPostal, node)
+	}
+	sort.Strings(ids)
+	for _, index := range []map[string][]string{byCountry, byCity, byRegion} {
+		for _, list := range index {
+			sort.Strings(list)
+		}
+	}
+
 	np.nodeCacheMu.Lock()
 	np.nodeCache = newCache
+	np.nodeIDs = ids
+	np.countryIndex = byCountry
+	np.cityIndex = byCity
+	np.regionIndex = byRegion
+	np.geoIndex = byGeohash
+	np.postalIndex = byPostal
 	np.nodeCacheMu.Unlock()
+	np.stats.forget(newCache)
 
 	np.logger.Debugf("Node cache refreshed: %d nodes", len(newCache))
 }
@@ -256,23 +366,30 @@ func (np *NodePool) GetProvenNodes(maxAge time.Duration) []string {
 
 // SelectNode selects the best available node based on targeting criteria
 func (np *NodePool) SelectNode(selection *NodeSelection) (*Node, error) {
+	if selection.Pin != nil {
+		return np.selectPinned(selection)
+	}
+
 	// If session ID is specified, try to get sticky node
 	if selection.SessionID != "" {
-		node, needsRotation, err := np.getStickyNode(selection.SessionID, selection.RotateAfter)
+		node, needsRotation, err := np.getStickyNode(StickyBinding(selection.SessionID, selection.SessionDomain), selection.RotateAfter)
 		if err == nil && node != nil && !needsRotation {
-			// Check if node is blacklisted
-			if !np.IsNodeBlacklisted(node.ID) {
+			// Check if node is blacklisted or burned for this target
+			if !np.IsNodeBlacklisted(node.ID) && !selection.Burned[node.ID] {
 				np.logger.Debugf("Using sticky node %s for session %s", node.ID, selection.SessionID)
+				if selection.Trace != nil {
+					selection.Trace.Decisions = append(selection.Trace.Decisions, &Decision{Sticky: true, Chosen: node.ID})
+				}
+				np.stats.acquire(node.ID)
 				return node, nil
 			}
-			np.logger.Debugf("Sticky node %s is blacklisted, selecting new node", node.ID)
+			np.logger.Debugf("Sticky node %s is blacklisted or burned, selecting new node", node.ID)
 		}
 		if needsRotation {
 			np.logger.Debugf("Rotating IP for session %s", selection.SessionID)
 		}
 	}
 
-	// Fast path: pick random connected node from cache
 	np.nodeCacheMu.RLock()
 	cacheLen := len(np.nodeCache)
 	np.nodeCacheMu.RUnlock()
@@ -281,77 +398,151 @@ func (np *NodePool) SelectNode(selection *NodeSelection) (*Node, error) {
 		return nil, fmt.Errorf("no connected nodes in cache")
 	}
 
-	country := strings.ToUpper(selection.Country)
-
-	// Random sampling from cache — O(1) per attempt
-	var selectedNode *Node
-	maxTries := 50
+	// The geo policy decides the candidate pools: the requested geo (or the
+	// nodes within the radius), then as far out as its mode allows
+	levels := np.geoLevels(selection)
 
-	np.nodeCacheMu.RLock()
-	// Build a snapshot of keys for random access
-	cacheKeys := make([]string, 0, len(np.nodeCache))
-	for k := range np.nodeCache {
-		cacheKeys = append(cacheKeys, k)
+	// Network targeting narrows the candidates through node-registration's
+	// indexes; round-robin keeps a separate cursor per filter
+	country := strings.ToUpper(selection.Country)
+	poolKey := country
+	if selection.Region != "" || selection.City != "" {
+		poolKey = fmt.Sprintf("%s|%s|%s", country, selection.Region, selection.City)
 	}
-	np.nodeCacheMu.RUnlock()
-
-	for tried := 0; tried < maxTries && tried < len(cacheKeys); tried++ {
-		idx := rand.Intn(len(cacheKeys))
-		nodeID := cacheKeys[idx]
-
-		if np.IsNodeBlacklisted(nodeID) {
-			continue
+	if selection.targetsNetwork() {
+		poolKey = fmt.Sprintf("%s|asn=%d|isp=%s|conn=%s", poolKey, selection.ASN, selection.ISP, selection.ConnectionType)
+	}
+	var level geoLevel
+
+	// pick runs the selection strategy on the current level, skipping exit
+	// IPs in recent
+	pick := func(recent map[string]time.Time) (*Node, *Decision) {
+		ids := level.ids
+		if selection.targetsNetwork() {
+			ids = np.networkCandidates(selection, ids)
 		}
-		if !np.IsConnected(nodeID) {
-			continue
+		selector := np.selector(selection.Strategy)
+		decision := &Decision{Strategy: selector.Name(), Pool: len(ids), Geo: level.name}
+		if selection.Trace != nil {
+			selection.Trace.Decisions = append(selection.Trace.Decisions, decision)
 		}
-
-		node := np.getCachedNode(nodeID)
-		if node == nil {
-			continue
+		node := selector.Select(CandidatePool{
+			Key: poolKey + level.name,
+			IDs: ids,
+			Eligible: func(nodeID string) *Node {
+				return np.eligibleNode(nodeID, selection, recent, decision)
+			},
+		}, decision)
+		if node != nil {
+			decision.Chosen = node.ID
 		}
+		return node, decision
+	}
 
-		if country != "" && strings.ToUpper(node.Country) != country {
-			continue
-		}
-		if selection.City != "" && normalizeCity(node.City) != normalizeCity(selection.City) {
-			continue
+	var selectedNode *Node
+	var decision *Decision
+	for _, level = range levels {
+		if selection.Reuse != nil {
+			var err error
+			selectedNode, decision, err = np.selectWithCooldown(selection.Reuse, pick)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			selectedNode, decision = pick(nil)
 		}
-		if node.Status != "available" {
-			continue
+		if selectedNode != nil {
+			break
 		}
-
-		selectedNode = node
-		break
 	}
 
+	if selectedNode == nil && selection.Near != nil {
+		return nil, fmt.Errorf("no matching nodes near %s, country=%s, city=%s (cache=%d)", selection.Near, selection.Country, selection.City, cacheLen)
+	}
 	if selectedNode == nil {
-		return nil, fmt.Errorf("no matching nodes for: country=%s, city=%s (cache=%d)", selection.Country, selection.City, cacheLen)
+		return nil, fmt.Errorf("no matching nodes for: country=%s, region=%s, city=%s, geo=%s, asn=%d, isp=%s, conn=%s (cache=%d)", selection.Country, selection.Region, selection.City, selection.GeoPolicy().mode(), selection.ASN, selection.ISP, selection.ConnectionType, cacheLen)
 	}
 
 	// Create sticky session if session ID is provided
 	if selection.SessionID != "" {
-		np.createStickySession(selection.SessionID, selectedNode, selection)
+		np.createStickySession(StickyBinding(selection.SessionID, selection.SessionDomain), selectedNode, selection)
 	}
 
 	// Mark node as busy temporarily
 	np.markNodeBusy(selectedNode.ID)
 
-	np.logger.Debugf("Selected node %s (%s, %s) for request", selectedNode.ID, selectedNode.IPAddress, selectedNode.Country)
+	np.logger.Debugf("Selected node %s (%s, %s) for request: %s", selectedNode.ID, selectedNode.IPAddress, selectedNode.Country, decision)
 	return selectedNode, nil
 }
 
+// eligibleNode returns the cached node if it passes the selection filters,
+// recording why it doesn't otherwise
+func (np *NodePool) eligibleNode(nodeID string, selection *NodeSelection, recent map[string]time.Time, d *Decision) *Node {
+	if np.IsNodeBlacklisted(nodeID) {
+		d.reject("blacklisted")
+		return nil
+	}
+	if !np.IsConnected(nodeID) {
+		d.reject("disconnected")
+		return nil
+	}
+	node := np.getCachedNode(nodeID)
+	if node == nil {
+		d.reject("evicted")
+		return nil
+	}
+	if !matchesNetwork(node, selection) {
+		d.reject("network")
+		return nil
+	}
+	if node.Status != "available" {
+		d.reject(statusReason(node.Status))
+		return nil
+	}
+	if !countryAllowed(node.Country, selection.AllowedCountries, selection.BlockedCountries) {
+		d.reject("plan-country")
+		return nil
+	}
+	if node.QualityScore < selection.MinQualityScore {
+		d.reject("quality")
+		return nil
+	}
+	if node.Caps.NearCap() != "" {
+		d.reject("near-cap")
+		return nil
+	}
+	if _, used := recent[node.IPAddress]; used {
+		d.reject("reused")
+		return nil
+	}
+	if selection.Burned[nodeID] {
+		atomic.AddInt64(&np.burns.skipped, 1)
+		d.reject("burned")
+		return nil
+	}
+	return node
+}
+
 // ReleaseNode marks a node as available again
 func (np *NodePool) ReleaseNode(nodeID string) {
 	ctx := context.Background()
 	key := fmt.Sprintf("node:busy:%s", nodeID)
 	np.rdb.Del(ctx, key)
+	np.stats.release(nodeID)
 	np.logger.Debugf("Released node %s", nodeID)
 }
 
 // GetNodeByID retrieves a specific node
 func (np *NodePool) GetNodeByID(nodeID string) (*Node, error) {
 	ctx := context.Background()
+
+	// Nodes are registered under node:<id>
+	if nodeData, err := np.rdb.Get(ctx, fmt.Sprintf("node:%s", nodeID)).Result(); err == nil {
+		var node Node
+		if err := json.Unmarshal([]byte(nodeData), &node); err == nil && node.ID == nodeID {
+			return &node, nil
+		}
+	}
 	
 	// Try to find the node in any country/city combination
 	keys, err := np.rdb.Keys(ctx, "node:*").Result()
@@ -484,58 +675,14 @@ func (np *NodePool) createStickySession(sessionID string, node *Node, selection
 	np.logger.Debugf("Created sticky session %s -> node %s (rotate after %d)", sessionID, node.ID, selection.RotateAfter)
 }
 
-func (np *NodePool) selectBestNode(nodes []*Node) *Node {
-	if len(nodes) == 1 {
-		return nodes[0]
-	}
-
-	// Weighted random selection for maximum IP diversity
-	// Shuffle nodes and pick from top candidates weighted by score
-	// This ensures we spread traffic across all available nodes
-	
-	// Fisher-Yates shuffle
-	shuffled := make([]*Node, len(nodes))
-	copy(shuffled, nodes)
-	for i := len(shuffled) - 1; i > 0; i-- {
-		j := rand.Intn(i + 1)
-		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
-	}
-
-	// Pick from shuffled list with slight quality bias
-	// Take top 50% by quality, then random from those
-	if len(shuffled) > 4 {
-		// Score all nodes
-		type scored struct {
-			node  *Node
-			score float64
-		}
-		scoredNodes := make([]scored, len(shuffled))
-		for i, n := range shuffled {
-			scoredNodes[i] = scored{node: n, score: np.calculateNodeScore(n)}
-		}
-		// Sort by score descending (simple selection of top half)
-		topHalf := len(scoredNodes) / 2
-		if topHalf < 4 {
-			topHalf = len(scoredNodes)
-		}
-		// Just pick random from the pool - maximize diversity
-		return shuffled[rand.Intn(len(shuffled))]
-	}
-
-	return shuffled[rand.Intn(len(shuffled))]
-}
-
 func (np *NodePool) calculateNodeScore(node *Node) float64 {
 	qualityScore := float64(node.QualityScore) / 100.0
-	
-	// Check if node is currently busy
-	ctx := context.Background()
-	busyKey := fmt.Sprintf("node:busy:%s", node.ID)
-	isBusy, _ := np.rdb.Exists(ctx, busyKey).Result()
-	
+
+	// Penalize nodes already carrying traffic from this gateway
+	active, _, _ := np.stats.get(node.ID)
 	loadPenalty := 0.0
-	if isBusy > 0 {
-		loadPenalty = 0.5 // Penalize busy nodes
+	if active > 0 {
+		loadPenalty = 0.5
 	}
 
 	// Time since last heartbeat (fresher is better)
@@ -569,6 +716,7 @@ func (np *NodePool) isNodeHealthy(node *Node) bool {
 }
 
 func (np *NodePool) markNodeBusy(nodeID string) {
+	np.stats.acquire(nodeID)
 	ctx := context.Background()
 	busyKey := fmt.Sprintf("node:busy:%s", nodeID)
 	np.rdb.Set(ctx, busyKey, "1", 30*time.Second) // Mark as busy for 30 seconds
@@ -630,6 +778,7 @@ func (np *NodePool) GetStatus() map[string]interface{} {
 		"available": 0,
 		"busy":      0,
 		"inactive":  0,
+		"resting":   0, // scheduled off or paused, still connected
 	}
 	
 	countries := make(map[string]int)
@@ -650,6 +799,8 @@ func (np *NodePool) GetStatus() map[string]interface{} {
 
 		if np.isNodeHealthy(&node) {
 			stats["available"]++
+		} else if node.resting() {
+			stats["resting"]++
 		} else {
 			stats["inactive"]++
 		}
@@ -665,6 +816,8 @@ func (np *NodePool) GetStatus() map[string]interface{} {
 		"stats":        stats,
 		"countries":    countries,
 		"health_stats": np.GetHealthStats(),
+		"ip_reuse":     np.reuse.Stats(),
+		"burns":        np.burns.Stats(),
 		"timestamp":    time.Now().UTC(),
 	}
 }
@@ -932,7 +1085,8 @@ func (np *NodePool) GetHealthStats() map[string]int {
 	return stats
 }
 
-// normalizeCity removes accents and lowercases for comparison
+// normalizeCity removes accents, spaces and punctuation and lowercases for
+// comparison
 func normalizeCity(s string) string {
 	// Simple replacements for common accented characters
 	replacements := map[rune]rune{
@@ -953,7 +1107,9 @@ func normalizeCity(s string) string {
 	for _, r := range s {
 		if replacement, ok := replacements[r]; ok {
 			result = append(result, replacement)
-		} else {
+		} else if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			// Spaces and punctuation vary between sources and can't be
+			// typed in a username: "New York", "new_york" and "newyork" match
 			result = append(result, r)
 		}
 	}
@@ -0,0 +1,220 @@
+package nodepool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Pinned node availability. Anything but PinAvailable is a PinError reason.
+const (
+	PinAvailable   = "available"
+	PinNotFound    = "not-found"   // no node with that ID or IP
+	PinOffline     = "offline"     // node not connected
+	PinBlacklisted = "blacklisted" // node failing, out of rotation for a while
+	PinBusy        = "busy"        // node at its in-flight limit on this gateway
+	PinResting     = "resting"     // node outside its operator's sharing hours or paused
+	PinNotAllowed  = "not-allowed" // node outside the plan's countries or pool tier
+)
+
+const (
+	// pinMaxActive caps the requests this gateway runs through one pinned
+	// node at a time
+	pinMaxActive = 16
+	// pinBusyRetry is the Retry-After suggested for busy nodes
+	pinBusyRetry = 5 * time.Second
+)
+
+// NodePin restricts a selection to one node, named by ID or by exit IP.
+// Pinning bypasses the selection strategy, geo targeting, reuse cooldowns and
+// burns; the plan's countries and pool tier still apply.
+type NodePin struct {
+	NodeID           string   `json:"node_id,omitempty"`
+	IP               string   `json:"ip,omitempty"`
+	AllowedCountries []string `json:"allowed_countries,omitempty"`
+	BlockedCountries []string `json:"blocked_countries,omitempty"`
+}
+
+func (p *NodePin) target() string {
+	if p.NodeID != "" {
+		return p.NodeID
+	}
+	return p.IP
+}
+
+// PinError reports why a pinned node can't take a request
+type PinError struct {
+	Target     string // node ID or IP as pinned
+	Reason     string // one of the Pin* reasons
+	RetryAfter time.Duration
+}
+
+func (e *PinError) Error() string {
+	return fmt.Sprintf("pinned exit %s unavailable: %s", e.Target, e.Reason)
+}
+
+// NodeAvailability is the answer to a pinned-node availability poll
+type NodeAvailability struct {
+	Target     string    `json:"target"`
+	Status     string    `json:"status"` // PinAvailable or a PinError reason
+	NodeID     string    `json:"node_id,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+	Country    string    `json:"country,omitempty"`
+	RetryAfter int       `json:"retry_after,omitempty"` // seconds
+	CheckedAt  time.Time `json:"checked_at"`
+}
+
+// CheckPin resolves the selection's pinned node and reports whether the
+// selection may use it now. Errors are *PinError.
+func (np *NodePool) CheckPin(selection *NodeSelection) (*Node, error) {
+	pin := selection.Pin
+	var nodes []*Node
+	if pin.NodeID != "" {
+		node, err := np.GetNodeByID(pin.NodeID)
+		if err == nil && (pin.IP == "" || node.IPAddress == pin.IP) {
+			nodes = append(nodes, node)
+		}
+	} else if pin.IP != "" {
+		nodes = np.nodesByIP(pin.IP)
+	}
+	if len(nodes) == 0 {
+		return nil, &PinError{Target: pin.target(), Reason: PinNotFound}
+	}
+
+	// Carrier NAT can put several nodes behind one IP; any of them will do
+	var first error
+	for _, node := range nodes {
+		err := np.pinAvailable(node, selection)
+		if err == nil {
+			return node, nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return nil, first
+}
+
+// Availability reports whether the selection's pinned node could take a
+// request now. The exit IP is only echoed back when the pin named that IP, so
+// a poll can't map node IDs to residential addresses.
+func (np *NodePool) Availability(selection *NodeSelection) *NodeAvailability {
+	a := &NodeAvailability{
+		Target:    selection.Pin.target(),
+		Status:    PinAvailable,
+		CheckedAt: time.Now().UTC(),
+	}
+	node, err := np.CheckPin(selection)
+	if pinErr, ok := err.(*PinError); ok {
+		a.Status = pinErr.Reason
+		a.RetryAfter = int((pinErr.RetryAfter + time.Second - 1) / time.Second)
+	}
+	if node != nil {
+		a.NodeID = node.ID
+		if selection.Pin.IP != "" && selection.Pin.IP == node.IPAddress {
+			a.IP = node.IPAddress
+		}
+		a.Country = node.Country
+	}
+	return a
+}
+
+// pinAvailable checks one pinned node, most lasting reason first
+func (np *NodePool) pinAvailable(node *Node, selection *NodeSelection) error {
+	pin := selection.Pin
+	fail := func(reason string, retryAfter time.Duration) error {
+		return &PinError{Target: pin.target(), Reason: reason, RetryAfter: retryAfter}
+	}
+
+	if !countryAllowed(node.Country, pin.AllowedCountries, pin.BlockedCountries) ||
+		node.QualityScore < selection.MinQualityScore {
+		return fail(PinNotAllowed, 0)
+	}
+	if !np.IsConnected(node.ID) || (node.Status != "available" && node.Status != PinBusy && !node.resting()) {
+		return fail(PinOffline, 0)
+	}
+	if node.resting() {
+		return fail(PinResting, node.returnsIn())
+	}
+	if np.IsNodeBlacklisted(node.ID) {
+		ttl, _ := np.rdb.TTL(context.Background(), fmt.Sprintf("blacklist:%s", node.ID)).Result()
+		return fail(PinBlacklisted, ttl)
+	}
+	if active, _, _ := np.stats.get(node.ID); active >= pinMaxActive || node.Status == PinBusy {
+		return fail(PinBusy, pinBusyRetry)
+	}
+	return nil
+}
+
+// selectPinned is SelectNode for pinned selections
+func (np *NodePool) selectPinned(selection *NodeSelection) (*Node, error) {
+	node, err := np.CheckPin(selection)
+	if err != nil {
+		return nil, err
+	}
+	if selection.Trace != nil {
+		selection.Trace.Decisions = append(selection.Trace.Decisions, &Decision{Pinned: true, Chosen: node.ID})
+	}
+	np.markNodeBusy(node.ID)
+	np.logger.Debugf("Selected pinned node %s (%s)", node.ID, node.IPAddress)
+	return node, nil
+}
+
+// nodesByIP finds the nodes with an exit IP: connected nodes from the cache,
+// otherwise any registered node so a disconnected one reports as offline
+func (np *NodePool) nodesByIP(ip string) []*Node {
+	var nodes []*Node
+	np.nodeCacheMu.RLock()
+	for _, node := range np.nodeCache {
+		if node.IPAddress == ip {
+			nodes = append(nodes, node)
+		}
+	}
+	np.nodeCacheMu.RUnlock()
+	if len(nodes) > 0 {
+		return nodes
+	}
+
+	ctx := context.Background()
+	keys, err := np.rdb.Keys(ctx, "node:*").Result()
+	if err != nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		data, err := np.rdb.Get(ctx, key).Result()
+		if err != nil {
+			continue
+		}
+		var node Node
+		if err := json.Unmarshal([]byte(data), &node); err != nil {
+			continue
+		}
+		if node.IPAddress == ip && !seen[node.ID] {
+			seen[node.ID] = true
+			nodes = append(nodes, &node)
+		}
+	}
+	return nodes
+}
+
+// countryAllowed applies a plan's allowed (empty means all) and blocked
+// country lists
+func countryAllowed(country string, allowed, blocked []string) bool {
+	for _, c := range blocked {
+		if strings.EqualFold(c, country) {
+			return false
+		}
+	}
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, c := range allowed {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
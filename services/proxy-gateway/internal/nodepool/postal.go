@@ -0,0 +1,77 @@
+package nodepool
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// postalPlace is where a postal code is
+type postalPlace struct {
+	lat, lon float64
+	country  string
+	region   string
+	city     string
+}
+
+// LoadPostalCodes reads postal code locations for zip- targeting from a
+// GeoNames postal code dump (tab-separated: country code, postal code, place
+// name, admin1 name, admin1 code, admin2 name, admin2 code, admin3 name,
+// admin3 code, latitude, longitude, accuracy). Without it, zip- only finds
+// postal codes some connected node registered with.
+func (np *NodePool) LoadPostalCodes(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	places := make(map[string]postalPlace)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 11 {
+			continue
+		}
+		lat, err := strconv.ParseFloat(fields[9], 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: bad latitude %q", file, line, fields[9])
+		}
+		lon, err := strconv.ParseFloat(fields[10], 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: bad longitude %q", file, line, fields[10])
+		}
+		country, postal := strings.ToUpper(fields[0]), normalizePostalCode(fields[1])
+		place := postalPlace{lat: lat, lon: lon, country: country, region: fields[3], city: fields[2]}
+		places[country+":"+postal] = place
+		// Without a country, the first country listing the code wins
+		if _, ok := places[":"+postal]; !ok {
+			places[":"+postal] = place
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+
+	np.postalMu.Lock()
+	np.postalCodes = places
+	np.postalMu.Unlock()
+	np.logger.Infof("Loaded %d postal codes from %s", len(places), file)
+	return nil
+}
+
+// lookupPostalCode locates a postal code, in the country if one is given
+func (np *NodePool) lookupPostalCode(country, zip string) (postalPlace, bool) {
+	np.postalMu.RLock()
+	defer np.postalMu.RUnlock()
+	place, ok := np.postalCodes[strings.ToUpper(country)+":"+normalizePostalCode(zip)]
+	return place, ok
+}
+
+// normalizePostalCode uppercases a postal code and drops its spaces, as
+// auth.NormalizePostalCode does for zip-
+func normalizePostalCode(value string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(value), " ", ""))
+}
@@ -0,0 +1,192 @@
+package nodepool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/publicsuffix"
+)
+
+// What SelectNode does when every candidate's exit IP is still cooling down
+const (
+	ReuseFallbackWait  = "wait"  // wait for the soonest IP to come off cooldown
+	ReuseFallbackRelax = "relax" // ignore the cooldown for this selection
+	ReuseFallbackFail  = "fail"  // return ErrNoFreshIP
+)
+
+const (
+	reuseKeyPrefix = "ipreuse:"
+	// maxReuseWait bounds the wait fallback; longer waits fail instead
+	maxReuseWait = 10 * time.Second
+)
+
+// ErrNoFreshIP means every eligible node's exit IP was used within the cooldown
+var ErrNoFreshIP = errors.New("no exit IP outside the reuse cooldown")
+
+// ReuseCooldown asks SelectNode to skip exit IPs the customer used within
+// Window. With Domain set the ledger is per target domain, so an IP used on
+// one site stays available for others.
+type ReuseCooldown struct {
+	CustomerID string
+	Domain     string
+	Window     time.Duration
+	Fallback   string // ReuseFallback*; "" relaxes
+}
+
+// ReuseLedger records exit IP use in Redis sorted sets (IP → last use, unix
+// ms), one per customer or customer+domain, shared by all gateway replicas
+type ReuseLedger struct {
+	rdb *redis.Client
+
+	// Outcomes of selections made under a cooldown
+	unaffected int64 // no candidate was cooling down
+	shrunk     int64 // the cooldown skipped candidates but a fresh IP was found
+	waited     int64
+	relaxed    int64
+	failed     int64
+	skipped    int64 // candidates skipped in total
+}
+
+func newReuseLedger(rdb *redis.Client) *ReuseLedger {
+	return &ReuseLedger{rdb: rdb}
+}
+
+func (l *ReuseLedger) key(c *ReuseCooldown) string {
+	if c.Domain != "" {
+		return reuseKeyPrefix + c.CustomerID + ":" + c.Domain
+	}
+	return reuseKeyPrefix + c.CustomerID
+}
+
+// Recent returns the exit IPs used within the window, with their last use
+func (l *ReuseLedger) Recent(c *ReuseCooldown) map[string]time.Time {
+	ctx := context.Background()
+	min := time.Now().Add(-c.Window).UnixMilli()
+	entries, err := l.rdb.ZRangeByScoreWithScores(ctx, l.key(c), &redis.ZRangeBy{
+		Min: strconv.FormatInt(min, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil
+	}
+	recent := make(map[string]time.Time, len(entries))
+	for _, e := range entries {
+		if ip, ok := e.Member.(string); ok {
+			recent[ip] = time.UnixMilli(int64(e.Score))
+		}
+	}
+	return recent
+}
+
+// Record marks ip as used now and trims entries older than the window
+func (l *ReuseLedger) Record(c *ReuseCooldown, ip string) {
+	if ip == "" {
+		return
+	}
+	ctx := context.Background()
+	key := l.key(c)
+	now := time.Now()
+	pipe := l.rdb.Pipeline()
+	pipe.ZAdd(ctx, key, &redis.Z{Score: float64(now.UnixMilli()), Member: ip})
+	pipe.ZRemRangeByScore(ctx, key, "-inf", fmt.Sprintf("(%d", now.Add(-c.Window).UnixMilli()))
+	pipe.Expire(ctx, key, c.Window)
+	pipe.Exec(ctx)
+}
+
+// Stats reports how often the cooldown narrowed selection
+func (l *ReuseLedger) Stats() map[string]int64 {
+	return map[string]int64{
+		"unaffected": atomic.LoadInt64(&l.unaffected),
+		"shrunk":     atomic.LoadInt64(&l.shrunk),
+		"waited":     atomic.LoadInt64(&l.waited),
+		"relaxed":    atomic.LoadInt64(&l.relaxed),
+		"failed":     atomic.LoadInt64(&l.failed),
+		"skipped":    atomic.LoadInt64(&l.skipped),
+	}
+}
+
+// nextFresh returns how long until the first recent IP leaves the window
+func nextFresh(recent map[string]time.Time, window time.Duration) time.Duration {
+	var soonest time.Time
+	for _, used := range recent {
+		if soonest.IsZero() || used.Before(soonest) {
+			soonest = used
+		}
+	}
+	return time.Until(soonest.Add(window))
+}
+
+// selectWithCooldown runs pick with the customer's recently used IPs excluded
+// and applies the cooldown's fallback when that leaves nothing. A selection
+// that fails for reasons other than the cooldown returns a nil node and no
+// error, as pick does.
+func (np *NodePool) selectWithCooldown(c *ReuseCooldown, pick func(map[string]time.Time) (*Node, *Decision)) (*Node, *Decision, error) {
+	l := np.reuse
+	recent := l.Recent(c)
+	node, d := pick(recent)
+	skipped := int64(d.Rejected["reused"])
+	atomic.AddInt64(&l.skipped, skipped)
+	switch {
+	case node != nil && skipped > 0:
+		atomic.AddInt64(&l.shrunk, 1)
+		return node, d, nil
+	case node != nil:
+		atomic.AddInt64(&l.unaffected, 1)
+		return node, d, nil
+	case skipped == 0:
+		return nil, d, nil
+	}
+
+	switch c.Fallback {
+	case ReuseFallbackFail:
+	case ReuseFallbackWait:
+		if wait := nextFresh(recent, c.Window); wait <= maxReuseWait {
+			np.logger.Debugf("All exit IPs for %s cooling down, waiting %v", c.CustomerID, wait)
+			time.Sleep(wait)
+			if node, d = pick(l.Recent(c)); node != nil {
+				atomic.AddInt64(&l.waited, 1)
+				return node, d, nil
+			}
+		}
+	default:
+		if node, d = pick(nil); node != nil {
+			atomic.AddInt64(&l.relaxed, 1)
+			return node, d, nil
+		}
+	}
+	atomic.AddInt64(&l.failed, 1)
+	return nil, d, ErrNoFreshIP
+}
+
+// RecordIPUse adds the node's exit IP to the selection's reuse ledger. Call it
+// for the node that actually carries the request, not every race candidate.
+func (np *NodePool) RecordIPUse(selection *NodeSelection, node *Node) {
+	if selection.Reuse == nil || node == nil {
+		return
+	}
+	np.reuse.Record(selection.Reuse, node.IPAddress)
+}
+
+// RegistrableDomain reduces a host to its registrable domain (eTLD+1), e.g.
+// "www.shop.example.co.uk:443" → "example.co.uk". IPs and hosts without a
+// public suffix come back as they are.
+func RegistrableDomain(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	if d, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return d
+	}
+	return host
+}
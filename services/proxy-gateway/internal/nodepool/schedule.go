@@ -0,0 +1,45 @@
+package nodepool
+
+import "time"
+
+// Statuses of nodes that are connected but take no traffic: outside their
+// operator's sharing hours (docker-node --schedule) or paused. They are
+// skipped like busy nodes, not treated as disconnected.
+const (
+	NodeScheduledOff = "scheduled_off"
+	NodePaused       = "paused"
+)
+
+// resting reports whether the node is scheduled off or paused
+func (n *Node) resting() bool {
+	return n.Status == NodeScheduledOff || n.Status == NodePaused
+}
+
+// returnsIn is how long until a resting node expects to take traffic
+// again, 0 if unknown
+func (n *Node) returnsIn() time.Duration {
+	if n.AvailableAt == nil {
+		return 0
+	}
+	if d := time.Until(*n.AvailableAt); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// statusReason is the trace reason for a node whose status isn't available
+func statusReason(status string) string {
+	switch status {
+	case NodeScheduledOff:
+		return "scheduled-off"
+	case NodePaused:
+		return "paused"
+	}
+	return "status"
+}
+
+// resting reports whether a cached node is scheduled off or paused
+func (np *NodePool) resting(nodeID string) bool {
+	node := np.getCachedNode(nodeID)
+	return node != nil && node.resting()
+}
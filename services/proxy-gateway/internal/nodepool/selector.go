@@ -0,0 +1,400 @@
+package nodepool
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Node selection strategies. Every strategy picks among nodes that already
+// pass the targeting filters (connected, not blacklisted, country, city,
+// status, quality floor); they differ only in which eligible node wins.
+const (
+	StrategyRandom     = "random"      // uniform random, maximum IP diversity
+	StrategyWeighted   = "weighted"    // random weighted by node score
+	StrategyLeastConn  = "least-conn"  // fewest in-flight connections among a sample
+	StrategyP2C        = "p2c"         // power of two choices on in-flight connections
+	StrategyEWMA       = "ewma"        // lowest tunnel-dial latency (EWMA) scaled by load
+	StrategyRoundRobin = "round-robin" // rotate through the country's nodes in order
+)
+
+const (
+	// maxSampleTries bounds how many pool entries one selection examines
+	maxSampleTries = 50
+	// selectorSample is how many eligible nodes the comparing strategies weigh
+	selectorSample = 8
+	// ewmaDecay weights the newest latency sample
+	ewmaDecay = 0.3
+	// ewmaUnknown is assumed for nodes with no latency samples yet
+	ewmaUnknown = 500.0
+)
+
+// CandidatePool is what a Selector chooses from
+type CandidatePool struct {
+	Key string   // targeted country, or "" for every country
+	IDs []string // sorted node IDs
+	// Eligible returns the node for an ID when it passes the selection
+	// filters, nil otherwise; it records rejections in the decision
+	Eligible func(id string) *Node
+}
+
+// Selector picks one eligible node from a candidate pool
+type Selector interface {
+	Name() string
+	Select(pool CandidatePool, d *Decision) *Node
+}
+
+// TierStrategy maps an AccountPlan pool quality tier to its default selection
+// strategy. "" means the pool default (random, with warm/tunnel pool shortcuts).
+func TierStrategy(tier string) string {
+	switch strings.ToLower(tier) {
+	case "premium":
+		return StrategyEWMA
+	case "dedicated", "elite":
+		return StrategyLeastConn
+	}
+	return ""
+}
+
+// IsStrategy reports whether name is a known selection strategy
+func IsStrategy(name string) bool {
+	switch name {
+	case StrategyRandom, StrategyWeighted, StrategyLeastConn, StrategyP2C, StrategyEWMA, StrategyRoundRobin:
+		return true
+	}
+	return false
+}
+
+// Decision records how one SelectNode call picked its node
+type Decision struct {
+	Strategy   string         `json:"strategy"`
+	Pool       int            `json:"pool"`     // candidate IDs for the targeted country
+	Examined   int            `json:"examined"` // IDs checked against the filters
+	Rejected   map[string]int `json:"rejected,omitempty"`
+	Candidates []Candidate    `json:"candidates,omitempty"` // eligible nodes weighed
+	Chosen     string         `json:"chosen,omitempty"`
+	Sticky     bool           `json:"sticky,omitempty"`
+	Pinned     bool           `json:"pinned,omitempty"`
+	Geo        string         `json:"geo,omitempty"` // GeoMatch* level searched, for radius targeting
+}
+
+// Candidate is one eligible node as a strategy saw it
+type Candidate struct {
+	NodeID    string  `json:"node_id"`
+	Score     float64 `json:"score"`
+	Active    int     `json:"active"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+func (d *Decision) reject(reason string) {
+	if d.Rejected == nil {
+		d.Rejected = make(map[string]int)
+	}
+	d.Rejected[reason]++
+}
+
+// String renders the decision on one line, e.g.
+// "ewma pool=120 examined=14 rejected=city:5,blacklisted:1 chose=n1 of n1,n7"
+func (d *Decision) String() string {
+	if d.Sticky {
+		return fmt.Sprintf("sticky chose=%s", d.Chosen)
+	}
+	if d.Pinned {
+		return fmt.Sprintf("pinned chose=%s", d.Chosen)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s pool=%d examined=%d", d.Strategy, d.Pool, d.Examined)
+	if d.Geo != "" {
+		fmt.Fprintf(&b, " geo=%s", d.Geo)
+	}
+	if len(d.Rejected) > 0 {
+		reasons := make([]string, 0, len(d.Rejected))
+		for r, n := range d.Rejected {
+			reasons = append(reasons, fmt.Sprintf("%s:%d", r, n))
+		}
+		sort.Strings(reasons)
+		fmt.Fprintf(&b, " rejected=%s", strings.Join(reasons, ","))
+	}
+	if d.Chosen == "" {
+		b.WriteString(" chose=none")
+		return b.String()
+	}
+	fmt.Fprintf(&b, " chose=%s", d.Chosen)
+	if len(d.Candidates) > 1 {
+		ids := make([]string, len(d.Candidates))
+		for i, c := range d.Candidates {
+			ids[i] = c.NodeID
+		}
+		fmt.Fprintf(&b, " of %s", strings.Join(ids, ","))
+	}
+	return b.String()
+}
+
+// SelectionTrace collects the decisions made while serving one request. Set
+// NodeSelection.Trace to have SelectNode fill it in.
+type SelectionTrace struct {
+	Decisions []*Decision `json:"decisions"`
+}
+
+// String joins the decisions with "; "
+func (t *SelectionTrace) String() string {
+	parts := make([]string, len(t.Decisions))
+	for i, d := range t.Decisions {
+		parts[i] = d.String()
+	}
+	return strings.Join(parts, "; ")
+}
+
+// nodeStats is the in-memory load and latency view the strategies weigh
+type nodeStats struct {
+	mu      sync.Mutex
+	active  map[string]int     // node ID → in-flight selections
+	latency map[string]float64 // node ID → tunnel-dial latency EWMA (ms)
+}
+
+func newNodeStats() *nodeStats {
+	return &nodeStats{
+		active:  make(map[string]int),
+		latency: make(map[string]float64),
+	}
+}
+
+func (s *nodeStats) acquire(nodeID string) {
+	s.mu.Lock()
+	s.active[nodeID]++
+	s.mu.Unlock()
+}
+
+func (s *nodeStats) release(nodeID string) {
+	s.mu.Lock()
+	if s.active[nodeID] <= 1 {
+		delete(s.active, nodeID)
+	} else {
+		s.active[nodeID]--
+	}
+	s.mu.Unlock()
+}
+
+func (s *nodeStats) observe(nodeID string, d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	s.mu.Lock()
+	if prev, ok := s.latency[nodeID]; ok {
+		ms = ewmaDecay*ms + (1-ewmaDecay)*prev
+	}
+	s.latency[nodeID] = ms
+	s.mu.Unlock()
+}
+
+func (s *nodeStats) get(nodeID string) (active int, latency float64, known bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	latency, known = s.latency[nodeID]
+	return s.active[nodeID], latency, known
+}
+
+// forget drops stats for nodes no longer in the cache
+func (s *nodeStats) forget(keep map[string]*Node) {
+	s.mu.Lock()
+	for id := range s.latency {
+		if _, ok := keep[id]; !ok {
+			delete(s.latency, id)
+		}
+	}
+	s.mu.Unlock()
+}
+
+// ObserveLatency feeds a successful tunnel dial time into the node's latency EWMA
+func (np *NodePool) ObserveLatency(nodeID string, d time.Duration) {
+	np.stats.observe(nodeID, d)
+}
+
+// selector returns the strategy registered under name, or the default
+func (np *NodePool) selector(name string) Selector {
+	if s, ok := np.selectors[name]; ok {
+		return s
+	}
+	return np.selectors[StrategyRandom]
+}
+
+func newSelectors(np *NodePool) map[string]Selector {
+	return map[string]Selector{
+		StrategyRandom:     randomSelector{},
+		StrategyWeighted:   weightedSelector{np},
+		StrategyLeastConn:  leastConnSelector{np},
+		StrategyP2C:        p2cSelector{np},
+		StrategyEWMA:       ewmaSelector{np},
+		StrategyRoundRobin: &roundRobinSelector{cursors: make(map[string]int)},
+	}
+}
+
+// sample returns up to k distinct eligible nodes picked at random from the pool
+func sample(pool CandidatePool, k int, d *Decision) []*Node {
+	ids, eligible := pool.IDs, pool.Eligible
+	out := make([]*Node, 0, k)
+	if len(ids) <= maxSampleTries {
+		for _, i := range rand.Perm(len(ids)) {
+			if len(out) == k {
+				break
+			}
+			d.Examined++
+			if n := eligible(ids[i]); n != nil {
+				out = append(out, n)
+			}
+		}
+		return out
+	}
+
+	seen := make(map[int]bool, maxSampleTries)
+	for tries := 0; tries < maxSampleTries && len(out) < k; tries++ {
+		i := rand.Intn(len(ids))
+		if seen[i] {
+			continue
+		}
+		seen[i] = true
+		d.Examined++
+		if n := eligible(ids[i]); n != nil {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// weigh records the sampled nodes in the decision with their current stats
+func (np *NodePool) weigh(nodes []*Node, d *Decision) []Candidate {
+	cands := make([]Candidate, len(nodes))
+	for i, n := range nodes {
+		active, latency, known := np.stats.get(n.ID)
+		if !known {
+			latency = ewmaUnknown
+		}
+		cands[i] = Candidate{
+			NodeID:    n.ID,
+			Score:     np.calculateNodeScore(n),
+			Active:    active,
+			LatencyMs: math.Round(latency),
+		}
+	}
+	d.Candidates = cands
+	return cands
+}
+
+// pickMin returns the node whose candidate has the lowest cost, breaking ties
+// by score
+func pickMin(nodes []*Node, cands []Candidate, cost func(Candidate) float64) *Node {
+	best := -1
+	for i, c := range cands {
+		if best < 0 || cost(c) < cost(cands[best]) ||
+			(cost(c) == cost(cands[best]) && c.Score > cands[best].Score) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	return nodes[best]
+}
+
+type randomSelector struct{}
+
+func (randomSelector) Name() string { return StrategyRandom }
+
+func (randomSelector) Select(pool CandidatePool, d *Decision) *Node {
+	if nodes := sample(pool, 1, d); len(nodes) > 0 {
+		return nodes[0]
+	}
+	return nil
+}
+
+type weightedSelector struct{ np *NodePool }
+
+func (weightedSelector) Name() string { return StrategyWeighted }
+
+func (s weightedSelector) Select(pool CandidatePool, d *Decision) *Node {
+	nodes := sample(pool, selectorSample, d)
+	if len(nodes) == 0 {
+		return nil
+	}
+	cands := s.np.weigh(nodes, d)
+
+	// Every node keeps a small chance so low scorers still see traffic
+	weights := make([]float64, len(cands))
+	total := 0.0
+	for i, c := range cands {
+		weights[i] = math.Max(c.Score, 0.05)
+		total += weights[i]
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return nodes[i]
+		}
+		r -= w
+	}
+	return nodes[len(nodes)-1]
+}
+
+type leastConnSelector struct{ np *NodePool }
+
+func (leastConnSelector) Name() string { return StrategyLeastConn }
+
+func (s leastConnSelector) Select(pool CandidatePool, d *Decision) *Node {
+	nodes := sample(pool, selectorSample, d)
+	cands := s.np.weigh(nodes, d)
+	return pickMin(nodes, cands, func(c Candidate) float64 { return float64(c.Active) })
+}
+
+type p2cSelector struct{ np *NodePool }
+
+func (p2cSelector) Name() string { return StrategyP2C }
+
+func (s p2cSelector) Select(pool CandidatePool, d *Decision) *Node {
+	nodes := sample(pool, 2, d)
+	cands := s.np.weigh(nodes, d)
+	return pickMin(nodes, cands, func(c Candidate) float64 { return float64(c.Active) })
+}
+
+type ewmaSelector struct{ np *NodePool }
+
+func (ewmaSelector) Name() string { return StrategyEWMA }
+
+func (s ewmaSelector) Select(pool CandidatePool, d *Decision) *Node {
+	nodes := sample(pool, selectorSample, d)
+	cands := s.np.weigh(nodes, d)
+	// Scale by load so one fast node doesn't take every request
+	return pickMin(nodes, cands, func(c Candidate) float64 { return c.LatencyMs * float64(c.Active+1) })
+}
+
+// roundRobinSelector walks each country's sorted node list from where the
+// previous selection for that country stopped
+type roundRobinSelector struct {
+	mu      sync.Mutex
+	cursors map[string]int // pool key → next index
+}
+
+func (*roundRobinSelector) Name() string { return StrategyRoundRobin }
+
+func (s *roundRobinSelector) Select(pool CandidatePool, d *Decision) *Node {
+	ids := pool.IDs
+	if len(ids) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	start := s.cursors[pool.Key] % len(ids)
+	s.mu.Unlock()
+
+	for i := 0; i < len(ids) && i < maxSampleTries; i++ {
+		pos := (start + i) % len(ids)
+		d.Examined++
+		if n := pool.Eligible(ids[pos]); n != nil {
+			s.mu.Lock()
+			s.cursors[pool.Key] = pos + 1
+			s.mu.Unlock()
+			return n
+		}
+	}
+	return nil
+}
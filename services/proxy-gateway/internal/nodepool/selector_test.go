@@ -0,0 +1,229 @@
+package nodepool
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func selectorTestPool() *NodePool {
+	np := &NodePool{stats: newNodeStats()}
+	np.selectors = newSelectors(np)
+	return np
+}
+
+func testNode(id string, quality int) *Node {
+	return &Node{ID: id, Status: "available", QualityScore: quality, LastHeartbeat: time.Now()}
+}
+
+// candidates builds a pool over nodes where only the listed IDs are eligible
+func candidates(key string, nodes []*Node, eligible ...string) CandidatePool {
+	byID := make(map[string]*Node, len(nodes))
+	ids := make([]string, len(nodes))
+	for i, n := range nodes {
+		byID[n.ID] = n
+		ids[i] = n.ID
+	}
+	ok := make(map[string]bool, len(eligible))
+	for _, id := range eligible {
+		ok[id] = true
+	}
+	return CandidatePool{Key: key, IDs: ids, Eligible: func(id string) *Node {
+		if ok[id] {
+			return byID[id]
+		}
+		return nil
+	}}
+}
+
+func TestSelectorsOnlyPickEligible(t *testing.T) {
+	nodes := []*Node{testNode("a", 90), testNode("b", 90), testNode("c", 90), testNode("d", 90)}
+	for _, name := range []string{StrategyRandom, StrategyWeighted, StrategyLeastConn, StrategyP2C, StrategyEWMA, StrategyRoundRobin} {
+		np := selectorTestPool()
+		s := np.selector(name)
+		if s.Name() != name {
+			t.Errorf("selector(%s).Name() = %s", name, s.Name())
+		}
+		for i := 0; i < 20; i++ {
+			d := &Decision{}
+			if got := s.Select(candidates("US", nodes, "c"), d); got == nil || got.ID != "c" {
+				t.Fatalf("%s picked %v, want c", name, got)
+			}
+			if d.Examined < 1 || d.Examined > len(nodes) {
+				t.Fatalf("%s examined %d of %d", name, d.Examined, len(nodes))
+			}
+		}
+		d := &Decision{}
+		if got := s.Select(candidates("US", nodes), d); got != nil {
+			t.Errorf("%s picked %s from a pool with nothing eligible", name, got.ID)
+		}
+		if got := s.Select(CandidatePool{Key: "US"}, &Decision{}); got != nil {
+			t.Errorf("%s picked %s from an empty pool", name, got.ID)
+		}
+	}
+	if np := selectorTestPool(); np.selector("fastest").Name() != StrategyRandom {
+		t.Error("unknown strategy does not fall back to random")
+	}
+}
+
+func TestComparingSelectors(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		quality  map[string]int
+		active   map[string]int
+		latency  map[string]time.Duration
+		want     string
+	}{
+		{"least-conn takes the idle node", StrategyLeastConn,
+			map[string]int{"a": 90, "b": 90, "c": 90}, map[string]int{"a": 3, "c": 1}, nil, "b"},
+		{"least-conn breaks ties by score", StrategyLeastConn,
+			map[string]int{"a": 60, "b": 95, "c": 70}, nil, nil, "b"},
+		{"p2c takes the less loaded of two", StrategyP2C,
+			map[string]int{"a": 90, "b": 90}, map[string]int{"a": 2, "b": 1}, nil, "b"},
+		{"ewma takes the fastest", StrategyEWMA,
+			map[string]int{"a": 90, "b": 90, "c": 90},
+			nil, map[string]time.Duration{"a": 120 * time.Millisecond, "b": 40 * time.Millisecond, "c": 80 * time.Millisecond}, "b"},
+		{"ewma scales latency by load", StrategyEWMA,
+			map[string]int{"a": 90, "b": 90},
+			map[string]int{"b": 3}, map[string]time.Duration{"a": 100 * time.Millisecond, "b": 50 * time.Millisecond}, "a"},
+		{"ewma prefers a measured node to an unknown one", StrategyEWMA,
+			map[string]int{"a": 90, "b": 90},
+			nil, map[string]time.Duration{"a": 450 * time.Millisecond}, "a"},
+	}
+	for _, tt := range tests {
+		np := selectorTestPool()
+		var nodes []*Node
+		var ids []string
+		for _, id := range []string{"a", "b", "c"} {
+			if q, ok := tt.quality[id]; ok {
+				nodes = append(nodes, testNode(id, q))
+				ids = append(ids, id)
+			}
+		}
+		for id, n := range tt.active {
+			for i := 0; i < n; i++ {
+				np.stats.acquire(id)
+			}
+		}
+		for id, d := range tt.latency {
+			np.ObserveLatency(id, d)
+		}
+		// Every node fits in one sample, so the choice is deterministic
+		for i := 0; i < 10; i++ {
+			d := &Decision{}
+			got := np.selector(tt.strategy).Select(candidates("US", nodes, ids...), d)
+			if got == nil || got.ID != tt.want {
+				t.Fatalf("%s: picked %v, want %s", tt.name, got, tt.want)
+			}
+			if len(d.Candidates) != len(nodes) {
+				t.Fatalf("%s: weighed %d candidates, want %d", tt.name, len(d.Candidates), len(nodes))
+			}
+		}
+	}
+}
+
+func TestWeightedSelector(t *testing.T) {
+	np := selectorTestPool()
+	// A stale node scores below zero and keeps only the floor weight
+	stale := testNode("stale", 50)
+	stale.LastHeartbeat = time.Now().Add(-time.Hour)
+	nodes := []*Node{testNode("good", 100), stale}
+	picked := map[string]int{}
+	for i := 0; i < 2000; i++ {
+		n := np.selector(StrategyWeighted).Select(candidates("US", nodes, "good", "stale"), &Decision{})
+		picked[n.ID]++
+	}
+	// good weighs 1.0 against 0.05: about 95% of the picks
+	if picked["good"] < 1800 || picked["stale"] == 0 {
+		t.Errorf("weighted picks = %v", picked)
+	}
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	np := selectorTestPool()
+	nodes := []*Node{testNode("a", 90), testNode("b", 90), testNode("c", 90), testNode("d", 90)}
+	us := candidates("US", nodes, "a", "b", "d")
+	de := candidates("DE", nodes, "a", "b", "c", "d")
+
+	s := np.selector(StrategyRoundRobin)
+	var got []string
+	for i := 0; i < 5; i++ {
+		got = append(got, s.Select(us, &Decision{}).ID)
+	}
+	if fmt.Sprint(got) != "[a b d a b]" {
+		t.Errorf("US rotation = %v, want [a b d a b]", got)
+	}
+	// Each pool key keeps its own cursor
+	if n := s.Select(de, &Decision{}); n.ID != "a" {
+		t.Errorf("first DE pick = %s, want a", n.ID)
+	}
+	if n := s.Select(us, &Decision{}); n.ID != "d" {
+		t.Errorf("US pick after DE = %s, want d", n.ID)
+	}
+}
+
+func TestSampleLargePool(t *testing.T) {
+	nodes := make([]*Node, 500)
+	for i := range nodes {
+		nodes[i] = testNode(fmt.Sprintf("n%03d", i), 90)
+	}
+	// Nothing eligible: the scan gives up after maxSampleTries
+	d := &Decision{}
+	if got := sample(candidates("US", nodes), selectorSample, d); len(got) != 0 || d.Examined > maxSampleTries {
+		t.Fatalf("sample = %d nodes, examined %d", len(got), d.Examined)
+	}
+	// Everything eligible: k distinct nodes
+	all := make([]string, len(nodes))
+	for i, n := range nodes {
+		all[i] = n.ID
+	}
+	got := sample(candidates("US", nodes, all...), selectorSample, &Decision{})
+	seen := map[string]bool{}
+	for _, n := range got {
+		seen[n.ID] = true
+	}
+	if len(got) != selectorSample || len(seen) != selectorSample {
+		t.Fatalf("sample returned %d nodes, %d distinct", len(got), len(seen))
+	}
+}
+
+func TestTierStrategy(t *testing.T) {
+	for tier, want := range map[string]string{"premium": StrategyEWMA, "Dedicated": StrategyLeastConn, "elite": StrategyLeastConn, "standard": "", "": ""} {
+		if got := TierStrategy(tier); got != want {
+			t.Errorf("TierStrategy(%q) = %q, want %q", tier, got, want)
+		}
+		if want != "" && !IsStrategy(want) {
+			t.Errorf("IsStrategy(%q) = false", want)
+		}
+	}
+	if IsStrategy("fastest") || IsStrategy("") {
+		t.Error("IsStrategy accepts unknown names")
+	}
+}
+
+func TestDecisionString(t *testing.T) {
+	tests := []struct {
+		d    Decision
+		want string
+	}{
+		{Decision{Sticky: true, Chosen: "n1"}, "sticky chose=n1"},
+		{Decision{Pinned: true, Chosen: "n2"}, "pinned chose=n2"},
+		{Decision{Strategy: StrategyRandom, Pool: 3, Examined: 3}, "random pool=3 examined=3 chose=none"},
+		{Decision{
+			Strategy: StrategyEWMA, Pool: 120, Examined: 14, Geo: GeoMatchCity,
+			Rejected:   map[string]int{"city": 5, "blacklisted": 1},
+			Candidates: []Candidate{{NodeID: "n1"}, {NodeID: "n7"}},
+			Chosen:     "n1",
+		}, "ewma pool=120 examined=14 geo=" + GeoMatchCity + " rejected=blacklisted:1,city:5 chose=n1 of n1,n7"},
+	}
+	for _, tt := range tests {
+		if got := tt.d.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+	trace := &SelectionTrace{Decisions: []*Decision{&tests[0].d, &tests[1].d}}
+	if got := trace.String(); got != "sticky chose=n1; pinned chose=n2" {
+		t.Errorf("trace = %q", got)
+	}
+}
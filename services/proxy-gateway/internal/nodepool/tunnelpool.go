@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -78,32 +79,34 @@ func NewTunnelPool(nodePool *NodePool, warmPool *WarmPool, nodeRegURL string, lo
 	return tp
 }
 
-// GetTunnel returns a pre-opened idle tunnel for the given country (or any).
-// Returns nil if none available — caller should fall back to on-demand dial.
-func (tp *TunnelPool) GetTunnel(country string) *IdleTunnel {
+// GetTunnel takes an idle tunnel to a node within the geo policy, returning
+// it with the GeoMatch* level it was found at. Returns nil if none available
+// — caller should fall back to on-demand dial.
+func (tp *TunnelPool) GetTunnel(policy GeoPolicy) (*IdleTunnel, string) {
 	tp.mu.Lock()
 	defer tp.mu.Unlock()
 
-	// Prefer matching country
-	if country != "" {
+	constrained := len(policy.AllowedCountries) > 0 || len(policy.BlockedCountries) > 0
+	for _, scope := range policy.Scopes() {
 		for i, t := range tp.tunnels {
-			if t.Country == country {
-				tp.tunnels = append(tp.tunnels[:i], tp.tunnels[i+1:]...)
-				atomic.AddInt64(&tp.served, 1)
-				return t
+			if scope.Country != "" && !strings.EqualFold(t.Country, scope.Country) {
+				continue
+			}
+			if tp.nodePool.nearCap(t.NodeID) || tp.nodePool.resting(t.NodeID) {
+				continue
+			}
+			if constrained || scope.Region != "" || scope.City != "" {
+				node := tp.nodePool.getCachedNode(t.NodeID)
+				if node == nil || !scope.Matches(node, policy) {
+					continue
+				}
 			}
+			tp.tunnels = append(tp.tunnels[:i], tp.tunnels[i+1:]...)
+			atomic.AddInt64(&tp.served, 1)
+			return t, scope.Level
 		}
 	}
-
-	// Fall back to any available
-	if len(tp.tunnels) > 0 {
-		t := tp.tunnels[0]
-		tp.tunnels = tp.tunnels[1:]
-		atomic.AddInt64(&tp.served, 1)
-		return t
-	}
-
-	return nil
+	return nil, ""
 }
 
 // Size returns current pool size.
@@ -231,7 +234,7 @@ func (tp *TunnelPool) getTargetNodes(count int) []string {
 	// Try warm pool first
 	if tp.warmPool != nil {
 		for i := 0; i < count*3 && len(nodeIDs) < count; i++ {
-			fastID := tp.warmPool.GetFastNode("")
+			fastID, _ := tp.warmPool.GetFastNode(GeoPolicy{})
 			if fastID == "" {
 				break
 			}
@@ -260,7 +263,7 @@ func (tp *TunnelPool) openPreTunnel(nodeID string) (*IdleTunnel, error) {
 	}
 
 	wsURL := tp.nodeRegURL
-	wsURL = fmt.Sprintf("%s/internal/tunnel-standby?node_id=%s",
+	wsURL = fmt.Sprintf("%s/internal/tunnel-standby?node_id=%s&half_close=1",
 		wsURL, nodeID)
 	// Convert http to ws
 	if len(wsURL) > 4 && wsURL[:4] == "http" {
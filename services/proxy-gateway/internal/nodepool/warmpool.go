@@ -73,51 +73,49 @@ func (wp *WarmPool) Stop() {
 	wp.logger.Info("Warm pool stopped")
 }
 
-// GetFastNode returns a fast-lane node ID for the given country, or "" if none.
-// The caller should fall back to normal selection when this returns "".
-func (wp *WarmPool) GetFastNode(country string) string {
+// GetFastNode returns a fast-lane node ID within the geo policy and the
+// GeoMatch* level it was found at, or "" if none. The caller should fall back
+// to normal selection when this returns "".
+func (wp *WarmPool) GetFastNode(policy GeoPolicy) (string, string) {
 	ctx := context.Background()
+	anyKey := fmt.Sprintf("%sANY", fastNodePrefix)
+	constrained := len(policy.AllowedCountries) > 0 || len(policy.BlockedCountries) > 0
 
-	// Try country-specific fast nodes first
-	if country != "" {
-		key := fmt.Sprintf("%s%s", fastNodePrefix, strings.ToUpper(country))
-		members, err := wp.nodePool.rdb.SMembers(ctx, key).Result()
-		if err == nil && len(members) > 0 {
-			// Pick a random fast node and verify it's not blacklisted
-			shuffled := shuffleStrings(members)
-			for _, nodeID := range shuffled {
-				if !wp.nodePool.IsNodeBlacklisted(nodeID) && wp.nodePool.IsConnected(nodeID) {
-					atomic.AddInt64(&wp.fastHits, 1)
-					wp.nodePool.rdb.SRem(ctx, key, nodeID)
-					return nodeID
-				}
-			}
+	for _, scope := range policy.Scopes() {
+		// Country-specific fast nodes first, then the "any" pool
+		keys := []string{anyKey}
+		if scope.Country != "" {
+			keys = []string{fmt.Sprintf("%s%s", fastNodePrefix, scope.Country), anyKey}
 		}
-	}
-
-	// Try "any" pool
-	key := fmt.Sprintf("%sANY", fastNodePrefix)
-	members, err := wp.nodePool.rdb.SMembers(ctx, key).Result()
-	if err == nil && len(members) > 0 {
-		shuffled := shuffleStrings(members)
-		for _, nodeID := range shuffled {
-			if !wp.nodePool.IsNodeBlacklisted(nodeID) && wp.nodePool.IsConnected(nodeID) {
-				// If country was requested, verify the node matches
-				if country != "" {
-					node, err := wp.nodePool.GetNodeByID(nodeID)
-					if err != nil || strings.ToUpper(node.Country) != strings.ToUpper(country) {
+		for _, key := range keys {
+			members, err := wp.nodePool.rdb.SMembers(ctx, key).Result()
+			if err != nil || len(members) == 0 {
+				continue
+			}
+			// Only the country is known from the set a node is in
+			check := constrained || scope.Region != "" || scope.City != "" || key == anyKey && scope.Country != ""
+			for _, nodeID := range shuffleStrings(members) {
+				if wp.nodePool.IsNodeBlacklisted(nodeID) || !wp.nodePool.IsConnected(nodeID) || wp.nodePool.nearCap(nodeID) || wp.nodePool.resting(nodeID) {
+					continue
+				}
+				if check {
+					node := wp.nodePool.getCachedNode(nodeID)
+					if node == nil {
+						node, _ = wp.nodePool.GetNodeByID(nodeID)
+					}
+					if node == nil || !scope.Matches(node, policy) {
 						continue
 					}
 				}
 				atomic.AddInt64(&wp.fastHits, 1)
 				wp.nodePool.rdb.SRem(ctx, key, nodeID)
-				return nodeID
+				return nodeID, scope.Level
 			}
 		}
 	}
 
 	atomic.AddInt64(&wp.fastMisses, 1)
-	return ""
+	return "", ""
 }
 
 // warmBackground continuously probes random nodes and adds fast ones to Redis.
@@ -173,7 +171,7 @@ func (wp *WarmPool) probeRandomNodes() {
 		if err := json.Unmarshal([]byte(nodeData), &node); err != nil {
 			continue
 		}
-		if node.Status == "available" {
+		if node.Status == "available" && node.Caps.NearCap() == "" {
 			candidates = append(candidates, &node)
 		}
 	}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -35,7 +36,6 @@ type ConnectedNode struct {
 // WebSocketNodePool manages real-time WebSocket connections to nodes
 type WebSocketNodePool struct {
 	nodes       map[string]*ConnectedNode
-	nodesByGeo  map[string][]*ConnectedNode // "country:city" -> nodes
 	mu          sync.RWMutex
 	pool        *NodePool // Reference to Redis-based pool for persistence
 	logger      *logrus.Entry
@@ -81,7 +81,6 @@ type HeartbeatData struct {
 func NewWebSocketNodePool(pool *NodePool, logger *logrus.Entry) *WebSocketNodePool {
 	wsPool := &WebSocketNodePool{
 		nodes:      make(map[string]*ConnectedNode),
-		nodesByGeo: make(map[string][]*ConnectedNode),
 		pool:       pool,
 		logger:     logger.WithField("component", "ws-nodepool"),
 	}
@@ -147,12 +146,6 @@ func (wp *WebSocketNodePool) registerNode(node *ConnectedNode) {
 	}
 
 	wp.nodes[node.ID] = node
-
-	// Update geo index if node has location
-	if node.Node.Country != "" {
-		geoKey := fmt.Sprintf("%s:%s", node.Node.Country, node.Node.City)
-		wp.nodesByGeo[geoKey] = append(wp.nodesByGeo[geoKey], node)
-	}
 }
 
 func (wp *WebSocketNodePool) unregisterNode(nodeID string) {
@@ -171,18 +164,6 @@ func (wp *WebSocketNodePool) unregisterNode(nodeID string) {
 	}
 	node.mu.Unlock()
 
-	// Remove from geo index
-	if node.Node.Country != "" {
-		geoKey := fmt.Sprintf("%s:%s", node.Node.Country, node.Node.City)
-		nodes := wp.nodesByGeo[geoKey]
-		for i, n := range nodes {
-			if n.ID == nodeID {
-				wp.nodesByGeo[geoKey] = append(nodes[:i], nodes[i+1:]...)
-				break
-			}
-		}
-	}
-
 	delete(wp.nodes, nodeID)
 	wp.logger.Infof("Node %s disconnected", nodeID)
 }
@@ -288,39 +269,24 @@ func (wp *WebSocketNodePool) handleProxyResponse(node *ConnectedNode, requestID
 	ch <- &resp
 }
 
-// SelectConnectedNode selects an available WebSocket-connected node
-func (wp *WebSocketNodePool) SelectConnectedNode(country, city string) (*ConnectedNode, error) {
+// SelectConnectedNode selects an available WebSocket-connected node within
+// the geo policy, returning it with the GeoMatch* level it was found at
+func (wp *WebSocketNodePool) SelectConnectedNode(policy GeoPolicy) (*ConnectedNode, string, error) {
 	wp.mu.RLock()
 	defer wp.mu.RUnlock()
 
-	// Try exact geo match first
-	if country != "" {
-		geoKey := fmt.Sprintf("%s:%s", country, city)
-		if nodes, exists := wp.nodesByGeo[geoKey]; exists && len(nodes) > 0 {
-			return wp.selectBestConnectedNode(nodes), nil
-		}
-
-		// Try country-level match
-		for key, nodes := range wp.nodesByGeo {
-			if len(key) >= 2 && key[:2] == country[:2] && len(nodes) > 0 {
-				return wp.selectBestConnectedNode(nodes), nil
+	for _, scope := range policy.Scopes() {
+		var availableNodes []*ConnectedNode
+		for _, node := range wp.nodes {
+			if node.Node.Status == "available" && scope.Matches(node.Node, policy) {
+				availableNodes = append(availableNodes, node)
 			}
 		}
-	}
-
-	// Fallback: any available node
-	var availableNodes []*ConnectedNode
-	for _, node := range wp.nodes {
-		if node.Node.Status == "available" {
-			availableNodes = append(availableNodes, node)
+		if len(availableNodes) > 0 {
+			return wp.selectBestConnectedNode(availableNodes), scope.Level, nil
 		}
 	}
-
-	if len(availableNodes) == 0 {
-		return nil, fmt.Errorf("no connected nodes available")
-	}
-
-	return wp.selectBestConnectedNode(availableNodes), nil
+	return nil, "", fmt.Errorf("no connected nodes available for country=%s, region=%s, city=%s, geo=%s", policy.Country, policy.Region, policy.City, policy.mode())
 }
 
 func (wp *WebSocketNodePool) selectBestConnectedNode(nodes []*ConnectedNode) *ConnectedNode {
@@ -383,17 +349,39 @@ func (wp *WebSocketNodePool) ExecuteProxyRequest(node *ConnectedNode, req *Proxy
 	}
 }
 
-// ForwardHTTPRequest forwards an HTTP request through a connected node
-func (wp *WebSocketNodePool) ForwardHTTPRequest(r *http.Request, country, city string) (*http.Response, error) {
-	node, err := wp.SelectConnectedNode(country, city)
+// maxForwardBodySize caps request bodies sent inline by ForwardHTTPRequest
+const maxForwardBodySize = 1 << 20
+
+// ErrResponseTooLarge is returned by ForwardHTTPRequest for a response body
+// over the caller's limit
+var ErrResponseTooLarge = errors.New("response body over the limit")
+
+// ForwardHTTPRequest forwards an HTTP request through a connected node. The
+// plan's body limits apply as on the tunnel path: a request body over
+// maxRequest (or maxForwardBodySize, whichever is lower) fails with an
+// *http.MaxBytesError, a response body over maxResponse with
+// ErrResponseTooLarge. Zero limits leave only maxForwardBodySize.
+func (wp *WebSocketNodePool) ForwardHTTPRequest(r *http.Request, policy GeoPolicy, maxRequest, maxResponse int64) (*http.Response, error) {
+	node, _, err := wp.SelectConnectedNode(policy)
 	if err != nil {
 		return nil, err
 	}
 
-	// Build proxy request
+	// Build proxy request. The body travels inside one JSON message, so large
+	// payloads belong on the streaming tunnel path instead.
 	var bodyBase64 string
 	if r.Body != nil {
-		bodyBytes, _ := io.ReadAll(r.Body)
+		limit := int64(maxForwardBodySize)
+		if maxRequest > 0 && maxRequest < limit {
+			limit = maxRequest
+		}
+		bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+		if err != nil {
+			return nil, fmt.Errorf("read request body: %v", err)
+		}
+		if int64(len(bodyBytes)) > limit {
+			return nil, &http.MaxBytesError{Limit: limit}
+		}
 		bodyBase64 = base64.StdEncoding.EncodeToString(bodyBytes)
 	}
 
@@ -429,6 +417,9 @@ func (wp *WebSocketNodePool) ForwardHTTPRequest(r *http.Request, country, city s
 
 	if resp.Body != "" {
 		bodyBytes, _ := base64.StdEncoding.DecodeString(resp.Body)
+		if maxResponse > 0 && int64(len(bodyBytes)) > maxResponse {
+			return nil, ErrResponseTooLarge
+		}
 		httpResp.Body = io.NopCloser(io.NewSectionReader(
 			&bytesReaderAt{data: bodyBytes}, 0, int64(len(bodyBytes)),
 		))
@@ -0,0 +1,49 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+// channel is the pub/sub channel the notifications service dispatches from
+const channel = "notifications"
+
+// Event types the gateway emits; the notifications service forwards them to
+// the customer's webhooks
+const (
+	EventRequestFailed  = "request.failed"
+	EventSessionRotated = "session.rotated"
+)
+
+// Publisher sends customer events to the notifications service
+type Publisher struct {
+	rdb    *redis.Client
+	logger *logrus.Entry
+}
+
+func NewPublisher(rdb *redis.Client, logger *logrus.Entry) *Publisher {
+	return &Publisher{
+		rdb:    rdb,
+		logger: logger.WithField("component", "notify"),
+	}
+}
+
+// Publish emits an event for a customer (user ID). Delivery is best effort:
+// failures are logged, never returned to the request path.
+func (p *Publisher) Publish(eventType, customerID string, data map[string]interface{}) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"type":        eventType,
+		"customer_id": customerID,
+		"data":        data,
+	})
+	if err != nil {
+		p.logger.Warnf("Failed to encode %s event: %v", eventType, err)
+		return
+	}
+	if err := p.rdb.Publish(context.Background(), channel, payload).Err(); err != nil {
+		p.logger.Warnf("Failed to publish %s event for %s: %v", eventType, customerID, err)
+	}
+}
@@ -0,0 +1,117 @@
+package policy
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// auditRecent is how many denials AuditLog keeps in memory for Recent
+const auditRecent = 1000
+
+// AuditEntry is one blocked attempt
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	CustomerID string    `json:"customer_id"`
+	Protocol   string    `json:"protocol"`
+	Host       string    `json:"host"`
+	IP         string    `json:"ip,omitempty"`
+	Port       int       `json:"port"`
+	Denial
+}
+
+// AuditLog records blocked attempts as JSON lines in a file, when one is
+// configured, and keeps the latest in memory
+type AuditLog struct {
+	logger *logrus.Entry
+
+	mu     sync.Mutex
+	file   *os.File
+	recent []AuditEntry // ring buffer
+	next   int
+	total  int64
+}
+
+// NewAuditLog opens (appending) the audit file; path may be "" to keep
+// denials in memory only
+func NewAuditLog(path string, logger *logrus.Entry) (*AuditLog, error) {
+	a := &AuditLog{logger: logger.WithField("component", "destination-audit")}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+		if err != nil {
+			return nil, err
+		}
+		a.file = f
+	}
+	return a, nil
+}
+
+// Record logs a denial. A nil log records nothing.
+func (a *AuditLog) Record(dest Destination, denial *Denial) {
+	if a == nil {
+		return
+	}
+	entry := AuditEntry{
+		Time:       time.Now().UTC(),
+		CustomerID: dest.CustomerID,
+		Protocol:   dest.Protocol,
+		Host:       dest.Host,
+		Port:       dest.Port,
+		Denial:     *denial,
+	}
+	if dest.IP != nil {
+		entry.IP = dest.IP.String()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.recent) < auditRecent {
+		a.recent = append(a.recent, entry)
+	} else {
+		a.recent[a.next] = entry
+	}
+	a.next = (a.next + 1) % auditRecent
+	a.total++
+
+	if a.file != nil {
+		line, _ := json.Marshal(entry)
+		if _, err := a.file.Write(append(line, '\n')); err != nil {
+			a.logger.Errorf("Audit log write failed: %v", err)
+		}
+	}
+}
+
+// Recent returns up to limit of the latest denials, newest first, optionally
+// for one customer only
+func (a *AuditLog) Recent(customerID string, limit int) []AuditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entries := make([]AuditEntry, 0)
+	for i := 1; i <= len(a.recent) && len(entries) < limit; i++ {
+		entry := a.recent[(a.next-i+len(a.recent))%len(a.recent)]
+		if customerID == "" || entry.CustomerID == customerID {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Total returns the number of denials recorded since start
+func (a *AuditLog) Total() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.total
+}
+
+// Close closes the audit file
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
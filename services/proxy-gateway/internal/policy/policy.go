@@ -0,0 +1,399 @@
+// Package policy decides which destinations customers may reach through the
+// proxy: global rules from a policy file, per-customer rules from account
+// plans, and domain category lists, with an audit log of what was blocked.
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Rule kinds reported in denials
+const (
+	RuleDomain     = "domain"      // deny_domains
+	RuleCIDR       = "cidr"        // deny_cidrs
+	RulePort       = "port"        // deny_ports
+	RuleCategory   = "category"    // deny_categories
+	RuleNotAllowed = "not-allowed" // outside allow_domains
+)
+
+// Rule scopes
+const (
+	ScopeGlobal   = "global"
+	ScopeCustomer = "customer"
+)
+
+// Rules are one scope's destination rules. Domains match themselves and
+// their subdomains, so "gov" blocks every .gov host. Ports are single ports
+// or ranges ("6660-6669").
+type Rules struct {
+	AllowDomains   []string `json:"allow_domains,omitempty"` // when set, only these domains
+	DenyDomains    []string `json:"deny_domains,omitempty"`
+	DenyCIDRs      []string `json:"deny_cidrs,omitempty"`
+	DenyPorts      []string `json:"deny_ports,omitempty"`
+	DenyCategories []string `json:"deny_categories,omitempty"` // category file names
+}
+
+// IsZero reports whether the rules restrict nothing
+func (r *Rules) IsZero() bool {
+	return r == nil || len(r.AllowDomains) == 0 && len(r.DenyDomains) == 0 &&
+		len(r.DenyCIDRs) == 0 && len(r.DenyPorts) == 0 && len(r.DenyCategories) == 0
+}
+
+// Destination is a connection target being checked
+type Destination struct {
+	CustomerID string
+	Protocol   string // "http", "connect", "socks5", "bind", "udp"
+	Host       string // domain name or IP literal
+	IP         net.IP // resolved address, when the caller has one
+	Port       int
+}
+
+// Denial says which rule blocked a destination
+type Denial struct {
+	Scope string `json:"scope"` // ScopeGlobal or ScopeCustomer
+	Rule  string `json:"rule"`  // Rule*
+	Match string `json:"match"` // the domain, CIDR, port range or category matched
+}
+
+func (d *Denial) Error() string {
+	return fmt.Sprintf("destination blocked by %s %s rule %s", d.Scope, d.Rule, d.Match)
+}
+
+// String renders the denial for the X-IPLoop-Policy header
+func (d *Denial) String() string {
+	return d.Scope + ":" + d.Rule + ":" + d.Match
+}
+
+// portRange is an inclusive range of ports
+type portRange struct {
+	lo, hi int
+}
+
+// ruleSet is Rules compiled for matching
+type ruleSet struct {
+	allow      map[string]bool
+	deny       map[string]bool
+	nets       []*net.IPNet
+	ports      []portRange
+	categories []string
+}
+
+// compile parses rules, failing on malformed CIDRs and ports
+func compile(r *Rules) (*ruleSet, error) {
+	rs := &ruleSet{
+		allow:      domainSet(r.AllowDomains),
+		deny:       domainSet(r.DenyDomains),
+		categories: r.DenyCategories,
+	}
+	for _, cidr := range r.DenyCIDRs {
+		ipnet, err := parseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		rs.nets = append(rs.nets, ipnet)
+	}
+	for _, spec := range r.DenyPorts {
+		pr, err := parsePortRange(spec)
+		if err != nil {
+			return nil, err
+		}
+		rs.ports = append(rs.ports, pr)
+	}
+	return rs, nil
+}
+
+// parseCIDR reads a CIDR, or a single address as a /32 or /128
+func parseCIDR(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("bad CIDR %q", s)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("bad CIDR %q", s)
+	}
+	return ipnet, nil
+}
+
+// parsePortRange reads "25" or "6660-6669"
+func parsePortRange(s string) (portRange, error) {
+	s = strings.TrimSpace(s)
+	lo, hi, isRange := strings.Cut(s, "-")
+	from, err := strconv.Atoi(lo)
+	if err != nil {
+		return portRange{}, fmt.Errorf("bad port %q", s)
+	}
+	to := from
+	if isRange {
+		if to, err = strconv.Atoi(hi); err != nil {
+			return portRange{}, fmt.Errorf("bad port range %q", s)
+		}
+	}
+	if from < 1 || to > 65535 || from > to {
+		return portRange{}, fmt.Errorf("bad port range %q", s)
+	}
+	return portRange{lo: from, hi: to}, nil
+}
+
+// domainSet normalizes a domain list into a set
+func domainSet(domains []string) map[string]bool {
+	if len(domains) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(domains))
+	for _, d := range domains {
+		if d = normalizeDomain(d); d != "" {
+			set[d] = true
+		}
+	}
+	return set
+}
+
+// normalizeDomain lowercases a domain and drops wildcard, leading and
+// trailing dots, so "*.Example.com." and ".example.com" mean example.com
+func normalizeDomain(d string) string {
+	d = strings.ToLower(strings.TrimSpace(d))
+	d = strings.TrimPrefix(d, "*")
+	return strings.Trim(d, ".")
+}
+
+// matchDomain returns the entry of set matching host or one of its parent
+// domains, or ""
+func matchDomain(set map[string]bool, host string) string {
+	if len(set) == 0 || host == "" {
+		return ""
+	}
+	for d := host; ; {
+		if set[d] {
+			return d
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			return ""
+		}
+		d = d[i+1:]
+	}
+}
+
+// check applies the rule set to a destination; host is normalized and ips
+// are the literal and resolved addresses
+func (rs *ruleSet) check(scope, host string, ips []net.IP, port int, categories map[string]map[string]bool) *Denial {
+	for _, pr := range rs.ports {
+		if port >= pr.lo && port <= pr.hi {
+			match := strconv.Itoa(pr.lo)
+			if pr.hi != pr.lo {
+				match += "-" + strconv.Itoa(pr.hi)
+			}
+			return &Denial{Scope: scope, Rule: RulePort, Match: match}
+		}
+	}
+	for _, ipnet := range rs.nets {
+		for _, ip := range ips {
+			if ipnet.Contains(ip) {
+				return &Denial{Scope: scope, Rule: RuleCIDR, Match: ipnet.String()}
+			}
+		}
+	}
+	if d := matchDomain(rs.deny, host); d != "" {
+		return &Denial{Scope: scope, Rule: RuleDomain, Match: d}
+	}
+	for _, name := range rs.categories {
+		if matchDomain(categories[name], host) != "" {
+			return &Denial{Scope: scope, Rule: RuleCategory, Match: name}
+		}
+	}
+	if len(rs.allow) > 0 && matchDomain(rs.allow, host) == "" {
+		match := host
+		if match == "" && len(ips) > 0 {
+			match = ips[0].String()
+		}
+		return &Denial{Scope: scope, Rule: RuleNotAllowed, Match: match}
+	}
+	return nil
+}
+
+// File is the policy file: global rules, plus rules for customers whose
+// plans can't carry them (resellers, trial accounts)
+//
+//	{
+//	  "global": {"deny_domains": ["gov", "mil"], "deny_ports": ["25"], "deny_categories": ["malware"]},
+//	  "customers": {"cus_123": {"allow_domains": ["example.com"]}}
+//	}
+type File struct {
+	Global    Rules            `json:"global"`
+	Customers map[string]Rules `json:"customers,omitempty"`
+}
+
+// Engine checks destinations against the global rules, the customer's rules
+// and the category lists, recording denials in the audit log
+type Engine struct {
+	file        string
+	categoryDir string
+	audit       *AuditLog
+	logger      *logrus.Entry
+
+	mu         sync.RWMutex
+	global     *ruleSet
+	customers  map[string]*ruleSet
+	categories map[string]map[string]bool // category -> domain set
+}
+
+// NewEngine loads the policy file and category directory; either may be "",
+// leaving only the customers' plan rules to apply
+func NewEngine(file, categoryDir string, audit *AuditLog, logger *logrus.Entry) (*Engine, error) {
+	e := &Engine{
+		file:        file,
+		categoryDir: categoryDir,
+		audit:       audit,
+		logger:      logger.WithField("component", "destination-policy"),
+		global:      &ruleSet{},
+	}
+	if err := e.Reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reload re-reads the policy file and category lists, keeping the previous
+// policy if either is invalid
+func (e *Engine) Reload() error {
+	global := &ruleSet{}
+	customers := make(map[string]*ruleSet)
+	if e.file != "" {
+		data, err := os.ReadFile(e.file)
+		if err != nil {
+			return fmt.Errorf("read destination policy: %w", err)
+		}
+		var f File
+		if err := json.Unmarshal(data, &f); err != nil {
+			return fmt.Errorf("parse destination policy %s: %w", e.file, err)
+		}
+		if global, err = compile(&f.Global); err != nil {
+			return fmt.Errorf("destination policy %s global: %w", e.file, err)
+		}
+		for id, rules := range f.Customers {
+			rules := rules
+			rs, err := compile(&rules)
+			if err != nil {
+				return fmt.Errorf("destination policy %s customer %s: %w", e.file, id, err)
+			}
+			customers[id] = rs
+		}
+	}
+
+	categories, err := loadCategories(e.categoryDir)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	e.global, e.customers, e.categories = global, customers, categories
+	e.mu.Unlock()
+
+	if e.file != "" || e.categoryDir != "" {
+		e.logger.Infof("Loaded destination policy (%d customer overrides, %d categories)", len(customers), len(categories))
+	}
+	return nil
+}
+
+// Check returns why a destination is blocked for a customer, or nil. Global
+// rules come first and can't be overridden; plan rules and the policy file's
+// customer rules both apply. Denials are written to the audit log.
+func (e *Engine) Check(dest Destination, plan *Rules) *Denial {
+	host := normalizeDomain(dest.Host)
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+		host = "" // domain rules don't apply to IP literals
+	}
+	if dest.IP != nil {
+		ips = append(ips, dest.IP)
+	}
+
+	e.mu.RLock()
+	denial := e.global.check(ScopeGlobal, host, ips, dest.Port, e.categories)
+	if denial == nil {
+		if rs := e.customers[dest.CustomerID]; rs != nil {
+			denial = rs.check(ScopeCustomer, host, ips, dest.Port, e.categories)
+		}
+	}
+	e.mu.RUnlock()
+
+	if denial == nil && !plan.IsZero() {
+		rs, err := compile(plan)
+		if err != nil {
+			e.logger.Warnf("Ignoring invalid plan destination rules for customer %s: %v", dest.CustomerID, err)
+		} else {
+			e.mu.RLock()
+			denial = rs.check(ScopeCustomer, host, ips, dest.Port, e.categories)
+			e.mu.RUnlock()
+		}
+	}
+
+	if denial != nil {
+		e.audit.Record(dest, denial)
+	}
+	return denial
+}
+
+// Audit returns the engine's audit log
+func (e *Engine) Audit() *AuditLog {
+	return e.audit
+}
+
+// loadCategories reads category lists from dir: one file per category named
+// after it (malware.txt), one domain per line. Hosts-file lines
+// ("0.0.0.0 example.com") and # comments are accepted.
+func loadCategories(dir string) (map[string]map[string]bool, error) {
+	categories := make(map[string]map[string]bool)
+	if dir == "" {
+		return categories, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read destination categories: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read destination category %s: %w", path, err)
+		}
+		domains := make(map[string]bool)
+		for _, line := range strings.Split(string(data), "\n") {
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			if d := normalizeDomain(fields[len(fields)-1]); d != "" && net.ParseIP(d) == nil {
+				domains[d] = true
+			}
+		}
+		name := strings.ToLower(strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())))
+		categories[name] = domains
+	}
+	return categories, nil
+}
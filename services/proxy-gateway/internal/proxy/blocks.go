@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"proxy-gateway/internal/auth"
+	"proxy-gateway/internal/nodepool"
+	"proxy-gateway/internal/notify"
+)
+
+// Block detection classifies how a target treated the exit IP. Plain HTTP
+// responses are judged by status, WAF headers and challenge pages. CONNECT
+// tunnels carry TLS the gateway can't read, so there the shape of the
+// handshake gives a block away: an alert as the target's first record, or a
+// close before it answers the ClientHello at all.
+
+// headerBlock reports the block kind of a plain HTTP response
+const headerBlock = "X-IPLoop-Block"
+
+// Block kinds
+const (
+	blockBlocked     = "blocked"
+	blockRateLimited = "rate-limited"
+	blockCaptcha     = "captcha"
+	blockTLSAlert    = "tls-alert" // target answered the ClientHello with an alert
+	blockTLSReset    = "tls-reset" // target closed without answering the ClientHello
+)
+
+// DefaultBlockBurnTTL is how long a blocked node is avoided for the site
+const DefaultBlockBurnTTL = 30 * time.Minute
+
+// TLS record content types
+const (
+	tlsRecordAlert     = 0x15
+	tlsRecordHandshake = 0x16
+)
+
+// SetBlockHandling sets how long rotate-on-block burns a node for the site
+// that blocked it, and where request.failed events go. A nil publisher skips
+// the events.
+func (p *HTTPProxy) SetBlockHandling(burnTTL time.Duration, n *notify.Publisher) {
+	if burnTTL > 0 {
+		p.blockBurnTTL = burnTTL
+	}
+	p.notifier = n
+}
+
+// classifyResponse returns the block kind of a plain HTTP response, or "" if
+// the target served it normally
+func classifyResponse(at *httpAttempt) string {
+	resp := at.resp
+	switch strings.ToLower(resp.Header.Get("X-Amzn-Waf-Action")) {
+	case "captcha", "challenge":
+		return blockCaptcha
+	case "block":
+		return blockBlocked
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return blockRateLimited
+	case http.StatusServiceUnavailable:
+		if resp.Header.Get("Retry-After") != "" {
+			return blockRateLimited
+		}
+	}
+	// Challenge pages often come as a 403, so look for them first
+	if looksLikeCaptcha(at) {
+		return blockCaptcha
+	}
+	switch resp.StatusCode {
+	case http.StatusForbidden, http.StatusUnavailableForLegalReasons:
+		return blockBlocked
+	}
+	return ""
+}
+
+// classifyTLS returns the block kind of a CONNECT tunnel from the first byte
+// each side sent and the byte counts, or "" if the tunnel wasn't TLS or the
+// handshake got an answer
+func classifyTLS(clientFirst, targetFirst byte, up, down int64) string {
+	if clientFirst != tlsRecordHandshake {
+		return ""
+	}
+	switch {
+	case down > 0 && targetFirst == tlsRecordAlert:
+		return blockTLSAlert
+	case down == 0 && up > 0:
+		return blockTLSReset
+	}
+	return ""
+}
+
+// reportBlock handles a block the target put on node. In rotate-on-block
+// mode it moves the session off the node, burns the node for the target's
+// site and tells the customer with a request.failed event.
+func (p *HTTPProxy) reportBlock(proxyAuth *auth.ProxyAuth, selection *nodepool.NodeSelection, node *nodepool.Node, target, kind string, status int) {
+	p.logger.Infof("Block detected for %s via node %s: %s (status %d)", target, node.ID, kind, status)
+	if proxyAuth.RotateMode != auth.RotateOnBlock {
+		return
+	}
+
+	rotated := selection.SessionID != ""
+	if rotated {
+		p.nodePool.RotateSession(nodepool.StickyBinding(selection.SessionID, selection.SessionDomain))
+	}
+	p.nodePool.BurnNode(node.ID, target, p.blockBurnTTL)
+	// Later attempts of this request skip the node too
+	if selection.Burned == nil {
+		selection.Burned = make(map[string]bool)
+	}
+	selection.Burned[node.ID] = true
+
+	if p.notifier == nil || proxyAuth.Customer == nil {
+		return
+	}
+	data := map[string]interface{}{
+		"reason":           kind,
+		"target":           target,
+		"domain":           nodepool.RegistrableDomain(target),
+		"node_id":          node.ID,
+		"exit_ip":          node.IPAddress,
+		"country":          node.Country,
+		"session_id":       selection.SessionID,
+		"rotated":          rotated,
+		"burn_ttl_seconds": int(p.blockBurnTTL.Seconds()),
+	}
+	if status != 0 {
+		data["status"] = status
+	}
+	go p.notifier.Publish(notify.EventRequestFailed, proxyAuth.Customer.UserID, data)
+}
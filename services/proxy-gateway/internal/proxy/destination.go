@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/armon/go-socks5"
+
+	"proxy-gateway/internal/auth"
+	"proxy-gateway/internal/policy"
+)
+
+// headerPolicy names the destination policy rule that blocked a request
+// (scope:rule:match, e.g. global:port:25)
+const headerPolicy = "X-IPLoop-Policy"
+
+// SetDestinationPolicy enables destination policy enforcement
+func (p *HTTPProxy) SetDestinationPolicy(e *policy.Engine) {
+	p.destinations = e
+}
+
+// SetDestinationPolicy enables destination policy enforcement
+func (p *SOCKS5Proxy) SetDestinationPolicy(e *policy.Engine) {
+	p.destinations = e
+}
+
+// SetDestinationPolicy enables destination policy enforcement
+func (p *EnhancedSOCKS5Proxy) SetDestinationPolicy(e *policy.Engine) {
+	p.destinations = e
+}
+
+// planRules returns the plan's destination rules, or nil
+func planRules(plan *auth.AccountPlan) *policy.Rules {
+	if plan == nil {
+		return nil
+	}
+	return &policy.Rules{
+		AllowDomains:   plan.DestinationAllowDomains,
+		DenyDomains:    plan.DestinationDenyDomains,
+		DenyCIDRs:      plan.DestinationDenyCIDRs,
+		DenyPorts:      plan.DestinationDenyPorts,
+		DenyCategories: plan.DestinationDenyCategories,
+	}
+}
+
+// checkDestination applies the destination policy, if one is configured
+func checkDestination(e *policy.Engine, dest policy.Destination, plan *auth.AccountPlan) *policy.Denial {
+	if e == nil {
+		return nil
+	}
+	return e.Check(dest, planRules(plan))
+}
+
+// httpDestination returns the target of a CONNECT or plain HTTP request
+func httpDestination(r *http.Request) (string, int) {
+	if r.Method == http.MethodConnect {
+		host, port, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			return r.Host, 0
+		}
+		n, _ := strconv.Atoi(port)
+		return host, n
+	}
+	port, _ := strconv.Atoi(r.URL.Port())
+	if port == 0 {
+		port = 80
+		if r.URL.Scheme == "https" {
+			port = 443
+		}
+	}
+	return r.URL.Hostname(), port
+}
+
+// rejectDestination refuses a request the destination policy blocks
+func (p *HTTPProxy) rejectDestination(w http.ResponseWriter, r *http.Request, proxyAuth *auth.ProxyAuth) bool {
+	host, port := httpDestination(r)
+	protocol := "http"
+	if r.Method == http.MethodConnect {
+		protocol = "connect"
+	}
+	denial := checkDestination(p.destinations, policy.Destination{
+		CustomerID: proxyAuth.Customer.ID,
+		Protocol:   protocol,
+		Host:       host,
+		Port:       port,
+	}, proxyAuth.Plan)
+	if denial == nil {
+		return false
+	}
+	p.logger.Warnf("Customer %s blocked from %s:%d: %v", proxyAuth.Customer.ID, host, port, denial)
+	w.Header().Set(headerPolicy, denial.String())
+	http.Error(w, "Destination blocked by policy", http.StatusForbidden)
+	return true
+}
+
+// socksDestination returns the target of a SOCKS5 request, as the client
+// named it and as resolved
+func socksDestination(req *socks5.Request) (string, net.IP, int) {
+	if req.DestAddr == nil {
+		return "", nil, 0
+	}
+	host := req.DestAddr.FQDN
+	if host == "" && req.DestAddr.IP != nil {
+		host = req.DestAddr.IP.String()
+	}
+	return host, req.DestAddr.IP, req.DestAddr.Port
+}
+
+// allowDestination applies the destination policy to a SOCKS5 CONNECT or BIND
+func (p *SOCKS5Proxy) allowDestination(req *socks5.Request) bool {
+	val, ok := p.auths.Load(socksUsername(req))
+	if !ok {
+		return true // Dial rejects requests without authentication
+	}
+	proxyAuth := val.(*auth.ProxyAuth)
+	host, ip, port := socksDestination(req)
+	denial := checkDestination(p.destinations, policy.Destination{
+		CustomerID: proxyAuth.Customer.ID,
+		Protocol:   socksProtocol(req),
+		Host:       host,
+		IP:         ip,
+		Port:       port,
+	}, proxyAuth.Plan)
+	if denial != nil {
+		p.logger.Warnf("Customer %s blocked from %s:%d: %v", proxyAuth.Customer.ID, host, port, denial)
+	}
+	return denial == nil
+}
+
+// allowDestination applies the destination policy to a SOCKS5 CONNECT or BIND
+func (p *EnhancedSOCKS5Proxy) allowDestination(req *socks5.Request) bool {
+	p.connectionsMutex.RLock()
+	connCtx := p.connections[socksUsername(req)]
+	p.connectionsMutex.RUnlock()
+	if connCtx == nil {
+		return true // Dial rejects requests without authentication
+	}
+	host, ip, port := socksDestination(req)
+	denial := checkDestination(p.destinations, policy.Destination{
+		CustomerID: connCtx.Auth.Customer.ID,
+		Protocol:   socksProtocol(req),
+		Host:       host,
+		IP:         ip,
+		Port:       port,
+	}, connCtx.Auth.Plan)
+	if denial != nil {
+		p.logger.Warnf("Customer %s blocked from %s:%d: %v", connCtx.Auth.Customer.ID, host, port, denial)
+	}
+	return denial == nil
+}
+
+// udpDestinationCheck returns the check for an association's datagrams
+func udpDestinationCheck(e *policy.Engine, customerID string, plan *auth.AccountPlan) func(host string, port int) bool {
+	if e == nil {
+		return nil
+	}
+	rules := planRules(plan)
+	return func(host string, port int) bool {
+		return e.Check(policy.Destination{
+			CustomerID: customerID,
+			Protocol:   "udp",
+			Host:       host,
+			Port:       port,
+		}, rules) == nil
+	}
+}
+
+// socksProtocol names a SOCKS5 command for the audit log
+func socksProtocol(req *socks5.Request) string {
+	if req.Command == socks5.BindCommand {
+		return "bind"
+	}
+	return "socks5"
+}
@@ -17,6 +17,7 @@ import (
 	"proxy-gateway/internal/auth"
 	"proxy-gateway/internal/nodepool"
 	"proxy-gateway/internal/metrics"
+	"proxy-gateway/internal/policy"
 	"proxy-gateway/internal/session"
 	"proxy-gateway/internal/headers"
 )
@@ -31,6 +32,8 @@ type EnhancedSOCKS5Proxy struct {
 	logger          *logrus.Entry
 	server          *socks5.Server
 	nodeRegURL      string
+	conns           *socksConnRegistry
+	destinations    *policy.Engine
 	
 	// Connection context tracking
 	connections     map[string]*ConnectionContext
@@ -64,6 +67,11 @@ func (c *WebSocketConn) Read(b []byte) (int, error) {
 		return 0, err
 	}
 
+	// Target half-closed — keep the write side open
+	if isTunnelFIN(messageType, data) {
+		return 0, io.EOF
+	}
+
 	if messageType != websocket.BinaryMessage && messageType != websocket.TextMessage {
 		return 0, fmt.Errorf("unexpected message type: %d", messageType)
 	}
@@ -88,6 +96,12 @@ func (c *WebSocketConn) Write(b []byte) (int, error) {
 	return len(b), nil
 }
 
+// CloseWrite forwards a client half-close to the exit node
+func (c *WebSocketConn) CloseWrite() error {
+	c.ws.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	return c.ws.WriteMessage(websocket.TextMessage, []byte(tunnelFINMessage))
+}
+
 func (c *WebSocketConn) Close() error {
 	c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 	return c.ws.Close()
@@ -172,6 +186,22 @@ func NewEnhancedSOCKS5Proxy(
 		logger:         logger.WithField("component", "enhanced-socks5"),
 		nodeRegURL:     nodeRegURL,
 		connections:    make(map[string]*ConnectionContext),
+		conns:          &socksConnRegistry{},
+	}
+	
+	udp := &udpRelay{
+		nodeRegURL:    nodeRegURL,
+		authenticator: authenticator,
+		metrics:       metrics,
+		logger:        proxy.logger,
+		route:         proxy.routeCommand,
+	}
+	bind := &bindRelay{
+		nodeRegURL:    nodeRegURL,
+		authenticator: authenticator,
+		metrics:       metrics,
+		logger:        proxy.logger,
+		route:         proxy.routeCommand,
 	}
 	
 	// Configure enhanced SOCKS5 server
@@ -184,6 +214,14 @@ func NewEnhancedSOCKS5Proxy(
 		},
 		Dial:     proxy.dialThroughNode,
 		Resolver: &CustomResolver{proxy: proxy},
+		Rules: &socksCommandRules{
+			conns: proxy.conns,
+			allow: proxy.allowDestination,
+			handlers: map[uint8]socksCommandHandler{
+				socks5.BindCommand:      bind.handleBind,
+				socks5.AssociateCommand: udp.handleAssociate,
+			},
+		},
 	}
 	
 	server, err := socks5.New(conf)
@@ -197,7 +235,7 @@ func NewEnhancedSOCKS5Proxy(
 
 func (p *EnhancedSOCKS5Proxy) Serve(listener net.Listener) error {
 	p.logger.Infof("Enhanced SOCKS5 proxy listening on %s", listener.Addr().String())
-	return p.server.Serve(listener)
+	return p.server.Serve(&socksListener{Listener: listener, conns: p.conns})
 }
 
 // Valid implements the socks5 UserPassAuthenticator interface
@@ -272,12 +310,55 @@ func (p *EnhancedSOCKS5Proxy) dialThroughNode(ctx context.Context, network, addr
 	return wrappedConn, nil
 }
 
+// routeCommand sends a BIND or UDP ASSOCIATE through the customer's session node
+func (p *EnhancedSOCKS5Proxy) routeCommand(req *socks5.Request) (*commandRoute, error) {
+	p.connectionsMutex.RLock()
+	connCtx := p.connections[socksUsername(req)]
+	p.connectionsMutex.RUnlock()
+	if connCtx == nil {
+		return nil, fmt.Errorf("no authentication context")
+	}
+	if err := p.checkLimits(connCtx); err != nil {
+		return nil, err
+	}
+
+	sess, err := p.sessionManager.GetOrCreateSession(connCtx.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("session error: %v", err)
+	}
+	target := req.DestAddr.FQDN
+	if target == "" && req.DestAddr.IP != nil {
+		target = req.DestAddr.IP.String()
+	}
+	nodeID, _, err := p.sessionManager.NodeFor(sess, target)
+	if err != nil {
+		return nil, err
+	}
+	if nodeID == "" {
+		return nil, fmt.Errorf("no node assigned to session")
+	}
+
+	return &commandRoute{
+		nodeID:     nodeID,
+		customerID: connCtx.Auth.Customer.ID,
+		country:    sess.Country,
+		release:    func() {},
+		allowUDP:   udpDestinationCheck(p.destinations, connCtx.Auth.Customer.ID, connCtx.Auth.Plan),
+	}, nil
+}
+
 func (p *EnhancedSOCKS5Proxy) connectThroughNode(sess *session.Session, host, port string) (net.Conn, error) {
+	// Domain-scoped sessions have a node per target site
+	nodeID, nodeIP, err := p.sessionManager.NodeFor(sess, host)
+	if err != nil {
+		return nil, err
+	}
+
 	// Check if we should use WebSocket nodes or direct connection
-	if sess.CurrentNodeID != "" {
+	if nodeID != "" {
 		// Try WebSocket node first for better routing
 		if p.wsNodePool != nil {
-			wsConn, err := p.connectViaWebSocket(sess, host, port)
+			wsConn, err := p.connectViaWebSocket(nodeID, nodeIP, host, port)
 			if err == nil {
 				return wsConn, nil
 			}
@@ -285,18 +366,18 @@ func (p *EnhancedSOCKS5Proxy) connectThroughNode(sess *session.Session, host, po
 		}
 		
 		// Fall back to direct connection through node IP
-		return p.connectDirectly(sess.CurrentNodeIP, host, port)
+		return p.connectDirectly(nodeIP, host, port)
 	}
 	
 	return nil, fmt.Errorf("no node assigned to session")
 }
 
-func (p *EnhancedSOCKS5Proxy) connectViaWebSocket(sess *session.Session, host, port string) (net.Conn, error) {
+func (p *EnhancedSOCKS5Proxy) connectViaWebSocket(nodeID, nodeIP, host, port string) (net.Conn, error) {
 	// Build WebSocket tunnel URL to node-registration service
 	tunnelURL := strings.Replace(p.nodeRegURL, "http://", "ws://", 1)
 	tunnelURL = strings.Replace(tunnelURL, "https://", "wss://", 1)
-	tunnelURL = fmt.Sprintf("%s/internal/tunnel?node_id=%s&host=%s&port=%s", 
-		tunnelURL, sess.CurrentNodeID, host, port)
+	tunnelURL = fmt.Sprintf("%s/internal/tunnel?node_id=%s&host=%s&port=%s&half_close=1",
+		tunnelURL, nodeID, host, port)
 
 	p.logger.Debugf("SOCKS5 connecting via WebSocket tunnel: %s", tunnelURL)
 
@@ -310,7 +391,7 @@ func (p *EnhancedSOCKS5Proxy) connectViaWebSocket(sess *session.Session, host, p
 	}
 
 	p.logger.Infof("SOCKS5 tunnel established to %s:%s via node %s (%s)", 
-		host, port, sess.CurrentNodeID, sess.CurrentNodeIP)
+		host, port, nodeID, nodeIP)
 
 	// Return wrapped connection that implements net.Conn
 	return &WebSocketConn{
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"proxy-gateway/internal/auth"
+	"proxy-gateway/internal/nodepool"
+)
+
+// Exit geo headers. Every proxied response says where its exit node is;
+// geo-targeted ones also say how close that is to the target: radius, or the
+// city, region or country (or anywhere, in GeoModeAny) it fell back to.
+const (
+	headerExitCountry = "X-IPLoop-Exit-Country"
+	headerExitRegion  = "X-IPLoop-Exit-Region"
+	headerExitCity    = "X-IPLoop-Exit-City"
+	headerGeoMatch    = "X-IPLoop-Geo-Match"
+)
+
+// exitGeoHeaders lists the exit geo headers in the order CONNECT replies
+// carry them
+var exitGeoHeaders = []string{headerExitCountry, headerExitRegion, headerExitCity, headerGeoMatch}
+
+// applyGeoPolicy sets the region, the geo fallback mode (the request's
+// fallback- parameter, else the plan's) and the plan's country limits, which
+// bind every fallback
+func applyGeoPolicy(selection *nodepool.NodeSelection, proxyAuth *auth.ProxyAuth) {
+	selection.Region = proxyAuth.Region
+	selection.GeoMode = auth.GeoMode(proxyAuth.GeoMode, proxyAuth.Plan)
+	if proxyAuth.Plan != nil {
+		selection.AllowedCountries = proxyAuth.Plan.AllowedCountries
+		selection.BlockedCountries = proxyAuth.Plan.BlockedCountries
+	}
+}
+
+// nearTarget converts lat-/lon-/radius-/zip- into radius targeting, or nil
+// when the request didn't ask for it
+func nearTarget(near auth.NearTarget) *nodepool.GeoTarget {
+	if !near.IsSet() {
+		return nil
+	}
+	return &nodepool.GeoTarget{
+		Lat:      near.Lat,
+		Lon:      near.Lon,
+		HasPoint: near.HasLat && near.HasLon,
+		RadiusKm: near.RadiusKm,
+		Zip:      near.Zip,
+	}
+}
+
+// setExitGeo reports where the exit node is and, for geo-targeted requests,
+// its match level. HTTP/1.1 CONNECT writes its own status line and picks the
+// headers up from there.
+func (p *HTTPProxy) setExitGeo(w http.ResponseWriter, selection *nodepool.NodeSelection, node *nodepool.Node) {
+	if node == nil {
+		return
+	}
+	h := w.Header()
+	for name, value := range map[string]string{
+		headerExitCountry: strings.ToUpper(node.Country),
+		headerExitRegion:  node.Region,
+		headerExitCity:    node.City,
+		headerGeoMatch:    p.nodePool.GeoMatch(selection, node),
+	} {
+		if value != "" {
+			h.Set(name, value)
+		}
+	}
+}
+
+// connectEstablished is the HTTP/1.1 CONNECT reply, with the exit geo headers
+// that were set
+func connectEstablished(h http.Header) []byte {
+	reply := "HTTP/1.1 200 Connection Established\r\n"
+	for _, name := range exitGeoHeaders {
+		if value := h.Get(name); value != "" {
+			reply += name + ": " + value + "\r\n"
+		}
+	}
+	return []byte(reply + "\r\n")
+}
@@ -4,13 +4,10 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"strings"
 	"sync"
@@ -23,6 +20,8 @@ import (
 	"proxy-gateway/internal/auth"
 	"proxy-gateway/internal/nodepool"
 	"proxy-gateway/internal/metrics"
+	"proxy-gateway/internal/notify"
+	"proxy-gateway/internal/policy"
 )
 
 type HTTPProxy struct {
@@ -31,7 +30,11 @@ type HTTPProxy struct {
 	wsNodePool      *nodepool.WebSocketNodePool
 	warmPool        *nodepool.WarmPool
 	tunnelPool      *nodepool.TunnelPool
+	tenants         *TenantRouter
+	destinations    *policy.Engine
 	metrics         *metrics.Collector
+	notifier        *notify.Publisher
+	blockBurnTTL    time.Duration
 	logger          *logrus.Entry
 	nodeRegURL      string
 	httpClient      *http.Client
@@ -58,6 +61,7 @@ func NewHTTPProxy(authenticator *auth.Authenticator, nodePool *nodepool.NodePool
 		nodePool:      nodePool,
 		wsNodePool:    wsNodePool,
 		metrics:       metrics,
+		blockBurnTTL:  DefaultBlockBurnTTL,
 		logger:        logger.WithField("component", "http-proxy"),
 		nodeRegURL:    nodeRegURL,
 		httpClient: &http.Client{
@@ -83,6 +87,20 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// SNI tenant on the HTTPS listener
+	tenant := p.tenantFor(r)
+	if tenant != nil && !tenant.allows(auth.Customer.ID) {
+		p.logger.Warnf("Customer %s not allowed on tenant host %s", auth.Customer.ID, r.TLS.ServerName)
+		http.Error(w, "Customer not allowed on this endpoint", http.StatusForbidden)
+		return
+	}
+	if tenant != nil && auth.Country == "" {
+		auth.Country = tenant.Country
+	}
+	if p.rejectDestination(w, r, auth) {
+		return
+	}
+
 	// Select node
 	// For rotating/per-request sessions, don't use session ID (forces new node each time)
 	sessionID := auth.SessionID
@@ -90,14 +108,36 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		sessionID = "" // Empty session = fresh node selection every request
 	}
 	selection := &nodepool.NodeSelection{
-		Country:   auth.Country,
-		City:      auth.City,
-		SessionID: sessionID,
+		Country:        auth.Country,
+		City:           auth.City,
+		ASN:            auth.ASN,
+		ISP:            auth.ISP,
+		ConnectionType: auth.ConnType,
+		SessionID:      sessionID,
+		Near:           nearTarget(auth.Near),
+	}
+	applyPoolTier(selection, auth, tenant)
+	applyGeoPolicy(selection, auth)
+	applyReuseCooldown(selection, auth, r.Host)
+	selection.Burned = p.nodePool.BurnedNodes(r.Host)
+	if sessionID != "" && auth.SessionScope == "domain" {
+		selection.SessionDomain = nodepool.RegistrableDomain(r.Host)
+	}
+	applyPin(selection, auth)
+	if auth.Debug {
+		selection.Trace = &nodepool.SelectionTrace{}
+	}
+	if p.rejectPinned(w, selection) {
+		return
 	}
 
 	if r.Method == http.MethodConnect {
 		// ── CONNECT: try pre-opened tunnel first, then race ──
-		node, ok := p.tryTunnelPoolConnect(w, r, auth)
+		var node *nodepool.Node
+		var ok bool
+		if selection.UsesDefaultPool() {
+			node, ok = p.tryTunnelPoolConnect(w, r, auth, selection)
+		}
 		if !ok {
 			node, ok = p.raceConnectTunnel(w, r, auth, selection)
 		}
@@ -109,50 +149,104 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		p.logger.Debugf("Request completed in %v via node %s (race winner)", duration, node.ID)
 	} else {
 		// ── Plain HTTP: parallel node racing with retry ──
-		// Buffer body so retries can re-send it
-		if r.Body != nil {
-			bodyData, _ := io.ReadAll(r.Body)
-			r.Body.Close()
-			r.Body = io.NopCloser(bytes.NewReader(bodyData))
-			r.ContentLength = int64(len(bodyData))
-			// Store for retries
-			r = r.Clone(r.Context())
-			r.Body = io.NopCloser(bytes.NewReader(bodyData))
-			r.GetBody = func() (io.ReadCloser, error) {
-				return io.NopCloser(bytes.NewReader(bodyData)), nil
-			}
+		if !r.URL.IsAbs() {
+			http.Error(w, "Absolute URL required", http.StatusBadRequest)
+			return
+		}
+		maxRequest, maxResponse := bodyLimitsFor(auth)
+		r, err = bufferForReplay(w, r, maxRequest)
+		if err != nil {
+			p.rejectRequestBody(w, err, maxRequest)
+			return
 		}
-		maxHTTPRetries := 3
-		deadline := time.Now().Add(20 * time.Second) // total budget for all retries
+		policy := retryPolicyFor(auth)
+		deadline := start.Add(policy.Budget) // total budget for all attempts
+		tried := make(map[string]bool)      // nodes already used, excluded from retries
+		var failures []string
 		var node *nodepool.Node
-		var ok bool
-		for attempt := 0; attempt < maxHTTPRetries; attempt++ {
-			if time.Now().After(deadline) {
-				p.logger.Warnf("HTTP retries exhausted time budget for %s", r.URL.String())
-				break
-			}
+		var result *httpAttempt
+		var block string // block kind of result
+		attempts := 0
+		for attempt := 0; attempt < policy.MaxAttempts; attempt++ {
 			if attempt > 0 {
-				p.logger.Infof("HTTP retry attempt %d/%d for %s", attempt+1, maxHTTPRetries, r.URL.String())
+				if time.Now().After(deadline) {
+					p.logger.Warnf("HTTP retries exhausted time budget for %s", r.URL.String())
+					break
+				}
+				p.logger.Infof("HTTP retry attempt %d/%d for %s", attempt+1, policy.MaxAttempts, r.URL.String())
 				// Reset body for retry
 				if r.GetBody != nil {
 					r.Body, _ = r.GetBody()
 				}
 			}
-			// Try pre-opened tunnel pool first
-			if attempt == 0 {
-				node, ok = p.tryTunnelPoolHTTP(w, r, auth)
+			attempts++
+			var n *nodepool.Node
+			var at *httpAttempt
+			var err error
+			// Try pre-opened tunnel pool first (tier-agnostic, so only on the default pool)
+			if attempt == 0 && selection.UsesDefaultPool() {
+				n, at, err = p.tryTunnelPoolHTTP(r, selection, tried, deadline)
+			}
+			if at == nil && err != nil && r.GetBody != nil && !isBodyLimit(err) && err != errRetryBudget {
+				// Pooled tunnel failed mid-request; rewind the body for the race
+				r.Body, _ = r.GetBody()
+				err = nil
+			}
+			if at == nil && err == nil {
+				n, at, err = p.raceHTTPTunnel(r, auth, selection, tried, deadline)
+			}
+			if err != nil && isBodyLimit(err) {
+				if at != nil {
+					at.Close()
+				}
+				p.rejectRequestBody(w, err, maxRequest)
+				return
+			}
+			if at != nil {
+				if result != nil {
+					result.Close()
+				}
+				node, result = n, at
+				if block = classifyResponse(at); block != "" {
+					p.reportBlock(auth, selection, n, r.Host, block, at.resp.StatusCode)
+				}
 			}
-			if !ok {
-				node, ok = p.raceHTTPTunnel(w, r, auth, selection)
+
+			reason := retryReason(policy, at, err)
+			if at != nil && selection.SessionDomain != "" && blocksSession(at.resp.StatusCode) {
+				// Move only this site's binding; the session's other domains keep their nodes
+				p.nodePool.RotateSession(nodepool.StickyBinding(selection.SessionID, selection.SessionDomain))
 			}
-			if ok {
+			if reason == "" {
+				break
+			}
+			failures = append(failures, reason)
+			if n != nil {
+				p.logger.Infof("HTTP attempt %d for %s via node %s failed (%s)", attempt+1, r.URL.String(), n.ID, reason)
+			}
+			// Replaying a request the target may have seen is only safe for
+			// idempotent methods with a buffered body; a request that never
+			// left is always safe.
+			if err != errNoTunnel && (!policy.AllowsMethod(r.Method) || !replayable(r)) {
 				break
 			}
 		}
-		if !ok {
+		setRetryHeaders(w, attempts, failures)
+		setSelectionTrace(w, selection)
+		if result != nil {
+			p.setExitGeo(w, selection, node)
+		}
+		if block != "" {
+			w.Header().Set(headerBlock, block)
+		}
+		if result == nil {
+			if p.rejectPinned(w, selection) {
+				return
+			}
 			http.Error(w, "All proxy attempts failed after retries", http.StatusBadGateway)
 			return
 		}
+		p.writeHTTPAttempt(w, r, node, auth, result, maxResponse)
 		duration := time.Since(start)
 		p.metrics.RecordRequest(auth.Customer.ID, node.Country, duration, true)
 		p.logger.Debugf("HTTP request completed in %v via node %s (race winner)", duration, node.ID)
@@ -185,21 +279,21 @@ func (p *HTTPProxy) raceConnectTunnel(w http.ResponseWriter, r *http.Request, pr
 	seen := make(map[string]bool) // de-duplicate by node ID
 	warmFlags := make([]bool, 0, racers)
 
-	// For sticky sessions, use the assigned node directly — no racing
-	if selection.SessionID != "" && proxyAuth.SessionType == "sticky" {
+	// For pins and sticky sessions, use the assigned node directly — no racing
+	if usesOneNode(selection, proxyAuth) {
 		stickyNode, err := p.nodePool.SelectNode(selection)
 		if err == nil && stickyNode != nil {
 			seen[stickyNode.ID] = true
 			candidates = append(candidates, stickyNode)
 			warmFlags = append(warmFlags, false)
-			p.logger.Debugf("Sticky session %s — using assigned node %s (no race)", selection.SessionID, stickyNode.ID)
+			p.logger.Debugf("Session %s — using assigned node %s (no race)", selection.SessionID, stickyNode.ID)
 		}
 	}
 
-	// Pull from warm pool (only for non-sticky sessions)
-	if len(candidates) == 0 && p.warmPool != nil && (proxyAuth.SessionType == "rotating" || proxyAuth.SessionType == "per-request" || selection.SessionID == "") {
+	// Pull from warm pool (only for non-sticky sessions on the default pool)
+	if len(candidates) == 0 && p.warmPool != nil && selection.UsesDefaultPool() && (proxyAuth.SessionType == "rotating" || proxyAuth.SessionType == "per-request" || selection.SessionID == "") {
 		for len(candidates) < racers {
-			fastID := p.warmPool.GetFastNode(proxyAuth.Country)
+			fastID, _ := p.warmPool.GetFastNode(selection.GeoPolicy().Exact())
 			if fastID == "" {
 				break
 			}
@@ -216,8 +310,8 @@ func (p *HTTPProxy) raceConnectTunnel(w http.ResponseWriter, r *http.Request, pr
 		}
 	}
 
-	// Fill remaining slots from normal pool (only for non-sticky sessions)
-	if selection.SessionID == "" || proxyAuth.SessionType != "sticky" {
+	// Fill remaining slots from normal pool (only for unpinned, non-sticky requests)
+	if !usesOneNode(selection, proxyAuth) {
 		for len(candidates) < racers {
 			n, err := p.nodePool.SelectNode(selection)
 			if err != nil {
@@ -234,6 +328,9 @@ func (p *HTTPProxy) raceConnectTunnel(w http.ResponseWriter, r *http.Request, pr
 	}
 
 	if len(candidates) == 0 {
+		if p.rejectPinned(w, selection) {
+			return nil, false
+		}
 		http.Error(w, "No nodes available", http.StatusBadGateway)
 		return nil, false
 	}
@@ -304,20 +401,20 @@ func (p *HTTPProxy) raceConnectTunnel(w http.ResponseWriter, r *http.Request, pr
 	}
 
 	// ── Hand off winning connection to the relay ──
-	p.handleConnectTunnel(w, r, winner.node, proxyAuth, winner.wsConn, host, port)
+	p.nodePool.RecordIPUse(selection, winner.node)
+	setSelectionTrace(w, selection)
+	p.setExitGeo(w, selection, winner.node)
+	p.handleConnectTunnel(w, r, winner.node, proxyAuth, selection, winner.wsConn, host, port)
 	p.nodePool.ReleaseNode(winner.node.ID)
 	return winner.node, true
 }
 
 // raceHTTPTunnel selects up to 3 candidate nodes, dials them in parallel,
-// and uses the first successful tunnel for a plain HTTP request.
-func (p *HTTPProxy) raceHTTPTunnel(w http.ResponseWriter, r *http.Request, proxyAuth *auth.ProxyAuth, selection *nodepool.NodeSelection) (*nodepool.Node, bool) {
+// and sends a plain HTTP request through the first successful tunnel. Nodes
+// in tried are skipped (except a sticky session's node) and every candidate
+// is added to it. Dials and the response head must be done by deadline.
+func (p *HTTPProxy) raceHTTPTunnel(r *http.Request, proxyAuth *auth.ProxyAuth, selection *nodepool.NodeSelection, tried map[string]bool, deadline time.Time) (*nodepool.Node, *httpAttempt, error) {
 	targetURL := r.URL
-	if !targetURL.IsAbs() {
-		http.Error(w, "Absolute URL required", http.StatusBadRequest)
-		return nil, false
-	}
-
 	host := targetURL.Hostname()
 	port := targetURL.Port()
 	if port == "" {
@@ -329,24 +426,24 @@ func (p *HTTPProxy) raceHTTPTunnel(w http.ResponseWriter, r *http.Request, proxy
 
 	// ── Gather candidates (warm-pool first, then normal pool) ──
 	candidates := make([]*nodepool.Node, 0, racers)
-	seen := make(map[string]bool)
+	seen := tried
 	warmFlags := make([]bool, 0, racers)
 
-	// For sticky sessions, use the assigned node directly — no racing
-	if selection.SessionID != "" && proxyAuth.SessionType == "sticky" {
+	// For pins and sticky sessions, use the assigned node directly — no racing
+	if usesOneNode(selection, proxyAuth) {
 		stickyNode, err := p.nodePool.SelectNode(selection)
 		if err == nil && stickyNode != nil {
 			seen[stickyNode.ID] = true
 			candidates = append(candidates, stickyNode)
 			warmFlags = append(warmFlags, false)
-			p.logger.Debugf("Sticky session %s — using assigned node %s (no race)", selection.SessionID, stickyNode.ID)
+			p.logger.Debugf("Session %s — using assigned node %s (no race)", selection.SessionID, stickyNode.ID)
 		}
 	}
 
-	// Pull from warm pool (only for non-sticky sessions)
-	if len(candidates) == 0 && p.warmPool != nil && (proxyAuth.SessionType == "rotating" || proxyAuth.SessionType == "per-request" || selection.SessionID == "") {
+	// Pull from warm pool (only for non-sticky sessions on the default pool)
+	if len(candidates) == 0 && p.warmPool != nil && selection.UsesDefaultPool() && (proxyAuth.SessionType == "rotating" || proxyAuth.SessionType == "per-request" || selection.SessionID == "") {
 		for len(candidates) < racers {
-			fastID := p.warmPool.GetFastNode(proxyAuth.Country)
+			fastID, _ := p.warmPool.GetFastNode(selection.GeoPolicy().Exact())
 			if fastID == "" {
 				break
 			}
@@ -363,8 +460,9 @@ func (p *HTTPProxy) raceHTTPTunnel(w http.ResponseWriter, r *http.Request, proxy
 		}
 	}
 
-	// Fill remaining slots from normal pool (only for non-sticky sessions)
-	if selection.SessionID == "" || proxyAuth.SessionType != "sticky" {
+	// Fill remaining slots from normal pool (only for unpinned, non-sticky requests)
+	if !usesOneNode(selection, proxyAuth) {
+		misses := 0
 		for len(candidates) < racers {
 			n, err := p.nodePool.SelectNode(selection)
 			if err != nil {
@@ -372,6 +470,9 @@ func (p *HTTPProxy) raceHTTPTunnel(w http.ResponseWriter, r *http.Request, proxy
 			}
 			if seen[n.ID] {
 				p.nodePool.ReleaseNode(n.ID)
+				if misses++; misses > 2*racers {
+					break // pool holds nothing we haven't tried
+				}
 				continue
 			}
 			seen[n.ID] = true
@@ -382,14 +483,14 @@ func (p *HTTPProxy) raceHTTPTunnel(w http.ResponseWriter, r *http.Request, proxy
 
 	if len(candidates) == 0 {
 		p.logger.Warnf("HTTP race: no nodes available for %s", targetURL.String())
-		return nil, false
+		return nil, nil, errNoTunnel
 	}
 
 	p.logger.Infof("HTTP race to %s — racing %d nodes", targetURL.String(), len(candidates))
 
 	// ── Launch parallel dials ──
 	resultCh := make(chan raceResult, len(candidates))
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
 	defer cancel()
 
 	var launched int32
@@ -428,7 +529,7 @@ func (p *HTTPProxy) raceHTTPTunnel(w http.ResponseWriter, r *http.Request, proxy
 				res.wsConn.Close()
 			}
 			p.nodePool.ReleaseNode(res.node.ID)
-		} else if res.err != nil && res.err != context.Canceled {
+		} else if res.err != nil && res.err != context.Canceled && res.err != context.DeadlineExceeded {
 			p.logger.Warnf("HTTP race: node %s failed: %v — blacklisting", res.node.ID, res.err)
 			p.nodePool.BlacklistNode(res.node.ID, 15*time.Minute)
 			p.nodePool.ReleaseNode(res.node.ID)
@@ -439,123 +540,147 @@ func (p *HTTPProxy) raceHTTPTunnel(w http.ResponseWriter, r *http.Request, proxy
 
 	if winner == nil {
 		p.logger.Warnf("HTTP race: all %d tunnel attempts failed for %s", len(candidates), targetURL.String())
-		return nil, false
+		return nil, nil, errNoTunnel
 	}
 
 	// ── Send HTTP request through winning tunnel ──
-	success := p.handleHTTPWithConn(w, r, winner.node, proxyAuth, winner.wsConn, host)
+	p.nodePool.RecordIPUse(selection, winner.node)
+	at, err := p.fetchHTTPWithConn(r, winner.node, winner.wsConn, deadline)
 	p.nodePool.ReleaseNode(winner.node.ID)
-	if !success {
-		return winner.node, false // malformed response — caller should retry
-	}
-	return winner.node, true
+	return winner.node, at, err
 }
 
-// handleHTTPWithConn sends an HTTP request through a pre-established WebSocket tunnel.
-// Returns true if response was successfully parsed and written, false if malformed (should retry).
-func (p *HTTPProxy) handleHTTPWithConn(w http.ResponseWriter, r *http.Request, node *nodepool.Node, proxyAuth *auth.ProxyAuth, wsConn *websocket.Conn, host string) bool {
-	defer wsConn.Close()
-
-	targetURL := r.URL
-
-	// Build raw HTTP request
-	var reqBuf bytes.Buffer
-	path := targetURL.RequestURI()
-	if path == "" {
-		path = "/"
-	}
-	reqBuf.WriteString(fmt.Sprintf("%s %s HTTP/1.1\r\n", r.Method, path))
-	reqBuf.WriteString(fmt.Sprintf("Host: %s\r\n", targetURL.Host))
+// httpAttempt is a response fetched through a node but not yet written to
+// the client, so the retry policy can look at it first. The body is still
+// streaming from the tunnel; Close releases it.
+type httpAttempt struct {
+	resp *http.Response
+	head []byte // body prefix read ahead by peek
+	conn io.Closer
+	up   *countingWriter
+	down *countingReader
+}
 
-	for name, values := range r.Header {
-		lowerName := strings.ToLower(name)
-		if lowerName == "proxy-authorization" || lowerName == "proxy-connection" {
-			continue
-		}
-		for _, v := range values {
-			reqBuf.WriteString(fmt.Sprintf("%s: %s\r\n", name, v))
-		}
+// peek returns up to n bytes from the start of the body without consuming them
+func (at *httpAttempt) peek(n int) []byte {
+	if at.head == nil {
+		at.head, _ = io.ReadAll(io.LimitReader(at.resp.Body, int64(n)))
+		at.resp.Body = readCloser{io.MultiReader(bytes.NewReader(at.head), at.resp.Body), at.resp.Body}
 	}
+	return at.head
+}
 
-	var bodyBytes []byte
-	if r.Body != nil {
-		bodyBytes, _ = io.ReadAll(r.Body)
-	}
-	if len(bodyBytes) > 0 {
-		reqBuf.WriteString(fmt.Sprintf("Content-Length: %d\r\n", len(bodyBytes)))
-	}
-	reqBuf.WriteString("\r\n")
-	if len(bodyBytes) > 0 {
-		reqBuf.Write(bodyBytes)
-	}
+func (at *httpAttempt) Close() {
+	at.resp.Body.Close()
+	at.conn.Close()
+}
 
-	if err := wsConn.WriteMessage(websocket.BinaryMessage, reqBuf.Bytes()); err != nil {
+// fetchHTTPWithConn streams an HTTP request through a pre-established
+// WebSocket tunnel and reads the response head. An error means the attempt
+// produced no usable response and may be retried on another node. The
+// tunnel is closed if the head isn't in by deadline.
+func (p *HTTPProxy) fetchHTTPWithConn(r *http.Request, node *nodepool.Node, wsConn *websocket.Conn, deadline time.Time) (*httpAttempt, error) {
+	tunnel := &SOCKS5WSConn{ws: wsConn, logger: p.logger}
+	out := outboundRequest(r)
+
+	// The tunnel sets its own per-message deadlines, so enforce the retry
+	// budget from outside
+	expired := time.AfterFunc(time.Until(deadline), func() { wsConn.Close() })
+
+	up := &countingWriter{w: tunnel}
+	bw := bufio.NewWriterSize(up, tunnelChunkSize)
+	if err := out.Write(bw); err != nil {
+		expired.Stop()
+		wsConn.Close()
+		if isBodyLimit(err) {
+			return nil, err
+		}
 		p.logger.Errorf("Failed to send request through tunnel: %v", err)
-		return false // retry
-	}
-	bytesUp := int64(reqBuf.Len())
-
-	// Read response
-	var respBuf bytes.Buffer
-	bytesDown := int64(0)
-
-	wsConn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	messageType, data, err := wsConn.ReadMessage()
-	if err != nil {
-		p.logger.Errorf("Failed to read response from tunnel: %v", err)
-		return false // retry
+		return nil, fmt.Errorf("send request: %w", err)
 	}
-	if messageType == websocket.BinaryMessage || messageType == websocket.TextMessage {
-		respBuf.Write(data)
-		bytesDown += int64(len(data))
+	if err := bw.Flush(); err != nil {
+		expired.Stop()
+		wsConn.Close()
+		p.logger.Errorf("Failed to send request through tunnel: %v", err)
+		return nil, fmt.Errorf("send request: %w", err)
 	}
 
-	for {
-		wsConn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
-		messageType, data, err := wsConn.ReadMessage()
-		if err != nil {
-			break
-		}
-		if messageType == websocket.CloseMessage {
-			break
-		}
-		if messageType == websocket.BinaryMessage || messageType == websocket.TextMessage {
-			respBuf.Write(data)
-			bytesDown += int64(len(data))
-		}
+	down := &countingReader{r: tunnel}
+	httpResp, err := http.ReadResponse(bufio.NewReaderSize(down, tunnelChunkSize), out)
+	if !expired.Stop() {
+		wsConn.Close()
+		p.logger.Warnf("No response from node %s within the retry budget", node.ID)
+		return nil, errRetryBudget
 	}
-
-	respReader := bufio.NewReader(&respBuf)
-	httpResp, err := http.ReadResponse(respReader, r)
 	if err != nil {
+		wsConn.Close()
+		if down.n == 0 {
+			p.logger.Errorf("Failed to read response from tunnel: %v", err)
+			return nil, fmt.Errorf("read response: %w", err)
+		}
 		p.logger.Warnf("Malformed HTTP response from node %s, blacklisting and retrying: %v", node.ID, err)
 		p.nodePool.BlacklistNode(node.ID, 15*time.Minute)
-		return false // retry with different node
+		return nil, fmt.Errorf("malformed response: %w", err)
 	}
-	defer httpResp.Body.Close()
 
-	for name, values := range httpResp.Header {
-		for _, v := range values {
-			w.Header().Add(name, v)
-		}
+	return &httpAttempt{
+		resp: httpResp,
+		conn: wsConn,
+		up:   up,
+		down: down,
+	}, nil
+}
+
+// writeHTTPAttempt streams a fetched response to the client and accounts for it
+func (p *HTTPProxy) writeHTTPAttempt(w http.ResponseWriter, r *http.Request, node *nodepool.Node, proxyAuth *auth.ProxyAuth, at *httpAttempt, maxResponse int64) {
+	defer at.Close()
+	host := r.URL.Hostname()
+
+	if maxResponse > 0 && at.resp.ContentLength > maxResponse {
+		p.logger.Warnf("Response from %s via node %s is %d bytes, over the %d byte limit", r.URL.String(), node.ID, at.resp.ContentLength, maxResponse)
+		http.Error(w, limitError("Response", maxResponse), http.StatusBadGateway)
+		p.authenticator.RecordUsage(proxyAuth.Customer.ID, at.up.n+at.down.n, node.ID, false, node.Country, host)
+		return
 	}
-	w.WriteHeader(httpResp.StatusCode)
-	bodyWritten, _ := io.Copy(w, httpResp.Body)
 
-	// Flush response to client immediately
-	if flusher, ok := w.(http.Flusher); ok {
-		flusher.Flush()
+	copyResponseHeaders(w.Header(), at.resp.Header)
+	w.WriteHeader(at.resp.StatusCode)
+
+	var body io.Reader = at.resp.Body
+	if maxResponse > 0 {
+		body = io.LimitReader(body, maxResponse+1)
 	}
+	buf := make([]byte, tunnelChunkSize)
+	bodyWritten, copyErr := io.CopyBuffer(flushWriter{w: w, rc: http.NewResponseController(w)}, body, buf)
 
-	totalBytes := bytesUp + bytesDown
+	totalBytes := at.up.n + at.down.n
 	p.authenticator.RecordUsage(proxyAuth.Customer.ID, totalBytes, node.ID, true, node.Country, host)
 
 	// Mark this node as proven — it actually completed a request
 	p.nodePool.MarkProven(node.ID)
 
 	p.logger.Infof("HTTP tunnel completed: %s via node %s, status=%d, bytes: up=%d down=%d body=%d",
-		targetURL.String(), node.ID, httpResp.StatusCode, bytesUp, bytesDown, bodyWritten)
-	return true
+		r.URL.String(), node.ID, at.resp.StatusCode, at.up.n, at.down.n, bodyWritten)
+
+	if maxResponse > 0 && bodyWritten > maxResponse {
+		// Status is already out; abort so the client sees a truncated response
+		p.logger.Warnf("Response from %s via node %s exceeded the %d byte limit, aborting", r.URL.String(), node.ID, maxResponse)
+		panic(http.ErrAbortHandler)
+	}
+	if copyErr != nil {
+		p.logger.Warnf("HTTP response body from %s via node %s cut short: %v", r.URL.String(), node.ID, copyErr)
+	}
+}
+
+// rejectRequestBody answers a request whose body is over the limit (413) or
+// could not be read (400)
+func (p *HTTPProxy) rejectRequestBody(w http.ResponseWriter, err error, limit int64) {
+	if isBodyLimit(err) {
+		http.Error(w, limitError("Request", limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	p.logger.Warnf("Failed to read request body: %v", err)
+	http.Error(w, "Failed to read request body", http.StatusBadRequest)
 }
 
 // dialTunnel opens a WebSocket tunnel to node-registration for a single node.
@@ -563,7 +688,7 @@ func (p *HTTPProxy) handleHTTPWithConn(w http.ResponseWriter, r *http.Request, n
 func (p *HTTPProxy) dialTunnel(ctx context.Context, node *nodepool.Node, host, port string) (*websocket.Conn, error) {
 	tunnelURL := strings.Replace(p.nodeRegURL, "http://", "ws://", 1)
 	tunnelURL = strings.Replace(tunnelURL, "https://", "wss://", 1)
-	tunnelURL = fmt.Sprintf("%s/internal/tunnel?node_id=%s&host=%s&port=%s",
+	tunnelURL = fmt.Sprintf("%s/internal/tunnel?node_id=%s&host=%s&port=%s&half_close=1",
 		tunnelURL, node.ID, host, port)
 
 	dialer := websocket.Dialer{
@@ -574,6 +699,8 @@ func (p *HTTPProxy) dialTunnel(ctx context.Context, node *nodepool.Node, host, p
 	// but we can use DialContext via the underlying net.Dialer.
 	dialer.NetDialContext = (&net.Dialer{Timeout: 10 * time.Second}).DialContext
 
+	start := time.Now()
+
 	// Use a channel to bridge gorilla's Dial with our context.
 	type dialResult struct {
 		conn *websocket.Conn
@@ -602,12 +729,13 @@ func (p *HTTPProxy) dialTunnel(ctx context.Context, node *nodepool.Node, host, p
 			return nil, ctx.Err()
 		default:
 		}
+		p.nodePool.ObserveLatency(node.ID, time.Since(start))
 		return res.conn, nil
 	}
 }
 
 // tryTunnelPoolConnect attempts to use a pre-opened tunnel for CONNECT requests.
-func (p *HTTPProxy) tryTunnelPoolConnect(w http.ResponseWriter, r *http.Request, proxyAuth *auth.ProxyAuth) (*nodepool.Node, bool) {
+func (p *HTTPProxy) tryTunnelPoolConnect(w http.ResponseWriter, r *http.Request, proxyAuth *auth.ProxyAuth, selection *nodepool.NodeSelection) (*nodepool.Node, bool) {
 	if p.tunnelPool == nil {
 		return nil, false
 	}
@@ -617,7 +745,7 @@ func (p *HTTPProxy) tryTunnelPoolConnect(w http.ResponseWriter, r *http.Request,
 		return nil, false
 	}
 
-	idle := p.tunnelPool.GetTunnel(proxyAuth.Country)
+	idle, _ := p.tunnelPool.GetTunnel(selection.GeoPolicy().Exact())
 	if idle == nil {
 		return nil, false
 	}
@@ -638,14 +766,16 @@ func (p *HTTPProxy) tryTunnelPoolConnect(w http.ResponseWriter, r *http.Request,
 	}
 
 	p.logger.Infof("CONNECT pre-opened tunnel activated: node %s target %s:%s", idle.NodeID, host, port)
-	p.handleConnectTunnel(w, r, node, proxyAuth, idle.Conn, host, port)
+	p.setExitGeo(w, selection, node)
+	p.handleConnectTunnel(w, r, node, proxyAuth, selection, idle.Conn, host, port)
 	return node, true
 }
 
 // tryTunnelPoolHTTP attempts to use a pre-opened tunnel for plain HTTP requests.
-func (p *HTTPProxy) tryTunnelPoolHTTP(w http.ResponseWriter, r *http.Request, proxyAuth *auth.ProxyAuth) (*nodepool.Node, bool) {
+// Returns a nil attempt when no pooled tunnel could be used.
+func (p *HTTPProxy) tryTunnelPoolHTTP(r *http.Request, selection *nodepool.NodeSelection, tried map[string]bool, deadline time.Time) (*nodepool.Node, *httpAttempt, error) {
 	if p.tunnelPool == nil {
-		return nil, false
+		return nil, nil, nil
 	}
 
 	targetURL := r.URL
@@ -659,9 +789,9 @@ func (p *HTTPProxy) tryTunnelPoolHTTP(w http.ResponseWriter, r *http.Request, pr
 		}
 	}
 
-	idle := p.tunnelPool.GetTunnel(proxyAuth.Country)
+	idle, _ := p.tunnelPool.GetTunnel(selection.GeoPolicy().Exact())
 	if idle == nil {
-		return nil, false
+		return nil, nil, nil
 	}
 
 	p.logger.Infof("HTTP using pre-opened tunnel to node %s for %s:%s", idle.NodeID, host, port)
@@ -670,44 +800,59 @@ func (p *HTTPProxy) tryTunnelPoolHTTP(w http.ResponseWriter, r *http.Request, pr
 	if err := nodepool.ActivateTunnel(idle, host, port); err != nil {
 		p.logger.Warnf("Pre-opened HTTP tunnel activation failed for node %s: %v — falling back to race", idle.NodeID, err)
 		idle.Conn.Close()
-		return nil, false
+		return nil, nil, nil
 	}
 
 	node, err := p.nodePool.GetNodeByID(idle.NodeID)
 	if err != nil || node == nil {
 		node = &nodepool.Node{ID: idle.NodeID, Country: idle.Country}
 	}
+	tried[node.ID] = true
 
 	p.logger.Infof("HTTP pre-opened tunnel activated: node %s target %s:%s", idle.NodeID, host, port)
-	p.handleHTTPWithConn(w, r, node, proxyAuth, idle.Conn, host)
-	return node, true
+	at, err := p.fetchHTTPWithConn(r, node, idle.Conn, deadline)
+	return node, at, err
 }
 
-func (p *HTTPProxy) handleConnectTunnel(w http.ResponseWriter, r *http.Request, node *nodepool.Node, auth *auth.ProxyAuth, wsConn *websocket.Conn, host, port string) {
+func (p *HTTPProxy) handleConnectTunnel(w http.ResponseWriter, r *http.Request, node *nodepool.Node, auth *auth.ProxyAuth, selection *nodepool.NodeSelection, wsConn *websocket.Conn, host, port string) {
 	defer wsConn.Close()
 
-	// Hijack the client connection
-	hijacker, ok := w.(http.Hijacker)
-	if !ok {
-		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
-		return
-	}
+	var clientConn net.Conn
+	var clientBuf io.Reader
+	if r.ProtoMajor == 2 {
+		// HTTP/2 stream: answer 200 and relay over the stream's DATA frames
+		w.WriteHeader(http.StatusOK)
+		stream := newH2StreamConn(w, r)
+		if err := stream.rc.Flush(); err != nil {
+			return
+		}
+		clientConn, clientBuf = stream, stream
+	} else {
+		// Hijack the client connection
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+			return
+		}
 
-	clientConn, clientBuf, err := hijacker.Hijack()
-	if err != nil {
-		http.Error(w, "Failed to hijack connection", http.StatusInternalServerError)
-		return
+		conn, buf, err := hijacker.Hijack()
+		if err != nil {
+			http.Error(w, "Failed to hijack connection", http.StatusInternalServerError)
+			return
+		}
+		clientConn, clientBuf = conn, buf
+
+		// Send 200 Connection established to client
+		clientConn.Write(connectEstablished(w.Header()))
 	}
 	defer clientConn.Close()
 
-	// Send 200 Connection established to client
-	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
-
 	p.logger.Debugf("Tunnel established, starting relay")
 
 	// Relay data bidirectionally
 	var wg sync.WaitGroup
 	var bytesUp, bytesDown int64
+	var clientFirst, targetFirst byte // first bytes each side sent, for block detection
 	wg.Add(2)
 
 	// Client -> WebSocket (to node)
@@ -717,14 +862,21 @@ func (p *HTTPProxy) handleConnectTunnel(w http.ResponseWriter, r *http.Request,
 		for {
 			clientConn.SetReadDeadline(time.Now().Add(60 * time.Second))
 			n, err := clientBuf.Read(buf)
+			if err == io.EOF {
+				// Client shut down its write side — half-close towards the node
+				// and keep relaying the response until the target is done too
+				wsConn.WriteMessage(websocket.TextMessage, []byte(tunnelFINMessage))
+				return
+			}
 			if err != nil {
-				if err != io.EOF {
-					p.logger.Debugf("Client read error: %v", err)
-				}
+				p.logger.Debugf("Client read error: %v", err)
 				wsConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 				return
 			}
 			if n > 0 {
+				if bytesUp == 0 {
+					clientFirst = buf[0]
+				}
 				bytesUp += int64(n)
 				if err := wsConn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
 					p.logger.Debugf("WebSocket write error: %v", err)
@@ -746,7 +898,18 @@ func (p *HTTPProxy) handleConnectTunnel(w http.ResponseWriter, r *http.Request,
 				}
 				return
 			}
-			if messageType == websocket.BinaryMessage || messageType == websocket.TextMessage {
+			if isTunnelFIN(messageType, data) {
+				// Target finished sending — half-close the client (TCP FIN,
+				// or END_STREAM on HTTP/2 once the client has finished too)
+				if cw, ok := clientConn.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+				}
+				return
+			}
+			if (messageType == websocket.BinaryMessage || messageType == websocket.TextMessage) && len(data) > 0 {
+				if bytesDown == 0 {
+					targetFirst = data[0]
+				}
 				bytesDown += int64(len(data))
 				clientConn.SetWriteDeadline(time.Now().Add(30 * time.Second))
 				if _, err := clientConn.Write(data); err != nil {
@@ -762,8 +925,14 @@ func (p *HTTPProxy) handleConnectTunnel(w http.ResponseWriter, r *http.Request,
 	totalBytes := bytesUp + bytesDown
 	p.logger.Infof("CONNECT tunnel closed: %s:%s via node %s, bytes: up=%d down=%d", host, port, node.ID, bytesUp, bytesDown)
 	
-	// Blacklist nodes that can't route traffic (very low response = tunnel failed)
-	if bytesDown < 100 && bytesUp > 100 {
+	block := classifyTLS(clientFirst, targetFirst, bytesUp, bytesDown)
+	if block != "" {
+		p.reportBlock(auth, selection, node, r.Host, block, 0)
+	}
+
+	// Blacklist nodes that can't route traffic (very low response = tunnel
+	// failed). An alert means the node reached the target, which refused it.
+	if bytesDown < 100 && bytesUp > 100 && block != blockTLSAlert {
 		p.logger.Warnf("Node %s returned only %d bytes — blacklisting for 15 min", node.ID, bytesDown)
 		p.nodePool.BlacklistNode(node.ID, 15*time.Minute)
 	}
@@ -772,249 +941,6 @@ func (p *HTTPProxy) handleConnectTunnel(w http.ResponseWriter, r *http.Request,
 	p.authenticator.RecordUsage(auth.Customer.ID, totalBytes, node.ID, bytesDown >= 100, node.Country, host)
 }
 
-func (p *HTTPProxy) handleHTTP(w http.ResponseWriter, r *http.Request, node *nodepool.Node, auth *auth.ProxyAuth) {
-	// Use WebSocket tunnel (same as CONNECT) - raw TCP streaming, no base64
-	targetURL := r.URL
-	if !targetURL.IsAbs() {
-		http.Error(w, "Absolute URL required", http.StatusBadRequest)
-		return
-	}
-
-	host := targetURL.Hostname()
-	port := targetURL.Port()
-	if port == "" {
-		port = "80"
-	}
-
-	p.logger.Infof("HTTP tunnel request to %s via node %s (%s)", targetURL.String(), node.ID, node.IPAddress)
-
-	// Connect to node-registration tunnel WebSocket
-	tunnelURL := strings.Replace(p.nodeRegURL, "http://", "ws://", 1)
-	tunnelURL = strings.Replace(tunnelURL, "https://", "wss://", 1)
-	tunnelURL = fmt.Sprintf("%s/internal/tunnel?node_id=%s&host=%s&port=%s", tunnelURL, node.ID, host, port)
-
-	dialer := websocket.Dialer{
-		HandshakeTimeout: 15 * time.Second,
-	}
-	wsConn, _, err := dialer.Dial(tunnelURL, nil)
-	if err != nil {
-		p.logger.Errorf("Failed to connect to tunnel WebSocket: %v", err)
-		http.Error(w, "Failed to establish tunnel", http.StatusBadGateway)
-		return
-	}
-	defer wsConn.Close()
-
-	// Build raw HTTP request
-	var reqBuf bytes.Buffer
-	
-	// Request line: GET /path HTTP/1.1
-	path := targetURL.RequestURI()
-	if path == "" {
-		path = "/"
-	}
-	reqBuf.WriteString(fmt.Sprintf("%s %s HTTP/1.1\r\n", r.Method, path))
-	
-	// Host header
-	reqBuf.WriteString(fmt.Sprintf("Host: %s\r\n", targetURL.Host))
-	
-	// Copy other headers (excluding proxy-specific)
-	for name, values := range r.Header {
-		lowerName := strings.ToLower(name)
-		if lowerName == "proxy-authorization" || lowerName == "proxy-connection" {
-			continue
-		}
-		for _, v := range values {
-			reqBuf.WriteString(fmt.Sprintf("%s: %s\r\n", name, v))
-		}
-	}
-	
-	// Read request body
-	var bodyBytes []byte
-	if r.Body != nil {
-		bodyBytes, _ = io.ReadAll(r.Body)
-	}
-	
-	// Add Content-Length if body exists
-	if len(bodyBytes) > 0 {
-		reqBuf.WriteString(fmt.Sprintf("Content-Length: %d\r\n", len(bodyBytes)))
-	}
-	
-	// End headers
-	reqBuf.WriteString("\r\n")
-	
-	// Add body
-	if len(bodyBytes) > 0 {
-		reqBuf.Write(bodyBytes)
-	}
-
-	// Send raw HTTP request through tunnel
-	if err := wsConn.WriteMessage(websocket.BinaryMessage, reqBuf.Bytes()); err != nil {
-		p.logger.Errorf("Failed to send request through tunnel: %v", err)
-		http.Error(w, "Failed to send request", http.StatusBadGateway)
-		return
-	}
-	
-	bytesUp := int64(reqBuf.Len())
-
-	// Read response from tunnel - for HTTP we expect a single response chunk
-	var respBuf bytes.Buffer
-	bytesDown := int64(0)
-	
-	// First read - wait for response with longer timeout
-	wsConn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	messageType, data, err := wsConn.ReadMessage()
-	if err != nil {
-		p.logger.Errorf("Failed to read response from tunnel: %v", err)
-		http.Error(w, "Failed to read response", http.StatusBadGateway)
-		return
-	}
-	if messageType == websocket.BinaryMessage || messageType == websocket.TextMessage {
-		respBuf.Write(data)
-		bytesDown += int64(len(data))
-	}
-
-	// Try to read more with short timeout (for chunked responses)
-	for {
-		wsConn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
-		messageType, data, err := wsConn.ReadMessage()
-		if err != nil {
-			break // Timeout or close - we have enough data
-		}
-		if messageType == websocket.CloseMessage {
-			break
-		}
-		if messageType == websocket.BinaryMessage || messageType == websocket.TextMessage {
-			respBuf.Write(data)
-			bytesDown += int64(len(data))
-		}
-	}
-
-	// Parse HTTP response
-	respReader := bufio.NewReader(&respBuf)
-	httpResp, err := http.ReadResponse(respReader, r)
-	if err != nil {
-		p.logger.Errorf("Failed to parse HTTP response: %v", err)
-		// Fallback: write raw response
-		w.WriteHeader(http.StatusBadGateway)
-		w.Write(respBuf.Bytes())
-		return
-	}
-	defer httpResp.Body.Close()
-
-	// Copy response headers
-	for name, values := range httpResp.Header {
-		for _, v := range values {
-			w.Header().Add(name, v)
-		}
-	}
-
-	// Write status code
-	w.WriteHeader(httpResp.StatusCode)
-
-	// Copy response body
-	bodyWritten, _ := io.Copy(w, httpResp.Body)
-
-	// Record usage with country and target host
-	totalBytes := bytesUp + bytesDown
-	p.authenticator.RecordUsage(auth.Customer.ID, totalBytes, node.ID, true, node.Country, host)
-
-	p.logger.Infof("HTTP tunnel completed: %s via node %s, status=%d, bytes: up=%d down=%d body=%d", 
-		targetURL.String(), node.ID, httpResp.StatusCode, bytesUp, bytesDown, bodyWritten)
-}
-
-// ProxyRequestPayload for internal proxy API
-type ProxyRequestPayload struct {
-	NodeID    string            `json:"node_id"`
-	Host      string            `json:"host"`
-	Port      string            `json:"port"`
-	Method    string            `json:"method,omitempty"`
-	URL       string            `json:"url,omitempty"`
-	Headers   map[string]string `json:"headers,omitempty"`
-	Body      string            `json:"body,omitempty"`
-	TimeoutMs int               `json:"timeout_ms"`
-}
-
-// ProxyResponsePayload from internal proxy API
-type ProxyResponsePayload struct {
-	Success    bool              `json:"success"`
-	StatusCode int               `json:"status_code,omitempty"`
-	Headers    map[string]string `json:"headers,omitempty"`
-	Body       string            `json:"body,omitempty"`
-	Error      string            `json:"error,omitempty"`
-	BytesRead  int64             `json:"bytes_read"`
-	BytesWrite int64             `json:"bytes_write"`
-	LatencyMs  int64             `json:"latency_ms"`
-}
-
-// proxyThroughNode sends an HTTP request through a node via the node-registration service
-func (p *HTTPProxy) proxyThroughNode(node *nodepool.Node, method, targetURL string, headers map[string]string, body []byte) (*ProxyResponsePayload, error) {
-	p.logger.Infof("Routing HTTP request to %s via node %s (%s, %s)", targetURL, node.ID, node.IPAddress, node.Country)
-
-	// Parse the URL to get host and port
-	parsedURL, err := url.Parse(targetURL)
-	if err != nil {
-		return nil, fmt.Errorf("invalid URL: %v", err)
-	}
-
-	host := parsedURL.Hostname()
-	port := parsedURL.Port()
-	if port == "" {
-		if parsedURL.Scheme == "https" {
-			port = "443"
-		} else {
-			port = "80"
-		}
-	}
-
-	payload := ProxyRequestPayload{
-		NodeID:    node.ID,
-		Host:      host,
-		Port:      port,
-		Method:    method,
-		URL:       targetURL,
-		Headers:   headers,
-		TimeoutMs: 30000,
-	}
-
-	if body != nil {
-		payload.Body = base64.StdEncoding.EncodeToString(body)
-	}
-
-	payloadJSON, err := json.Marshal(payload)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %v", err)
-	}
-
-	// Send to node-registration internal API
-	url := p.nodeRegURL + "/internal/proxy"
-	p.logger.Debugf("Calling node-registration at: %s", url)
-	
-	resp, err := p.httpClient.Post(
-		url,
-		"application/json",
-		bytes.NewReader(payloadJSON),
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to call node-registration: %v", err)
-	}
-	defer resp.Body.Close()
-
-	// Read response body for debugging
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
-	}
-	
-	p.logger.Debugf("Response from node-registration: status=%d, body=%s", resp.StatusCode, string(bodyBytes))
-
-	var proxyResp ProxyResponsePayload
-	if err := json.Unmarshal(bodyBytes, &proxyResp); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %v (body: %s)", err, string(bodyBytes))
-	}
-
-	return &proxyResp, nil
-}
-
 func (p *HTTPProxy) connectThroughNode(node *nodepool.Node, host, port string) (net.Conn, error) {
 	// For TCP tunnel (CONNECT), we still need a direct connection approach
 	// This is more complex as it requires streaming through WebSocket
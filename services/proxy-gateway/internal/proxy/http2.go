@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// HTTP/2 listener. Every stream is an independent proxy request and goes
+// through ServeHTTP, so auth, geo targeting, racing and metrics apply per
+// stream. CONNECT comes in two shapes:
+//
+//   classic CONNECT   :method CONNECT, :authority host:port (RFC 9113 §8.5)
+//   extended CONNECT  :protocol connect-tcp, target in :path (RFC 8441 / 9298)
+//
+// Extended CONNECT needs GODEBUG=http2xconnect=1 until x/net enables it by
+// default; classic CONNECT always works.
+
+// connectTCPProtocol is the :protocol token for TCP tunnels via extended CONNECT
+const connectTCPProtocol = "connect-tcp"
+
+// NewHTTP2Server returns a server for the HTTP/2 listener. With a TLS config
+// it negotiates h2 (falling back to http/1.1) via ALPN; without one it speaks
+// h2c, both prior-knowledge and Upgrade.
+func (p *HTTPProxy) NewHTTP2Server(tlsConfig *tls.Config) (*http.Server, error) {
+	h2s := &http2.Server{
+		MaxConcurrentStreams: 250,
+		IdleTimeout:          5 * time.Minute,
+	}
+
+	srv := &http.Server{
+		Handler:           http.HandlerFunc(p.serveHTTP2),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if tlsConfig != nil {
+		srv.TLSConfig = tlsConfig.Clone()
+		if len(srv.TLSConfig.NextProtos) == 0 {
+			srv.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+		if err := http2.ConfigureServer(srv, h2s); err != nil {
+			return nil, fmt.Errorf("configure http2: %w", err)
+		}
+		return srv, nil
+	}
+
+	srv.Handler = h2c.NewHandler(srv.Handler, h2s)
+	return srv, nil
+}
+
+// serveHTTP2 normalises HTTP/2 proxy requests into the shape ServeHTTP
+// expects — CONNECT target in r.Host, absolute URL for plain requests.
+func (p *HTTPProxy) serveHTTP2(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		p.ServeHTTP(w, r)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		if proto := r.Header.Get(":protocol"); proto != "" {
+			if proto != connectTCPProtocol {
+				http.Error(w, "Unsupported CONNECT protocol", http.StatusNotImplemented)
+				return
+			}
+			target, err := connectTCPTarget(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.Host = target
+			r.Header.Del(":protocol")
+		}
+	} else if !r.URL.IsAbs() {
+		r.URL.Scheme = "http"
+		r.URL.Host = r.Host
+	}
+
+	p.ServeHTTP(w, r)
+}
+
+// connectTCPTarget extracts host:port from an extended CONNECT :path. Accepts
+// the well-known template /.well-known/masque/tcp/{host}/{port}/ and query
+// forms ?h=&p= or ?target_host=&tcp_port=.
+func connectTCPTarget(r *http.Request) (string, error) {
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/.well-known/masque/tcp/"); ok {
+		parts := strings.Split(strings.Trim(rest, "/"), "/")
+		if len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+			return net.JoinHostPort(parts[0], parts[1]), nil
+		}
+	}
+
+	q := r.URL.Query()
+	host, port := q.Get("h"), q.Get("p")
+	if host == "" {
+		host, port = q.Get("target_host"), q.Get("tcp_port")
+	}
+	if host == "" || port == "" {
+		return "", fmt.Errorf("connect-tcp target missing")
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// errStreamWriteClosed is returned by writes after CloseWrite
+var errStreamWriteClosed = errors.New("http2 stream: write side closed")
+
+// h2StreamConn adapts an HTTP/2 CONNECT stream to net.Conn so the tunnel
+// relay can treat it like a hijacked HTTP/1.1 connection. Reads come from
+// the request body, writes are flushed as DATA frames.
+type h2StreamConn struct {
+	w           http.ResponseWriter
+	r           *http.Request
+	rc          *http.ResponseController
+	writeClosed atomic.Bool
+}
+
+func newH2StreamConn(w http.ResponseWriter, r *http.Request) *h2StreamConn {
+	return &h2StreamConn{w: w, r: r, rc: http.NewResponseController(w)}
+}
+
+func (c *h2StreamConn) Read(b []byte) (int, error) {
+	return c.r.Body.Read(b)
+}
+
+func (c *h2StreamConn) Write(b []byte) (int, error) {
+	if c.writeClosed.Load() {
+		return 0, errStreamWriteClosed
+	}
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.rc.Flush()
+}
+
+// Close ends the request side; the response side ends when the handler returns
+func (c *h2StreamConn) Close() error {
+	return c.r.Body.Close()
+}
+
+// CloseWrite passes a target half-close on as the stream's END_STREAM. The
+// server only sends END_STREAM once the handler returns, so this flushes what
+// was written and refuses further writes; the request body stays open, and
+// the CONNECT relay returns once the client has finished sending too.
+func (c *h2StreamConn) CloseWrite() error {
+	if !c.writeClosed.CompareAndSwap(false, true) {
+		return nil
+	}
+	return c.rc.Flush()
+}
+
+func (c *h2StreamConn) LocalAddr() net.Addr {
+	if addr, ok := c.r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return nil
+}
+
+func (c *h2StreamConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.r.RemoteAddr)
+	return addr
+}
+
+func (c *h2StreamConn) SetDeadline(t time.Time) error {
+	if err := c.rc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.rc.SetWriteDeadline(t)
+}
+
+func (c *h2StreamConn) SetReadDeadline(t time.Time) error  { return c.rc.SetReadDeadline(t) }
+func (c *h2StreamConn) SetWriteDeadline(t time.Time) error { return c.rc.SetWriteDeadline(t) }
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"proxy-gateway/internal/auth"
+)
+
+// Plain HTTP requests stream through the tunnel in both directions, so memory
+// per request stays at a few buffers regardless of payload size. Only request
+// bodies up to retryBodyBuffer are held in full, so retries can replay them;
+// larger uploads are sent once.
+
+const (
+	// retryBodyBuffer is the largest request body kept in memory for replay
+	retryBodyBuffer = 1 << 20
+	// tunnelChunkSize is the buffer size, and so the largest WS frame, used
+	// when streaming bodies through a tunnel
+	tunnelChunkSize = 32 << 10
+)
+
+// hopHeaders are connection-scoped and never forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// bufferForReplay caps the request body at limit and buffers it when small
+// enough to replay. Bodies over retryBodyBuffer keep streaming and come back
+// with GetBody unset. A declared or read size over limit returns
+// *http.MaxBytesError.
+func bufferForReplay(w http.ResponseWriter, r *http.Request, limit int64) (*http.Request, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return r, nil
+	}
+	if limit > 0 && r.ContentLength > limit {
+		return nil, &http.MaxBytesError{Limit: limit}
+	}
+
+	body := r.Body
+	if limit > 0 {
+		body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	head, err := io.ReadAll(io.LimitReader(body, retryBodyBuffer+1))
+	if err != nil {
+		return nil, err
+	}
+
+	r = r.Clone(r.Context())
+	if len(head) <= retryBodyBuffer {
+		r.ContentLength = int64(len(head))
+		r.Body = io.NopCloser(bytes.NewReader(head))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(head)), nil
+		}
+		return r, nil
+	}
+
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(head), body), body}
+	r.GetBody = nil
+	return r, nil
+}
+
+// replayable reports whether the request body can be sent again
+func replayable(r *http.Request) bool {
+	return r.Body == nil || r.Body == http.NoBody || r.GetBody != nil
+}
+
+// outboundRequest prepares a proxy request to be written to the target
+// through a tunnel. Each tunnel carries one request, so it asks the target to
+// close afterwards, which also ends bodies that have no length framing.
+func outboundRequest(r *http.Request) *http.Request {
+	out := r.Clone(r.Context())
+	out.Body = r.Body
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+	// Request.Write adds Go's User-Agent unless one is present, even empty
+	if _, ok := out.Header["User-Agent"]; !ok {
+		out.Header["User-Agent"] = []string{""}
+	}
+	out.Close = true
+	out.RequestURI = ""
+	return out
+}
+
+// copyResponseHeaders copies end-to-end response headers to the client
+func copyResponseHeaders(dst, src http.Header) {
+	for name, values := range src {
+		for _, v := range values {
+			dst.Add(name, v)
+		}
+	}
+	for _, h := range hopHeaders {
+		dst.Del(h)
+	}
+}
+
+// limitError describes a body cap for the client
+func limitError(what string, limit int64) string {
+	return fmt.Sprintf("%s body exceeds the %d MB limit for this account", what, limit>>20)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// flushWriter pushes every chunk to the client as it arrives
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if err == nil {
+		f.rc.Flush()
+	}
+	return n, err
+}
+
+func bodyLimitsFor(proxyAuth *auth.ProxyAuth) (request, response int64) {
+	return auth.BodyLimits(proxyAuth.Plan)
+}
+
+// isBodyLimit reports whether err came from a request body cap
+func isBodyLimit(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"proxy-gateway/internal/auth"
+	"proxy-gateway/internal/nodepool"
+)
+
+// headerPin says why a request pinned with ip- or node- couldn't use its
+// node: not-found, offline, blacklisted, busy or not-allowed
+const headerPin = "X-IPLoop-Pin"
+
+// applyPin restricts the selection to the node or exit IP the request pins,
+// within the plan's countries
+func applyPin(selection *nodepool.NodeSelection, proxyAuth *auth.ProxyAuth) {
+	if proxyAuth.PinNode == "" && proxyAuth.PinIP == "" {
+		return
+	}
+	selection.Pin = &nodepool.NodePin{NodeID: proxyAuth.PinNode, IP: proxyAuth.PinIP}
+	if plan := proxyAuth.Plan; plan != nil {
+		selection.Pin.AllowedCountries = plan.AllowedCountries
+		selection.Pin.BlockedCountries = plan.BlockedCountries
+	}
+}
+
+// PinnedSelection builds the selection a request pinned to target (a node ID
+// or IP) would make, for availability polls by an authenticated customer
+func PinnedSelection(proxyAuth *auth.ProxyAuth, target string) *nodepool.NodeSelection {
+	pinned := *proxyAuth
+	pinned.PinNode, pinned.PinIP = target, ""
+	if net.ParseIP(target) != nil {
+		pinned.PinNode, pinned.PinIP = "", target
+	}
+	selection := &nodepool.NodeSelection{}
+	applyPoolTier(selection, &pinned, nil)
+	applyPin(selection, &pinned)
+	return selection
+}
+
+// usesOneNode reports whether the request goes through a node chosen up
+// front, a pinned one or a sticky session's, rather than racing candidates
+func usesOneNode(selection *nodepool.NodeSelection, proxyAuth *auth.ProxyAuth) bool {
+	return selection.Pin != nil || (selection.SessionID != "" && proxyAuth.SessionType == "sticky")
+}
+
+// rejectPinned answers a pinned request whose node can't take it, with the
+// reason in X-IPLoop-Pin. It returns false when the selection isn't pinned or
+// the node is available.
+func (p *HTTPProxy) rejectPinned(w http.ResponseWriter, selection *nodepool.NodeSelection) bool {
+	if selection.Pin == nil {
+		return false
+	}
+	_, err := p.nodePool.CheckPin(selection)
+	var pinErr *nodepool.PinError
+	if !errors.As(err, &pinErr) {
+		return false
+	}
+
+	status := http.StatusServiceUnavailable
+	switch pinErr.Reason {
+	case nodepool.PinNotAllowed:
+		status = http.StatusForbidden
+	case nodepool.PinNotFound, nodepool.PinOffline:
+		status = http.StatusBadGateway
+	}
+	w.Header().Set(headerPin, pinErr.Reason)
+	if pinErr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((pinErr.RetryAfter+time.Second-1)/time.Second)))
+	}
+	p.logger.Infof("Rejecting request: %v", pinErr)
+	http.Error(w, pinErr.Error(), status)
+	return true
+}
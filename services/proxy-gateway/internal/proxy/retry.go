@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"proxy-gateway/internal/auth"
+)
+
+// Response headers reporting plain-HTTP retries to the client
+const (
+	headerAttempts     = "X-IPLoop-Attempts"
+	headerRetryReasons = "X-IPLoop-Retry-Reasons"
+)
+
+// errNoTunnel means no node could be reached, so nothing was sent upstream
+var errNoTunnel = errors.New("no tunnel available")
+
+// errRetryBudget means an attempt ran out of the retry policy's time budget
+var errRetryBudget = errors.New("retry time budget exhausted")
+
+// captchaScanLimit bounds how much of a response body is searched for markers
+const captchaScanLimit = 64 << 10
+
+// captchaMarkers identify challenge pages served with a 200
+var captchaMarkers = [][]byte{
+	[]byte("g-recaptcha"),
+	[]byte("hcaptcha.com"),
+	[]byte("challenges.cloudflare.com"),
+	[]byte("/cdn-cgi/challenge-platform"),
+	[]byte("captcha-delivery.com"),
+	[]byte("px-captcha"),
+}
+
+func retryPolicyFor(proxyAuth *auth.ProxyAuth) *auth.RetryPolicy {
+	return auth.ResolveRetryPolicy(proxyAuth.Plan, proxyAuth.Retry)
+}
+
+// retryReason returns why an attempt counts as failed, or "" if it succeeded
+func retryReason(policy *auth.RetryPolicy, at *httpAttempt, err error) string {
+	if at == nil {
+		switch err {
+		case nil, errNoTunnel:
+			return "no-node"
+		case errRetryBudget:
+			return "timeout"
+		}
+		return "error"
+	}
+	if policy.RetryOnStatus(at.resp.StatusCode) {
+		return strconv.Itoa(at.resp.StatusCode)
+	}
+	if policy.RetryOnCaptcha() && looksLikeCaptcha(at) {
+		return auth.RetryOnCaptcha
+	}
+	return ""
+}
+
+// looksLikeCaptcha spots bot challenges by header or by markers near the
+// start of an HTML body
+func looksLikeCaptcha(at *httpAttempt) bool {
+	resp := at.resp
+	if resp.Header.Get("Cf-Mitigated") == "challenge" {
+		return true
+	}
+	if !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return false
+	}
+
+	body := at.peek(captchaScanLimit)
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return false
+		}
+		// The prefix usually ends mid-stream; whatever inflates is enough
+		body, _ = io.ReadAll(io.LimitReader(zr, captchaScanLimit))
+	}
+
+	lower := bytes.ToLower(body)
+	for _, m := range captchaMarkers {
+		if bytes.Contains(lower, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// setRetryHeaders reports how many attempts were made and why earlier ones failed
+func setRetryHeaders(w http.ResponseWriter, attempts int, failures []string) {
+	w.Header().Set(headerAttempts, strconv.Itoa(attempts))
+	if len(failures) > 0 {
+		w.Header().Set(headerRetryReasons, strings.Join(failures, ", "))
+	}
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"proxy-gateway/internal/auth"
+	"proxy-gateway/internal/nodepool"
+)
+
+// headerSelection carries the node selection trace for requests with debug-1
+const headerSelection = "X-IPLoop-Selection"
+
+// setSelectionTrace reports how the exit node was chosen when tracing is on.
+// Plain HTTP and HTTP/2 CONNECT carry it in a header; HTTP/1.1 CONNECT writes
+// its own status line, so there it only reaches the debug log.
+func setSelectionTrace(w http.ResponseWriter, selection *nodepool.NodeSelection) {
+	if selection.Trace == nil || len(selection.Trace.Decisions) == 0 {
+		return
+	}
+	w.Header().Set(headerSelection, selection.Trace.String())
+}
+
+// applyReuseCooldown enforces the plan's exit IP reuse cooldown, scoped to
+// the target's registrable domain when the plan asks for it
+func applyReuseCooldown(selection *nodepool.NodeSelection, proxyAuth *auth.ProxyAuth, target string) {
+	plan := proxyAuth.Plan
+	if plan == nil || plan.IPReuseCooldownSeconds <= 0 || proxyAuth.Customer == nil {
+		return
+	}
+	selection.Reuse = &nodepool.ReuseCooldown{
+		CustomerID: proxyAuth.Customer.ID,
+		Window:     time.Duration(plan.IPReuseCooldownSeconds) * time.Second,
+		Fallback:   plan.IPReuseFallback,
+	}
+	if plan.IPReuseScope == "domain" {
+		selection.Reuse.Domain = nodepool.RegistrableDomain(target)
+	}
+}
+
+// blocksSession reports whether a response status means the site is refusing
+// the session's exit IP
+func blocksSession(status int) bool {
+	return status == http.StatusForbidden || status == http.StatusTooManyRequests
+}
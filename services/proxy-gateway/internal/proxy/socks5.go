@@ -7,6 +7,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/armon/go-socks5"
@@ -16,6 +17,7 @@ import (
 	"proxy-gateway/internal/auth"
 	"proxy-gateway/internal/nodepool"
 	"proxy-gateway/internal/metrics"
+	"proxy-gateway/internal/policy"
 )
 
 type SOCKS5Proxy struct {
@@ -26,6 +28,18 @@ type SOCKS5Proxy struct {
 	logger        *logrus.Entry
 	server        *socks5.Server
 	nodeRegURL    string
+	conns         *socksConnRegistry
+	destinations  *policy.Engine
+	auths         sync.Map // username -> *auth.ProxyAuth, for commands handled outside Dial
+}
+
+// tunnelFINMessage is the half-close control frame on tunnels dialed with
+// half_close=1: we send it when the client shuts down its write side, and
+// node-registration sends it when the target has finished sending.
+const tunnelFINMessage = "fin"
+
+func isTunnelFIN(messageType int, data []byte) bool {
+	return messageType == websocket.TextMessage && string(data) == tunnelFINMessage
 }
 
 // SOCKS5WSConn wraps a WebSocket connection to implement net.Conn for SOCKS5
@@ -68,6 +82,11 @@ func (c *SOCKS5WSConn) Read(b []byte) (int, error) {
 		return 0, io.EOF
 	}
 
+	// Target half-closed — keep the write side open
+	if isTunnelFIN(messageType, data) {
+		return 0, io.EOF
+	}
+
 	if messageType != websocket.BinaryMessage && messageType != websocket.TextMessage {
 		return 0, fmt.Errorf("unexpected message type: %d", messageType)
 	}
@@ -88,6 +107,12 @@ func (c *SOCKS5WSConn) Write(b []byte) (int, error) {
 	return len(b), nil
 }
 
+// CloseWrite forwards a client half-close to the exit node
+func (c *SOCKS5WSConn) CloseWrite() error {
+	c.ws.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	return c.ws.WriteMessage(websocket.TextMessage, []byte(tunnelFINMessage))
+}
+
 func (c *SOCKS5WSConn) Close() error {
 	c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 	return c.ws.Close()
@@ -119,6 +144,22 @@ func NewSOCKS5Proxy(authenticator *auth.Authenticator, nodePool *nodepool.NodePo
 		metrics:       metrics,
 		logger:        logger.WithField("component", "socks5-proxy"),
 		nodeRegURL:    nodeRegURL,
+		conns:         &socksConnRegistry{},
+	}
+
+	udp := &udpRelay{
+		nodeRegURL:    nodeRegURL,
+		authenticator: authenticator,
+		metrics:       metrics,
+		logger:        proxy.logger,
+		route:         proxy.routeCommand,
+	}
+	bind := &bindRelay{
+		nodeRegURL:    nodeRegURL,
+		authenticator: authenticator,
+		metrics:       metrics,
+		logger:        proxy.logger,
+		route:         proxy.routeCommand,
 	}
 
 	// Configure SOCKS5 server
@@ -129,6 +170,14 @@ func NewSOCKS5Proxy(authenticator *auth.Authenticator, nodePool *nodepool.NodePo
 			},
 		},
 		Dial: proxy.dialThroughNode,
+		Rules: &socksCommandRules{
+			conns: proxy.conns,
+			allow: proxy.allowDestination,
+			handlers: map[uint8]socksCommandHandler{
+				socks5.BindCommand:      bind.handleBind,
+				socks5.AssociateCommand: udp.handleAssociate,
+			},
+		},
 	}
 
 	server, err := socks5.New(conf)
@@ -141,7 +190,7 @@ func NewSOCKS5Proxy(authenticator *auth.Authenticator, nodePool *nodepool.NodePo
 }
 
 func (p *SOCKS5Proxy) Serve(listener net.Listener) error {
-	return p.server.Serve(listener)
+	return p.server.Serve(&socksListener{Listener: listener, conns: p.conns})
 }
 
 // Valid implements the socks5 UserPassAuthenticator interface
@@ -180,10 +229,18 @@ func (p *SOCKS5Proxy) dialThroughNode(ctx context.Context, network, addr string)
 
 	// Select node
 	selection := &nodepool.NodeSelection{
-		Country:   auth.Country,
-		City:      auth.City,
-		SessionID: auth.SessionID,
+		Country:        auth.Country,
+		City:           auth.City,
+		ASN:            auth.ASN,
+		ISP:            auth.ISP,
+		ConnectionType: auth.ConnType,
+		SessionID:      auth.SessionID,
+		Near:           nearTarget(auth.Near),
 	}
+	applyGeoPolicy(selection, auth)
+	applyReuseCooldown(selection, auth, host)
+	selection.Burned = p.nodePool.BurnedNodes(host)
+	applyPin(selection, auth)
 
 	node, err := p.nodePool.SelectNode(selection)
 	if err != nil {
@@ -198,6 +255,8 @@ func (p *SOCKS5Proxy) dialThroughNode(ctx context.Context, network, addr string)
 		return nil, err
 	}
 
+	p.nodePool.RecordIPUse(selection, node)
+
 	// Wrap connection to track usage and release node when closed
 	wrappedConn := &trackedConnection{
 		Conn:          conn,
@@ -215,13 +274,46 @@ func (p *SOCKS5Proxy) dialThroughNode(ctx context.Context, network, addr string)
 	return wrappedConn, nil
 }
 
+// routeCommand picks the exit node for a BIND or UDP ASSOCIATE
+func (p *SOCKS5Proxy) routeCommand(req *socks5.Request) (*commandRoute, error) {
+	val, ok := p.auths.Load(socksUsername(req))
+	if !ok {
+		return nil, fmt.Errorf("no authentication context")
+	}
+	auth := val.(*auth.ProxyAuth)
+
+	selection := &nodepool.NodeSelection{
+		Country:        auth.Country,
+		City:           auth.City,
+		ASN:            auth.ASN,
+		ISP:            auth.ISP,
+		ConnectionType: auth.ConnType,
+		SessionID:      auth.SessionID,
+		Near:           nearTarget(auth.Near),
+	}
+	applyGeoPolicy(selection, auth)
+	applyPin(selection, auth)
+	node, err := p.nodePool.SelectNode(selection)
+	if err != nil {
+		return nil, fmt.Errorf("no nodes available")
+	}
+
+	return &commandRoute{
+		nodeID:     node.ID,
+		customerID: auth.Customer.ID,
+		country:    node.Country,
+		release:    func() { p.nodePool.ReleaseNode(node.ID) },
+		allowUDP:   udpDestinationCheck(p.destinations, auth.Customer.ID, auth.Plan),
+	}, nil
+}
+
 func (p *SOCKS5Proxy) connectThroughNode(node *nodepool.Node, host, port string) (net.Conn, error) {
 	p.logger.Infof("SOCKS5 routing to %s:%s via node %s (%s)", host, port, node.ID, node.IPAddress)
 	
 	// Build WebSocket tunnel URL to node-registration service
 	tunnelURL := strings.Replace(p.nodeRegURL, "http://", "ws://", 1)
 	tunnelURL = strings.Replace(tunnelURL, "https://", "wss://", 1)
-	tunnelURL = fmt.Sprintf("%s/internal/tunnel?node_id=%s&host=%s&port=%s", 
+	tunnelURL = fmt.Sprintf("%s/internal/tunnel?node_id=%s&host=%s&port=%s&half_close=1",
 		tunnelURL, node.ID, host, port)
 
 	p.logger.Debugf("SOCKS5 connecting via WebSocket tunnel: %s", tunnelURL)
@@ -249,6 +341,7 @@ var lastAuth *auth.ProxyAuth
 
 func (p *SOCKS5Proxy) storeAuthForConnection(user string, auth *auth.ProxyAuth) {
 	lastAuth = auth
+	p.auths.Store(user, auth)
 }
 
 func (p *SOCKS5Proxy) getLastAuth() *auth.ProxyAuth {
@@ -281,6 +374,14 @@ func (tc *trackedConnection) Write(b []byte) (n int, err error) {
 	return n, err
 }
 
+// CloseWrite passes half-close through so go-socks5 can propagate client FINs
+func (tc *trackedConnection) CloseWrite() error {
+	if cw, ok := tc.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
 func (tc *trackedConnection) Close() error {
 	if !tc.closed {
 		tc.closed = true
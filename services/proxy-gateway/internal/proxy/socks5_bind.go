@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+
+	"proxy-gateway/internal/auth"
+	"proxy-gateway/internal/metrics"
+)
+
+const (
+	// How long the exit node listens for the inbound connection
+	socks5BindTimeout = 30 * time.Second
+	// Time allowed for node-registration to open the listener on the node
+	socks5BindOpenTimeout = 10 * time.Second
+)
+
+// bindRelay serves SOCKS5 BIND. The exit node listens via node-registration's
+// /internal/bind, which reports "bind_ready:<addr>" and later
+// "bind_accepted:<peer>" as text frames before relaying the accepted
+// connection like a CONNECT tunnel. Each maps to one of the two BIND replies.
+type bindRelay struct {
+	nodeRegURL    string
+	authenticator *auth.Authenticator
+	metrics       *metrics.Collector
+	logger        *logrus.Entry
+	route         func(req *socks5.Request) (*commandRoute, error)
+}
+
+func (r *bindRelay) handleBind(ctx context.Context, req *socks5.Request, conn *socksClientConn) {
+	start := time.Now()
+
+	route, err := r.route(req)
+	if err != nil {
+		r.logger.Warnf("SOCKS5 BIND rejected: %v", err)
+		conn.reply(socksReplyNotAllowed, nil)
+		return
+	}
+	defer route.release()
+
+	ws, bound, err := r.dialNode(route.nodeID)
+	if err != nil {
+		r.logger.Errorf("SOCKS5 BIND via node %s failed: %v", route.nodeID, err)
+		conn.reply(socksReplyHostUnreachable, nil)
+		return
+	}
+	defer ws.Close()
+
+	// First reply: where the peer should connect
+	if err := conn.reply(socksReplySucceeded, bound); err != nil {
+		return
+	}
+
+	ws.SetReadDeadline(time.Now().Add(socks5BindTimeout + socks5BindOpenTimeout))
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		conn.reply(socksReplyTTLExpired, nil)
+		return
+	}
+	peerAddr, ok := strings.CutPrefix(string(msg), "bind_accepted:")
+	if !ok {
+		r.logger.Infof("SOCKS5 BIND on %s ended without a peer: %s", bound, string(msg))
+		rep := socksReplyServerFailure
+		if strings.Contains(string(msg), "timeout") {
+			rep = socksReplyTTLExpired
+		}
+		conn.reply(rep, nil)
+		return
+	}
+	ws.SetReadDeadline(time.Time{})
+
+	// Second reply: who connected
+	peer, _ := net.ResolveTCPAddr("tcp", peerAddr)
+	if err := conn.reply(socksReplySucceeded, peer); err != nil {
+		return
+	}
+	r.logger.Infof("SOCKS5 BIND %s accepted %s via node %s", bound, peerAddr, route.nodeID)
+
+	tunnel := &SOCKS5WSConn{ws: ws, logger: r.logger}
+	var up, down int64
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(tunnel, conn.Conn)
+		atomic.AddInt64(&up, n)
+		tunnel.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(conn.Conn, tunnel)
+		atomic.AddInt64(&down, n)
+		if cw, ok := conn.Conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			conn.Conn.Close()
+		}
+	}()
+	wg.Wait()
+
+	total := up + down
+	host, _, _ := net.SplitHostPort(peerAddr)
+	if total > 0 {
+		r.authenticator.RecordUsage(route.customerID, total, route.nodeID, true, route.country, host)
+	}
+	r.metrics.RecordRequest(route.customerID, host, time.Since(start), total > 0)
+	r.logger.Debugf("SOCKS5 BIND closed, transferred %d bytes via node %s", total, route.nodeID)
+}
+
+// dialNode opens the bind WebSocket and waits for the node's listener address
+func (r *bindRelay) dialNode(nodeID string) (*websocket.Conn, *net.TCPAddr, error) {
+	wsURL := strings.Replace(r.nodeRegURL, "http://", "ws://", 1)
+	wsURL = strings.Replace(wsURL, "https://", "wss://", 1)
+	wsURL = fmt.Sprintf("%s/internal/bind?node_id=%s&timeout=%d&half_close=1",
+		wsURL, nodeID, int(socks5BindTimeout/time.Second))
+
+	dialer := websocket.Dialer{
+		HandshakeTimeout: 10 * time.Second,
+	}
+	ws, _, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ws.SetReadDeadline(time.Now().Add(socks5BindOpenTimeout))
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		ws.Close()
+		return nil, nil, fmt.Errorf("bind ready read: %w", err)
+	}
+	addr, ok := strings.CutPrefix(string(msg), "bind_ready:")
+	if !ok {
+		ws.Close()
+		return nil, nil, fmt.Errorf("bind open failed: %s", string(msg))
+	}
+	bound, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		ws.Close()
+		return nil, nil, fmt.Errorf("bad bind address %q: %w", addr, err)
+	}
+	return ws, bound, nil
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/armon/go-socks5"
+)
+
+// go-socks5 only implements CONNECT. For BIND and ASSOCIATE it consults
+// Config.Rules and then replies "command not supported", so socksCommandRules
+// takes those requests over from inside Allow: the handler writes its own
+// replies on the raw client connection and runs the command to completion,
+// then Allow returns false and the library's trailing reply is swallowed.
+
+// SOCKS5 reply codes (RFC 1928 §6)
+const (
+	socksReplySucceeded       uint8 = 0x00
+	socksReplyServerFailure   uint8 = 0x01
+	socksReplyNotAllowed      uint8 = 0x02
+	socksReplyHostUnreachable uint8 = 0x04
+	socksReplyTTLExpired      uint8 = 0x06
+)
+
+type socksCommandHandler func(ctx context.Context, req *socks5.Request, conn *socksClientConn)
+
+// socksCommandRules applies the destination policy to CONNECT and BIND, then
+// routes selected commands to handlers and permits the rest
+type socksCommandRules struct {
+	conns    *socksConnRegistry
+	allow    func(req *socks5.Request) bool
+	handlers map[uint8]socksCommandHandler
+}
+
+func (r *socksCommandRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.Command != socks5.AssociateCommand && r.allow != nil && !r.allow(req) {
+		return ctx, false // go-socks5 replies "not allowed by ruleset"
+	}
+	handler, ok := r.handlers[req.Command]
+	if !ok {
+		return ctx, true
+	}
+	conn := r.conns.lookup(req.RemoteAddr)
+	if conn == nil {
+		return ctx, false
+	}
+	conn.hijack()
+	handler(ctx, req, conn)
+	return ctx, false
+}
+
+// socksConnRegistry maps client addresses to accepted connections, since
+// go-socks5 only hands the rule set the request, not the connection
+type socksConnRegistry struct {
+	conns sync.Map // remote addr -> *socksClientConn
+}
+
+// socksListener registers every accepted connection with the registry
+type socksListener struct {
+	net.Listener
+	conns *socksConnRegistry
+}
+
+func (l *socksListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	sc := &socksClientConn{Conn: c, conns: l.conns}
+	l.conns.conns.Store(c.RemoteAddr().String(), sc)
+	return sc, nil
+}
+
+func (r *socksConnRegistry) lookup(addr *socks5.AddrSpec) *socksClientConn {
+	if addr == nil {
+		return nil
+	}
+	val, ok := r.conns.Load(net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port)))
+	if !ok {
+		return nil
+	}
+	return val.(*socksClientConn)
+}
+
+// socksClientConn is a client connection that a command handler can take over
+type socksClientConn struct {
+	net.Conn
+	conns    *socksConnRegistry
+	hijacked int32
+}
+
+func (c *socksClientConn) hijack() {
+	atomic.StoreInt32(&c.hijacked, 1)
+}
+
+// Write discards library writes once a handler owns the connection
+func (c *socksClientConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.hijacked) == 1 {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+// reply writes a SOCKS5 reply directly to the client
+func (c *socksClientConn) reply(rep uint8, bound net.Addr) error {
+	msg := []byte{0x05, rep, 0x00}
+	msg = appendSOCKSAddr(msg, bound)
+	_, err := c.Conn.Write(msg)
+	return err
+}
+
+// CloseWrite lets go-socks5 half-close CONNECT clients
+func (c *socksClientConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *socksClientConn) Close() error {
+	c.conns.conns.Delete(c.Conn.RemoteAddr().String())
+	return c.Conn.Close()
+}
+
+// commandRoute is the exit node chosen for one BIND or UDP ASSOCIATE
+type commandRoute struct {
+	nodeID     string
+	customerID string
+	country    string
+	release    func()
+	allowUDP   func(host string, port int) bool // destination policy for datagrams, nil allows all
+}
+
+// socksUsername returns the authenticated user for a request, if any
+func socksUsername(req *socks5.Request) string {
+	if req.AuthContext == nil {
+		return ""
+	}
+	return req.AuthContext.Payload["Username"]
+}
+
+// ─── SOCKS5 address encoding ──────────────────────────────────────────────────
+
+const (
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+)
+
+// appendSOCKSAddr appends [atyp][addr][port] for a TCP or UDP address
+func appendSOCKSAddr(b []byte, addr net.Addr) []byte {
+	var ip net.IP
+	port := 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a != nil {
+			ip, port = a.IP, a.Port
+		}
+	case *net.UDPAddr:
+		if a != nil {
+			ip, port = a.IP, a.Port
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil || ip == nil {
+		if ip4 == nil {
+			ip4 = net.IPv4zero.To4()
+		}
+		b = append(b, socksAtypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socksAtypIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+// parseSOCKSAddr splits [atyp][addr][port][data] into host, port and data
+func parseSOCKSAddr(b []byte) (string, int, []byte, error) {
+	if len(b) < 1 {
+		return "", 0, nil, io.ErrUnexpectedEOF
+	}
+	var host string
+	off := 1
+	switch b[0] {
+	case socksAtypIPv4:
+		if len(b) < off+net.IPv4len+2 {
+			return "", 0, nil, io.ErrUnexpectedEOF
+		}
+		host = net.IP(b[off : off+net.IPv4len]).String()
+		off += net.IPv4len
+	case socksAtypIPv6:
+		if len(b) < off+net.IPv6len+2 {
+			return "", 0, nil, io.ErrUnexpectedEOF
+		}
+		host = net.IP(b[off : off+net.IPv6len]).String()
+		off += net.IPv6len
+	case socksAtypDomain:
+		if len(b) < 2 || len(b) < off+1+int(b[1])+2 {
+			return "", 0, nil, io.ErrUnexpectedEOF
+		}
+		host = string(b[off+1 : off+1+int(b[1])])
+		off += 1 + int(b[1])
+	default:
+		return "", 0, nil, fmt.Errorf("unsupported address type %d", b[0])
+	}
+	port := int(binary.BigEndian.Uint16(b[off : off+2]))
+	return host, port, b[off+2:], nil
+}
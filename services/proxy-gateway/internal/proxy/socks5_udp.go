@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+
+	"proxy-gateway/internal/auth"
+	"proxy-gateway/internal/metrics"
+)
+
+const (
+	// Association closes after this long without a datagram in either direction
+	socks5UDPIdleTimeout = 2 * time.Minute
+	// Time allowed for node-registration to bind a UDP socket on the node
+	socks5UDPOpenTimeout = 10 * time.Second
+	// Largest datagram relayed; matches the UDP payload limit
+	socks5UDPMaxDatagram = 65535
+	// Destination policy verdicts remembered per association
+	socks5UDPMaxVerdicts = 1024
+)
+
+// udpRelay serves SOCKS5 UDP ASSOCIATE. Each association gets its own local
+// UDP socket for the client and a WebSocket to node-registration's
+// /internal/udp, which carries one datagram per binary message as
+// [atyp][addr][port][data] — the SOCKS5 UDP header without RSV/FRAG.
+type udpRelay struct {
+	nodeRegURL    string
+	authenticator *auth.Authenticator
+	metrics       *metrics.Collector
+	logger        *logrus.Entry
+	route         func(req *socks5.Request) (*commandRoute, error)
+}
+
+// handleAssociate runs one association until the control connection closes
+// or it goes idle
+func (r *udpRelay) handleAssociate(ctx context.Context, req *socks5.Request, conn *socksClientConn) {
+	start := time.Now()
+
+	route, err := r.route(req)
+	if err != nil {
+		r.logger.Warnf("SOCKS5 UDP associate rejected: %v", err)
+		conn.reply(socksReplyNotAllowed, nil)
+		return
+	}
+	defer route.release()
+
+	ws, err := r.dialNode(route.nodeID)
+	if err != nil {
+		r.logger.Errorf("SOCKS5 UDP associate via node %s failed: %v", route.nodeID, err)
+		conn.reply(socksReplyHostUnreachable, nil)
+		return
+	}
+	defer ws.Close()
+
+	// Bind on the address the client reached us on so BND.ADDR is routable
+	var bindIP net.IP
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		bindIP = local.IP
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: bindIP})
+	if err != nil {
+		r.logger.Errorf("SOCKS5 UDP relay listen failed: %v", err)
+		conn.reply(socksReplyServerFailure, nil)
+		return
+	}
+	defer udpConn.Close()
+
+	if err := conn.reply(socksReplySucceeded, udpConn.LocalAddr()); err != nil {
+		return
+	}
+
+	a := &udpAssociation{
+		relay:    r,
+		client:   conn,
+		udpConn:  udpConn,
+		ws:       ws,
+		clientIP: req.RemoteAddr.IP,
+		allow:    route.allowUDP,
+		done:     make(chan struct{}),
+	}
+	// Clients may announce the address they'll send from; 0.0.0.0:0 means unknown,
+	// and an address other than the control connection's is likely pre-NAT
+	if req.DestAddr != nil && req.DestAddr.Port != 0 && req.DestAddr.IP.Equal(a.clientIP) {
+		a.clientAddr = &net.UDPAddr{IP: req.DestAddr.IP, Port: req.DestAddr.Port}
+	}
+	a.touch()
+
+	r.logger.Infof("SOCKS5 UDP association %s for customer %s via node %s", udpConn.LocalAddr(), route.customerID, route.nodeID)
+	a.run()
+
+	up := atomic.LoadInt64(&a.bytesUp)
+	down := atomic.LoadInt64(&a.bytesDown)
+	success := down > 0
+	target := a.target()
+	if up+down > 0 {
+		r.authenticator.RecordUsage(route.customerID, up+down, route.nodeID, success, route.country, target)
+	}
+	r.metrics.RecordRequest(route.customerID, target, time.Since(start), success)
+	r.logger.Debugf("SOCKS5 UDP association closed, %d bytes up / %d down via node %s", up, down, route.nodeID)
+}
+
+func (r *udpRelay) dialNode(nodeID string) (*websocket.Conn, error) {
+	wsURL := strings.Replace(r.nodeRegURL, "http://", "ws://", 1)
+	wsURL = strings.Replace(wsURL, "https://", "wss://", 1)
+	wsURL = fmt.Sprintf("%s/internal/udp?node_id=%s&idle_timeout=%d",
+		wsURL, nodeID, int(socks5UDPIdleTimeout/time.Second))
+
+	dialer := websocket.Dialer{
+		HandshakeTimeout: 10 * time.Second,
+	}
+	ws, _, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ws.SetReadDeadline(time.Now().Add(socks5UDPOpenTimeout))
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		ws.Close()
+		return nil, fmt.Errorf("udp ready read: %w", err)
+	}
+	if string(msg) != "udp_ready" {
+		ws.Close()
+		return nil, fmt.Errorf("udp open failed: %s", string(msg))
+	}
+	ws.SetReadDeadline(time.Time{})
+	return ws, nil
+}
+
+// udpAssociation is the live state of one ASSOCIATE
+type udpAssociation struct {
+	relay    *udpRelay
+	client   *socksClientConn
+	udpConn  *net.UDPConn
+	ws       *websocket.Conn
+	clientIP net.IP
+	allow    func(host string, port int) bool // nil allows every destination
+	verdicts map[string]bool                  // policy verdicts by host:port, so each is checked and audited once
+
+	mu         sync.Mutex
+	clientAddr *net.UDPAddr
+	firstHost  string
+
+	lastActive int64 // unix nanos
+	bytesUp    int64
+	bytesDown  int64
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (a *udpAssociation) run() {
+	go a.clientToNode()
+	go a.nodeToClient()
+	go func() {
+		// The association lives as long as the TCP control connection
+		io.Copy(io.Discard, a.client.Conn)
+		a.close()
+	}()
+
+	ticker := time.NewTicker(socks5UDPIdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&a.lastActive))) > socks5UDPIdleTimeout {
+				a.relay.logger.Debugf("SOCKS5 UDP association %s idle, closing", a.udpConn.LocalAddr())
+				a.close()
+				return
+			}
+		}
+	}
+}
+
+// clientToNode forwards client datagrams, dropping fragments and strangers
+func (a *udpAssociation) clientToNode() {
+	defer a.close()
+	buf := make([]byte, socks5UDPMaxDatagram)
+	for {
+		n, from, err := a.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !a.acceptFrom(from) {
+			continue
+		}
+		// [2B RSV][1B FRAG][atyp][addr][port][data]; fragmentation isn't supported
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		host, port, _, err := parseSOCKSAddr(buf[3:n])
+		if err != nil {
+			continue
+		}
+		if !a.allowed(host, port) {
+			continue
+		}
+		a.mu.Lock()
+		if a.firstHost == "" {
+			a.firstHost = host
+		}
+		a.mu.Unlock()
+
+		a.ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := a.ws.WriteMessage(websocket.BinaryMessage, buf[3:n]); err != nil {
+			return
+		}
+		atomic.AddInt64(&a.bytesUp, int64(n-3))
+		a.touch()
+	}
+}
+
+// allowed applies the destination policy to a datagram's target, dropping
+// datagrams to blocked ones
+func (a *udpAssociation) allowed(host string, port int) bool {
+	if a.allow == nil {
+		return true
+	}
+	key := net.JoinHostPort(host, strconv.Itoa(port))
+	if ok, seen := a.verdicts[key]; seen {
+		return ok
+	}
+	if a.verdicts == nil || len(a.verdicts) >= socks5UDPMaxVerdicts {
+		a.verdicts = make(map[string]bool)
+	}
+	ok := a.allow(host, port)
+	a.verdicts[key] = ok
+	return ok
+}
+
+// nodeToClient returns datagrams from the node with the SOCKS5 UDP header
+func (a *udpAssociation) nodeToClient() {
+	defer a.close()
+	for {
+		messageType, data, err := a.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+		a.mu.Lock()
+		dst := a.clientAddr
+		a.mu.Unlock()
+		if dst == nil {
+			continue
+		}
+		pkt := make([]byte, 3+len(data))
+		copy(pkt[3:], data)
+		if _, err := a.udpConn.WriteToUDP(pkt, dst); err != nil {
+			return
+		}
+		atomic.AddInt64(&a.bytesDown, int64(len(data)))
+		a.touch()
+	}
+}
+
+// acceptFrom pins the client's UDP address on first use. Only datagrams from
+// the IP that opened the TCP control connection are relayed.
+func (a *udpAssociation) acceptFrom(from *net.UDPAddr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.clientAddr != nil {
+		return a.clientAddr.IP.Equal(from.IP) && a.clientAddr.Port == from.Port
+	}
+	if a.clientIP != nil && !a.clientIP.Equal(from.IP) {
+		return false
+	}
+	a.clientAddr = from
+	return true
+}
+
+func (a *udpAssociation) target() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.firstHost
+}
+
+func (a *udpAssociation) touch() {
+	atomic.StoreInt64(&a.lastActive, time.Now().UnixNano())
+}
+
+func (a *udpAssociation) close() {
+	a.closeOnce.Do(func() {
+		close(a.done)
+		a.udpConn.Close()
+		a.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		a.ws.Close()
+		a.client.Conn.Close()
+	})
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"proxy-gateway/internal/auth"
+	"proxy-gateway/internal/nodepool"
+)
+
+// Tenant holds per-hostname settings for the HTTPS proxy listener. Customers
+// reach their tenant by connecting with its hostname as SNI, e.g.
+// acme.proxy.iploop.com. The tenants file maps hostnames (exact, or wildcard
+// "*.example.com" matching one label) to settings:
+//
+//	{
+//	  "acme.proxy.iploop.com": {"pool_quality_tier": "premium", "customers": ["cus_123"]},
+//	  "*.eu.proxy.iploop.com": {"country": "DE"}
+//	}
+type Tenant struct {
+	// PoolQualityTier overrides AccountPlan.PoolQualityTier for requests on this host
+	PoolQualityTier string `json:"pool_quality_tier"`
+	// MinQualityScore raises the node quality floor beyond what the tier implies
+	MinQualityScore int `json:"min_quality_score"`
+	// Country applies when the client doesn't target one
+	Country string `json:"country"`
+	// Customers restricts the host to these customer IDs (empty allows all)
+	Customers []string `json:"customers"`
+}
+
+// allows reports whether a customer may use this tenant's hostname
+func (t *Tenant) allows(customerID string) bool {
+	if len(t.Customers) == 0 {
+		return true
+	}
+	for _, c := range t.Customers {
+		if c == customerID {
+			return true
+		}
+	}
+	return false
+}
+
+// TenantRouter resolves SNI hostnames to tenants, reloading its file on change
+type TenantRouter struct {
+	file   string
+	logger *logrus.Entry
+
+	mu      sync.RWMutex
+	tenants map[string]*Tenant
+	modTime time.Time
+}
+
+func NewTenantRouter(file string, logger *logrus.Entry) (*TenantRouter, error) {
+	tr := &TenantRouter{
+		file:   file,
+		logger: logger.WithField("component", "tenants"),
+	}
+	if err := tr.Reload(); err != nil {
+		return nil, err
+	}
+	return tr, nil
+}
+
+// Reload reads the tenants file
+func (tr *TenantRouter) Reload() error {
+	modTime := latestModTime(tr.file)
+	data, err := os.ReadFile(tr.file)
+	if err != nil {
+		return fmt.Errorf("read tenants file: %w", err)
+	}
+
+	var raw map[string]*Tenant
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("parse tenants file %s: %w", tr.file, err)
+	}
+	tenants := make(map[string]*Tenant, len(raw))
+	for host, t := range raw {
+		if t == nil {
+			continue
+		}
+		t.Country = strings.ToUpper(t.Country)
+		tenants[strings.ToLower(host)] = t
+	}
+
+	tr.mu.Lock()
+	tr.tenants = tenants
+	tr.modTime = modTime
+	tr.mu.Unlock()
+
+	tr.logger.Infof("Loaded %d SNI tenants from %s", len(tenants), tr.file)
+	return nil
+}
+
+// Lookup returns the tenant for an SNI hostname, or nil
+func (tr *TenantRouter) Lookup(serverName string) *Tenant {
+	if serverName == "" {
+		return nil
+	}
+	host := strings.ToLower(strings.TrimSuffix(serverName, "."))
+
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	if t, ok := tr.tenants[host]; ok {
+		return t
+	}
+	if i := strings.IndexByte(host, '.'); i > 0 {
+		if t, ok := tr.tenants["*"+host[i:]]; ok {
+			return t
+		}
+	}
+	return nil
+}
+
+// Watch reloads the file whenever it changes, until stop is closed
+func (tr *TenantRouter) Watch(stop <-chan struct{}) {
+	watchFiles(stop, func() {
+		tr.mu.RLock()
+		seen := tr.modTime
+		tr.mu.RUnlock()
+		if !latestModTime(tr.file).After(seen) {
+			return
+		}
+		if err := tr.Reload(); err != nil {
+			tr.logger.Errorf("Tenants reload failed, keeping previous: %v", err)
+		}
+	})
+}
+
+// SetTenantRouter enables SNI tenant routing on TLS connections
+func (p *HTTPProxy) SetTenantRouter(tr *TenantRouter) {
+	p.tenants = tr
+}
+
+// tenantFor returns the tenant selected by the request's SNI, if any
+func (p *HTTPProxy) tenantFor(r *http.Request) *Tenant {
+	if p.tenants == nil || r.TLS == nil {
+		return nil
+	}
+	return p.tenants.Lookup(r.TLS.ServerName)
+}
+
+// applyPoolTier narrows node selection to the pool tier in effect: the
+// tenant's when the request arrived on a tenant hostname, otherwise the
+// customer's plan tier. The tier also picks the selection strategy unless the
+// request names one.
+func applyPoolTier(selection *nodepool.NodeSelection, proxyAuth *auth.ProxyAuth, tenant *Tenant) {
+	tier := ""
+	minScore := 0
+	if proxyAuth.Plan != nil {
+		tier = proxyAuth.Plan.PoolQualityTier
+		minScore = proxyAuth.Plan.MinNodeQualityScore
+	}
+	if tenant != nil {
+		if tenant.PoolQualityTier != "" {
+			tier = tenant.PoolQualityTier
+		}
+		if tenant.MinQualityScore > minScore {
+			minScore = tenant.MinQualityScore
+		}
+	}
+	if tierScore := nodepool.TierMinQualityScore(tier); tierScore > minScore {
+		minScore = tierScore
+	}
+	selection.MinQualityScore = minScore
+	selection.Strategy = nodepool.TierStrategy(tier)
+	if nodepool.IsStrategy(proxyAuth.Strategy) {
+		selection.Strategy = proxyAuth.Strategy
+	}
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reloadInterval is how often certificate and tenant files are checked for changes
+const reloadInterval = 30 * time.Second
+
+// CertReloader serves a certificate pair from disk and picks up replacements
+// (e.g. a renewed Let's Encrypt cert) without a restart. A failed reload keeps
+// the previous certificate.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	logger   *logrus.Entry
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func NewCertReloader(certFile, keyFile string, logger *logrus.Entry) (*CertReloader, error) {
+	cr := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger.WithField("component", "tls"),
+	}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Reload loads the certificate pair from disk
+func (cr *CertReloader) Reload() error {
+	modTime := latestModTime(cr.certFile, cr.keyFile)
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate %s: %w", cr.certFile, err)
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.mu.Unlock()
+
+	cr.logger.Infof("Loaded TLS certificate %s", cr.certFile)
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// TLSConfig returns a server config backed by the reloader
+func (cr *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: cr.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// Watch reloads the pair whenever either file changes, until stop is closed
+func (cr *CertReloader) Watch(stop <-chan struct{}) {
+	watchFiles(stop, func() {
+		cr.mu.RLock()
+		seen := cr.modTime
+		cr.mu.RUnlock()
+		if !latestModTime(cr.certFile, cr.keyFile).After(seen) {
+			return
+		}
+		if err := cr.Reload(); err != nil {
+			cr.logger.Errorf("TLS certificate reload failed, keeping previous: %v", err)
+		}
+	})
+}
+
+// watchFiles runs check every reloadInterval until stop is closed
+func watchFiles(stop <-chan struct{}, check func()) {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
+
+// latestModTime returns the newest modification time among files that exist
+func latestModTime(files ...string) time.Time {
+	var latest time.Time
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
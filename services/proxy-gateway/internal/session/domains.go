@@ -0,0 +1,188 @@
+package session
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"proxy-gateway/internal/nodepool"
+)
+
+// Session stickiness scopes
+const (
+	ScopeSession = "session" // one exit node for every target
+	ScopeDomain  = "domain"  // one exit node per target registrable domain
+)
+
+// DomainBinding is a domain-scoped session's exit node for one site
+type DomainBinding struct {
+	NodeID       string    `json:"node_id"`
+	NodeIP       string    `json:"node_ip"`
+	Country      string    `json:"country,omitempty"`
+	BoundAt      time.Time `json:"bound_at"`
+	RequestCount int64     `json:"request_count"`
+}
+
+// NodeFor returns the exit node a session uses for target (host or
+// host:port). Domain-scoped sessions bind a node to the target's eTLD+1 on
+// first use and keep it until that binding rotates.
+func (sm *SessionManager) NodeFor(session *Session, target string) (nodeID, nodeIP string, err error) {
+	if session.Scope != ScopeDomain {
+		session.mutex.RLock()
+		defer session.mutex.RUnlock()
+		return session.CurrentNodeID, session.CurrentNodeIP, nil
+	}
+
+	domain := nodepool.RegistrableDomain(target)
+	session.mutex.Lock()
+	if b, ok := session.Bindings[domain]; ok {
+		b.RequestCount++
+		session.mutex.Unlock()
+		return b.NodeID, b.NodeIP, nil
+	}
+	session.mutex.Unlock()
+
+	// Prefer a node the session isn't already using for another site
+	selection := sm.selectionFor(session)
+	var node *nodepool.Node
+	for attempt := 0; attempt < 3; attempt++ {
+		n, err := sm.nodePool.SelectNode(selection)
+		if err != nil {
+			if node == nil {
+				return "", "", fmt.Errorf("no suitable nodes available: %v", err)
+			}
+			break
+		}
+		if node != nil {
+			sm.nodePool.ReleaseNode(node.ID)
+		}
+		node = n
+		if !sm.boundElsewhere(session, n.ID) {
+			break
+		}
+	}
+	sm.nodePool.RecordIPUse(selection, node)
+
+	var bound DomainBinding
+	session, err = sm.update(session, func(s *Session) bool {
+		if s.Bindings == nil {
+			s.Bindings = make(map[string]*DomainBinding)
+		}
+		if b, ok := s.Bindings[domain]; ok {
+			// Another request or gateway bound the domain while we were selecting
+			bound = *b
+			return false
+		}
+		s.Bindings[domain] = &DomainBinding{
+			NodeID:       node.ID,
+			NodeIP:       node.IPAddress,
+			Country:      node.Country,
+			BoundAt:      time.Now(),
+			RequestCount: 1,
+		}
+		s.NodeHistory = append(s.NodeHistory, NodeAssignment{
+			NodeID:     node.ID,
+			NodeIP:     node.IPAddress,
+			Country:    node.Country,
+			Domain:     domain,
+			Reason:     ReasonBind,
+			AssignedAt: time.Now(),
+		})
+		bound = *s.Bindings[domain]
+		return true
+	})
+	if err != nil {
+		sm.logger.Warnf("Failed to save session %s: %v", session.ID, err)
+	}
+	if bound.NodeID != node.ID {
+		sm.nodePool.ReleaseNode(node.ID)
+		return bound.NodeID, bound.NodeIP, nil
+	}
+	sm.logger.Debugf("Bound %s to node %s (%s) in session %s", domain, node.ID, node.IPAddress, session.ID)
+	return node.ID, node.IPAddress, nil
+}
+
+// RotateDomain drops a domain-scoped session's binding for target's site so
+// the next request there gets a fresh node. Other sites keep theirs. Reason
+// goes to the history and the session.rotated event.
+func (sm *SessionManager) RotateDomain(sessionID, target, reason string) error {
+	session := sm.getFromCache(fmt.Sprintf("session:%s", sessionID))
+	if session == nil {
+		return fmt.Errorf("session not found: %s", sessionID)
+	}
+	if session.Scope != ScopeDomain {
+		_, err := sm.rotateNode(session, reason)
+		return err
+	}
+
+	domain := nodepool.RegistrableDomain(target)
+	var released *DomainBinding
+	session, err := sm.update(session, func(s *Session) bool {
+		b, ok := s.Bindings[domain]
+		if !ok {
+			return false
+		}
+		delete(s.Bindings, domain)
+		sm.releaseBinding(s, b)
+		released = b
+		return true
+	})
+	if released != nil {
+		sm.logger.Infof("Rotated %s binding (node %s) in session %s", domain, released.NodeID, sessionID)
+		if err == nil {
+			sm.notifyDomainsRotated(session, reason, map[string]DomainBinding{domain: *released})
+		}
+	}
+	return err
+}
+
+// ReportStatus feeds an upstream response status back to the session. A 403
+// or 429 rotates the binding for that site only.
+func (sm *SessionManager) ReportStatus(sessionID, target string, status int) {
+	if status != http.StatusForbidden && status != http.StatusTooManyRequests {
+		return
+	}
+	session := sm.getFromCache(fmt.Sprintf("session:%s", sessionID))
+	if session == nil || session.Scope != ScopeDomain {
+		return
+	}
+	if err := sm.RotateDomain(sessionID, target, strconv.Itoa(status)); err != nil {
+		sm.logger.Warnf("Failed to rotate %s for session %s: %v", target, sessionID, err)
+	}
+}
+
+// boundElsewhere reports whether the node already serves another site
+func (sm *SessionManager) boundElsewhere(session *Session, nodeID string) bool {
+	session.mutex.RLock()
+	defer session.mutex.RUnlock()
+	for _, b := range session.Bindings {
+		if b.NodeID == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// clearBindings releases every domain binding. Caller holds session.mutex.
+func (sm *SessionManager) clearBindings(session *Session) {
+	for domain, b := range session.Bindings {
+		delete(session.Bindings, domain)
+		sm.releaseBinding(session, b)
+	}
+}
+
+// releaseBinding frees a binding's node and closes its history entry. Caller
+// holds session.mutex.
+func (sm *SessionManager) releaseBinding(session *Session, b *DomainBinding) {
+	for i := len(session.NodeHistory) - 1; i >= 0; i-- {
+		a := &session.NodeHistory[i]
+		if a.NodeID == b.NodeID && a.ReleasedAt == nil {
+			now := time.Now()
+			a.ReleasedAt = &now
+			a.RequestCount = b.RequestCount
+			break
+		}
+	}
+	sm.nodePool.ReleaseNode(b.NodeID)
+}
@@ -0,0 +1,67 @@
+package session
+
+import (
+	"fmt"
+	"time"
+)
+
+// Sessions move between deployments (a blue/green switch, a region
+// migration) by exporting them from one store and importing them into the
+// other. Node IDs are global, so an imported session keeps its exit node.
+
+// ImportResult reports what ImportSessions did with each exported session
+type ImportResult struct {
+	Imported int      `json:"imported"`
+	Skipped  int      `json:"skipped"` // already present and replace not set
+	Expired  int      `json:"expired"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// ExportSessions returns every live session in the store, whichever gateway
+// created it
+func (sm *SessionManager) ExportSessions() ([]*Session, error) {
+	return sm.store.List()
+}
+
+// ImportSessions writes exported sessions into the store. Sessions that
+// already exist are left alone unless replace is set. Gateways holding a
+// cached copy of a replaced session pick up the import on their next request.
+func (sm *SessionManager) ImportSessions(sessions []*Session, replace bool) *ImportResult {
+	result := &ImportResult{}
+	now := time.Now()
+	for _, session := range sessions {
+		if session == nil || session.ID == "" {
+			result.Errors = append(result.Errors, "session without an id")
+			continue
+		}
+		if now.After(session.ExpiresAt) {
+			result.Expired++
+			continue
+		}
+		if replace {
+			// Move the version past the replaced copy so cached copies of it
+			// are seen as stale
+			if existing, err := sm.store.Load(session.ID); err == nil && existing.Version >= session.Version {
+				session.Version = existing.Version + 1
+			}
+			if err := sm.store.Delete(session.ID); err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", session.ID, err))
+				continue
+			}
+		}
+
+		switch err := sm.store.Create(session); err {
+		case nil:
+			result.Imported++
+			// Drop any cached copy so the next request loads the import
+			sm.sessions.Delete(fmt.Sprintf("session:%s", session.ID))
+		case ErrSessionExists:
+			result.Skipped++
+		default:
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", session.ID, err))
+		}
+	}
+	sm.logger.Infof("Imported %d sessions (%d skipped, %d expired, %d failed)",
+		result.Imported, result.Skipped, result.Expired, len(result.Errors))
+	return result
+}
@@ -1,11 +1,10 @@
 package session
 
 import (
-	"context"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,12 +13,15 @@ import (
 
 	"proxy-gateway/internal/auth"
 	"proxy-gateway/internal/nodepool"
+	"proxy-gateway/internal/notify"
 )
 
 type SessionManager struct {
 	rdb         *redis.Client
 	nodePool    *nodepool.NodePool
 	wsNodePool  *nodepool.WebSocketNodePool
+	store       Store    // Shared with the other gateway replicas
+	notifier    *notify.Publisher
 	logger      *logrus.Entry
 	sessions    sync.Map // In-memory cache for active sessions
 }
@@ -27,31 +29,51 @@ type SessionManager struct {
 type Session struct {
 	ID              string                 `json:"id"`
 	CustomerID      string                 `json:"customer_id"`
+	UserID          string                 `json:"user_id"` // Owner of the customer's webhooks
 	Type            string                 `json:"type"` // sticky, rotating, per-request
 	CreatedAt       time.Time             `json:"created_at"`
 	LastUsed        time.Time             `json:"last_used"`
 	ExpiresAt       time.Time             `json:"expires_at"`
+	Version         int64                 `json:"version"` // Bumped by every Store.Save
 	
 	// Node assignment
 	CurrentNodeID   string                 `json:"current_node_id"`
 	CurrentNodeIP   string                 `json:"current_node_ip"`
 	NodeHistory     []NodeAssignment       `json:"node_history"`
 	
+	// Domain-scoped stickiness: one exit node per target site
+	Scope           string                    `json:"scope"` // "session" or "domain"
+	Bindings        map[string]*DomainBinding `json:"bindings,omitempty"` // eTLD+1 → node
+	
 	// Rotation settings
-	RotateMode      string                 `json:"rotate_mode"` // request, time, manual, ip-change
+	RotateMode      string                 `json:"rotate_mode"` // request, time, manual, ip-change, schedule
 	RotateInterval  time.Duration         `json:"rotate_interval"`
+	RotateSchedule  string                `json:"rotate_schedule,omitempty"` // cron spec, see ParseSchedule
+	NextRotation    time.Time             `json:"next_rotation,omitempty"`
 	LastRotation    time.Time             `json:"last_rotation"`
 	RequestCount    int64                 `json:"request_count"`
 	
 	// Geographic preferences
 	Country         string                 `json:"country"`
 	City            string                 `json:"city"`
+	Region          string                `json:"region,omitempty"`
+	GeoMode         string                `json:"geo_mode,omitempty"` // fallback- or the plan's mode
+	AllowedCountries []string             `json:"allowed_countries,omitempty"` // plan limits on geo fallbacks
+	BlockedCountries []string             `json:"blocked_countries,omitempty"`
 	ASN             int                   `json:"asn"`
+	ISP             string                `json:"isp,omitempty"`       // isp- name words
+	ConnType        string                `json:"conn_type,omitempty"` // conn- connection type
+	Pin             *nodepool.NodePin     `json:"pin,omitempty"` // ip-/node- pinning
+	Near            *nodepool.GeoTarget   `json:"near,omitempty"` // lat-/lon-/radius-/zip- targeting
 	
 	// Performance requirements
 	MinSpeed        int                   `json:"min_speed"`
 	MaxLatency      int                   `json:"max_latency"`
 	
+	// Exit IP reuse cooldown from the account plan
+	ReuseCooldown   time.Duration         `json:"reuse_cooldown"`
+	ReuseFallback   string                `json:"reuse_fallback"`
+	
 	// Usage tracking
 	BytesTransferred int64                `json:"bytes_transferred"`
 	SuccessfulRequests int64              `json:"successful_requests"`
@@ -68,6 +90,9 @@ type Session struct {
 type NodeAssignment struct {
 	NodeID    string    `json:"node_id"`
 	NodeIP    string    `json:"node_ip"`
+	Country   string    `json:"country,omitempty"`
+	Domain    string    `json:"domain,omitempty"` // Site the node was bound to, for domain scope
+	Reason    string    `json:"reason,omitempty"` // What replaced the previous node
 	AssignedAt time.Time `json:"assigned_at"`
 	ReleasedAt *time.Time `json:"released_at,omitempty"`
 	BytesUsed int64     `json:"bytes_used"`
@@ -79,6 +104,8 @@ func NewSessionManager(rdb *redis.Client, nodePool *nodepool.NodePool, wsNodePoo
 		rdb:        rdb,
 		nodePool:   nodePool,
 		wsNodePool: wsNodePool,
+		store:      NewRedisStore(rdb),
+		notifier:   notify.NewPublisher(rdb, logger),
 		logger:     logger.WithField("component", "session-manager"),
 	}
 }
@@ -86,61 +113,125 @@ func NewSessionManager(rdb *redis.Client, nodePool *nodepool.NodePool, wsNodePoo
 func (sm *SessionManager) GetOrCreateSession(auth *auth.EnhancedProxyAuth) (*Session, error) {
 	sessionKey := sm.generateSessionKey(auth)
 	
-	// Try to get existing session
-	if session := sm.getFromCache(sessionKey); session != nil {
-		session.mutex.Lock()
-		session.LastUsed = time.Now()
-		session.mutex.Unlock()
-		
-		// Check if rotation is needed
-		if sm.shouldRotate(session) {
-			if err := sm.rotateNode(session); err != nil {
-				sm.logger.Warnf("Failed to rotate node for session %s: %v", session.ID, err)
-			}
-		}
-		
-		return session, nil
+	// Try to get existing session, from the cache if no other gateway has
+	// changed it since, otherwise from the store
+	session := sm.getFromCache(sessionKey)
+	if session != nil {
+		session = sm.refresh(sessionKey, session)
+	} else if stored, err := sm.store.Load(sessionIDFromKey(sessionKey)); err == nil {
+		sm.sessions.Store(sessionKey, stored)
+		session = stored
+	}
+	if session == nil {
+		return sm.createNewSession(auth, sessionKey)
 	}
 	
-	// Try Redis
-	session, err := sm.getFromRedis(sessionKey)
-	if err == nil {
-		sm.sessions.Store(sessionKey, session)
-		return session, nil
+	session.mutex.Lock()
+	session.LastUsed = time.Now()
+	session.mutex.Unlock()
+	
+	// Check if rotation is needed
+	if sm.shouldRotate(session) {
+		rotated, err := sm.rotateNode(session, session.RotateMode)
+		if err != nil {
+			sm.logger.Warnf("Failed to rotate node for session %s: %v", session.ID, err)
+		}
+		session = rotated
 	}
 	
-	// Create new session
-	return sm.createNewSession(auth, sessionKey)
+	return session, nil
 }
 
 func (sm *SessionManager) createNewSession(auth *auth.EnhancedProxyAuth, sessionKey string) (*Session, error) {
 	session := &Session{
-		ID:               auth.SessionID,
+		ID:               sessionIDFromKey(sessionKey),
 		CustomerID:       auth.Customer.ID,
+		UserID:           auth.Customer.UserID,
 		Type:             auth.SessionType,
 		CreatedAt:        time.Now(),
 		LastUsed:         time.Now(),
 		ExpiresAt:        time.Now().Add(auth.Lifetime),
 		RotateMode:       auth.RotateMode,
 		RotateInterval:   auth.RotateInterval,
+		RotateSchedule:   auth.RotateSchedule,
 		Country:          auth.Country,
 		City:             auth.City,
+		Region:           auth.Region,
+		GeoMode:          auth.GeoMode,
 		ASN:              auth.ASN,
+		ISP:              auth.ISP,
+		ConnType:         auth.ConnType,
 		MinSpeed:         auth.MinSpeed,
 		MaxLatency:       auth.MaxLatency,
 		Headers:          auth.Headers,
 		UserAgent:        auth.UserAgent,
 		Profile:          auth.Profile,
 		NodeHistory:      make([]NodeAssignment, 0),
+		Scope:            ScopeSession,
+	}
+	if auth.SessionScope == ScopeDomain {
+		session.Scope = ScopeDomain
+		session.Bindings = make(map[string]*DomainBinding)
+	}
+	if auth.Plan != nil {
+		if session.GeoMode == "" {
+			session.GeoMode = auth.Plan.GeoFallbackMode
+		}
+		session.AllowedCountries = auth.Plan.AllowedCountries
+		session.BlockedCountries = auth.Plan.BlockedCountries
+	}
+	if auth.PinNode != "" || auth.PinIP != "" {
+		session.Pin = &nodepool.NodePin{NodeID: auth.PinNode, IP: auth.PinIP}
+		if auth.Plan != nil {
+			session.Pin.AllowedCountries = auth.Plan.AllowedCountries
+			session.Pin.BlockedCountries = auth.Plan.BlockedCountries
+		}
+	}
+	if auth.Near.IsSet() {
+		session.Near = &nodepool.GeoTarget{
+			Lat:      auth.Near.Lat,
+			Lon:      auth.Near.Lon,
+			HasPoint: auth.Near.HasLat && auth.Near.HasLon,
+			RadiusKm: auth.Near.RadiusKm,
+			Zip:      auth.Near.Zip,
+		}
+	}
+	if auth.Plan != nil && auth.Plan.IPReuseCooldownSeconds > 0 {
+		session.ReuseCooldown = time.Duration(auth.Plan.IPReuseCooldownSeconds) * time.Second
+		session.ReuseFallback = auth.Plan.IPReuseFallback
+	}
+	if session.RotateSchedule != "" {
+		schedule, err := ParseSchedule(session.RotateSchedule)
+		if err != nil {
+			return nil, err
+		}
+		if schedule.Interval() > 0 {
+			session.RotateInterval = schedule.Interval()
+		}
+		session.NextRotation = schedule.Next(time.Now())
 	}
 	
-	// Assign initial node
-	if err := sm.assignNode(session); err != nil {
-		return nil, fmt.Errorf("failed to assign node: %v", err)
+	// Assign initial node (domain-scoped sessions bind per site on first use)
+	if session.Scope != ScopeDomain {
+		if err := sm.assignNode(session); err != nil {
+			return nil, fmt.Errorf("failed to assign node: %v", err)
+		}
 	}
 	
-	// Save to Redis
-	if err := sm.saveToRedis(sessionKey, session); err != nil {
+	// Save to the store
+	switch err := sm.store.Create(session); err {
+	case nil:
+	case ErrSessionExists:
+		// Another gateway created it at the same time; use its node so the
+		// client sees one exit IP whichever gateway it lands on
+		if stored, err := sm.store.Load(session.ID); err == nil {
+			session.mutex.Lock()
+			sm.releaseCurrentNode(session)
+			session.mutex.Unlock()
+			sm.sessions.Store(sessionKey, stored)
+			return stored, nil
+		}
+	default:
 		sm.logger.Warnf("Failed to save session to Redis: %v", err)
 	}
 	
@@ -155,23 +246,33 @@ func (sm *SessionManager) createNewSession(auth *auth.EnhancedProxyAuth, session
 }
 
 func (sm *SessionManager) assignNode(session *Session) error {
-	selection := &nodepool.NodeSelection{
-		Country:    session.Country,
-		City:       session.City,
-		ASN:        session.ASN,
-		MinSpeed:   session.MinSpeed,
-		MaxLatency: session.MaxLatency,
-		SessionID:  session.ID,
-	}
-	
-	node, err := sm.nodePool.SelectNode(selection)
+	node, err := sm.selectNode(session)
 	if err != nil {
-		return fmt.Errorf("no suitable nodes available: %v", err)
+		return err
 	}
 	
 	session.mutex.Lock()
 	defer session.mutex.Unlock()
+	sm.setNode(session, node, "")
+	return nil
+}
+
+// selectNode picks a new exit node for a session-scoped session
+func (sm *SessionManager) selectNode(session *Session) (*nodepool.Node, error) {
+	selection := sm.selectionFor(session)
+	selection.SessionID = session.ID
 	
+	node, err := sm.nodePool.SelectNode(selection)
+	if err != nil {
+		return nil, fmt.Errorf("no suitable nodes available: %w", err)
+	}
+	sm.nodePool.RecordIPUse(selection, node)
+	return node, nil
+}
+
+// setNode makes node the session's exit node, recording why the previous one
+// was replaced. Caller holds session.mutex.
+func (sm *SessionManager) setNode(session *Session, node *nodepool.Node, reason string) {
 	// Release previous node if any
 	if session.CurrentNodeID != "" {
 		sm.releaseCurrentNode(session)
@@ -186,15 +287,47 @@ func (sm *SessionManager) assignNode(session *Session) error {
 	assignment := NodeAssignment{
 		NodeID:     node.ID,
 		NodeIP:     node.IPAddress,
+		Country:    node.Country,
+		Reason:     reason,
 		AssignedAt: time.Now(),
 	}
 	session.NodeHistory = append(session.NodeHistory, assignment)
 	
 	sm.logger.Debugf("Assigned node %s (%s) to session %s", node.ID, node.IPAddress, session.ID)
-	return nil
+}
+
+// selectionFor builds node selection criteria from the session's targeting
+func (sm *SessionManager) selectionFor(session *Session) *nodepool.NodeSelection {
+	selection := &nodepool.NodeSelection{
+		Country:        session.Country,
+		City:           session.City,
+		Region:         session.Region,
+		GeoMode:        session.GeoMode,
+		ASN:            session.ASN,
+		ISP:            session.ISP,
+		ConnectionType: session.ConnType,
+		MinSpeed:       session.MinSpeed,
+		MaxLatency:     session.MaxLatency,
+		Pin:            session.Pin,
+		Near:           session.Near,
+
+		AllowedCountries: session.AllowedCountries,
+		BlockedCountries: session.BlockedCountries,
+	}
+	if session.ReuseCooldown > 0 {
+		selection.Reuse = &nodepool.ReuseCooldown{
+			CustomerID: session.CustomerID,
+			Window:     session.ReuseCooldown,
+			Fallback:   session.ReuseFallback,
+		}
+	}
+	return selection
 }
 
 func (sm *SessionManager) releaseCurrentNode(session *Session) {
+	if session.CurrentNodeID == "" {
+		return
+	}
 	if len(session.NodeHistory) > 0 {
 		lastAssignment := &session.NodeHistory[len(session.NodeHistory)-1]
 		if lastAssignment.ReleasedAt == nil {
@@ -221,14 +354,77 @@ func (sm *SessionManager) shouldRotate(session *Session) bool {
 	case "ip-change":
 		// Would need to check if target IP changed (complex logic)
 		return false
+	case auth.RotateOnBlock:
+		return false // Rotated by the proxy when the target blocks the node
+	case auth.RotateOnSchedule:
+		return !session.NextRotation.IsZero() && !time.Now().Before(session.NextRotation)
 	default:
 		return false
 	}
 }
 
-func (sm *SessionManager) rotateNode(session *Session) error {
-	sm.logger.Debugf("Rotating node for session %s", session.ID)
-	return sm.assignNode(session)
+// rotateNode moves the session to a new node and saves it, recording reason
+// in the history. The returned session is the current copy, which differs
+// from session if another gateway saved it in between; if that gateway
+// already rotated, its node is kept and no event is sent from here.
+func (sm *SessionManager) rotateNode(session *Session, reason string) (*Session, error) {
+	sm.logger.Debugf("Rotating node for session %s (%s)", session.ID, reason)
+	if session.Scope == ScopeDomain {
+		session.mutex.RLock()
+		last := session.LastRotation
+		session.mutex.RUnlock()
+		
+		var released map[string]DomainBinding
+		session, err := sm.update(session, func(s *Session) bool {
+			if !s.LastRotation.Equal(last) {
+				released = nil
+				return false // Another gateway rotated it already
+			}
+			released = make(map[string]DomainBinding, len(s.Bindings))
+			for domain, b := range s.Bindings {
+				released[domain] = *b
+			}
+			sm.clearBindings(s)
+			s.LastRotation = time.Now()
+			sm.advanceSchedule(s)
+			return true
+		})
+		if err == nil {
+			sm.notifyDomainsRotated(session, reason, released)
+		}
+		return session, err
+	}
+	
+	session.mutex.RLock()
+	prev := session.CurrentNodeID
+	session.mutex.RUnlock()
+	
+	node, err := sm.selectNode(session)
+	if err != nil {
+		return session, err
+	}
+	var old NodeAssignment
+	session, err = sm.update(session, func(s *Session) bool {
+		if s.CurrentNodeID != prev {
+			return false // Another gateway rotated it already
+		}
+		old = s.currentAssignment()
+		sm.setNode(s, node, reason)
+		sm.advanceSchedule(s)
+		return true
+	})
+	
+	session.mutex.RLock()
+	kept := session.CurrentNodeID == node.ID
+	session.mutex.RUnlock()
+	if !kept {
+		sm.nodePool.ReleaseNode(node.ID)
+		return session, err
+	}
+	if err == nil {
+		sm.notifyRotated(session, reason, old, node)
+	}
+	return session, err
 }
 
 func (sm *SessionManager) RecordUsage(sessionID string, bytesUsed int64, success bool) {
@@ -236,35 +432,33 @@ func (sm *SessionManager) RecordUsage(sessionID string, bytesUsed int64, success
 	
 	if sessionData, exists := sm.sessions.Load(sessionKey); exists {
 		session := sessionData.(*Session)
-		session.mutex.Lock()
-		
-		session.BytesTransferred += bytesUsed
-		session.RequestCount++
-		
-		if success {
-			session.SuccessfulRequests++
-		} else {
-			session.FailedRequests++
-		}
-		
-		// Update current node assignment usage
-		if len(session.NodeHistory) > 0 {
-			lastAssignment := &session.NodeHistory[len(session.NodeHistory)-1]
-			if lastAssignment.ReleasedAt == nil {
-				lastAssignment.BytesUsed += bytesUsed
-				lastAssignment.RequestCount++
-			}
-		}
-		
-		session.mutex.Unlock()
 		
-		// Update Redis asynchronously
+		// Update the store asynchronously; counters are reapplied on top of
+		// whatever another gateway saved in between
 		go func() {
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			defer cancel()
-			
-			sessionData, _ := json.Marshal(session)
-			sm.rdb.Set(ctx, sessionKey, sessionData, session.ExpiresAt.Sub(time.Now()))
+			_, err := sm.update(session, func(s *Session) bool {
+				s.BytesTransferred += bytesUsed
+				s.RequestCount++
+				
+				if success {
+					s.SuccessfulRequests++
+				} else {
+					s.FailedRequests++
+				}
+				
+				// Update current node assignment usage
+				if len(s.NodeHistory) > 0 {
+					lastAssignment := &s.NodeHistory[len(s.NodeHistory)-1]
+					if lastAssignment.ReleasedAt == nil {
+						lastAssignment.BytesUsed += bytesUsed
+						lastAssignment.RequestCount++
+					}
+				}
+				return true
+			})
+			if err != nil {
+				sm.logger.Warnf("Failed to save usage for session %s: %v", sessionID, err)
+			}
 		}()
 	}
 }
@@ -281,8 +475,8 @@ func (sm *SessionManager) GetSessionStats(sessionID string) (*Session, error) {
 		return sm.copySession(session), nil
 	}
 	
-	// Try Redis
-	return sm.getFromRedis(sessionKey)
+	// Try the store
+	return sm.store.Load(sessionID)
 }
 
 func (sm *SessionManager) TerminateSession(sessionID string) error {
@@ -292,14 +486,14 @@ func (sm *SessionManager) TerminateSession(sessionID string) error {
 		session := sessionData.(*Session)
 		session.mutex.Lock()
 		sm.releaseCurrentNode(session)
+		sm.clearBindings(session)
 		session.mutex.Unlock()
 	}
 	
-	// Remove from Redis
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	
-	sm.rdb.Del(ctx, sessionKey)
+	// Remove from the store
+	if err := sm.store.Delete(sessionID); err != nil {
+		return fmt.Errorf("failed to delete session %s: %v", sessionID, err)
+	}
 	
 	sm.logger.Infof("Terminated session %s", sessionID)
 	return nil
@@ -336,39 +530,62 @@ func (sm *SessionManager) getFromCache(sessionKey string) *Session {
 	return nil
 }
 
-func (sm *SessionManager) getFromRedis(sessionKey string) (*Session, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
-	
-	data, err := sm.rdb.Get(ctx, sessionKey).Result()
-	if err != nil {
-		return nil, err
+// sessionIDFromKey strips the cache key prefix from generateSessionKey
+func sessionIDFromKey(sessionKey string) string {
+	return strings.TrimPrefix(sessionKey, "session:")
+}
+
+// refresh swaps a cached session for the stored copy when another gateway
+// saved it since (or an import replaced it), so a client moved between
+// replicas keeps its node. It returns nil if the session ended elsewhere.
+func (sm *SessionManager) refresh(sessionKey string, cached *Session) *Session {
+	stored, err := sm.store.Load(cached.ID)
+	if err == ErrSessionNotFound {
+		sm.sessions.Delete(sessionKey)
+		return nil
 	}
-	
-	var session Session
-	if err := json.Unmarshal([]byte(data), &session); err != nil {
-		return nil, err
+	if err != nil {
+		return cached // Store unreachable: keep serving from the cache
 	}
 	
-	// Check if expired
-	if time.Now().After(session.ExpiresAt) {
-		sm.rdb.Del(ctx, sessionKey)
-		return nil, fmt.Errorf("session expired")
+	cached.mutex.RLock()
+	changed := stored.Version != cached.Version
+	cached.mutex.RUnlock()
+	if !changed {
+		return cached
 	}
-	
-	return &session, nil
+	sm.sessions.Store(sessionKey, stored)
+	return stored
 }
 
-func (sm *SessionManager) saveToRedis(sessionKey string, session *Session) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	
-	sessionData, err := json.Marshal(session)
-	if err != nil {
-		return err
+// maxSaveAttempts bounds how often update retries on version conflicts
+const maxSaveAttempts = 5
+
+// update applies change to the session and saves it. When another gateway
+// saved first, the stored copy replaces the cached one and change is applied
+// again on top of it. change runs under the session lock and returns false to
+// skip the write, e.g. when the stored copy already has what it wanted.
+// update returns the session as it now stands.
+func (sm *SessionManager) update(session *Session, change func(*Session) bool) (*Session, error) {
+	for attempt := 1; ; attempt++ {
+		session.mutex.Lock()
+		if !change(session) {
+			session.mutex.Unlock()
+			return session, nil
+		}
+		err := sm.store.Save(session)
+		session.mutex.Unlock()
+		if err != ErrVersionConflict || attempt == maxSaveAttempts {
+			return session, err
+		}
+		
+		stored, err := sm.store.Load(session.ID)
+		if err != nil {
+			return session, err
+		}
+		sm.sessions.Store(fmt.Sprintf("session:%s", session.ID), stored)
+		session = stored
 	}
-	
-	return sm.rdb.Set(ctx, sessionKey, sessionData, session.ExpiresAt.Sub(time.Now())).Err()
 }
 
 func (sm *SessionManager) scheduleCleanup(sessionKey string, lifetime time.Duration) {
@@ -386,6 +603,13 @@ func (sm *SessionManager) copySession(session *Session) *Session {
 	}
 	sessionCopy.NodeHistory = make([]NodeAssignment, len(session.NodeHistory))
 	copy(sessionCopy.NodeHistory, session.NodeHistory)
+	if session.Bindings != nil {
+		sessionCopy.Bindings = make(map[string]*DomainBinding, len(session.Bindings))
+		for d, b := range session.Bindings {
+			bc := *b
+			sessionCopy.Bindings[d] = &bc
+		}
+	}
 	return &sessionCopy
 }
 
@@ -394,11 +618,15 @@ func (sm *SessionManager) StartCleanupRoutine() {
 	go func() {
 		ticker := time.NewTicker(1 * time.Minute)
 		defer ticker.Stop()
+		rotateTicker := time.NewTicker(scheduleTick)
+		defer rotateTicker.Stop()
 		
 		for {
 			select {
 			case <-ticker.C:
 				sm.cleanupExpiredSessions()
+			case <-rotateTicker.C:
+				sm.rotateDueSessions()
 			}
 		}
 	}()
@@ -414,6 +642,7 @@ func (sm *SessionManager) cleanupExpiredSessions() {
 			
 			session.mutex.Lock()
 			sm.releaseCurrentNode(session)
+			sm.clearBindings(session)
 			session.mutex.Unlock()
 			
 			sm.logger.Debugf("Cleaned up expired session %s", session.ID)
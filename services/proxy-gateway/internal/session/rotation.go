@@ -0,0 +1,152 @@
+package session
+
+import (
+	"fmt"
+	"time"
+
+	"proxy-gateway/internal/auth"
+	"proxy-gateway/internal/nodepool"
+	"proxy-gateway/internal/notify"
+)
+
+// scheduleTick is how often cached sessions are checked for due rotations.
+// Schedules have minute resolution.
+const scheduleTick = 15 * time.Second
+
+// Rotation reasons recorded in NodeAssignment.Reason besides the rotate modes
+const (
+	ReasonManual = "manual" // rotated through the API
+	ReasonBind   = "bind"   // first request to a site in a domain-scoped session
+)
+
+// currentAssignment returns the open history entry for the session's node.
+// Caller holds session.mutex.
+func (s *Session) currentAssignment() NodeAssignment {
+	if n := len(s.NodeHistory); n > 0 && s.NodeHistory[n-1].NodeID == s.CurrentNodeID {
+		return s.NodeHistory[n-1]
+	}
+	return NodeAssignment{NodeID: s.CurrentNodeID, NodeIP: s.CurrentNodeIP}
+}
+
+// advanceSchedule moves NextRotation past now for scheduled sessions. Caller
+// holds session.mutex.
+func (sm *SessionManager) advanceSchedule(s *Session) {
+	if s.RotateSchedule == "" {
+		return
+	}
+	schedule, err := ParseSchedule(s.RotateSchedule)
+	if err != nil {
+		sm.logger.Warnf("Session %s has an invalid schedule: %v", s.ID, err)
+		s.NextRotation = time.Time{}
+		return
+	}
+	s.NextRotation = schedule.Next(time.Now())
+}
+
+// rotateDueSessions rotates cached sessions whose time or schedule is up, so
+// rotations (and their webhooks) happen on time rather than on the next
+// request. When several gateways cache a session only one rotation wins; the
+// others adopt its node.
+func (sm *SessionManager) rotateDueSessions() {
+	sm.sessions.Range(func(key, value interface{}) bool {
+		session := value.(*Session)
+		session.mutex.RLock()
+		mode := session.RotateMode
+		due := (mode == "time" && session.RotateInterval > 0) || mode == auth.RotateOnSchedule
+		expired := time.Now().After(session.ExpiresAt)
+		session.mutex.RUnlock()
+
+		if expired || !due || !sm.shouldRotate(session) {
+			return true
+		}
+		if _, err := sm.rotateNode(session, mode); err != nil {
+			sm.logger.Warnf("Scheduled rotation of session %s failed: %v", session.ID, err)
+		}
+		return true
+	})
+}
+
+// RotateSession rotates a session's node now
+func (sm *SessionManager) RotateSession(sessionID string) (*Session, error) {
+	sessionKey := fmt.Sprintf("session:%s", sessionID)
+	session := sm.getFromCache(sessionKey)
+	if session == nil {
+		stored, err := sm.store.Load(sessionID)
+		if err != nil {
+			return nil, err
+		}
+		sm.sessions.Store(sessionKey, stored)
+		session = stored
+	}
+	session, err := sm.rotateNode(session, ReasonManual)
+	if err != nil {
+		return nil, err
+	}
+	session.mutex.RLock()
+	defer session.mutex.RUnlock()
+	return sm.copySession(session), nil
+}
+
+// GetSessionHistory returns the nodes a session has used, oldest first
+func (sm *SessionManager) GetSessionHistory(sessionID string) ([]NodeAssignment, error) {
+	session, err := sm.GetSessionStats(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return session.NodeHistory, nil
+}
+
+// notifyRotated sends a session.rotated event for a session-scoped rotation
+func (sm *SessionManager) notifyRotated(session *Session, reason string, old NodeAssignment, node *nodepool.Node) {
+	data := sm.rotationEvent(session, reason)
+	data["old_node_id"] = old.NodeID
+	data["old_ip"] = old.NodeIP
+	data["old_country"] = old.Country
+	data["new_node_id"] = node.ID
+	data["new_ip"] = node.IPAddress
+	data["new_country"] = node.Country
+	sm.publishRotation(session, data)
+}
+
+// notifyDomainsRotated sends a session.rotated event for released domain
+// bindings. Their new nodes are bound on the next request to each site, so
+// the event carries only the old exit IPs.
+func (sm *SessionManager) notifyDomainsRotated(session *Session, reason string, released map[string]DomainBinding) {
+	if len(released) == 0 {
+		return
+	}
+	domains := make([]map[string]interface{}, 0, len(released))
+	for domain, b := range released {
+		domains = append(domains, map[string]interface{}{
+			"domain":      domain,
+			"old_node_id": b.NodeID,
+			"old_ip":      b.NodeIP,
+			"old_country": b.Country,
+		})
+	}
+	data := sm.rotationEvent(session, reason)
+	data["domains"] = domains
+	sm.publishRotation(session, data)
+}
+
+func (sm *SessionManager) rotationEvent(session *Session, reason string) map[string]interface{} {
+	session.mutex.RLock()
+	defer session.mutex.RUnlock()
+	data := map[string]interface{}{
+		"session_id": session.ID,
+		"scope":      session.Scope,
+		"reason":     reason,
+		"rotated_at": session.LastRotation,
+	}
+	if !session.NextRotation.IsZero() {
+		data["next_rotation"] = session.NextRotation
+	}
+	return data
+}
+
+func (sm *SessionManager) publishRotation(session *Session, data map[string]interface{}) {
+	if session.UserID == "" {
+		return // Created through the API without a customer account
+	}
+	go sm.notifier.Publish(notify.EventSessionRotated, session.UserID, data)
+}
@@ -0,0 +1,97 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func utc(t *testing.T, s string) time.Time {
+	t.Helper()
+	tm, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatalf("parse %s: %v", s, err)
+	}
+	return tm
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"@yearly",
+		"@every 30s",
+		"@every soon",
+	} {
+		if s, err := ParseSchedule(spec); err == nil {
+			t.Errorf("ParseSchedule(%q) = %v, want error", spec, s)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	// 2026-10-12 is a Monday
+	tests := []struct {
+		spec, from, want string
+	}{
+		{"*/15 * * * *", "2026-10-12T10:07:30Z", "2026-10-12T10:15:00Z"},
+		{"*/15 * * * *", "2026-10-12T10:45:00Z", "2026-10-12T11:00:00Z"}, // strictly after
+		{"5/20 * * * *", "2026-10-12T10:30:00Z", "2026-10-12T10:45:00Z"},
+		{"0 9-17/4 * * *", "2026-10-12T13:00:00Z", "2026-10-12T17:00:00Z"},
+		{"30 2 * * 1,3", "2026-10-12T03:00:00Z", "2026-10-14T02:30:00Z"},
+		{"0 0 * * 7", "2026-10-12T00:00:00Z", "2026-10-18T00:00:00Z"}, // 7 is Sunday
+		{"0 0 31 * *", "2026-10-31T12:00:00Z", "2026-12-31T00:00:00Z"}, // November has no 31st
+		{"0 0 29 2 *", "2026-10-12T00:00:00Z", "2028-02-29T00:00:00Z"},
+		// Both day fields restricted: either matches
+		{"0 0 13 * 5", "2026-10-12T00:00:00Z", "2026-10-13T00:00:00Z"},
+		{"0 0 20 * 5", "2026-10-12T00:00:00Z", "2026-10-16T00:00:00Z"},
+		{"@hourly", "2026-10-12T10:00:00Z", "2026-10-12T11:00:00Z"},
+		{"@daily", "2026-12-31T23:59:00Z", "2027-01-01T00:00:00Z"},
+		{"@weekly", "2026-10-12T10:00:00Z", "2026-10-18T00:00:00Z"},
+		{"@monthly", "2026-10-12T10:00:00Z", "2026-11-01T00:00:00Z"},
+		{"@every 15m", "2026-10-12T10:07:00Z", "2026-10-12T10:15:00Z"},
+		{"@every 6h", "2026-10-12T13:00:00Z", "2026-10-12T18:00:00Z"},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.spec)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := s.Next(utc(t, tt.from)); !got.Equal(utc(t, tt.want)) {
+			t.Errorf("%q: Next(%s) = %s, want %s", tt.spec, tt.from, got.Format(time.RFC3339), tt.want)
+		}
+	}
+
+	// Evaluated in UTC whatever the zone of the input
+	s, _ := ParseSchedule("0 12 * * *")
+	berlin := utc(t, "2026-10-12T11:30:00Z").In(time.FixedZone("CEST", 2*60*60))
+	if got := s.Next(berlin); !got.Equal(utc(t, "2026-10-12T12:00:00Z")) {
+		t.Errorf("Next from a CEST time = %s", got)
+	}
+}
+
+func TestScheduleNever(t *testing.T) {
+	s, err := ParseSchedule("0 0 31 2 *")
+	if err != nil {
+		t.Fatalf("ParseSchedule: %v", err)
+	}
+	if next := s.Next(utc(t, "2026-10-12T00:00:00Z")); !next.IsZero() {
+		t.Errorf("February 31st: Next = %s, want zero", next)
+	}
+	if s.Interval() != 0 || s.String() != "0 0 31 2 *" {
+		t.Errorf("Interval %v, String %q", s.Interval(), s.String())
+	}
+	if every, _ := ParseSchedule(" @every 90m "); every.Interval() != 90*time.Minute {
+		t.Errorf("@every 90m: Interval = %v", every.Interval())
+	}
+}
@@ -0,0 +1,194 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionExists   = errors.New("session already exists")
+	// ErrVersionConflict means another gateway saved the session since it
+	// was loaded
+	ErrVersionConflict = errors.New("session was changed by another gateway")
+)
+
+// Store keeps sessions where every gateway replica sees them. Writes are
+// optimistic: Save only succeeds if the stored Version is still the one the
+// session was loaded with, and bumps it.
+type Store interface {
+	Load(id string) (*Session, error)
+	Save(session *Session) error   // ErrVersionConflict if the stored copy moved on
+	Create(session *Session) error // ErrSessionExists if the ID is taken; keeps Version
+	Delete(id string) error
+	List() ([]*Session, error) // every live session
+}
+
+const (
+	// Kept apart from the node pool's sticky bindings, which use session:<id>
+	storeKeyPrefix = "sessions:"
+	// storeIndexKey is a sorted set of session IDs scored by expiry (unix ms)
+	storeIndexKey = "sessions"
+	storeTimeout  = 5 * time.Second
+)
+
+// Each session is a hash {version, data}. The scripts check the version and
+// keep the expiry index in step with the write.
+var (
+	saveScript = redis.NewScript(`
+if (redis.call('HGET', KEYS[1], 'version') or '0') ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'version', ARGV[2], 'data', ARGV[3])
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+redis.call('ZADD', KEYS[2], ARGV[5], ARGV[6])
+return 1
+`)
+	createScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'version', ARGV[1], 'data', ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+redis.call('ZADD', KEYS[2], ARGV[4], ARGV[5])
+return 1
+`)
+)
+
+// RedisStore is the Store shared by gateway replicas
+type RedisStore struct {
+	rdb *redis.Client
+}
+
+func NewRedisStore(rdb *redis.Client) *RedisStore {
+	return &RedisStore{rdb: rdb}
+}
+
+func storeKey(id string) string {
+	return storeKeyPrefix + id
+}
+
+func (s *RedisStore) Load(id string) (*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	data, err := s.rdb.HGet(ctx, storeKey(id), "data").Result()
+	if err == redis.Nil {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var session Session
+	if err := json.Unmarshal([]byte(data), &session); err != nil {
+		return nil, err
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return nil, ErrSessionNotFound
+	}
+	return &session, nil
+}
+
+// Save writes the session if nobody else saved it since it was loaded. The
+// caller holds session.mutex; on success session.Version is the new version.
+func (s *RedisStore) Save(session *Session) error {
+	ttl := time.Until(session.ExpiresAt)
+	if ttl <= 0 {
+		return s.Delete(session.ID)
+	}
+
+	expected := session.Version
+	session.Version++
+	data, err := json.Marshal(session)
+	if err != nil {
+		session.Version = expected
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	ok, err := saveScript.Run(ctx, s.rdb, []string{storeKey(session.ID), storeIndexKey},
+		expected, session.Version, data, ttl.Milliseconds(), session.ExpiresAt.UnixMilli(), session.ID).Int()
+	if err != nil || ok == 0 {
+		session.Version = expected
+		if err == nil {
+			err = ErrVersionConflict
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *RedisStore) Create(session *Session) error {
+	ttl := time.Until(session.ExpiresAt)
+	if ttl <= 0 {
+		return ErrSessionNotFound
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	ok, err := createScript.Run(ctx, s.rdb, []string{storeKey(session.ID), storeIndexKey},
+		session.Version, data, ttl.Milliseconds(), session.ExpiresAt.UnixMilli(), session.ID).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrSessionExists
+	}
+	return nil
+}
+
+func (s *RedisStore) Delete(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	pipe := s.rdb.TxPipeline()
+	pipe.Del(ctx, storeKey(id))
+	pipe.ZRem(ctx, storeIndexKey, id)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisStore) List() ([]*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	s.rdb.ZRemRangeByScore(ctx, storeIndexKey, "-inf", "("+now)
+	ids, err := s.rdb.ZRangeByScore(ctx, storeIndexKey, &redis.ZRangeBy{Min: now, Max: "+inf"}).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	pipe := s.rdb.Pipeline()
+	cmds := make([]*redis.StringCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.HGet(ctx, storeKey(id), "data")
+	}
+	pipe.Exec(ctx)
+
+	sessions := make([]*Session, 0, len(ids))
+	for _, cmd := range cmds {
+		data, err := cmd.Result()
+		if err != nil {
+			continue // expired between the index read and the fetch
+		}
+		var session Session
+		if err := json.Unmarshal([]byte(data), &session); err != nil {
+			continue
+		}
+		sessions = append(sessions, &session)
+	}
+	return sessions, nil
+}
@@ -0,0 +1,179 @@
+package session
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestStore(t *testing.T) *RedisStore {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return NewRedisStore(rdb)
+}
+
+func testSession(id string, ttl time.Duration) *Session {
+	return &Session{ID: id, CustomerID: "cust1", Type: "sticky", ExpiresAt: time.Now().Add(ttl), CurrentNodeID: "node-a"}
+}
+
+func TestRedisStoreCreate(t *testing.T) {
+	store := newTestStore(t)
+	tests := []struct {
+		name    string
+		session *Session
+		want    error
+	}{
+		{"new", testSession("s1", time.Hour), nil},
+		{"taken", testSession("s1", time.Hour), ErrSessionExists},
+		{"expired", testSession("s2", -time.Minute), ErrSessionNotFound},
+	}
+	for _, tt := range tests {
+		if err := store.Create(tt.session); err != tt.want {
+			t.Errorf("%s: Create = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// Create keeps the version it was given, for imports
+	imported := testSession("s3", time.Hour)
+	imported.Version = 7
+	if err := store.Create(imported); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if got, err := store.Load("s3"); err != nil || got.Version != 7 {
+		t.Fatalf("Load after Create = %+v, %v; want version 7", got, err)
+	}
+}
+
+func TestRedisStoreSaveVersions(t *testing.T) {
+	store := newTestStore(t)
+	if err := store.Create(testSession("s1", time.Hour)); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	a, _ := store.Load("s1")
+	b, _ := store.Load("s1")
+
+	tests := []struct {
+		name        string
+		session     *Session
+		node        string
+		want        error
+		wantVersion int64
+	}{
+		{"first writer", a, "node-b", nil, 1},
+		{"stale copy", b, "node-c", ErrVersionConflict, 0}, // version rolled back
+		{"first writer again", a, "node-d", nil, 2},
+	}
+	for _, tt := range tests {
+		tt.session.CurrentNodeID = tt.node
+		if err := store.Save(tt.session); err != tt.want {
+			t.Errorf("%s: Save = %v, want %v", tt.name, err, tt.want)
+		}
+		if tt.session.Version != tt.wantVersion {
+			t.Errorf("%s: version %d after Save, want %d", tt.name, tt.session.Version, tt.wantVersion)
+		}
+	}
+
+	// The stale copy succeeds once reloaded
+	b, _ = store.Load("s1")
+	if b.CurrentNodeID != "node-d" || b.Version != 2 {
+		t.Fatalf("Load = node %s version %d, want node-d version 2", b.CurrentNodeID, b.Version)
+	}
+	b.CurrentNodeID = "node-e"
+	if err := store.Save(b); err != nil || b.Version != 3 {
+		t.Fatalf("Save after reload = %v, version %d", err, b.Version)
+	}
+
+	// A missing session counts as version 0
+	if ghost := testSession("ghost", time.Hour); store.Save(ghost) != nil || ghost.Version != 1 {
+		t.Fatalf("Save of a session never created: version %d", ghost.Version)
+	}
+
+	// An expired session is deleted rather than saved
+	expired, _ := store.Load("s1")
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	if err := store.Save(expired); err != nil {
+		t.Fatalf("Save of an expired session: %v", err)
+	}
+	if _, err := store.Load("s1"); err != ErrSessionNotFound {
+		t.Fatalf("Load after saving it expired = %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestRedisStoreList(t *testing.T) {
+	store := newTestStore(t)
+	for _, id := range []string{"s1", "s2"} {
+		if err := store.Create(testSession(id, time.Hour)); err != nil {
+			t.Fatalf("Create %s: %v", id, err)
+		}
+	}
+	if err := store.Delete("s1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	sessions, err := store.List()
+	if err != nil || len(sessions) != 1 || sessions[0].ID != "s2" {
+		t.Fatalf("List = %v, %v; want s2 only", sessions, err)
+	}
+}
+
+func TestImportSessions(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	store := newTestStore(t)
+	sm := &SessionManager{store: store, logger: logrus.NewEntry(logger)}
+
+	existing := testSession("taken", time.Hour)
+	existing.Version = 4
+	if err := store.Create(existing); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	sm.sessions.Store("session:taken", existing)
+
+	moved := func(version int64) *Session {
+		s := testSession("taken", time.Hour)
+		s.CurrentNodeID, s.Version = "node-moved", version
+		return s
+	}
+	tests := []struct {
+		name        string
+		sessions    []*Session
+		replace     bool
+		want        ImportResult
+		wantNode    string
+		wantVersion int64
+	}{
+		{"skip existing", []*Session{moved(2), testSession("fresh", time.Hour)}, false,
+			ImportResult{Imported: 1, Skipped: 1}, "node-a", 4},
+		{"replace existing with an older version", []*Session{moved(2)}, true,
+			ImportResult{Imported: 1}, "node-moved", 5},
+		{"replace keeps a newer version", []*Session{moved(9)}, true,
+			ImportResult{Imported: 1}, "node-moved", 9},
+		{"expired and broken", []*Session{testSession("old", -time.Minute), nil, {}}, true,
+			ImportResult{Expired: 1, Errors: []string{"session without an id", "session without an id"}}, "node-moved", 9},
+	}
+	for _, tt := range tests {
+		got := sm.ImportSessions(tt.sessions, tt.replace)
+		if got.Imported != tt.want.Imported || got.Skipped != tt.want.Skipped ||
+			got.Expired != tt.want.Expired || len(got.Errors) != len(tt.want.Errors) {
+			t.Errorf("%s: ImportSessions = %+v, want %+v", tt.name, got, tt.want)
+		}
+		stored, err := store.Load("taken")
+		if err != nil || stored.CurrentNodeID != tt.wantNode || stored.Version != tt.wantVersion {
+			t.Errorf("%s: stored %+v, %v; want node %s version %d", tt.name, stored, err, tt.wantNode, tt.wantVersion)
+		}
+	}
+	if _, err := store.Load("fresh"); err != nil {
+		t.Errorf("imported session not in the store: %v", err)
+	}
+	if _, err := store.Load("old"); err != ErrSessionNotFound {
+		t.Errorf("expired session imported: %v", err)
+	}
+	if _, cached := sm.sessions.Load("session:taken"); cached {
+		t.Error("replaced session still cached")
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"context"
 	"database/sql"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"strconv"
 	"log"
@@ -376,6 +379,12 @@ const (
 	pongWait       = 45 * time.Second
 	writeWait      = 10 * time.Second
 	maxMessageSize = 2097152 // 2MB for proxy responses with base64 payloads
+
+	// maxInlineBody caps request bodies sent inside a proxy_request, whose
+	// base64 has to fit in one message. Responses share the limit: a node's
+	// proxy_response over maxMessageSize drops its connection, so large
+	// transfers belong on CONNECT tunnels.
+	maxInlineBody = 1 << 20
 )
 
 var upgrader = websocket.Upgrader{
@@ -414,6 +423,10 @@ type Connection struct {
 	SafeWrite func(int, []byte) error `json:"-"`
 	SendCh    chan []byte              `json:"-"`
 	BinaryCh  chan []byte              `json:"-"` // Binary tunnel data frames
+	BulkCh    chan []byte              `json:"-"` // Low-priority mux frames, drained after BinaryCh
+
+	// Tunnel frame protocol negotiated at registration (tunnelProtoLegacy / tunnelProtoMux)
+	TunnelProto int `json:"tunnel_proto"`
 }
 
 // ─── Message types ─────────────────────────────────────────────────────────────
@@ -441,6 +454,7 @@ type RegistrationMessage struct {
 	Loc            string  `json:"loc"`
 	Org            string  `json:"org"`
 	Timezone       string  `json:"timezone"`
+	TunnelProtocol int     `json:"tunnel_protocol"` // highest tunnel frame version the node speaks
 }
 
 type IPGeoInfo struct {
@@ -460,6 +474,10 @@ type TunnelOpenRequest struct {
 	TunnelID string `json:"tunnel_id"`
 	Host     string `json:"host"`
 	Port     string `json:"port"`
+	// Mux protocol only — legacy nodes ignore these and use the 36B frame
+	StreamID uint32 `json:"stream_id,omitempty"`
+	Window   int    `json:"window,omitempty"`
+	Priority uint8  `json:"priority,omitempty"`
 }
 
 type TunnelOpenResponse struct {
@@ -468,6 +486,40 @@ type TunnelOpenResponse struct {
 	Error    string `json:"error,omitempty"`
 }
 
+type UDPOpenRequest struct {
+	AssocID     string `json:"assoc_id"`
+	StreamID    uint32 `json:"stream_id"`
+	IdleTimeout int    `json:"idle_timeout,omitempty"` // seconds
+}
+
+type UDPOpenResponse struct {
+	AssocID string `json:"assoc_id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+type BindOpenRequest struct {
+	TunnelID string `json:"tunnel_id"`
+	StreamID uint32 `json:"stream_id"`
+	Window   int    `json:"window,omitempty"`
+	Priority uint8  `json:"priority,omitempty"`
+	Timeout  int    `json:"timeout,omitempty"` // seconds to wait for the inbound connection
+}
+
+type BindResponse struct {
+	TunnelID  string `json:"tunnel_id"`
+	Success   bool   `json:"success"`
+	Error     string `json:"error,omitempty"`
+	BoundPort int    `json:"bound_port,omitempty"`
+}
+
+type BindAccepted struct {
+	TunnelID   string `json:"tunnel_id"`
+	Success    bool   `json:"success"`
+	Error      string `json:"error,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+}
+
 type TunnelDataMessage struct {
 	TunnelID string `json:"tunnel_id"`
 	Data     string `json:"data"`
@@ -492,6 +544,23 @@ type Tunnel struct {
 	readyErr  string
 	BytesSentToNode     int64
 	BytesRecvFromNode   int64
+
+	// Mux protocol state (StreamID == 0 means legacy framing)
+	StreamID    uint32
+	Priority    uint8
+	sendCredit  int
+	creditCh    chan struct{}
+	recvPending int
+
+	// Half-close state (mux only): writeClosed = we sent FIN, readClosed = node sent FIN
+	writeClosed bool
+	readClosed  bool
+	readDoneCh  chan struct{}
+
+	// SOCKS5 BIND: the node's listener address and the peer that connected to it
+	BindAddr string
+	BindPeer string
+	acceptCh chan bool
 }
 
 func (t *Tunnel) Close() {
@@ -517,9 +586,15 @@ func (t *Tunnel) IsClosed() bool {
 }
 
 func (t *Tunnel) Write(data []byte) error {
-	if t.IsClosed() {
+	t.mu.Lock()
+	closed, writeClosed := t.closed, t.writeClosed
+	t.mu.Unlock()
+	if closed {
 		return fmt.Errorf("tunnel closed")
 	}
+	if writeClosed {
+		return fmt.Errorf("tunnel write side closed")
+	}
 	select {
 	case t.WriteCh <- data:
 		atomic.AddInt64(&t.BytesSentToNode, int64(len(data)))
@@ -534,7 +609,10 @@ func (t *Tunnel) Write(data []byte) error {
 func (t *Tunnel) Read() ([]byte, error) {
 	select {
 	case data := <-t.DataCh:
+		t.consumed(len(data))
 		return data, nil
+	case <-t.readDoneCh:
+		return t.drainAfterFIN()
 	case <-t.CloseCh:
 		return nil, fmt.Errorf("tunnel closed")
 	}
@@ -543,7 +621,10 @@ func (t *Tunnel) Read() ([]byte, error) {
 func (t *Tunnel) ReadWithTimeout(timeout time.Duration) ([]byte, error) {
 	select {
 	case data := <-t.DataCh:
+		t.consumed(len(data))
 		return data, nil
+	case <-t.readDoneCh:
+		return t.drainAfterFIN()
 	case <-t.CloseCh:
 		return nil, fmt.Errorf("tunnel closed")
 	case <-time.After(timeout):
@@ -551,6 +632,115 @@ func (t *Tunnel) ReadWithTimeout(timeout time.Duration) ([]byte, error) {
 	}
 }
 
+// drainAfterFIN returns data still queued ahead of the node's FIN, then io.EOF
+func (t *Tunnel) drainAfterFIN() ([]byte, error) {
+	select {
+	case data := <-t.DataCh:
+		return data, nil
+	default:
+		return nil, io.EOF
+	}
+}
+
+// CloseWrite half-closes the tunnel: the node gets a FIN (after any queued data)
+// and shuts down the write side of its TCP connection, while data keeps flowing
+// back until the node sends its own FIN. Legacy frames have no half-close, so
+// this is a no-op there and the caller's full close still applies.
+func (t *Tunnel) CloseWrite() error {
+	if t.StreamID == 0 {
+		return nil
+	}
+	t.mu.Lock()
+	if t.closed || t.writeClosed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.writeClosed = true
+	t.mu.Unlock()
+
+	// nil is the FIN marker for muxTunnelWriter, keeping it ordered behind data
+	select {
+	case t.WriteCh <- nil:
+		return nil
+	case <-t.CloseCh:
+		return fmt.Errorf("tunnel closed")
+	case <-time.After(5 * time.Second):
+		return fmt.Errorf("tunnel write timeout")
+	}
+}
+
+// fullyHalfClosed reports whether FIN has gone both ways
+func (t *Tunnel) fullyHalfClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.writeClosed && t.readClosed
+}
+
+// consumed returns receive credit to the node once half the window has been read
+func (t *Tunnel) consumed(n int) {
+	if t.StreamID == 0 || n == 0 {
+		return
+	}
+	t.mu.Lock()
+	t.recvPending += n
+	grant := 0
+	if t.recvPending >= muxInitialWindow/2 && !t.closed {
+		grant = t.recvPending
+		t.recvPending = 0
+	}
+	t.mu.Unlock()
+	if grant == 0 {
+		return
+	}
+	frame := encodeMuxWindowUpdate(t.StreamID, uint32(grant))
+	select {
+	case t.Conn.BinaryCh <- frame:
+	case <-t.CloseCh:
+	case <-time.After(5 * time.Second):
+		log.Printf("[TUNNEL] %s window update send timeout", t.ID[:8])
+	}
+}
+
+// acquireCredit blocks until the node has granted send credit, returning up to want bytes
+func (t *Tunnel) acquireCredit(want int, timeout time.Duration) (int, error) {
+	deadline := time.After(timeout)
+	for {
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			return 0, fmt.Errorf("tunnel closed")
+		}
+		if t.sendCredit > 0 {
+			n := want
+			if n > t.sendCredit {
+				n = t.sendCredit
+			}
+			t.sendCredit -= n
+			t.mu.Unlock()
+			return n, nil
+		}
+		t.mu.Unlock()
+
+		select {
+		case <-t.creditCh:
+		case <-t.CloseCh:
+			return 0, fmt.Errorf("tunnel closed")
+		case <-deadline:
+			return 0, fmt.Errorf("tunnel window stalled")
+		}
+	}
+}
+
+func (t *Tunnel) addCredit(n int) {
+	t.mu.Lock()
+	t.sendCredit += n
+	t.mu.Unlock()
+	select {
+	case t.creditCh <- struct{}{}:
+	default:
+	}
+}
+
 // ─── Proxy types ───────────────────────────────────────────────────────────────
 
 type ProxyRequest struct {
@@ -1300,32 +1490,274 @@ func storeDisconnect(event DisconnectEvent) {
 	}
 }
 
-// ─── Helper functions ──────────────────────────────────────────────────────────
+// ─── SDK Version Policy ────────────────────────────────────────────────────────
+// Which SDK builds may register, from VERSION_POLICY_FILE (same format as
+// node-registration's):
+//
+//	{"default": {"min_version": "1.0.62"},
+//	 "platforms": {"android": {"min_version": "1.0.70", "deprecated_below": "1.0.75",
+//	                           "latest_version": "1.0.78", "download_url": "https://...",
+//	                           "enforce_percent": 25}},
+//	 "deny": ["1.0.71", "windows:2.1.0"]}
+//
+// Builds below min_version or on the deny list get upgrade_required and are
+// refused; enforce_percent refuses only that share of devices and warns the
+// rest. Builds below deprecated_below register and get version_deprecated.
+// The file is re-read when it changes.
 
-// isSDKVersionAllowed checks if SDK version is >= 1.0.62
-func isSDKVersionAllowed(version string) bool {
-	parts := strings.Split(strings.TrimSpace(version), ".")
-	if len(parts) != 3 {
-		return false
+const (
+	defaultMinSDKVersion = "1.0.62"
+
+	versionAllow           = "allow"
+	versionDeprecated      = "deprecated"
+	versionUpgradeRequired = "upgrade_required"
+
+	versionReasonCurrent      = "current"
+	versionReasonDeprecated   = "deprecated"
+	versionReasonBelowMinimum = "below_minimum"
+	versionReasonDenied       = "denied"
+	versionReasonInvalid      = "invalid_version"
+)
+
+type versionRule struct {
+	MinVersion      string `json:"min_version,omitempty"`
+	DeprecatedBelow string `json:"deprecated_below,omitempty"`
+	LatestVersion   string `json:"latest_version,omitempty"`
+	DownloadURL     string `json:"download_url,omitempty"`
+	EnforcePercent  *int   `json:"enforce_percent,omitempty"` // nil = 100
+	Message         string `json:"message,omitempty"`
+}
+
+type versionPolicyFile struct {
+	Default   versionRule            `json:"default"`
+	Platforms map[string]versionRule `json:"platforms,omitempty"`
+	Deny      []string               `json:"deny,omitempty"` // "version" or "platform:version"
+}
+
+type versionVerdict struct {
+	Action        string
+	Reason        string
+	Platform      string
+	Version       string
+	MinVersion    string
+	LatestVersion string
+	DownloadURL   string
+	Message       string
+}
+
+var (
+	versionPolicyPath    string
+	versionPolicyMu      sync.RWMutex
+	versionPolicy        = versionPolicyFile{Default: versionRule{MinVersion: defaultMinSDKVersion}}
+	versionPolicyDenied  = map[string]bool{}
+	versionPolicyModTime time.Time
+)
+
+// loadVersionPolicy reads VERSION_POLICY_FILE, keeping the previous policy
+// on error
+func loadVersionPolicy() error {
+	fi, err := os.Stat(versionPolicyPath)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(versionPolicyPath)
+	if err != nil {
+		return err
+	}
+	var file versionPolicyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("parse %s: %w", versionPolicyPath, err)
+	}
+	if file.Default.MinVersion == "" {
+		file.Default.MinVersion = defaultMinSDKVersion
+	}
+	platforms := make(map[string]versionRule, len(file.Platforms))
+	for name, rule := range file.Platforms {
+		platforms[strings.ToLower(name)] = rule
+	}
+	file.Platforms = platforms
+	denied := make(map[string]bool, len(file.Deny))
+	for _, d := range file.Deny {
+		denied[strings.ToLower(strings.TrimSpace(d))] = true
 	}
-	var major, minor, patch int
-	fmt.Sscanf(parts[0], "%d", &major)
-	fmt.Sscanf(parts[1], "%d", &minor)
-	fmt.Sscanf(parts[2], "%d", &patch)
 
-	if major > 1 {
-		return true
+	versionPolicyMu.Lock()
+	versionPolicy = file
+	versionPolicyDenied = denied
+	versionPolicyModTime = fi.ModTime()
+	versionPolicyMu.Unlock()
+	log.Printf("[VERSION] Loaded SDK version policy from %s (%d platforms, %d denied)", versionPolicyPath, len(platforms), len(denied))
+	return nil
+}
+
+// watchVersionPolicy re-reads the policy file when it changes
+func watchVersionPolicy() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		versionPolicyMu.RLock()
+		seen := versionPolicyModTime
+		versionPolicyMu.RUnlock()
+		if fi, err := os.Stat(versionPolicyPath); err != nil || !fi.ModTime().After(seen) {
+			continue
+		}
+		if err := loadVersionPolicy(); err != nil {
+			log.Printf("[VERSION] Reload failed, keeping previous policy: %v", err)
+		}
 	}
-	if major < 1 {
-		return false
+}
+
+// versionRuleFor returns a platform's rule with the default filled in
+func versionRuleFor(platform string) (versionRule, map[string]bool) {
+	versionPolicyMu.RLock()
+	defer versionPolicyMu.RUnlock()
+	rule := versionPolicy.Default
+	if r, ok := versionPolicy.Platforms[platform]; ok {
+		if r.MinVersion != "" {
+			rule.MinVersion = r.MinVersion
+		}
+		if r.DeprecatedBelow != "" {
+			rule.DeprecatedBelow = r.DeprecatedBelow
+		}
+		if r.LatestVersion != "" {
+			rule.LatestVersion = r.LatestVersion
+		}
+		if r.DownloadURL != "" {
+			rule.DownloadURL = r.DownloadURL
+		}
+		if r.EnforcePercent != nil {
+			rule.EnforcePercent = r.EnforcePercent
+		}
+		if r.Message != "" {
+			rule.Message = r.Message
+		}
 	}
-	if minor > 0 {
+	return rule, versionPolicyDenied
+}
+
+// checkSDKVersion decides whether a build may register. deviceID places the
+// device in a staged rollout; "" counts as enforced.
+func checkSDKVersion(platform, version, deviceID string) versionVerdict {
+	platform = strings.ToLower(strings.TrimSpace(platform))
+	version = strings.TrimSpace(version)
+	rule, denied := versionRuleFor(platform)
+	v := versionVerdict{
+		Action:        versionAllow,
+		Reason:        versionReasonCurrent,
+		Platform:      platform,
+		Version:       version,
+		MinVersion:    rule.MinVersion,
+		LatestVersion: rule.LatestVersion,
+		DownloadURL:   rule.DownloadURL,
+		Message:       rule.Message,
+	}
+
+	parsed, ok := parseSDKVersion(version)
+	lower := strings.ToLower(version)
+	switch {
+	case !ok:
+		v.Action, v.Reason = versionUpgradeRequired, versionReasonInvalid
+	case denied[lower] || denied[platform+":"+lower]:
+		v.Action, v.Reason = versionUpgradeRequired, versionReasonDenied
+	case sdkVersionBelow(parsed, rule.MinVersion):
+		v.Action, v.Reason = versionUpgradeRequired, versionReasonBelowMinimum
+		if deviceID != "" && !inVersionRollout(deviceID, rule.EnforcePercent) {
+			v.Action = versionDeprecated
+		}
+	case sdkVersionBelow(parsed, rule.DeprecatedBelow):
+		v.Action, v.Reason = versionDeprecated, versionReasonDeprecated
+	}
+
+	if v.Message == "" && v.Action != versionAllow {
+		switch {
+		case v.Reason == versionReasonDenied:
+			v.Message = fmt.Sprintf("SDK %s has a known problem and can't be used. Please upgrade.", v.Version)
+		case v.Reason == versionReasonInvalid:
+			v.Message = "SDK version not recognised. Please upgrade."
+		case v.Reason == versionReasonBelowMinimum && v.Action == versionDeprecated:
+			v.Message = fmt.Sprintf("SDK %s will soon be refused. Minimum required: %s", v.Version, v.MinVersion)
+		case v.Reason == versionReasonBelowMinimum:
+			v.Message = fmt.Sprintf("SDK version too old. Minimum required: %s", v.MinVersion)
+		default:
+			v.Message = fmt.Sprintf("SDK %s is deprecated. Please upgrade.", v.Version)
+		}
+	}
+	return v
+}
+
+// inVersionRollout places a device inside or outside a staged minimum
+func inVersionRollout(deviceID string, percent *int) bool {
+	if percent == nil || *percent >= 100 {
 		return true
 	}
-	if minor < 0 {
+	h := fnv.New32a()
+	h.Write([]byte(deviceID))
+	return int(h.Sum32()%100) < *percent
+}
+
+// parseSDKVersion reads a dotted version, ignoring a prefix such as "v" or
+// "docker-" and a suffix such as "-beta"
+func parseSDKVersion(version string) ([]int, bool) {
+	if i := strings.IndexAny(version, "0123456789"); i > 0 {
+		version = version[i:]
+	}
+	if i := strings.IndexAny(version, "-+ "); i >= 0 {
+		version = version[:i]
+	}
+	parts := strings.Split(version, ".")
+	if len(parts) < 2 || len(parts) > 4 {
+		return nil, false
+	}
+	parsed := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		parsed[i] = n
+	}
+	return parsed, true
+}
+
+// sdkVersionBelow reports whether v is older than limit; an empty or
+// invalid limit never is
+func sdkVersionBelow(v []int, limit string) bool {
+	l, ok := parseSDKVersion(limit)
+	if !ok {
 		return false
 	}
-	return patch >= 62
+	for i := 0; i < len(v) || i < len(l); i++ {
+		var x, y int
+		if i < len(v) {
+			x = v[i]
+		}
+		if i < len(l) {
+			y = l[i]
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return false
+}
+
+// sendVersionNotice tells a node its build must (upgrade_required) or should
+// (version_deprecated) be upgraded, and where to get a new one
+func sendVersionNotice(conn *Connection, msgType string, v versionVerdict) {
+	msg, _ := json.Marshal(Message{
+		Type: msgType,
+		Data: map[string]interface{}{
+			"platform":       v.Platform,
+			"version":        v.Version,
+			"reason":         v.Reason,
+			"min_version":    v.MinVersion,
+			"latest_version": v.LatestVersion,
+			"download_url":   v.DownloadURL,
+			"message":        v.Message,
+			"timestamp":      time.Now().UTC(),
+		},
+	})
+	conn.SafeWrite(websocket.TextMessage, msg)
 }
 
 // ─── IP Geo Cache ──────────────────────────────────────────────────────────────
@@ -1418,15 +1850,28 @@ func extractClientIP(r *http.Request) string {
 // ─── TunnelManager ─────────────────────────────────────────────────────────────
 
 type TunnelManager struct {
-	hub     *Hub
-	tunnels map[string]*Tunnel
-	mu      sync.RWMutex
+	hub          *Hub
+	tunnels      map[string]*Tunnel
+	streams      map[muxStreamKey]*Tunnel
+	udp          map[muxStreamKey]*UDPAssociation
+	udpByID      map[string]*UDPAssociation
+	nextStreamID uint32
+	mu           sync.RWMutex
+}
+
+// muxStreamKey identifies a mux stream — stream IDs are only unique per node connection
+type muxStreamKey struct {
+	nodeID   string
+	streamID uint32
 }
 
 func NewTunnelManager(hub *Hub) *TunnelManager {
 	tm := &TunnelManager{
 		hub:     hub,
 		tunnels: make(map[string]*Tunnel),
+		streams: make(map[muxStreamKey]*Tunnel),
+		udp:     make(map[muxStreamKey]*UDPAssociation),
+		udpByID: make(map[string]*UDPAssociation),
 	}
 	go tm.cleanupExpiredTunnels()
 	return tm
@@ -1434,6 +1879,12 @@ func NewTunnelManager(hub *Hub) *TunnelManager {
 
 // OpenTunnel opens a new tunnel through a node and waits for confirmation
 func (tm *TunnelManager) OpenTunnel(nodeID, host, port string) (*Tunnel, error) {
+	return tm.OpenTunnelWithPriority(nodeID, host, port, muxPriorityDefault)
+}
+
+// OpenTunnelWithPriority opens a tunnel whose frames are scheduled at the given mux priority
+// (lower is more urgent). Priority is ignored for nodes on the legacy frame format.
+func (tm *TunnelManager) OpenTunnelWithPriority(nodeID, host, port string, priority uint8) (*Tunnel, error) {
 	conn := tm.hub.GetConnectionByNodeID(nodeID)
 	if conn == nil {
 		return nil, fmt.Errorf("node not connected")
@@ -1454,54 +1905,90 @@ func (tm *TunnelManager) OpenTunnel(nodeID, host, port string) (*Tunnel, error)
 		CreatedAt: time.Now(),
 	}
 
+	openReq := &TunnelOpenRequest{
+		TunnelID: tunnelID,
+		Host:     host,
+		Port:     port,
+	}
+
 	tm.mu.Lock()
 	tm.tunnels[tunnelID] = tunnel
+	if conn.TunnelProto >= tunnelProtoMux {
+		tunnel.StreamID = tm.allocStreamID()
+		tunnel.Priority = priority
+		tunnel.sendCredit = muxInitialWindow
+		tunnel.creditCh = make(chan struct{}, 1)
+		tunnel.readDoneCh = make(chan struct{})
+		tm.streams[muxStreamKey{nodeID, tunnel.StreamID}] = tunnel
+
+		openReq.StreamID = tunnel.StreamID
+		openReq.Window = muxInitialWindow
+		openReq.Priority = priority
+	}
 	tm.mu.Unlock()
 
 	// Send tunnel_open to node
 	msg, _ := json.Marshal(Message{
 		Type: "tunnel_open",
-		Data: &TunnelOpenRequest{
-			TunnelID: tunnelID,
-			Host:     host,
-			Port:     port,
-		},
+		Data: openReq,
 	})
 
 	select {
 	case conn.SendCh <- msg:
 	default:
-		tm.mu.Lock()
-		delete(tm.tunnels, tunnelID)
-		tm.mu.Unlock()
+		tm.forget(tunnel)
 		return nil, fmt.Errorf("send channel full")
 	}
 
-	log.Printf("[TUNNEL] Opening %s to %s:%s via node %s", tunnelID[:8], host, port, nodeID)
+	log.Printf("[TUNNEL] Opening %s to %s:%s via node %s (stream=%d)", tunnelID[:8], host, port, nodeID, tunnel.StreamID)
 
 	// Wait for SDK to confirm
 	select {
 	case success := <-tunnel.ReadyCh:
 		if !success {
-			tm.mu.Lock()
-			delete(tm.tunnels, tunnelID)
-			tm.mu.Unlock()
+			tm.forget(tunnel)
 			return nil, fmt.Errorf("tunnel open failed: %s", tunnel.readyErr)
 		}
 		log.Printf("[TUNNEL] %s confirmed ready by SDK", tunnelID[:8])
 	case <-time.After(10 * time.Second):
-		tm.mu.Lock()
-		delete(tm.tunnels, tunnelID)
-		tm.mu.Unlock()
+		tm.forget(tunnel)
 		return nil, fmt.Errorf("tunnel open timeout")
 	}
 
 	// Start writer goroutine for this tunnel
-	go tm.tunnelWriter(tunnel)
+	if tunnel.StreamID != 0 {
+		go tm.muxTunnelWriter(tunnel)
+	} else {
+		go tm.tunnelWriter(tunnel)
+	}
 
 	return tunnel, nil
 }
 
+// allocStreamID hands out the next mux stream ID. Caller must hold tm.mu.
+func (tm *TunnelManager) allocStreamID() uint32 {
+	tm.nextStreamID++
+	if tm.nextStreamID == 0 {
+		tm.nextStreamID = 1
+	}
+	return tm.nextStreamID
+}
+
+// forget drops a tunnel from the lookup tables without signalling the node.
+// Returns false if it was already gone.
+func (tm *TunnelManager) forget(tunnel *Tunnel) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if _, ok := tm.tunnels[tunnel.ID]; !ok {
+		return false
+	}
+	delete(tm.tunnels, tunnel.ID)
+	if tunnel.StreamID != 0 {
+		delete(tm.streams, muxStreamKey{tunnel.NodeID, tunnel.StreamID})
+	}
+	return true
+}
+
 // encodeBinaryTunnelData creates a binary tunnel frame:
 // [36 bytes tunnel_id][1 byte flags: 0x00=data, 0x01=EOF][N bytes payload]
 func encodeBinaryTunnelData(tunnelID string, data []byte, eof bool) []byte {
@@ -1535,6 +2022,97 @@ func decodeBinaryTunnelData(frame []byte) (tunnelID string, data []byte, eof boo
 	return
 }
 
+// negotiateTunnelProto picks the highest frame version both sides speak.
+// Nodes that don't advertise one get the legacy 36B-ID frame.
+func negotiateTunnelProto(offered int) int {
+	if offered >= tunnelProtoMux {
+		return tunnelProtoMux
+	}
+	return tunnelProtoLegacy
+}
+
+// ─── Mux tunnel frames (protocol v2) ───────────────────────────────────────────
+//
+// [1B version=0x02][1B type][1B flags][1B priority][4B stream_id BE][payload]
+//
+// Legacy frames start with an ASCII UUID character, so the version byte alone
+// tells the two formats apart on the same connection.
+//   DATA          payload = bytes for the stream, FIN flag = sender is done writing
+//                 (half-close: the other direction stays open until it FINs too)
+//   WINDOW_UPDATE payload = 4B BE credit increment
+//   RST           payload = optional reason, stream is aborted in both directions
+//                 (also sent by a full close that happens before both FINs)
+
+const (
+	tunnelProtoLegacy = 1
+	tunnelProtoMux    = 2
+
+	muxFrameVersion = 0x02
+	muxHeaderSize   = 8
+
+	muxTypeData         = 0x00
+	muxTypeWindowUpdate = 0x01
+	muxTypeRST          = 0x02
+	muxTypeUDP          = 0x03 // SOCKS5 UDP datagram: [atyp][addr][port BE][data]
+
+	muxFlagFIN = 0x01
+
+	muxInitialWindow   = 256 * 1024 // per-stream credit in each direction
+	muxMaxDataPayload  = 32 * 1024
+	muxPriorityDefault = 4
+	muxPriorityBulk    = 6 // priority >= this is queued behind interactive streams
+)
+
+type muxFrame struct {
+	Type     byte
+	Flags    byte
+	Priority byte
+	StreamID uint32
+	Payload  []byte
+}
+
+func isMuxFrame(frame []byte) bool {
+	return len(frame) >= muxHeaderSize && frame[0] == muxFrameVersion
+}
+
+func encodeMuxFrame(f muxFrame) []byte {
+	frame := make([]byte, muxHeaderSize+len(f.Payload))
+	frame[0] = muxFrameVersion
+	frame[1] = f.Type
+	frame[2] = f.Flags
+	frame[3] = f.Priority
+	binary.BigEndian.PutUint32(frame[4:8], f.StreamID)
+	copy(frame[muxHeaderSize:], f.Payload)
+	return frame
+}
+
+func decodeMuxFrame(frame []byte) (muxFrame, error) {
+	if !isMuxFrame(frame) {
+		return muxFrame{}, fmt.Errorf("not a mux frame")
+	}
+	return muxFrame{
+		Type:     frame[1],
+		Flags:    frame[2],
+		Priority: frame[3],
+		StreamID: binary.BigEndian.Uint32(frame[4:8]),
+		Payload:  frame[muxHeaderSize:],
+	}, nil
+}
+
+func encodeMuxWindowUpdate(streamID, increment uint32) []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, increment)
+	return encodeMuxFrame(muxFrame{Type: muxTypeWindowUpdate, StreamID: streamID, Payload: payload})
+}
+
+// queueFor picks the write queue matching a stream's priority
+func (c *Connection) queueFor(priority uint8) chan []byte {
+	if priority >= muxPriorityBulk && c.BulkCh != nil {
+		return c.BulkCh
+	}
+	return c.BinaryCh
+}
+
 // tunnelWriter sends data from WriteCh to the node via binary WebSocket frames
 func (tm *TunnelManager) tunnelWriter(tunnel *Tunnel) {
 	for {
@@ -1556,6 +2134,61 @@ func (tm *TunnelManager) tunnelWriter(tunnel *Tunnel) {
 	}
 }
 
+// muxTunnelWriter sends WriteCh data as mux DATA frames, never exceeding the node's credit
+func (tm *TunnelManager) muxTunnelWriter(tunnel *Tunnel) {
+	queue := tunnel.Conn.queueFor(tunnel.Priority)
+	for {
+		select {
+		case data := <-tunnel.WriteCh:
+			if data == nil {
+				// CloseWrite — send FIN, keep the stream open for the node's reply
+				fin := encodeMuxFrame(muxFrame{Type: muxTypeData, Flags: muxFlagFIN, Priority: tunnel.Priority, StreamID: tunnel.StreamID})
+				select {
+				case queue <- fin:
+				case <-tunnel.CloseCh:
+					return
+				}
+				if tunnel.fullyHalfClosed() {
+					go tm.CloseTunnel(tunnel.ID)
+				}
+				return
+			}
+			for len(data) > 0 {
+				want := len(data)
+				if want > muxMaxDataPayload {
+					want = muxMaxDataPayload
+				}
+				n, err := tunnel.acquireCredit(want, 30*time.Second)
+				if err != nil {
+					if !tunnel.IsClosed() {
+						log.Printf("[TUNNEL] %s %v, resetting stream", tunnel.ID[:8], err)
+						go tm.ResetTunnel(tunnel.ID, err.Error())
+					}
+					return
+				}
+				frame := encodeMuxFrame(muxFrame{
+					Type:     muxTypeData,
+					Priority: tunnel.Priority,
+					StreamID: tunnel.StreamID,
+					Payload:  data[:n],
+				})
+				select {
+				case queue <- frame:
+				case <-time.After(10 * time.Second):
+					log.Printf("[TUNNEL] %s mux send timeout, resetting stream", tunnel.ID[:8])
+					go tm.ResetTunnel(tunnel.ID, "send timeout")
+					return
+				case <-tunnel.CloseCh:
+					return
+				}
+				data = data[n:]
+			}
+		case <-tunnel.CloseCh:
+			return
+		}
+	}
+}
+
 // GetTunnel returns a tunnel by ID
 func (tm *TunnelManager) GetTunnel(tunnelID string) *Tunnel {
 	tm.mu.RLock()
@@ -1563,88 +2196,466 @@ func (tm *TunnelManager) GetTunnel(tunnelID string) *Tunnel {
 	return tm.tunnels[tunnelID]
 }
 
+// getStream returns a mux tunnel by node and stream ID
+func (tm *TunnelManager) getStream(nodeID string, streamID uint32) *Tunnel {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.streams[muxStreamKey{nodeID, streamID}]
+}
+
 // CloseTunnel closes a tunnel and sends EOF to node
 func (tm *TunnelManager) CloseTunnel(tunnelID string) {
-	tm.mu.Lock()
-	tunnel, exists := tm.tunnels[tunnelID]
-	if exists {
-		delete(tm.tunnels, tunnelID)
-	}
-	tm.mu.Unlock()
+	tm.closeTunnel(tunnelID, false, "")
+}
 
-	if tunnel != nil {
-		tunnel.Close()
+// ResetTunnel aborts a tunnel — mux nodes get an RST instead of an orderly FIN
+func (tm *TunnelManager) ResetTunnel(tunnelID, reason string) {
+	tm.closeTunnel(tunnelID, true, reason)
+}
 
+func (tm *TunnelManager) closeTunnel(tunnelID string, reset bool, reason string) {
+	tunnel := tm.GetTunnel(tunnelID)
+	if tunnel == nil || !tm.forget(tunnel) {
+		return
+	}
+	tunnel.Close()
+
+	var frame []byte
+	switch {
+	case tunnel.StreamID == 0:
 		// Send binary EOF to node
-		eofFrame := encodeBinaryTunnelData(tunnelID, nil, true)
+		frame = encodeBinaryTunnelData(tunnelID, nil, true)
+	case !reset && tunnel.fullyHalfClosed():
+		// FIN went both ways — node has already dropped the stream
+	default:
+		// Full close before both FINs means we stop reading too, so abort the stream
+		if reason == "" {
+			reason = "closed"
+		}
+		frame = encodeMuxFrame(muxFrame{Type: muxTypeRST, StreamID: tunnel.StreamID, Payload: []byte(reason)})
+	}
+	if frame != nil {
 		select {
-		case tunnel.Conn.BinaryCh <- eofFrame:
+		case tunnel.Conn.BinaryCh <- frame:
 		case <-time.After(5 * time.Second):
 		}
+	}
+
+	log.Printf("[TUNNEL] Closed %s", tunnelID[:8])
+}
+
+// HandleTunnelResponse handles tunnel open response from node
+func (tm *TunnelManager) HandleTunnelResponse(resp *TunnelOpenResponse) {
+	tunnel := tm.GetTunnel(resp.TunnelID)
+	if tunnel == nil {
+		log.Printf("[TUNNEL] Response for unknown tunnel: %s", resp.TunnelID)
+		return
+	}
+
+	tunnel.mu.Lock()
+	tunnel.ready = resp.Success
+	tunnel.readyErr = resp.Error
+	tunnel.mu.Unlock()
+
+	select {
+	case tunnel.ReadyCh <- resp.Success:
+	default:
+	}
+
+	if resp.Success {
+		log.Printf("[TUNNEL] %s opened successfully", resp.TunnelID[:8])
+	} else {
+		log.Printf("[TUNNEL] %s failed: %s", resp.TunnelID[:8], resp.Error)
+	}
+}
+
+// HandleTunnelData handles incoming data from node
+func (tm *TunnelManager) HandleTunnelData(data *TunnelDataMessage) {
+	tunnel := tm.GetTunnel(data.TunnelID)
+	if tunnel == nil {
+		log.Printf("[TUNNEL] Data for unknown tunnel: %s", data.TunnelID[:8])
+		return
+	}
+
+	if data.EOF {
+		log.Printf("[TUNNEL] %s received EOF from SDK", data.TunnelID[:8])
+		tm.CloseTunnel(data.TunnelID)
+		return
+	}
+
+	// Use RawData (binary) if available, otherwise decode base64 (legacy)
+	var payload []byte
+	if len(data.RawData) > 0 {
+		payload = data.RawData
+	} else {
+		var err error
+		payload, err = base64.StdEncoding.DecodeString(data.Data)
+		if err != nil {
+			log.Printf("[TUNNEL] Failed to decode data for %s: %v", data.TunnelID[:8], err)
+			return
+		}
+	}
+
+	tm.deliver(tunnel, payload)
+}
+
+// deliver pushes node data to the tunnel reader
+func (tm *TunnelManager) deliver(tunnel *Tunnel, payload []byte) {
+	select {
+	case tunnel.DataCh <- payload:
+		atomic.AddInt64(&tunnel.BytesRecvFromNode, int64(len(payload)))
+	case <-time.After(5 * time.Second):
+		log.Printf("[TUNNEL] %s data channel timeout, closing tunnel (%d bytes lost)", tunnel.ID[:8], len(payload))
+		go tm.ResetTunnel(tunnel.ID, "receiver stalled")
+	}
+}
+
+// HandleMuxFrame dispatches a v2 frame received from a node
+func (tm *TunnelManager) HandleMuxFrame(nodeID string, raw []byte) {
+	frame, err := decodeMuxFrame(raw)
+	if err != nil {
+		return
+	}
+	if tm.handleUDPFrame(nodeID, frame) {
+		return
+	}
+	tunnel := tm.getStream(nodeID, frame.StreamID)
+	if tunnel == nil {
+		if frame.Type != muxTypeRST {
+			// Tell the node to drop state for a stream we no longer know about
+			if conn := tm.hub.GetConnectionByNodeID(nodeID); conn != nil {
+				rst := encodeMuxFrame(muxFrame{Type: muxTypeRST, StreamID: frame.StreamID, Payload: []byte("unknown stream")})
+				select {
+				case conn.BinaryCh <- rst:
+				default:
+				}
+			}
+		}
+		return
+	}
+
+	switch frame.Type {
+	case muxTypeData:
+		if len(frame.Payload) > 0 {
+			// Payload aliases the websocket read buffer — copy before handing off
+			payload := make([]byte, len(frame.Payload))
+			copy(payload, frame.Payload)
+			tm.deliver(tunnel, payload)
+		}
+		if frame.Flags&muxFlagFIN != 0 {
+			// Node's target finished sending — half-close our read side
+			tunnel.mu.Lock()
+			already := tunnel.readClosed
+			tunnel.readClosed = true
+			tunnel.mu.Unlock()
+			if !already {
+				close(tunnel.readDoneCh)
+				log.Printf("[TUNNEL] %s received FIN from node", tunnel.ID[:8])
+			}
+			if tunnel.fullyHalfClosed() {
+				tm.CloseTunnel(tunnel.ID)
+			}
+		}
+	case muxTypeWindowUpdate:
+		if len(frame.Payload) >= 4 {
+			tunnel.addCredit(int(binary.BigEndian.Uint32(frame.Payload[:4])))
+		}
+	case muxTypeRST:
+		log.Printf("[TUNNEL] %s reset by node: %s", tunnel.ID[:8], string(frame.Payload))
+		tm.forget(tunnel)
+		tunnel.Close()
+	}
+}
+
+// ─── Bind Tunnels ──────────────────────────────────────────────────────────────
+
+// OpenBind asks a mux-capable node to listen for one inbound connection. The
+// returned tunnel has BindAddr set; call WaitBindAccept before relaying.
+func (tm *TunnelManager) OpenBind(nodeID string, timeout time.Duration) (*Tunnel, error) {
+	conn := tm.hub.GetConnectionByNodeID(nodeID)
+	if conn == nil {
+		return nil, fmt.Errorf("node not connected")
+	}
+	if conn.TunnelProto < tunnelProtoMux {
+		return nil, fmt.Errorf("node does not support bind")
+	}
+
+	tunnel := &Tunnel{
+		ID:         uuid.New().String(),
+		NodeID:     nodeID,
+		Conn:       conn,
+		DataCh:     make(chan []byte, 1024),
+		WriteCh:    make(chan []byte, 1024),
+		CloseCh:    make(chan struct{}),
+		ReadyCh:    make(chan bool, 1),
+		CreatedAt:  time.Now(),
+		Priority:   muxPriorityDefault,
+		sendCredit: muxInitialWindow,
+		creditCh:   make(chan struct{}, 1),
+		readDoneCh: make(chan struct{}),
+		acceptCh:   make(chan bool, 1),
+	}
+
+	tm.mu.Lock()
+	tunnel.StreamID = tm.allocStreamID()
+	tm.tunnels[tunnel.ID] = tunnel
+	tm.streams[muxStreamKey{nodeID, tunnel.StreamID}] = tunnel
+	tm.mu.Unlock()
+
+	msg, _ := json.Marshal(Message{
+		Type: "bind_open",
+		Data: &BindOpenRequest{
+			TunnelID: tunnel.ID,
+			StreamID: tunnel.StreamID,
+			Window:   muxInitialWindow,
+			Priority: tunnel.Priority,
+			Timeout:  int(timeout / time.Second),
+		},
+	})
+
+	select {
+	case conn.SendCh <- msg:
+	default:
+		tm.forget(tunnel)
+		return nil, fmt.Errorf("send channel full")
+	}
+
+	select {
+	case success := <-tunnel.ReadyCh:
+		if !success {
+			tm.forget(tunnel)
+			return nil, fmt.Errorf("bind failed: %s", tunnel.readyErr)
+		}
+	case <-time.After(10 * time.Second):
+		tm.forget(tunnel)
+		return nil, fmt.Errorf("bind open timeout")
+	}
+
+	log.Printf("[BIND] %s listening on %s via node %s (stream=%d)", tunnel.ID[:8], tunnel.BindAddr, nodeID, tunnel.StreamID)
+	return tunnel, nil
+}
+
+// WaitBindAccept blocks until the node reports its inbound connection, then
+// starts relaying. The node enforces the bind timeout; ours is a backstop.
+func (tm *TunnelManager) WaitBindAccept(tunnel *Tunnel, timeout time.Duration) error {
+	select {
+	case success := <-tunnel.acceptCh:
+		if !success {
+			tm.forget(tunnel)
+			return fmt.Errorf("bind accept failed: %s", tunnel.readyErr)
+		}
+	case <-tunnel.CloseCh:
+		return fmt.Errorf("bind closed")
+	case <-time.After(timeout + 5*time.Second):
+		tm.ResetTunnel(tunnel.ID, "bind timeout")
+		return fmt.Errorf("bind accept timeout")
+	}
+	go tm.muxTunnelWriter(tunnel)
+	return nil
+}
+
+// HandleBindResponse handles the node's answer to bind_open
+func (tm *TunnelManager) HandleBindResponse(resp *BindResponse) {
+	tunnel := tm.GetTunnel(resp.TunnelID)
+	if tunnel == nil {
+		return
+	}
+	tunnel.mu.Lock()
+	tunnel.readyErr = resp.Error
+	if resp.Success {
+		tunnel.BindAddr = net.JoinHostPort(tunnel.Conn.IP, strconv.Itoa(resp.BoundPort))
+	}
+	tunnel.mu.Unlock()
+	select {
+	case tunnel.ReadyCh <- resp.Success:
+	default:
+	}
+}
+
+// HandleBindAccepted handles the node reporting its inbound connection (or timeout)
+func (tm *TunnelManager) HandleBindAccepted(msg *BindAccepted) {
+	tunnel := tm.GetTunnel(msg.TunnelID)
+	if tunnel == nil || tunnel.acceptCh == nil {
+		return
+	}
+	tunnel.mu.Lock()
+	tunnel.readyErr = msg.Error
+	tunnel.BindPeer = msg.RemoteAddr
+	tunnel.mu.Unlock()
+	select {
+	case tunnel.acceptCh <- msg.Success:
+	default:
+	}
+}
+
+// ─── UDP Associations ──────────────────────────────────────────────────────────
+
+// UDPAssociation relays SOCKS5 UDP datagrams through a mux-capable node. Each
+// datagram is one muxTypeUDP frame; the node closes it with RST on idle timeout.
+type UDPAssociation struct {
+	ID        string
+	NodeID    string
+	StreamID  uint32
+	Conn      *Connection
+	DataCh    chan []byte // [atyp][addr][port][data] from node, source address
+	CloseCh   chan struct{}
+	ReadyCh   chan bool
+	CreatedAt time.Time
+
+	BytesSent int64
+	BytesRecv int64
+
+	readyErr  string
+	closeOnce sync.Once
+}
+
+// OpenUDPAssociation asks the node for a UDP socket and waits for confirmation
+func (tm *TunnelManager) OpenUDPAssociation(nodeID string, idleTimeout time.Duration) (*UDPAssociation, error) {
+	conn := tm.hub.GetConnectionByNodeID(nodeID)
+	if conn == nil {
+		return nil, fmt.Errorf("node not connected")
+	}
+	if conn.TunnelProto < tunnelProtoMux {
+		return nil, fmt.Errorf("node does not support udp")
+	}
+
+	assoc := &UDPAssociation{
+		ID:        uuid.New().String(),
+		NodeID:    nodeID,
+		Conn:      conn,
+		DataCh:    make(chan []byte, 256),
+		CloseCh:   make(chan struct{}),
+		ReadyCh:   make(chan bool, 1),
+		CreatedAt: time.Now(),
+	}
+
+	tm.mu.Lock()
+	assoc.StreamID = tm.allocStreamID()
+	tm.udp[muxStreamKey{nodeID, assoc.StreamID}] = assoc
+	tm.udpByID[assoc.ID] = assoc
+	tm.mu.Unlock()
+
+	msg, _ := json.Marshal(Message{
+		Type: "udp_open",
+		Data: &UDPOpenRequest{
+			AssocID:     assoc.ID,
+			StreamID:    assoc.StreamID,
+			IdleTimeout: int(idleTimeout / time.Second),
+		},
+	})
+
+	select {
+	case conn.SendCh <- msg:
+	default:
+		tm.forgetUDP(assoc)
+		return nil, fmt.Errorf("send channel full")
+	}
 
-		log.Printf("[TUNNEL] Closed %s", tunnelID[:8])
+	select {
+	case success := <-assoc.ReadyCh:
+		if !success {
+			tm.forgetUDP(assoc)
+			return nil, fmt.Errorf("udp open failed: %s", assoc.readyErr)
+		}
+	case <-time.After(10 * time.Second):
+		tm.forgetUDP(assoc)
+		return nil, fmt.Errorf("udp open timeout")
 	}
+
+	log.Printf("[UDP] Association %s open via node %s (stream=%d)", assoc.ID[:8], nodeID, assoc.StreamID)
+	return assoc, nil
 }
 
-// HandleTunnelResponse handles tunnel open response from node
-func (tm *TunnelManager) HandleTunnelResponse(resp *TunnelOpenResponse) {
-	tunnel := tm.GetTunnel(resp.TunnelID)
-	if tunnel == nil {
-		log.Printf("[TUNNEL] Response for unknown tunnel: %s", resp.TunnelID)
+// HandleUDPResponse handles the node's answer to udp_open
+func (tm *TunnelManager) HandleUDPResponse(resp *UDPOpenResponse) {
+	tm.mu.RLock()
+	assoc := tm.udpByID[resp.AssocID]
+	tm.mu.RUnlock()
+	if assoc == nil {
 		return
 	}
-
-	tunnel.mu.Lock()
-	tunnel.ready = resp.Success
-	tunnel.readyErr = resp.Error
-	tunnel.mu.Unlock()
-
+	assoc.readyErr = resp.Error
 	select {
-	case tunnel.ReadyCh <- resp.Success:
+	case assoc.ReadyCh <- resp.Success:
 	default:
 	}
+}
 
-	if resp.Success {
-		log.Printf("[TUNNEL] %s opened successfully", resp.TunnelID[:8])
-	} else {
-		log.Printf("[TUNNEL] %s failed: %s", resp.TunnelID[:8], resp.Error)
+// Send forwards one datagram ([atyp][addr][port][data]) to the node. Datagrams
+// are dropped rather than queued when the node connection is backed up.
+func (a *UDPAssociation) Send(payload []byte) bool {
+	frame := encodeMuxFrame(muxFrame{Type: muxTypeUDP, Priority: muxPriorityDefault, StreamID: a.StreamID, Payload: payload})
+	select {
+	case a.Conn.BinaryCh <- frame:
+		atomic.AddInt64(&a.BytesSent, int64(len(payload)))
+		return true
+	case <-a.CloseCh:
+	default:
 	}
+	return false
 }
 
-// HandleTunnelData handles incoming data from node
-func (tm *TunnelManager) HandleTunnelData(data *TunnelDataMessage) {
-	tunnel := tm.GetTunnel(data.TunnelID)
-	if tunnel == nil {
-		log.Printf("[TUNNEL] Data for unknown tunnel: %s", data.TunnelID[:8])
-		return
-	}
+func (a *UDPAssociation) close() bool {
+	closed := false
+	a.closeOnce.Do(func() {
+		closed = true
+		close(a.CloseCh)
+	})
+	return closed
+}
 
-	if data.EOF {
-		log.Printf("[TUNNEL] %s received EOF from SDK", data.TunnelID[:8])
-		tm.CloseTunnel(data.TunnelID)
+// CloseUDPAssociation tears down an association and tells the node
+func (tm *TunnelManager) CloseUDPAssociation(assocID string) {
+	tm.mu.RLock()
+	assoc := tm.udpByID[assocID]
+	tm.mu.RUnlock()
+	if assoc == nil || !tm.forgetUDP(assoc) {
 		return
 	}
+	rst := encodeMuxFrame(muxFrame{Type: muxTypeRST, StreamID: assoc.StreamID, Payload: []byte("closed")})
+	select {
+	case assoc.Conn.BinaryCh <- rst:
+	case <-time.After(5 * time.Second):
+	}
+	log.Printf("[UDP] Association %s closed (sent=%d recv=%d)", assocID[:8],
+		atomic.LoadInt64(&assoc.BytesSent), atomic.LoadInt64(&assoc.BytesRecv))
+}
 
-	// Use RawData (binary) if available, otherwise decode base64 (legacy)
-	var payload []byte
-	if len(data.RawData) > 0 {
-		payload = data.RawData
-	} else {
-		var err error
-		payload, err = base64.StdEncoding.DecodeString(data.Data)
-		if err != nil {
-			log.Printf("[TUNNEL] Failed to decode data for %s: %v", data.TunnelID[:8], err)
-			return
-		}
+// forgetUDP drops an association from the lookup tables without signalling the node
+func (tm *TunnelManager) forgetUDP(assoc *UDPAssociation) bool {
+	tm.mu.Lock()
+	_, ok := tm.udpByID[assoc.ID]
+	delete(tm.udpByID, assoc.ID)
+	delete(tm.udp, muxStreamKey{assoc.NodeID, assoc.StreamID})
+	tm.mu.Unlock()
+	assoc.close()
+	return ok
+}
+
+// handleUDPFrame consumes frames for UDP associations; returns false for other streams
+func (tm *TunnelManager) handleUDPFrame(nodeID string, frame muxFrame) bool {
+	tm.mu.RLock()
+	assoc := tm.udp[muxStreamKey{nodeID, frame.StreamID}]
+	tm.mu.RUnlock()
+	if assoc == nil {
+		return false
 	}
 
-	select {
-	case tunnel.DataCh <- payload:
-		atomic.AddInt64(&tunnel.BytesRecvFromNode, int64(len(payload)))
-	case <-time.After(5 * time.Second):
-		log.Printf("[TUNNEL] %s data channel timeout, closing tunnel (%d bytes lost)", data.TunnelID[:8], len(payload))
-		go tm.CloseTunnel(data.TunnelID)
+	switch frame.Type {
+	case muxTypeUDP:
+		payload := make([]byte, len(frame.Payload))
+		copy(payload, frame.Payload)
+		select {
+		case assoc.DataCh <- payload:
+			atomic.AddInt64(&assoc.BytesRecv, int64(len(payload)))
+		default:
+			// Reader is behind — drop, as UDP would
+		}
+	case muxTypeRST:
+		log.Printf("[UDP] Association %s closed by node: %s", assoc.ID[:8], string(frame.Payload))
+		tm.forgetUDP(assoc)
 	}
+	return true
 }
 
 // cleanupExpiredTunnels removes old tunnels
@@ -1658,6 +2669,9 @@ func (tm *TunnelManager) cleanupExpiredTunnels() {
 		for id, tunnel := range tm.tunnels {
 			if now.Sub(tunnel.CreatedAt) > 10*time.Minute {
 				delete(tm.tunnels, id)
+				if tunnel.StreamID != 0 {
+					delete(tm.streams, muxStreamKey{tunnel.NodeID, tunnel.StreamID})
+				}
 				tunnel.Close()
 				log.Printf("[TUNNEL] Cleaned up expired tunnel %s", id[:8])
 			}
@@ -2275,6 +3289,8 @@ func (h *Hub) Stats() map[string]interface{} {
 	byModel := make(map[string]int)
 	byCountry := make(map[string]int)
 	bySDKVersion := make(map[string]int)
+	byPlatformVersion := make(map[string]map[string]int)
+	versionActions := map[string]int{versionAllow: 0, versionDeprecated: 0, versionUpgradeRequired: 0}
 	registered := 0
 
 	for _, conn := range h.connections {
@@ -2303,6 +3319,16 @@ func (h *Hub) Stats() map[string]interface{} {
 		bySDKVersion[sdk]++
 		if conn.Registered {
 			registered++
+			platform := strings.ToLower(conn.DeviceType)
+			if platform == "" {
+				platform = "unknown"
+			}
+			if byPlatformVersion[platform] == nil {
+				byPlatformVersion[platform] = make(map[string]int)
+			}
+			byPlatformVersion[platform][sdk]++
+			// What the current policy would say if the node reconnected now
+			versionActions[checkSDKVersion(conn.DeviceType, conn.SDKVersion, conn.DeviceID).Action]++
 		}
 	}
 
@@ -2344,6 +3370,8 @@ func (h *Hub) Stats() map[string]interface{} {
 		"by_model":               byModel,
 		"by_country":             byCountry,
 		"by_sdk_version":         bySDKVersion,
+		"by_platform_version":    byPlatformVersion,
+		"version_policy":         versionActions,
 		"total_cooldowns":        h.totalCooldowns,
 		"active_cooldowns": func() int {
 			count := 0
@@ -2601,6 +3629,7 @@ func handleWS(w http.ResponseWriter, r *http.Request) {
 
 	sendCh := make(chan []byte, 256)
 	binaryCh := make(chan []byte, 256)
+	bulkCh := make(chan []byte, 256)
 
 	nodeOS := hello.OS
 	if nodeOS == "" {
@@ -2620,6 +3649,8 @@ func handleWS(w http.ResponseWriter, r *http.Request) {
 		SafeWrite:   safeWrite,
 		SendCh:      sendCh,
 		BinaryCh:    binaryCh,
+		BulkCh:      bulkCh,
+		TunnelProto: tunnelProtoLegacy,
 	}
 	hub.Add(hello.NodeID, nodeConn)
 
@@ -2638,25 +3669,53 @@ func handleWS(w http.ResponseWriter, r *http.Request) {
 		return nil
 	})
 
-	// writePump goroutine — reads from SendCh (text) and BinaryCh (binary) and writes to WS
+	// writePump goroutine — reads from SendCh (text), BinaryCh (binary) and BulkCh
+	// (low-priority mux frames) and writes to WS. BulkCh is only drained when the
+	// other two are empty so a bulk download can't starve interactive tunnels.
 	done := make(chan struct{})
 	go func() {
+		writeText := func(msg []byte) bool {
+			if err := safeWrite(websocket.TextMessage, msg); err != nil {
+				log.Printf("[SEND_ERR] node=%s: %v", hello.NodeID, err)
+				return false
+			}
+			return true
+		}
+		writeBinary := func(binMsg []byte) bool {
+			if err := safeWrite(websocket.BinaryMessage, binMsg); err != nil {
+				log.Printf("[SEND_ERR_BIN] node=%s: %v", hello.NodeID, err)
+				return false
+			}
+			return true
+		}
 		for {
 			select {
 			case msg, ok := <-sendCh:
-				if !ok {
+				if !ok || !writeText(msg) {
+					return
+				}
+				continue
+			case binMsg, ok := <-binaryCh:
+				if !ok || !writeBinary(binMsg) {
 					return
 				}
-				if err := safeWrite(websocket.TextMessage, msg); err != nil {
-					log.Printf("[SEND_ERR] node=%s: %v", hello.NodeID, err)
+				continue
+			case <-done:
+				return
+			default:
+			}
+
+			select {
+			case msg, ok := <-sendCh:
+				if !ok || !writeText(msg) {
 					return
 				}
 			case binMsg, ok := <-binaryCh:
-				if !ok {
+				if !ok || !writeBinary(binMsg) {
 					return
 				}
-				if err := safeWrite(websocket.BinaryMessage, binMsg); err != nil {
-					log.Printf("[SEND_ERR_BIN] node=%s: %v", hello.NodeID, err)
+			case bulkMsg, ok := <-bulkCh:
+				if !ok || !writeBinary(bulkMsg) {
 					return
 				}
 			case <-done:
@@ -2685,9 +3744,11 @@ func handleWS(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			// Handle binary frames (tunnel data)
+			// Handle binary frames (tunnel data) — v2 mux frames first, then legacy 36B-ID frames
 			if msgType == websocket.BinaryMessage {
-				if hub.tunnelManager != nil {
+				if hub.tunnelManager != nil && isMuxFrame(rawMsg) {
+					hub.tunnelManager.HandleMuxFrame(hello.NodeID, rawMsg)
+				} else if hub.tunnelManager != nil {
 					tunnelID, data, eof, decErr := decodeBinaryTunnelData(rawMsg)
 					if decErr == nil {
 						hub.tunnelManager.HandleTunnelData(&TunnelDataMessage{
@@ -2749,6 +3810,33 @@ func handleWS(w http.ResponseWriter, r *http.Request) {
 					}
 				}
 
+			case "bind_response":
+				if hub.tunnelManager != nil {
+					dataBytes, _ := json.Marshal(m["data"])
+					var resp BindResponse
+					if json.Unmarshal(dataBytes, &resp) == nil {
+						hub.tunnelManager.HandleBindResponse(&resp)
+					}
+				}
+
+			case "bind_accepted":
+				if hub.tunnelManager != nil {
+					dataBytes, _ := json.Marshal(m["data"])
+					var msg BindAccepted
+					if json.Unmarshal(dataBytes, &msg) == nil {
+						hub.tunnelManager.HandleBindAccepted(&msg)
+					}
+				}
+
+			case "udp_response":
+				if hub.tunnelManager != nil {
+					dataBytes, _ := json.Marshal(m["data"])
+					var resp UDPOpenResponse
+					if json.Unmarshal(dataBytes, &resp) == nil {
+						hub.tunnelManager.HandleUDPResponse(&resp)
+					}
+				}
+
 			case "tunnel_data":
 				if hub.tunnelManager != nil {
 					dataBytes, _ := json.Marshal(m["data"])
@@ -2797,7 +3885,7 @@ func handleWS(w http.ResponseWriter, r *http.Request) {
 				}
 
 			default:
-				log.Printf("[MSG] unknown type=%s from node=%s", msgType, hello.NodeID)
+				log.Printf("[MSG] unknown type=%s from node=%s", jsonMsgType, hello.NodeID)
 			}
 		}
 	}()
@@ -2871,12 +3959,18 @@ func handleRegistration(nodeID, clientIP string, conn *Connection, m map[string]
 	deviceFingerprintsMu.Unlock()
 
 	// Validate SDK version
-	if !isSDKVersionAllowed(regData.SDKVersion) {
-		log.Printf("[REGISTER] Rejected old SDK %s from device %s", regData.SDKVersion, regData.DeviceID)
+	platform := regData.DeviceType
+	if platform == "" {
+		platform = conn.OS
+	}
+	verdict := checkSDKVersion(platform, regData.SDKVersion, regData.DeviceID)
+	if verdict.Action == versionUpgradeRequired {
+		log.Printf("[REGISTER] Rejected SDK %s (%s, %s) from device %s", regData.SDKVersion, verdict.Platform, verdict.Reason, regData.DeviceID)
+		sendVersionNotice(conn, "upgrade_required", verdict)
 		errMsg, _ := json.Marshal(Message{
 			Type: "error",
 			Data: map[string]interface{}{
-				"error":     "SDK version too old. Minimum required: 1.0.62",
+				"error":     verdict.Message,
 				"timestamp": time.Now().UTC(),
 			},
 		})
@@ -2924,6 +4018,7 @@ func handleRegistration(nodeID, clientIP string, conn *Connection, m map[string]
 	conn.SDKVersion = regData.SDKVersion
 	conn.ConnectionType = regData.ConnectionType
 	conn.DeviceType = regData.DeviceType
+	conn.TunnelProto = negotiateTunnelProto(regData.TunnelProtocol)
 	conn.Registered = true
 	hub.mu.Unlock()
 
@@ -2931,13 +4026,17 @@ func handleRegistration(nodeID, clientIP string, conn *Connection, m map[string]
 	resp, _ := json.Marshal(Message{
 		Type: "registration_success",
 		Data: map[string]interface{}{
-			"node_id":   nodeID,
-			"status":    "registered",
-			"message":   "Node successfully registered",
-			"timestamp": time.Now().UTC(),
+			"node_id":         nodeID,
+			"status":          "registered",
+			"message":         "Node successfully registered",
+			"tunnel_protocol": conn.TunnelProto,
+			"timestamp":       time.Now().UTC(),
 		},
 	})
 	conn.SafeWrite(websocket.TextMessage, resp)
+	if verdict.Action == versionDeprecated {
+		sendVersionNotice(conn, "version_deprecated", verdict)
+	}
 
 	log.Printf("[REGISTER] Success: node=%s device=%s ip=%s country=%s city=%s isp=%s",
 		nodeID, regData.DeviceID, clientIP, regData.Country, regData.City, regData.ISP)
@@ -3386,7 +4485,14 @@ func handleAPIProxy(w http.ResponseWriter, r *http.Request) {
 		TimeoutMs int               `json:"timeout_ms"`
 		Profile   string            `json:"profile,omitempty"`
 	}
+	// The payload goes to the node in one message
+	r.Body = http.MaxBytesReader(w, r.Body, maxMessageSize)
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
@@ -3577,10 +4683,21 @@ func handleAPINodeByID(w http.ResponseWriter, r *http.Request) {
 
 // ─── API: Tunnel WebSocket (for proxy-gateway bidirectional relay) ─────────────
 
+// tunnelFINMessage is the half-close text frame on API tunnel WebSockets
+// opened with half_close=1: from the proxy it means the client shut down its
+// write side, towards the proxy that the node's target finished sending.
+// Without half_close a node FIN still ends the relay with a close frame.
+const tunnelFINMessage = "fin"
+
+func isTunnelFIN(messageType int, data []byte) bool {
+	return messageType == websocket.TextMessage && string(data) == tunnelFINMessage
+}
+
 func handleAPITunnelWS(w http.ResponseWriter, r *http.Request) {
 	nodeID := r.URL.Query().Get("node_id")
 	host := r.URL.Query().Get("host")
 	port := r.URL.Query().Get("port")
+	halfClose := r.URL.Query().Get("half_close") == "1"
 
 	if nodeID == "" || host == "" || port == "" {
 		http.Error(w, "Missing required parameters: node_id, host, port", http.StatusBadRequest)
@@ -3621,6 +4738,10 @@ func handleAPITunnelWS(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				return
 			}
+			if halfClose && isTunnelFIN(messageType, data) {
+				tunnel.CloseWrite()
+				continue
+			}
 			if messageType == websocket.BinaryMessage || messageType == websocket.TextMessage {
 				if err := tunnel.Write(data); err != nil {
 					return
@@ -3634,6 +4755,11 @@ func handleAPITunnelWS(w http.ResponseWriter, r *http.Request) {
 		defer wg.Done()
 		for {
 			data, err := tunnel.ReadWithTimeout(30 * time.Second)
+			if err == io.EOF && halfClose {
+				// Node's target finished sending — half-close, keep relaying the other way
+				wsConn.WriteMessage(websocket.TextMessage, []byte(tunnelFINMessage))
+				return
+			}
 			if err != nil {
 				wsConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 				return
@@ -3648,10 +4774,175 @@ func handleAPITunnelWS(w http.ResponseWriter, r *http.Request) {
 	log.Printf("[TUNNEL_WS] Tunnel %s closed", tunnel.ID[:8])
 }
 
+// ─── API: Bind WebSocket ──────────────────────────────────────────────────────
+
+// handleAPIBindWS serves SOCKS5 BIND. Text frames report progress —
+// "bind_ready:<host:port>" once the node listens, "bind_accepted:<peer>" when
+// the inbound connection arrives — then binary frames relay it like a tunnel.
+func handleAPIBindWS(w http.ResponseWriter, r *http.Request) {
+	nodeID := r.URL.Query().Get("node_id")
+	halfClose := r.URL.Query().Get("half_close") == "1"
+	if nodeID == "" {
+		http.Error(w, "Missing required parameter: node_id", http.StatusBadRequest)
+		return
+	}
+	timeout := 30 * time.Second
+	if secs, err := strconv.Atoi(r.URL.Query().Get("timeout")); err == nil && secs > 0 {
+		timeout = time.Duration(secs) * time.Second
+	}
+
+	wsUpgrader := websocket.Upgrader{
+		CheckOrigin:     func(r *http.Request) bool { return true },
+		ReadBufferSize:  65536,
+		WriteBufferSize: 65536,
+	}
+
+	wsConn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("[BIND_WS] Upgrade failed: %v", err)
+		return
+	}
+	defer wsConn.Close()
+
+	tunnel, err := hub.tunnelManager.OpenBind(nodeID, timeout)
+	if err != nil {
+		log.Printf("[BIND_WS] Failed to open bind: %v", err)
+		wsConn.WriteJSON(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	defer hub.tunnelManager.CloseTunnel(tunnel.ID)
+
+	if err := wsConn.WriteMessage(websocket.TextMessage, []byte("bind_ready:"+tunnel.BindAddr)); err != nil {
+		return
+	}
+	if err := hub.tunnelManager.WaitBindAccept(tunnel, timeout); err != nil {
+		log.Printf("[BIND_WS] %s: %v", tunnel.ID[:8], err)
+		wsConn.WriteJSON(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if err := wsConn.WriteMessage(websocket.TextMessage, []byte("bind_accepted:"+tunnel.BindPeer)); err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// Proxy -> Node
+	go func() {
+		defer wg.Done()
+		for {
+			messageType, data, err := wsConn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if halfClose && isTunnelFIN(messageType, data) {
+				tunnel.CloseWrite()
+				continue
+			}
+			if messageType == websocket.BinaryMessage {
+				if err := tunnel.Write(data); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	// Node -> Proxy
+	go func() {
+		defer wg.Done()
+		for {
+			data, err := tunnel.ReadWithTimeout(5 * time.Minute)
+			if err == io.EOF && halfClose {
+				wsConn.WriteMessage(websocket.TextMessage, []byte(tunnelFINMessage))
+				return
+			}
+			if err != nil {
+				wsConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if err := wsConn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	log.Printf("[BIND_WS] %s closed", tunnel.ID[:8])
+}
+
+// ─── API: UDP Association WebSocket ────────────────────────────────────────────
+
+// handleAPIUDPWS relays SOCKS5 UDP ASSOCIATE traffic. Each binary message is one
+// datagram as [atyp][addr][port][data] — the SOCKS5 UDP header minus RSV/FRAG.
+func handleAPIUDPWS(w http.ResponseWriter, r *http.Request) {
+	nodeID := r.URL.Query().Get("node_id")
+	if nodeID == "" {
+		http.Error(w, "Missing required parameter: node_id", http.StatusBadRequest)
+		return
+	}
+	idle := 2 * time.Minute
+	if secs, err := strconv.Atoi(r.URL.Query().Get("idle_timeout")); err == nil && secs > 0 {
+		idle = time.Duration(secs) * time.Second
+	}
+
+	wsUpgrader := websocket.Upgrader{
+		CheckOrigin:     func(r *http.Request) bool { return true },
+		ReadBufferSize:  65536,
+		WriteBufferSize: 65536,
+	}
+
+	wsConn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("[UDP_WS] Upgrade failed: %v", err)
+		return
+	}
+	defer wsConn.Close()
+
+	assoc, err := hub.tunnelManager.OpenUDPAssociation(nodeID, idle)
+	if err != nil {
+		log.Printf("[UDP_WS] Failed to open association: %v", err)
+		wsConn.WriteJSON(map[string]interface{}{"error": err.Error()})
+		return
+	}
+	defer hub.tunnelManager.CloseUDPAssociation(assoc.ID)
+
+	if err := wsConn.WriteMessage(websocket.TextMessage, []byte("udp_ready")); err != nil {
+		return
+	}
+
+	// Proxy -> Node
+	go func() {
+		for {
+			messageType, data, err := wsConn.ReadMessage()
+			if err != nil {
+				hub.tunnelManager.CloseUDPAssociation(assoc.ID)
+				return
+			}
+			if messageType == websocket.BinaryMessage {
+				assoc.Send(data)
+			}
+		}
+	}()
+
+	// Node -> Proxy
+	for {
+		select {
+		case data := <-assoc.DataCh:
+			if err := wsConn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+				return
+			}
+		case <-assoc.CloseCh:
+			wsConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
+	}
+}
+
 // ─── API: Tunnel Standby (pre-opened tunnel pools) ────────────────────────────
 
 func handleAPITunnelStandby(w http.ResponseWriter, r *http.Request) {
 	nodeID := r.URL.Query().Get("node_id")
+	halfClose := r.URL.Query().Get("half_close") == "1"
 	if nodeID == "" {
 		http.Error(w, "Missing node_id", http.StatusBadRequest)
 		return
@@ -3737,6 +5028,10 @@ func handleAPITunnelStandby(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				return
 			}
+			if halfClose && isTunnelFIN(messageType, data) {
+				tunnel.CloseWrite()
+				continue
+			}
 			if messageType == websocket.BinaryMessage || messageType == websocket.TextMessage {
 				if err := tunnel.Write(data); err != nil {
 					return
@@ -3749,6 +5044,11 @@ func handleAPITunnelStandby(w http.ResponseWriter, r *http.Request) {
 		defer wg.Done()
 		for {
 			data, err := tunnel.ReadWithTimeout(30 * time.Second)
+			if err == io.EOF && halfClose {
+				// Node's target finished sending — half-close, keep relaying the other way
+				wsConn.WriteMessage(websocket.TextMessage, []byte(tunnelFINMessage))
+				return
+			}
 			if err != nil {
 				wsConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 				return
@@ -3914,7 +5214,15 @@ func handleProxyConn(clientConn net.Conn) {
 
 	reqBody := ""
 	if req.Body != nil {
-		bodyBytes, _ := io.ReadAll(io.LimitReader(req.Body, 1048576))
+		bodyBytes, readErr := io.ReadAll(io.LimitReader(req.Body, maxInlineBody+1))
+		if len(bodyBytes) > maxInlineBody {
+			clientConn.Write([]byte("HTTP/1.1 413 Request Entity Too Large\r\n\r\n"))
+			return
+		}
+		if readErr != nil {
+			clientConn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+			return
+		}
 		if len(bodyBytes) > 0 {
 			reqBody = base64.StdEncoding.EncodeToString(bodyBytes)
 		}
@@ -4211,6 +5519,10 @@ func handleCONNECTRaw(clientConn net.Conn, req *http.Request) {
 					copy(cpy, buf[:n])
 					if wErr := t.Write(cpy); wErr != nil { break }
 				}
+				if rErr == io.EOF {
+					// Client shut down its write side — pass the FIN on to the node
+					t.CloseWrite()
+				}
 				if rErr != nil { break }
 			}
 		}()
@@ -4223,6 +5535,12 @@ func handleCONNECTRaw(clientConn net.Conn, req *http.Request) {
 					atomic.AddInt64(&tBytesOut, int64(len(data)))
 					if _, wErr := clientConn.Write(data); wErr != nil { break }
 				}
+				if rErr == io.EOF {
+					// Target finished sending — half-close the client side
+					if cw, ok := clientConn.(interface{ CloseWrite() error }); ok {
+						cw.CloseWrite()
+					}
+				}
 				if rErr != nil { break }
 			}
 		}()
@@ -4423,6 +5741,10 @@ func handleCONNECTRaw(clientConn net.Conn, req *http.Request) {
 				}
 			}
 			if err != nil {
+				if err == io.EOF {
+					// Client shut down its write side — pass the FIN on to the node
+					winTunnel.CloseWrite()
+				}
 				break
 			}
 		}
@@ -4433,6 +5755,13 @@ func handleCONNECTRaw(clientConn net.Conn, req *http.Request) {
 		defer wg.Done()
 		for {
 			data, err := winTunnel.ReadWithTimeout(30 * time.Second)
+			if err == io.EOF {
+				// Target finished sending — half-close the client side
+				if cw, ok := clientConn.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+				}
+				break
+			}
 			if err != nil {
 				break
 			}
@@ -6067,6 +7396,14 @@ func main() {
 	// Initialize Redis for node registry
 	initRedis()
 
+	// SDK version policy (built-in minimum unless a file is given)
+	if versionPolicyPath = os.Getenv("VERSION_POLICY_FILE"); versionPolicyPath != "" {
+		if err := loadVersionPolicy(); err != nil {
+			log.Printf("[VERSION] %v — using built-in minimum %s", err, defaultMinSDKVersion)
+		}
+		go watchVersionPolicy()
+	}
+
 	// Initialize tunnel and proxy managers
 	hub.tunnelManager = NewTunnelManager(hub)
 	hub.proxyManager = NewProxyManager(hub)
@@ -6195,6 +7532,8 @@ func main() {
 	http.HandleFunc("/api/tunnel/data", rateLimitAPI(handleAPITunnelData))
 	http.HandleFunc("/api/tunnel/close", rateLimitAPI(handleAPITunnelClose))
 	http.HandleFunc("/api/tunnel/ws", rateLimitAPI(handleAPITunnelWS))
+	http.HandleFunc("/api/udp/ws", rateLimitAPI(handleAPIUDPWS))
+	http.HandleFunc("/api/bind/ws", rateLimitAPI(handleAPIBindWS))
 	http.HandleFunc("/api/tunnel/standby", rateLimitAPI(handleAPITunnelStandby))
 
 	// API: Proxy endpoint (rate limited)
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMuxFrameRoundTrip(t *testing.T) {
+	frames := []muxFrame{
+		{Type: muxTypeData, Priority: muxPriorityDefault, StreamID: 1, Payload: []byte("hello")},
+		{Type: muxTypeData, Flags: muxFlagFIN, Priority: muxPriorityBulk, StreamID: 0xdeadbeef},
+		{Type: muxTypeRST, StreamID: 1 << 31, Payload: []byte("receiver stalled")},
+		{Type: muxTypeUDP, StreamID: 9, Payload: bytes.Repeat([]byte{0xff}, muxMaxDataPayload)},
+	}
+	for _, f := range frames {
+		raw := encodeMuxFrame(f)
+		if len(raw) != muxHeaderSize+len(f.Payload) {
+			t.Fatalf("stream %d: encoded %d bytes, want %d", f.StreamID, len(raw), muxHeaderSize+len(f.Payload))
+		}
+		if raw[0] != muxFrameVersion || raw[1] != f.Type || raw[2] != f.Flags || raw[3] != f.Priority {
+			t.Fatalf("stream %d: header % x", f.StreamID, raw[:4])
+		}
+		if id := binary.BigEndian.Uint32(raw[4:8]); id != f.StreamID {
+			t.Fatalf("stream id on the wire = %#x, want %#x (big-endian)", id, f.StreamID)
+		}
+		got, err := decodeMuxFrame(raw)
+		if err != nil {
+			t.Fatalf("stream %d: decode: %v", f.StreamID, err)
+		}
+		if got.Type != f.Type || got.Flags != f.Flags || got.Priority != f.Priority ||
+			got.StreamID != f.StreamID || !bytes.Equal(got.Payload, f.Payload) {
+			t.Fatalf("round trip = %+v, want %+v", got, f)
+		}
+	}
+
+	wu, err := decodeMuxFrame(encodeMuxWindowUpdate(7, muxInitialWindow))
+	if err != nil || wu.Type != muxTypeWindowUpdate || wu.StreamID != 7 ||
+		binary.BigEndian.Uint32(wu.Payload) != muxInitialWindow {
+		t.Fatalf("window update = %+v, %v", wu, err)
+	}
+}
+
+func TestMuxFrameRejectsLegacyAndShort(t *testing.T) {
+	legacy := encodeBinaryTunnelData(uuid.New().String(), []byte("x"), false)
+	for _, raw := range [][]byte{nil, {muxFrameVersion}, {muxFrameVersion, 0, 0, 0, 0, 0, 0}, legacy} {
+		if isMuxFrame(raw) {
+			t.Fatalf("isMuxFrame(% x) = true", raw)
+		}
+		if _, err := decodeMuxFrame(raw); err == nil {
+			t.Fatalf("decodeMuxFrame(% x) succeeded", raw)
+		}
+	}
+}
+
+// ─── Tunnel harness ────────────────────────────────────────────────────────────
+
+const testNodeID = "node-0123456789"
+
+func newTestTunnelManager() *TunnelManager {
+	return &TunnelManager{
+		hub:     NewHub(),
+		tunnels: make(map[string]*Tunnel),
+		streams: make(map[muxStreamKey]*Tunnel),
+		udp:     make(map[muxStreamKey]*UDPAssociation),
+		udpByID: make(map[string]*UDPAssociation),
+	}
+}
+
+// newTestStream registers a mux tunnel with credit bytes of send window and starts its writer
+func newTestStream(tm *TunnelManager, streamID uint32, credit int) *Tunnel {
+	tunnel := &Tunnel{
+		ID:         uuid.New().String(),
+		NodeID:     testNodeID,
+		Conn:       &Connection{NodeID: testNodeID, BinaryCh: make(chan []byte, 64)},
+		DataCh:     make(chan []byte, 1024),
+		WriteCh:    make(chan []byte, 1024),
+		CloseCh:    make(chan struct{}),
+		ReadyCh:    make(chan bool, 1),
+		CreatedAt:  time.Now(),
+		StreamID:   streamID,
+		Priority:   muxPriorityDefault,
+		sendCredit: credit,
+		creditCh:   make(chan struct{}, 1),
+		readDoneCh: make(chan struct{}),
+	}
+	tm.mu.Lock()
+	tm.tunnels[tunnel.ID] = tunnel
+	tm.streams[muxStreamKey{testNodeID, streamID}] = tunnel
+	tm.mu.Unlock()
+	go tm.muxTunnelWriter(tunnel)
+	return tunnel
+}
+
+// nextFrame waits for the next frame queued for the node
+func nextFrame(t *testing.T, tunnel *Tunnel) muxFrame {
+	t.Helper()
+	select {
+	case raw := <-tunnel.Conn.BinaryCh:
+		f, err := decodeMuxFrame(raw)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return f
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame for node")
+		return muxFrame{}
+	}
+}
+
+// noFrame fails if anything is queued for the node within d
+func noFrame(t *testing.T, tunnel *Tunnel, d time.Duration) {
+	t.Helper()
+	select {
+	case raw := <-tunnel.Conn.BinaryCh:
+		f, _ := decodeMuxFrame(raw)
+		t.Fatalf("unexpected frame %+v", f)
+	case <-time.After(d):
+	}
+}
+
+func TestTunnelAcquireCreditExhaustion(t *testing.T) {
+	tunnel := &Tunnel{StreamID: 1, sendCredit: 4, CloseCh: make(chan struct{}), creditCh: make(chan struct{}, 1)}
+
+	if n, err := tunnel.acquireCredit(10, time.Second); err != nil || n != 4 {
+		t.Fatalf("acquireCredit = %d, %v; want the 4 bytes of credit", n, err)
+	}
+	if _, err := tunnel.acquireCredit(1, 50*time.Millisecond); err == nil || err.Error() != "tunnel window stalled" {
+		t.Fatalf("acquireCredit with no credit = %v, want tunnel window stalled", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		tunnel.addCredit(6)
+	}()
+	if n, err := tunnel.acquireCredit(10, 5*time.Second); err != nil || n != 6 {
+		t.Fatalf("acquireCredit after window update = %d, %v; want 6", n, err)
+	}
+}
+
+func TestMuxTunnelWriterStopsAtCreditExhaustion(t *testing.T) {
+	tm := newTestTunnelManager()
+	tunnel := newTestStream(tm, 3, 4)
+
+	if err := tunnel.Write([]byte("0123456789")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if f := nextFrame(t, tunnel); f.Type != muxTypeData || string(f.Payload) != "0123" {
+		t.Fatalf("got %+v, want DATA 0123", f)
+	}
+	noFrame(t, tunnel, 200*time.Millisecond)
+
+	tm.HandleMuxFrame(testNodeID, encodeMuxWindowUpdate(3, 100))
+	if f := nextFrame(t, tunnel); f.Type != muxTypeData || string(f.Payload) != "456789" {
+		t.Fatalf("got %+v, want DATA 456789", f)
+	}
+
+	if err := tunnel.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	if f := nextFrame(t, tunnel); f.Type != muxTypeData || f.Flags&muxFlagFIN == 0 || len(f.Payload) != 0 {
+		t.Fatalf("got %+v, want FIN", f)
+	}
+}
+
+func TestHandleMuxFrameNodeFINClosesOnlyRead(t *testing.T) {
+	tm := newTestTunnelManager()
+	tunnel := newTestStream(tm, 5, muxInitialWindow)
+
+	tm.HandleMuxFrame(testNodeID, encodeMuxFrame(muxFrame{
+		Type: muxTypeData, Flags: muxFlagFIN, StreamID: 5, Payload: []byte("response"),
+	}))
+	if data, err := tunnel.ReadWithTimeout(time.Second); err != nil || string(data) != "response" {
+		t.Fatalf("read = %q, %v; want data queued ahead of FIN", data, err)
+	}
+	if _, err := tunnel.ReadWithTimeout(time.Second); err != io.EOF {
+		t.Fatalf("read after FIN = %v, want io.EOF", err)
+	}
+
+	// Our side can still send until we FIN too
+	if tunnel.IsClosed() || tm.GetTunnel(tunnel.ID) == nil {
+		t.Fatal("tunnel closed on the node's FIN")
+	}
+	if err := tunnel.Write([]byte("more")); err != nil {
+		t.Fatalf("write after node FIN: %v", err)
+	}
+	if f := nextFrame(t, tunnel); f.Type != muxTypeData || string(f.Payload) != "more" {
+		t.Fatalf("got %+v, want DATA more", f)
+	}
+
+	if err := tunnel.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	if f := nextFrame(t, tunnel); f.Flags&muxFlagFIN == 0 {
+		t.Fatalf("got %+v, want FIN", f)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for tm.GetTunnel(tunnel.ID) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel still registered after FIN both ways")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !tunnel.IsClosed() {
+		t.Fatal("tunnel not closed after FIN both ways")
+	}
+	// Both sides dropped the stream in order, so no RST follows
+	noFrame(t, tunnel, 100*time.Millisecond)
+}
+
+func TestHandleMuxFrameRSTForgetsStream(t *testing.T) {
+	tm := newTestTunnelManager()
+	tunnel := newTestStream(tm, 8, muxInitialWindow)
+
+	tm.HandleMuxFrame(testNodeID, encodeMuxFrame(muxFrame{Type: muxTypeRST, StreamID: 8, Payload: []byte("refused")}))
+	if !tunnel.IsClosed() || tm.getStream(testNodeID, 8) != nil {
+		t.Fatal("stream still open after node RST")
+	}
+	if _, err := tunnel.ReadWithTimeout(time.Second); err == nil || err == io.EOF {
+		t.Fatalf("read after RST = %v, want tunnel closed", err)
+	}
+}